@@ -64,9 +64,11 @@ require (
 	github.com/vmware/go-vcloud-director/v2 v2.16.0
 	github.com/vmware/govmomi v0.29.0
 	go.anx.io/go-anxcloud v0.4.6
+	go.uber.org/goleak v1.2.0
 	go.uber.org/zap v1.23.0
 	golang.org/x/crypto v0.1.0 // indirect
 	golang.org/x/oauth2 v0.1.0
+	golang.org/x/sync v0.1.0
 	gomodules.xyz/jsonpatch/v2 v2.2.0 // indirect
 	google.golang.org/api v0.101.0
 	google.golang.org/genproto v0.0.0-20221027153422-115e99e71e1c // indirect
@@ -19,8 +19,12 @@ package provider
 import (
 	"context"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
+
+	"go.uber.org/zap"
 
 	apiv1 "k8c.io/dashboard/v2/pkg/api/v1"
 	handlercommon "k8c.io/dashboard/v2/pkg/handler/common"
@@ -29,9 +33,23 @@ import (
 	"k8c.io/dashboard/v2/pkg/provider"
 	"k8c.io/dashboard/v2/pkg/provider/cloud/vsphere"
 	kubernetesprovider "k8c.io/dashboard/v2/pkg/provider/kubernetes"
+	"k8c.io/kubermatic/v2/pkg/log"
 	utilerrors "k8c.io/kubermatic/v2/pkg/util/errors"
 )
 
+// vsphereFolderCacheTTL is how long the folders of a datacenter are cached. Folders rarely change, but
+// are listed every time the cluster wizard is opened.
+const vsphereFolderCacheTTL = time.Minute
+
+// vsphereProviderIdleTTL is how long the provider of a datacenter is kept without being used, so
+// providers of deleted or renamed datacenters are eventually closed.
+const vsphereProviderIdleTTL = time.Hour
+
+// vsphereProviders keeps the providers of the vSphere datacenters between requests, so their folder
+// listings can be cached. Cluster folders are created by the seed controllers, so folders of new
+// clusters show up once the listing expires.
+var vsphereProviders = vsphere.NewProviderCache(vsphereProviderIdleTTL, vsphere.WithFolderCache(vsphereFolderCacheTTL))
+
 func VsphereNetworksWithClusterCredentialsEndpoint(ctx context.Context, userInfoGetter provider.UserInfoGetter,
 	projectProvider provider.ProjectProvider, privilegedProjectProvider provider.PrivilegedProjectProvider,
 	seedsGetter provider.SeedsGetter, projectID, clusterID string, caBundle *x509.CertPool,
@@ -65,7 +83,7 @@ func VsphereNetworksWithClusterCredentialsEndpoint(ctx context.Context, userInfo
 
 	username, password, err := vsphere.GetCredentialsForCluster(cluster.Spec.Cloud, secretKeySelector, datacenter.Spec.VSphere)
 	if err != nil {
-		return nil, err
+		return nil, vsphereErrorToHTTPError(err)
 	}
 	return GetVsphereNetworks(ctx, userInfo, seedsGetter, username, password, datacenterName, caBundle)
 }
@@ -78,7 +96,7 @@ func GetVsphereNetworks(ctx context.Context, userInfo *provider.UserInfo, seedsG
 
 	networks, err := vsphere.GetNetworks(ctx, datacenter.Spec.VSphere, username, password, caBundle)
 	if err != nil {
-		return nil, err
+		return nil, vsphereErrorToHTTPError(err)
 	}
 
 	var apiNetworks []apiv1.VSphereNetwork
@@ -126,7 +144,7 @@ func VsphereFoldersWithClusterCredentialsEndpoint(ctx context.Context, userInfoG
 
 	username, password, err := vsphere.GetCredentialsForCluster(cluster.Spec.Cloud, secretKeySelector, datacenter.Spec.VSphere)
 	if err != nil {
-		return nil, err
+		return nil, vsphereErrorToHTTPError(err)
 	}
 	return GetVsphereFolders(ctx, userInfo, seedsGetter, username, password, datacenterName, caBundle)
 }
@@ -137,9 +155,19 @@ func GetVsphereFolders(ctx context.Context, userInfo *provider.UserInfo, seedsGe
 		return nil, fmt.Errorf("failed to find Datacenter %q: %w", datacenterName, err)
 	}
 
-	folders, err := vsphere.GetVMFolders(ctx, datacenter.Spec.VSphere, username, password, caBundle)
+	vsphereProvider, err := vsphereProviders.Provider(ctx, datacenterName, datacenter, caBundle)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get folders: %w", err)
+		return nil, err
+	}
+
+	folders, err := vsphereProvider.GetVMFolders(ctx, username, password)
+	if err != nil {
+		// Folders which could not be listed are skipped, the others can still be selected.
+		var partialErr *vsphere.PartialResultError
+		if !errors.As(err, &partialErr) {
+			return nil, vsphereErrorToHTTPError(fmt.Errorf("failed to get folders: %w", err))
+		}
+		log.Logger.Warnw("Some vSphere folders could not be listed", "datacenter", datacenterName, zap.Error(err))
 	}
 
 	var apiFolders []apiv1.VSphereFolder
@@ -159,7 +187,7 @@ func GetVsphereDatastoreList(ctx context.Context, userInfo *provider.UserInfo, s
 
 	datastores, err := vsphere.GetDatastoreList(ctx, datacenter.Spec.VSphere, username, password, caBundle)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get datastore list: %w", err)
+		return nil, vsphereErrorToHTTPError(fmt.Errorf("failed to get datastore list: %w", err))
 	}
 
 	apiDatastores := &apiv1.VSphereDatastoreList{}
@@ -169,3 +197,17 @@ func GetVsphereDatastoreList(ctx context.Context, userInfo *provider.UserInfo, s
 
 	return apiDatastores, nil
 }
+
+// vsphereErrorToHTTPError maps the typed errors of the vSphere provider to the matching HTTP errors.
+func vsphereErrorToHTTPError(err error) error {
+	switch {
+	case errors.Is(err, vsphere.ErrNoCredentials):
+		return utilerrors.New(http.StatusBadRequest, err.Error())
+	case errors.Is(err, vsphere.ErrDatacenterNotFound):
+		return utilerrors.New(http.StatusNotFound, err.Error())
+	case vsphere.IsTimeout(err):
+		return utilerrors.New(http.StatusGatewayTimeout, err.Error())
+	default:
+		return err
+	}
+}
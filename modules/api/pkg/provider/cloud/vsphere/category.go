@@ -18,54 +18,338 @@ package vsphere
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
 
 	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
 )
 
-func categoryName(cluster *kubermaticv1.Cluster) string {
-	return defaultCategory + cluster.Name
+// tagCategoryIDPrefix is the prefix vCenter uses for the IDs of tag categories.
+const tagCategoryIDPrefix = "urn:vmomi:InventoryServiceCategory:"
+
+// categoryName returns the name of the tag category created for the cluster. If no
+// prefix is configured for the datacenter, the defaultCategory is used.
+func categoryName(prefix string, cluster *kubermaticv1.Cluster) string {
+	if prefix == "" {
+		prefix = defaultCategory
+	}
+	return prefix + cluster.Name
+}
+
+// Tag represents a vSphere tag attached to an object.
+type Tag struct {
+	ID           string
+	Name         string
+	Description  string
+	CategoryID   string
+	CategoryName string
 }
 
-// createTagCategory creates the specified tag category if it does not exist yet.
-func createTagCategory(ctx context.Context, restSession *RESTSession, cluster *kubermaticv1.Cluster) (string, error) {
+// GetFolderTags returns the tags attached to the VM folder of the cluster, sorted by category and
+// name. The folder is looked up by its reference if the cluster was initialized by KKP and the
+// reference still refers to a folder of the cluster, and by its path otherwise.
+func (v *Provider) GetFolderTags(ctx context.Context, cluster *kubermaticv1.Cluster) ([]Tag, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	folderPath := cluster.Spec.Cloud.VSphere.Folder
+	ref := folderRef(cluster)
+	if ref == nil && folderPath == "" {
+		return nil, errors.New("cluster has no vSphere folder")
+	}
+
+	username, password, err := GetCredentialsForCluster(cluster.Spec.Cloud, v.secretKeySelector, v.dc)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := v.newSession(ctx, v.logger(cluster), username, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	restSession, err := newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client session: %w", err)
+	}
+	defer restSession.Logout(ctx)
+
+	if ref, err = v.verifiedFolderRef(ctx, session, cluster, func() (*RESTSession, error) { return restSession, nil }); err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		if folderPath == "" {
+			return nil, errors.New("folder reference of the cluster doesn't refer to a folder of the cluster")
+		}
+		folder, err := session.Finder.Folder(ctx, folderPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open folder %q: %w", folderPath, err)
+		}
+		folderRef := folder.Reference()
+		ref = &folderRef
+	}
+
+	return getAttachedTags(ctx, tags.NewManager(restSession.Client), ref)
+}
+
+// getAttachedTags returns the tags attached to the object along with the names of their categories.
+func getAttachedTags(ctx context.Context, tagManager *tags.Manager, ref mo.Reference) ([]Tag, error) {
+	attachedTags, err := tagManager.GetAttachedTags(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attached tags: %w", err)
+	}
+	if len(attachedTags) == 0 {
+		return nil, nil
+	}
+
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag categories %w", err)
+	}
+	categoryNames := map[string]string{}
+	for _, category := range categories {
+		categoryNames[category.ID] = category.Name
+	}
+
+	result := make([]Tag, 0, len(attachedTags))
+	for _, tag := range attachedTags {
+		result = append(result, Tag{
+			ID:           tag.ID,
+			Name:         tag.Name,
+			Description:  tag.Description,
+			CategoryID:   tag.CategoryID,
+			CategoryName: categoryNames[tag.CategoryID],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].CategoryName != result[j].CategoryName {
+			return result[i].CategoryName < result[j].CategoryName
+		}
+		return result[i].Name < result[j].Name
+	})
+
+	return result, nil
+}
+
+// managedByKubermatic marks the descriptions of vSphere objects created by KKP, so they can be told
+// apart from objects created by users in vCenter.
+const managedByKubermatic = "Managed by Kubermatic"
+
+// clusterCategoryAssociableTypes are the types of objects the tags of a cluster category can be
+// attached to: the cluster folder and the node VMs, e.g. for the anti-affinity tag.
+var clusterCategoryAssociableTypes = []string{"Folder", "VirtualMachine"}
+
+// createTagCategory creates the specified tag category for the cluster if it does not exist yet. Existing
+// categories are used as they are. The category allows multiple tags per object, as node VMs carry both the
+// cluster tag and the anti-affinity tag.
+func createTagCategory(ctx context.Context, restSession *RESTSession, name, clusterName string) (string, error) {
 	tagManager := tags.NewManager(restSession.Client)
 	categories, err := tagManager.GetCategories(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get tag categories %w", err)
 	}
 
-	defaultCategoryName := categoryName(cluster)
-
 	for _, category := range categories {
-		if category.Name == defaultCategoryName {
+		if category.Name == name {
 			return category.ID, nil
 		}
 	}
 
 	return tagManager.CreateCategory(ctx, &tags.Category{
-		Name:        defaultCategoryName,
-		Cardinality: "MULTIPLE",
+		Name:            name,
+		Description:     categoryDescription(clusterName),
+		Cardinality:     "MULTIPLE",
+		AssociableTypes: clusterCategoryAssociableTypes,
 	})
 }
 
-// deleteTagCategory deletes the tag category.
-func deleteTagCategory(ctx context.Context, restSession *RESTSession, cluster *kubermaticv1.Cluster) error {
+// categoryDescription returns the description of the tag category of the cluster.
+func categoryDescription(clusterName string) string {
+	return fmt.Sprintf("Tags of the vSphere resources of KKP cluster %q. %s, do not modify.", clusterName, managedByKubermatic)
+}
+
+// validateTagCategoryID checks that the ID has the format of a vCenter category ID. This keeps
+// the tagging client from resolving the ID as a category name.
+func validateTagCategoryID(categoryID string) error {
+	if !strings.HasPrefix(categoryID, tagCategoryIDPrefix) {
+		return fmt.Errorf("%w: %q", ErrInvalidTagCategoryID, categoryID)
+	}
+	return nil
+}
+
+// validateTagCategory checks that the tag category with the given ID exists.
+func validateTagCategory(ctx context.Context, restSession *RESTSession, categoryID string) error {
+	if err := validateTagCategoryID(categoryID); err != nil {
+		return err
+	}
+
+	categoryIDs, err := tags.NewManager(restSession.Client).ListCategories(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list tag categories: %w", err)
+	}
+
+	for _, id := range categoryIDs {
+		if id == categoryID {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrTagCategoryNotFound, categoryID)
+}
+
+// deleteTagCategory deletes the tag category of the cluster. The category is matched by
+// the TagCategoryID stored in the cluster, so renaming the category in vCenter or changing
+// the configured prefix doesn't orphan it. Users can edit the TagCategoryID, so it must match
+// the ID of the category created for the cluster, see tagCategoryIDAnnotationKey. For clusters
+// initialized before the ID was stored, the category must have the given name instead. Other
+// categories are left untouched and false is returned for them.
+func deleteTagCategory(ctx context.Context, restSession *RESTSession, cluster *kubermaticv1.Cluster, name string) (bool, error) {
+	categoryID := cluster.Spec.Cloud.VSphere.TagCategoryID
+	createdID, ok := cluster.Annotations[tagCategoryIDAnnotationKey]
+	if ok && createdID != categoryID {
+		return false, nil
+	}
+
 	tagManager := tags.NewManager(restSession.Client)
 	categories, err := tagManager.GetCategories(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to get tag categories %w", err)
+		return false, fmt.Errorf("failed to get tag categories %w", err)
 	}
 
-	defaultCategoryName := categoryName(cluster)
-
+	// Like the folder, a category which got deleted in vCenter meanwhile is not an error.
 	for _, category := range categories {
-		if category.Name == defaultCategoryName {
-			return tagManager.DeleteCategory(ctx, &tags.Category{ID: category.ID})
+		if (categoryID != "" && category.ID == categoryID) || (categoryID == "" && category.Name == name) {
+			if !ok && category.Name != name {
+				return false, nil
+			}
+			if err := deleteTags(ctx, tagManager, category.ID); err != nil {
+				return false, err
+			}
+			if err := tagManager.DeleteCategory(ctx, &tags.Category{ID: category.ID}); err != nil && !isRESTNotFound(err) {
+				return false, err
+			}
+			return true, nil
 		}
 	}
 
+	return true, nil
+}
+
+// antiAffinityTagName returns the name of the anti-affinity tag of the cluster.
+func antiAffinityTagName(cluster *kubermaticv1.Cluster) string {
+	return cluster.Name + "-anti-affinity"
+}
+
+// createTag creates the tag within the given category if it does not exist yet and returns its ID.
+func createTag(ctx context.Context, tagManager *tags.Manager, categoryID, name string) (string, error) {
+	categoryTags, err := tagManager.GetTagsForCategory(ctx, categoryID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tags for category %q: %w", categoryID, err)
+	}
+
+	for _, tag := range categoryTags {
+		if tag.Name == name {
+			return tag.ID, nil
+		}
+	}
+
+	tagID, err := tagManager.CreateTag(ctx, &tags.Tag{
+		Name:       name,
+		CategoryID: categoryID,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create tag %q: %w", name, err)
+	}
+
+	return tagID, nil
+}
+
+// createAndAttachTag creates the cluster tag within the given category if it does not exist yet
+// and attaches it to the passed object.
+func createAndAttachTag(ctx context.Context, restSession *RESTSession, cluster *kubermaticv1.Cluster, categoryID string, ref mo.Reference) error {
+	tagManager := tags.NewManager(restSession.Client)
+	tagID, err := createTag(ctx, tagManager, categoryID, cluster.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := tagManager.AttachTag(ctx, tagID, ref); err != nil {
+		return fmt.Errorf("failed to attach tag %q: %w", cluster.Name, err)
+	}
+
+	return nil
+}
+
+// deleteTag detaches the tag with the given ID from all objects and deletes it, if it has the given
+// name and belongs to the given category. Tags which are already gone, e.g. together with their
+// category, are ignored. As the ID is taken from an annotation, which users can edit, other tags
+// are left untouched and false is returned for them.
+func deleteTag(ctx context.Context, tagManager *tags.Manager, tagID, categoryID, name string) (bool, error) {
+	if tagID == "" {
+		return true, nil
+	}
+	// GetTag looks up anything which isn't an ID by name.
+	if !strings.HasPrefix(tagID, "urn:") {
+		return false, nil
+	}
+
+	tag, err := tagManager.GetTag(ctx, tagID)
+	if err != nil {
+		if isRESTNotFound(err) {
+			return true, nil
+		}
+		return false, fmt.Errorf("failed to get tag %q: %w", tagID, err)
+	}
+	if tag.Name != name || tag.CategoryID != categoryID {
+		return false, nil
+	}
+
+	return true, deleteTagAndDetach(ctx, tagManager, *tag)
+}
+
+// deleteTags detaches all tags of the given category from their objects and deletes them.
+func deleteTags(ctx context.Context, tagManager *tags.Manager, categoryID string) error {
+	categoryTags, err := tagManager.GetTagsForCategory(ctx, categoryID)
+	if err != nil {
+		if isRESTNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get tags for category %q: %w", categoryID, err)
+	}
+
+	for _, tag := range categoryTags {
+		if err := deleteTagAndDetach(ctx, tagManager, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteTagAndDetach detaches the tag from its objects and deletes it. A tag which is already gone is ignored.
+func deleteTagAndDetach(ctx context.Context, tagManager *tags.Manager, tag tags.Tag) error {
+	refs, err := tagManager.ListAttachedObjects(ctx, tag.ID)
+	if err != nil {
+		if isRESTNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to list objects attached to tag %q: %w", tag.Name, err)
+	}
+	for _, ref := range refs {
+		if err := tagManager.DetachTag(ctx, tag.ID, ref); err != nil {
+			return fmt.Errorf("failed to detach tag %q: %w", tag.Name, err)
+		}
+	}
+
+	if err := tagManager.DeleteTag(ctx, &tags.Tag{ID: tag.ID}); err != nil && !isRESTNotFound(err) {
+		return fmt.Errorf("failed to delete tag %q: %w", tag.Name, err)
+	}
+
 	return nil
 }
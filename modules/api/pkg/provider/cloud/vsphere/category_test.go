@@ -0,0 +1,770 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vapi/tags"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	kuberneteshelper "k8c.io/kubermatic/v2/pkg/kubernetes"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestClusterTagLifecycle(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	folder, err := session.Finder.Folder(ctx, cluster.Spec.Cloud.VSphere.Folder)
+	if err != nil {
+		t.Fatalf("failed to get cluster folder: %v", err)
+	}
+
+	tagManager := tags.NewManager(restSession.Client)
+	attachedTags, err := tagManager.GetAttachedTags(ctx, folder)
+	if err != nil {
+		t.Fatalf("failed to get attached tags: %v", err)
+	}
+	if len(attachedTags) != 1 {
+		t.Fatalf("expected exactly one tag to be attached to the cluster folder, got %v", attachedTags)
+	}
+	if attachedTags[0].Name != cluster.Name {
+		t.Errorf("expected tag %q, got %q", cluster.Name, attachedTags[0].Name)
+	}
+	if attachedTags[0].CategoryID != cluster.Spec.Cloud.VSphere.TagCategoryID {
+		t.Errorf("expected tag to belong to category %q, got %q", cluster.Spec.Cloud.VSphere.TagCategoryID, attachedTags[0].CategoryID)
+	}
+
+	// The category documents its purpose for admins browsing vCenter.
+	category, err := tagManager.GetCategory(ctx, cluster.Spec.Cloud.VSphere.TagCategoryID)
+	if err != nil {
+		t.Fatalf("failed to get tag category: %v", err)
+	}
+	if !strings.Contains(category.Description, `"test"`) || !strings.Contains(category.Description, managedByKubermatic) {
+		t.Errorf("expected the category description to name the cluster and KKP, got %q", category.Description)
+	}
+	if category.Cardinality != "MULTIPLE" || strings.Join(category.AssociableTypes, ",") != "Folder,VirtualMachine" {
+		t.Errorf("expected tags of the category to be attachable to folders and VMs, got cardinality %q and types %v", category.Cardinality, category.AssociableTypes)
+	}
+
+	// Initializing again must not create a second tag.
+	cluster.Spec.Cloud.VSphere.TagCategoryID = ""
+	if _, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to initialize cloud provider again: %v", err)
+	}
+	categoryTags, err := tagManager.GetTagsForCategory(ctx, cluster.Spec.Cloud.VSphere.TagCategoryID)
+	if err != nil {
+		t.Fatalf("failed to get tags for category: %v", err)
+	}
+	if len(categoryTags) != 1 {
+		t.Fatalf("expected exactly one tag in the category, got %v", categoryTags)
+	}
+
+	if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+
+	remainingTags, err := tagManager.GetTags(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tags: %v", err)
+	}
+	if len(remainingTags) != 0 {
+		t.Errorf("expected all tags to be deleted, got %v", remainingTags)
+	}
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tag categories: %v", err)
+	}
+	for _, category := range categories {
+		if category.Name == categoryName("", cluster) {
+			t.Errorf("expected tag category %q to be deleted", category.Name)
+		}
+	}
+}
+
+func TestCustomTagCategory(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+	WithDefaultTagCategory("kkp-")(v)
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	tagManager := tags.NewManager(restSession.Client)
+	category, err := tagManager.GetCategory(ctx, cluster.Spec.Cloud.VSphere.TagCategoryID)
+	if err != nil {
+		t.Fatalf("failed to get tag category: %v", err)
+	}
+	if category.Name != "kkp-test" {
+		t.Errorf("expected tag category %q, got %q", "kkp-test", category.Name)
+	}
+
+	// A renamed category must still be cleaned up.
+	category.Name = "renamed"
+	if err := tagManager.UpdateCategory(ctx, category); err != nil {
+		t.Fatalf("failed to rename tag category: %v", err)
+	}
+
+	if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tag categories: %v", err)
+	}
+	if len(categories) != 0 {
+		t.Errorf("expected the renamed tag category to be deleted, got %v", categories)
+	}
+}
+
+func TestProviderCleanUpForeignTagCategory(t *testing.T) {
+	tests := []struct {
+		name string
+		// legacy drops the stored ID of the created category, like for clusters initialized before it was stored.
+		legacy bool
+	}{
+		{
+			name: "Category changed in the spec",
+		},
+		{
+			name:   "Category changed in the spec of a cluster without stored category ID",
+			legacy: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := vSphereSimulator{t: t}
+			sim.setUp()
+			defer sim.tearDown()
+
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			v := &Provider{
+				dc:             dc,
+				cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+			}
+
+			cluster := &kubermaticv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{Name: "test"},
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{
+						VSphere: &kubermaticv1.VSphereCloudSpec{},
+					},
+				},
+			}
+
+			ctx := context.Background()
+			cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+			if err != nil {
+				t.Fatalf("failed to initialize cloud provider: %v", err)
+			}
+			if cluster.Annotations[tagCategoryIDAnnotationKey] != cluster.Spec.Cloud.VSphere.TagCategoryID {
+				t.Fatalf("expected the ID of the created category to be stored, got annotations %v", cluster.Annotations)
+			}
+
+			restSession, err := newRESTSession(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create REST client session: %v", err)
+			}
+			defer restSession.Logout(ctx)
+			tagManager := tags.NewManager(restSession.Client)
+
+			// The spec is pointed to a category shared by the organisation.
+			sharedID, err := tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            "organisation",
+				Cardinality:     "MULTIPLE",
+				AssociableTypes: []string{"Folder"},
+			})
+			if err != nil {
+				t.Fatalf("failed to create tag category: %v", err)
+			}
+			tagID, err := tagManager.CreateTag(ctx, &tags.Tag{Name: "shared", CategoryID: sharedID})
+			if err != nil {
+				t.Fatalf("failed to create tag: %v", err)
+			}
+			session, err := newSession(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+			folder, err := session.Finder.Folder(ctx, "/DC0/vm")
+			if err != nil {
+				t.Fatalf("failed to get folder: %v", err)
+			}
+			if err := tagManager.AttachTag(ctx, tagID, folder); err != nil {
+				t.Fatalf("failed to attach tag: %v", err)
+			}
+			cluster.Spec.Cloud.VSphere.TagCategoryID = sharedID
+			if tt.legacy {
+				delete(cluster.Annotations, tagCategoryIDAnnotationKey)
+			}
+
+			cluster, err = v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+			if err != nil {
+				t.Fatalf("failed to clean up cloud provider: %v", err)
+			}
+			if kuberneteshelper.HasFinalizer(cluster, tagCategoryCleanupFinilizer) {
+				t.Errorf("expected finalizer %q to be removed", tagCategoryCleanupFinilizer)
+			}
+			if _, ok := cluster.Annotations[tagCategoryIDAnnotationKey]; ok {
+				t.Errorf("expected the stored category ID to be removed, got annotations %v", cluster.Annotations)
+			}
+
+			if _, err := tagManager.GetCategory(ctx, sharedID); err != nil {
+				t.Errorf("expected the shared category to be kept: %v", err)
+			}
+			attached, err := tagManager.ListAttachedObjects(ctx, tagID)
+			if err != nil {
+				t.Fatalf("expected the tag of the shared category to be kept: %v", err)
+			}
+			if len(attached) != 1 {
+				t.Errorf("expected the tag of the shared category to stay attached, got %v", attached)
+			}
+		})
+	}
+}
+
+func TestCategoryName(t *testing.T) {
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+	}
+
+	if name := categoryName("", cluster); name != "clustertest" {
+		t.Errorf("expected the default prefix to be used, got %q", name)
+	}
+	if name := categoryName("org-k8s-", cluster); name != "org-k8s-test" {
+		t.Errorf("expected the configured prefix to be used, got %q", name)
+	}
+}
+
+func TestAntiAffinityTag(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+	WithAntiAffinityTag()(v)
+
+	ctx := context.Background()
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	tagManager := tags.NewManager(restSession.Client)
+	userCategoryID, err := createTagCategory(ctx, restSession, "user-category", "test")
+	if err != nil {
+		t.Fatalf("failed to create tag category: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		categoryID string
+	}{
+		{
+			name: "Default tag category",
+		},
+		{
+			name:       "User tag category",
+			categoryID: userCategoryID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := &kubermaticv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{
+						VSphere: &kubermaticv1.VSphereCloudSpec{
+							TagCategoryID: tt.categoryID,
+						},
+					},
+				},
+			}
+
+			cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+			if err != nil {
+				t.Fatalf("failed to initialize cloud provider: %v", err)
+			}
+
+			tagID := cluster.Annotations[AntiAffinityTagAnnotationKey]
+			if tagID == "" {
+				t.Fatalf("expected the anti-affinity tag ID to be stored, got annotations %v", cluster.Annotations)
+			}
+			tag, err := tagManager.GetTag(ctx, tagID)
+			if err != nil {
+				t.Fatalf("failed to get anti-affinity tag: %v", err)
+			}
+			if tag.Name != "test-anti-affinity" || tag.CategoryID != cluster.Spec.Cloud.VSphere.TagCategoryID {
+				t.Errorf("expected tag %q in category %q, got %+v", "test-anti-affinity", cluster.Spec.Cloud.VSphere.TagCategoryID, tag)
+			}
+
+			// machine-controller attaches the tag to the node VMs.
+			session, err := newSession(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+			vm, err := session.Finder.VirtualMachine(ctx, "DC0_H0_VM0")
+			if err != nil {
+				t.Fatalf("failed to get VM: %v", err)
+			}
+			if err := tagManager.AttachTag(ctx, tagID, vm); err != nil {
+				t.Fatalf("failed to attach anti-affinity tag: %v", err)
+			}
+
+			cluster, err = v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+			if err != nil {
+				t.Fatalf("failed to clean up cloud provider: %v", err)
+			}
+			if _, ok := cluster.Annotations[AntiAffinityTagAnnotationKey]; ok {
+				t.Errorf("expected the anti-affinity tag ID to be removed, got annotations %v", cluster.Annotations)
+			}
+			if len(cluster.Finalizers) != 0 {
+				t.Errorf("expected all finalizers to be removed, got %v", cluster.Finalizers)
+			}
+
+			remainingTags, err := tagManager.GetTags(ctx)
+			if err != nil {
+				t.Fatalf("failed to get tags: %v", err)
+			}
+			for _, tag := range remainingTags {
+				if tag.ID == tagID {
+					t.Errorf("expected the anti-affinity tag to be deleted")
+				}
+			}
+		})
+	}
+
+	// A tag category provided by the user must be left alone.
+	if _, err := tagManager.GetCategory(ctx, userCategoryID); err != nil {
+		t.Errorf("expected the user tag category to be kept: %v", err)
+	}
+
+	// Tags referenced by an edited annotation, which aren't the anti-affinity tag of the cluster, must be left alone.
+	otherCategoryID, err := createTagCategory(ctx, restSession, "other-category", "test")
+	if err != nil {
+		t.Fatalf("failed to create tag category: %v", err)
+	}
+	foreignTags := map[string]tags.Tag{
+		"Other name":     {Name: "other", CategoryID: userCategoryID},
+		"Other category": {Name: "test-anti-affinity", CategoryID: otherCategoryID},
+	}
+	for name, tag := range foreignTags {
+		t.Run(name, func(t *testing.T) {
+			tagID, err := tagManager.CreateTag(ctx, &tag)
+			if err != nil {
+				t.Fatalf("failed to create tag: %v", err)
+			}
+
+			cluster := &kubermaticv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test",
+					Annotations: map[string]string{AntiAffinityTagAnnotationKey: tagID},
+					Finalizers:  []string{antiAffinityTagCleanupFinalizer},
+				},
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{
+						VSphere: &kubermaticv1.VSphereCloudSpec{
+							TagCategoryID: userCategoryID,
+						},
+					},
+				},
+			}
+
+			cluster, err = v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+			if err != nil {
+				t.Fatalf("failed to clean up cloud provider: %v", err)
+			}
+			if len(cluster.Finalizers) != 0 {
+				t.Errorf("expected all finalizers to be removed, got %v", cluster.Finalizers)
+			}
+			if _, err := tagManager.GetTag(ctx, tagID); err != nil {
+				t.Errorf("expected the tag to be kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestProviderValidateTagCategoryUpdate(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+
+	ctx := context.Background()
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	categoryID, err := createTagCategory(ctx, restSession, "cluster-category", "test")
+	if err != nil {
+		t.Fatalf("failed to create tag category: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		oldCategoryID string
+		newCategoryID string
+		expectedErr   error
+	}{
+		{
+			name:          "Existing category",
+			oldCategoryID: "urn:vmomi:InventoryServiceCategory:previous:GLOBAL",
+			newCategoryID: categoryID,
+		},
+		{
+			name:          "Category set for the first time",
+			newCategoryID: categoryID,
+		},
+		{
+			name:          "Missing category",
+			oldCategoryID: categoryID,
+			newCategoryID: "urn:vmomi:InventoryServiceCategory:missing:GLOBAL",
+			expectedErr:   ErrTagCategoryNotFound,
+		},
+		{
+			name:          "Category name instead of ID",
+			oldCategoryID: categoryID,
+			newCategoryID: "cluster-category",
+			expectedErr:   ErrInvalidTagCategoryID,
+		},
+		{
+			// A carried over category is not looked up, so it doesn't block unrelated updates.
+			name:          "Unchanged missing category",
+			oldCategoryID: "urn:vmomi:InventoryServiceCategory:missing:GLOBAL",
+			newCategoryID: "urn:vmomi:InventoryServiceCategory:missing:GLOBAL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldSpec := kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{TagCategoryID: tt.oldCategoryID}}
+			newSpec := kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{TagCategoryID: tt.newCategoryID}}
+
+			err := v.ValidateCloudSpecUpdate(ctx, oldSpec, newSpec)
+			if tt.expectedErr == nil && err != nil {
+				t.Fatalf("expected the update to be valid, got %v", err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestProviderWithoutTagCategoryCreation(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+	tagManager := tags.NewManager(restSession.Client)
+
+	newProvider := func(disabled bool) *Provider {
+		v := &Provider{
+			dc:             dc,
+			cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+		}
+		WithAntiAffinityTag()(v)
+		if disabled {
+			WithoutTagCategoryCreation()(v)
+		}
+		return v
+	}
+	newCluster := func(name string) *kubermaticv1.Cluster {
+		return &kubermaticv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: kubermaticv1.ClusterSpec{
+				Cloud: kubermaticv1.CloudSpec{
+					VSphere: &kubermaticv1.VSphereCloudSpec{},
+				},
+			},
+		}
+	}
+
+	// Neither the category nor the anti-affinity tag, which would live in it, are created.
+	cluster := newCluster("disabled")
+	cluster, err = newProvider(true).InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if cluster.Spec.Cloud.VSphere.TagCategoryID != "" || cluster.Annotations[AntiAffinityTagAnnotationKey] != "" {
+		t.Errorf("expected no tag category and anti-affinity tag, got %+v", cluster)
+	}
+	if kuberneteshelper.HasAnyFinalizer(cluster, tagCategoryCleanupFinilizer, antiAffinityTagCleanupFinalizer) {
+		t.Errorf("expected no tag finalizers, got %v", cluster.Finalizers)
+	}
+	if _, err := tagManager.GetCategory(ctx, categoryName("", cluster)); err == nil {
+		t.Error("expected the tag category not to be created")
+	}
+
+	// Clusters created before the creation got disabled still get their category deleted.
+	cluster = newCluster("enabled")
+	cluster, err = newProvider(false).InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if !kuberneteshelper.HasFinalizer(cluster, tagCategoryCleanupFinilizer) || cluster.Spec.Cloud.VSphere.TagCategoryID == "" {
+		t.Fatalf("expected a tag category to be created, got %+v", cluster)
+	}
+
+	cluster, err = newProvider(true).CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+	if len(cluster.Finalizers) != 0 {
+		t.Errorf("expected all finalizers to be removed, got %v", cluster.Finalizers)
+	}
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tag categories: %v", err)
+	}
+	if len(categories) != 0 {
+		t.Errorf("expected the tag category to be deleted, got %v", categories)
+	}
+}
+
+func TestProviderCleanUpDeletedTagCategory(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "test"},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	categoryID := cluster.Spec.Cloud.VSphere.TagCategoryID
+
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+	tagManager := tags.NewManager(restSession.Client)
+
+	// The category is deleted manually in vCenter.
+	if err := tagManager.DeleteCategory(ctx, &tags.Category{ID: categoryID}); err != nil {
+		t.Fatalf("failed to delete tag category: %v", err)
+	}
+
+	// Lookups of the category which raced with its deletion fail with a not found error.
+	err = tagManager.DeleteCategory(ctx, &tags.Category{ID: categoryID})
+	if !isRESTNotFound(err) {
+		t.Errorf("expected a not found error deleting the category again, got %v", err)
+	}
+	if isRESTNotFound(errors.New("DELETE https://vcenter/rest/com/vmware/cis/tagging/category: 500 Internal Server Error")) {
+		t.Error("expected other errors not to be reported as not found")
+	}
+	if err := deleteTags(ctx, tagManager, categoryID); err != nil {
+		t.Errorf("expected the tags of the deleted category to be skipped, got %v", err)
+	}
+
+	cluster, err = v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+	if kuberneteshelper.HasFinalizer(cluster, tagCategoryCleanupFinilizer) {
+		t.Errorf("expected finalizer %q to be removed", tagCategoryCleanupFinilizer)
+	}
+}
+
+func TestProviderGetFolderTags(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+
+	// The folder created for the cluster is tagged with the cluster tag of its category.
+	folderTags, err := v.GetFolderTags(ctx, cluster)
+	if err != nil {
+		t.Fatalf("failed to get folder tags: %v", err)
+	}
+	if len(folderTags) != 1 {
+		t.Fatalf("expected exactly one tag, got %v", folderTags)
+	}
+	if tag := folderTags[0]; tag.Name != "test" || tag.CategoryID != cluster.Spec.Cloud.VSphere.TagCategoryID || tag.CategoryName != "clustertest" {
+		t.Errorf("expected the cluster tag in category %q, got %+v", cluster.Spec.Cloud.VSphere.TagCategoryID, tag)
+	}
+
+	// Folders chosen by the user are looked up by their path.
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	if _, err := createVMFolder(ctx, session, "/DC0/vm/untagged"); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+
+	untagged := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "untagged",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/vm/untagged",
+				},
+			},
+		},
+	}
+	folderTags, err = v.GetFolderTags(ctx, untagged)
+	if err != nil {
+		t.Fatalf("failed to get folder tags: %v", err)
+	}
+	if len(folderTags) != 0 {
+		t.Errorf("expected no tags, got %v", folderTags)
+	}
+
+	untagged.Spec.Cloud.VSphere.Folder = ""
+	if _, err := v.GetFolderTags(ctx, untagged); err == nil {
+		t.Error("expected an error for a cluster without folder")
+	}
+}
@@ -17,11 +17,22 @@ limitations under the License.
 package vsphere
 
 import (
+	"bytes"
 	"context"
 	"crypto/x509"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/vmware/govmomi/session/keepalive"
 	"github.com/vmware/govmomi/vapi/rest"
 	"github.com/vmware/govmomi/vim25"
 	"github.com/vmware/govmomi/vim25/soap"
@@ -31,34 +42,269 @@ import (
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 )
 
+// newSOAPClient creates the SOAP client for the vCenter endpoint of the datacenter.
+func newSOAPClient(dc *kubermaticv1.DatacenterSpecVSphere, caBundle *x509.CertPool, options *sessionOptions) (*soap.Client, error) {
+	u, err := parseEndpoint(dc.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	// creating the govmoni Client in roundabout way because we need to set the proper CA bundle: reference https://github.com/vmware/govmomi/issues/1200
+	insecure := dc.AllowInsecure
+	if options.insecure && !insecure {
+		options.log.Warnw("Skipping vCenter certificate verification as requested", "endpoint", u.Redacted(), "datacenter", dc.Datacenter)
+		insecure = true
+	}
+
+	transport, err := transports.get(transportConfig{
+		caBundle:      caBundle,
+		insecure:      insecure,
+		thumbprint:    options.thumbprint,
+		proxy:         options.proxy,
+		minTLSVersion: options.minTLSVersion,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	soapClient := soap.NewClient(u, insecure)
+	soapClient.Client.Transport = transport
+	// Service clients, e.g. for the REST API, are created with the TLS config of the default transport.
+	// govmomi modifies that config, e.g. when setting client certificates, so every client gets a copy
+	// and the cached transport is never touched after its creation.
+	soapClient.DefaultTransport().TLSClientConfig = transport.TLSClientConfig.Clone()
+
+	return soapClient, nil
+}
+
+// parseEndpoint returns the URL of the vCenter SDK for the configured endpoint. The endpoint may
+// omit the scheme, which defaults to https, and may already include the "/sdk" path. IPv6 literals
+// should be enclosed in brackets, e.g. "https://[2001:db8::1]:443", but are accepted without them
+// as long as no port is given.
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	endpoint = strings.TrimSpace(endpoint)
+	if endpoint == "" {
+		return nil, fmt.Errorf("%w: endpoint must not be empty", ErrInvalidEndpoint)
+	}
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+	endpoint = bracketIPv6Host(endpoint)
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidEndpoint, err.Error())
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("%w: unsupported scheme %q in %q", ErrInvalidEndpoint, u.Scheme, endpoint)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: missing host in %q", ErrInvalidEndpoint, endpoint)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%w: %q must not contain a query or fragment", ErrInvalidEndpoint, endpoint)
+	}
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	if path.Base(u.Path) != "sdk" {
+		u.Path += "/sdk"
+	}
+	u.RawPath = ""
+
+	return u, nil
+}
+
+// redactEndpoint returns the URL of the vCenter SDK for the endpoint with the password, which the endpoint
+// might contain, masked, so the endpoint can be logged.
+func redactEndpoint(endpoint string) string {
+	u, err := parseEndpoint(endpoint)
+	if err != nil {
+		return ""
+	}
+	return u.Redacted()
+}
+
+// bracketIPv6Host encloses an unbracketed IPv6 literal host of the endpoint URL in brackets, which
+// url.Parse would otherwise mistake for a host and port. The "%" of a zone, e.g. "fe80::1%eth0",
+// is escaped as required within URLs.
+func bracketIPv6Host(endpoint string) string {
+	scheme, rest, _ := strings.Cut(endpoint, "://")
+	host, path, hasPath := strings.Cut(rest, "/")
+
+	if strings.HasPrefix(host, "[") {
+		if addr, port, ok := strings.Cut(host[1:], "]"); ok {
+			host = "[" + escapeZone(addr) + "]" + port
+		}
+	} else if ip, _, _ := strings.Cut(host, "%"); strings.Contains(ip, ":") && net.ParseIP(ip) != nil {
+		host = "[" + escapeZone(host) + "]"
+	}
+
+	endpoint = scheme + "://" + host
+	if hasPath {
+		endpoint += "/" + path
+	}
+	return endpoint
+}
+
+// escapeZone escapes the zone separator of an IPv6 address unless it is escaped already.
+func escapeZone(addr string) string {
+	ip, zone, ok := strings.Cut(addr, "%")
+	if !ok || strings.HasPrefix(zone, "25") {
+		return addr
+	}
+	return ip + "%25" + zone
+}
+
+var apiVersionRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)+$`)
+
+// validateAPIVersion returns an error unless the version consists of dot separated numbers, e.g. "6.7".
+func validateAPIVersion(version string) error {
+	if !apiVersionRegexp.MatchString(version) {
+		return fmt.Errorf("%w: %q, expected a version like \"6.7\"", ErrInvalidAPIVersion, version)
+	}
+	return nil
+}
+
+// useAPIVersion pins the vim25 API version of the client or, if no version is given, negotiates the
+// newest version supported by both vCenter and govmomi, as older vCenter builds reject newer versions.
+// If vCenter doesn't list its versions, the govmomi default is kept.
+func useAPIVersion(client *vim25.Client, version string) error {
+	if version != "" {
+		if err := validateAPIVersion(version); err != nil {
+			return err
+		}
+		client.Version = version
+		return nil
+	}
+
+	namespace, defaultVersion := client.Namespace, client.Version
+	err := client.UseServiceVersion()
+	if isTransientError(err) {
+		return err
+	}
+	// UseServiceVersion takes over whatever vCenter lists first, so only versions of the vim25
+	// namespace which govmomi supports are used.
+	if err != nil || client.Namespace != namespace || validateAPIVersion(client.Version) != nil || compareAPIVersions(client.Version, defaultVersion) > 0 {
+		client.Namespace, client.Version = namespace, defaultVersion
+	}
+
+	return nil
+}
+
+// compareAPIVersions compares two valid API versions numerically and returns -1, 0 or 1.
+func compareAPIVersions(a, b string) int {
+	aParts, bParts := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			aPart, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bPart, _ = strconv.Atoi(bParts[i])
+		}
+		switch {
+		case aPart < bPart:
+			return -1
+		case aPart > bPart:
+			return 1
+		}
+	}
+	return 0
+}
+
 type RESTSession struct {
 	Client *rest.Client
 }
 
-func newRESTSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool) (*RESTSession, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/sdk", dc.Endpoint))
+func newRESTSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*RESTSession, error) {
+	options := newSessionOptions(opts)
+
+	return loginREST(ctx, dc, options, func(ctx context.Context) (*RESTSession, error) {
+		return connectREST(ctx, dc, username, password, caBundle, options)
+	})
+}
+
+// newBrowseRESTSession creates a REST session for listing the inventory of the datacenter, see WithBrowseUser.
+func newBrowseRESTSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*RESTSession, error) {
+	dc, username, password = browseCredentials(dc, username, password, newSessionOptions(opts))
+	return newRESTSession(ctx, dc, username, password, caBundle, opts...)
+}
+
+// newRESTSessionFromSession creates a REST session on top of the connection of an existing
+// vCenter session. This saves connecting to vCenter a second time, but the REST API still
+// requires its own login: vCenter only accepts REST session IDs issued by the REST login,
+// which authenticates with basic auth or an SSO token, and rejects the SOAP session cookie.
+func newRESTSessionFromSession(ctx context.Context, session *Session, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, opts ...SessionOption) (*RESTSession, error) {
+	options := newSessionOptions(opts)
+
+	return loginREST(ctx, dc, options, func(ctx context.Context) (*RESTSession, error) {
+		return authenticateREST(ctx, newRESTClient(session.Client.Client), dc, username, password, options)
+	})
+}
+
+// loginREST establishes a REST session using connect, giving up once the login timeout is reached.
+func loginREST(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, options *sessionOptions, connect func(context.Context) (*RESTSession, error)) (*RESTSession, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.loginTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var restSession *RESTSession
+	err := retryLogin(ctx, options.loginAttempts, func() (err error) {
+		restSession, err = connect(ctx)
+		return err
+	})
+	options.metrics.observeLogin(dc.Datacenter, operationRESTLogin, start, err)
 	if err != nil {
-		return nil, err
+		return nil, asTimeoutError(ctx, dc.Endpoint, options.loginTimeout, err)
 	}
 
-	// creating the govmoni Client in roundabout way because we need to set the proper CA bundle: reference https://github.com/vmware/govmomi/issues/1200
-	soapClient := soap.NewClient(u, dc.AllowInsecure)
-	// set our CA bundle
-	soapClient.DefaultTransport().TLSClientConfig.RootCAs = caBundle
+	return restSession, nil
+}
+
+func connectREST(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, options *sessionOptions) (*RESTSession, error) {
+	soapClient, err := newSOAPClient(dc, caBundle, options)
+	if err != nil {
+		return nil, err
+	}
 
 	vim25Client, err := vim25.NewClient(ctx, soapClient)
 	if err != nil {
 		return nil, err
 	}
+	if err := useAPIVersion(vim25Client, options.apiVersion); err != nil {
+		return nil, err
+	}
 
+	return authenticateREST(ctx, newRESTClient(vim25Client), dc, username, password, options)
+}
+
+// newRESTClient creates a REST client which shares the transport of the SOAP client. govmomi
+// creates a new transport for service clients, which would ignore the configured proxy.
+func newRESTClient(vim25Client *vim25.Client) *rest.Client {
 	client := rest.NewClient(vim25Client)
+	client.Client.Client.Transport = vim25Client.Client.Client.Transport
+	return client
+}
 
+// authenticateREST logs the REST client in. Unlike SOAP sessions, REST sessions expire during long operations
+// like the cleanup of a cluster, so the client keeps its session alive if a keepalive interval is configured
+// and logs in again if vCenter rejects a request nonetheless.
+func authenticateREST(ctx context.Context, client *rest.Client, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, options *sessionOptions) (*RESTSession, error) {
 	user := url.UserPassword(username, password)
 	if dc.InfraManagementUser != nil {
 		user = url.UserPassword(dc.InfraManagementUser.Username, dc.InfraManagementUser.Password)
 	}
 
-	if err = client.Login(ctx, user); err != nil {
+	if options.keepAlive > 0 {
+		client.Transport = keepalive.NewHandlerREST(client, options.keepAlive, nil)
+	}
+	client.Transport = &reauthRoundTripper{
+		RoundTripper: client.Transport,
+		client:       client,
+		user:         user,
+	}
+
+	if err := client.Login(ctx, user); err != nil {
 		return nil, fmt.Errorf("failed to login: %w", err)
 	}
 
@@ -67,8 +313,84 @@ func newRESTSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere,
 	}, nil
 }
 
-// Logout closes the idling vCenter connections.
-func (s *RESTSession) Logout(ctx context.Context) {
+const (
+	// restSessionPath is the path of the REST API, which logs in and out and reports the current session.
+	restSessionPath = "/com/vmware/cis/session"
+	// restSessionHeader is the header carrying the ID of the REST session.
+	restSessionHeader = "vmware-api-session-id"
+)
+
+// reauthRoundTripper logs the REST client in again and retries the request once, if vCenter rejects it
+// because the session expired.
+type reauthRoundTripper struct {
+	http.RoundTripper
+
+	client *rest.Client
+	user   *url.Userinfo
+	// lock serializes logins, so concurrent requests failing at once log in only once.
+	lock sync.Mutex
+}
+
+func (rt *reauthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Requests for the session itself, e.g. the login, are never retried.
+	if strings.HasSuffix(req.URL.Path, restSessionPath) {
+		return rt.RoundTripper.RoundTrip(req)
+	}
+
+	// The body is consumed by the first attempt, so it is kept for the retry. REST request bodies are small.
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	res, err := rt.RoundTripper.RoundTrip(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	if err := rt.login(req.Context(), req.Header.Get(restSessionHeader)); err != nil {
+		// The original response tells the caller that the session is gone.
+		utilruntime.HandleError(fmt.Errorf("failed to log in to the vCenter REST API again: %w", err))
+		return res, nil
+	}
+	res.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set(restSessionHeader, rt.client.SessionID())
+
+	return rt.RoundTripper.RoundTrip(retry)
+}
+
+// login logs in again, unless another request already did so since the session with the given ID was rejected.
+func (rt *reauthRoundTripper) login(ctx context.Context, rejectedID string) error {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+
+	if rt.client.SessionID() != rejectedID {
+		return nil
+	}
+	return rt.client.Login(ctx, rt.user)
+}
+
+// Logout closes the idling vCenter connections. Like Session.Logout, it is attempted
+// even if ctx is already done.
+func (s *RESTSession) Logout(_ context.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+
 	if err := s.Client.Logout(ctx); err != nil {
 		utilruntime.HandleError(fmt.Errorf("vsphere REST client failed to logout: %w", err))
 	}
@@ -0,0 +1,402 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		endpoint    string
+		expectedURL string
+		wantErr     bool
+	}{
+		{
+			name:        "Scheme and host",
+			endpoint:    "https://vcenter.example.com",
+			expectedURL: "https://vcenter.example.com/sdk",
+		},
+		{
+			name:        "Trailing slash",
+			endpoint:    "https://vcenter.example.com/",
+			expectedURL: "https://vcenter.example.com/sdk",
+		},
+		{
+			name:        "SDK path already included",
+			endpoint:    "https://vcenter.example.com/sdk",
+			expectedURL: "https://vcenter.example.com/sdk",
+		},
+		{
+			name:        "SDK path with trailing slash",
+			endpoint:    "https://vcenter.example.com/sdk/",
+			expectedURL: "https://vcenter.example.com/sdk",
+		},
+		{
+			name:        "Custom port and path",
+			endpoint:    "https://proxy.example.com:8443/vcenter",
+			expectedURL: "https://proxy.example.com:8443/vcenter/sdk",
+		},
+		{
+			name:        "Host and port without scheme",
+			endpoint:    "vcenter.example.com:8443",
+			expectedURL: "https://vcenter.example.com:8443/sdk",
+		},
+		{
+			name:        "Plain HTTP",
+			endpoint:    "http://127.0.0.1:8989",
+			expectedURL: "http://127.0.0.1:8989/sdk",
+		},
+		{
+			name:        "Surrounding whitespace",
+			endpoint:    " https://vcenter.example.com ",
+			expectedURL: "https://vcenter.example.com/sdk",
+		},
+		{
+			name:        "IPv6 literal",
+			endpoint:    "https://[2001:db8::1]/sdk",
+			expectedURL: "https://[2001:db8::1]/sdk",
+		},
+		{
+			name:        "IPv6 literal and port without scheme",
+			endpoint:    "[2001:db8::1]:8443",
+			expectedURL: "https://[2001:db8::1]:8443/sdk",
+		},
+		{
+			name:        "IPv6 literal without brackets",
+			endpoint:    "https://2001:db8::1",
+			expectedURL: "https://[2001:db8::1]/sdk",
+		},
+		{
+			name:        "IPv6 literal without brackets and scheme",
+			endpoint:    "2001:db8::1/vcenter",
+			expectedURL: "https://[2001:db8::1]/vcenter/sdk",
+		},
+		{
+			name:        "IPv6 literal with zone",
+			endpoint:    "https://[fe80::1%eth0]:443",
+			expectedURL: "https://[fe80::1%25eth0]:443/sdk",
+		},
+		{
+			name:        "IPv6 literal with escaped zone",
+			endpoint:    "https://[fe80::1%25eth0]:443",
+			expectedURL: "https://[fe80::1%25eth0]:443/sdk",
+		},
+		{
+			name:     "Empty",
+			endpoint: "",
+			wantErr:  true,
+		},
+		{
+			name:     "Unsupported scheme",
+			endpoint: "ftp://vcenter.example.com",
+			wantErr:  true,
+		},
+		{
+			name:     "Missing host",
+			endpoint: "https:///sdk",
+			wantErr:  true,
+		},
+		{
+			name:     "Invalid port",
+			endpoint: "https://vcenter.example.com:port",
+			wantErr:  true,
+		},
+		{
+			name:     "Query",
+			endpoint: "https://vcenter.example.com/?foo=bar",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := parseEndpoint(tt.endpoint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidEndpoint) {
+					t.Errorf("expected error to be ErrInvalidEndpoint, got %v", err)
+				}
+				return
+			}
+			if u.String() != tt.expectedURL {
+				t.Errorf("expected URL %q, got %q", tt.expectedURL, u.String())
+			}
+		})
+	}
+}
+
+func TestInsecureWarning(t *testing.T) {
+	const password = "s3cr3t-password"
+	dc := &kubermaticv1.DatacenterSpecVSphere{
+		Endpoint:   "https://user:" + password + "@vcenter.example.com",
+		Datacenter: "DC0",
+	}
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	if _, err := newSOAPClient(dc, nil, newSessionOptions([]SessionOption{WithInsecure(), WithSessionLogger(zap.New(core).Sugar())})); err != nil {
+		t.Fatalf("failed to create SOAP client: %v", err)
+	}
+
+	entries := logs.FilterMessage("Skipping vCenter certificate verification as requested").All()
+	if len(entries) != 1 {
+		t.Fatalf("expected the skipped verification to be logged to the given logger once, got %d entries", len(entries))
+	}
+	if endpoint := entries[0].ContextMap()["endpoint"]; strings.Contains(fmt.Sprint(endpoint), password) {
+		t.Errorf("expected the endpoint to be logged without the password, got %q", endpoint)
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	tests := []struct {
+		name            string
+		opts            []SessionOption
+		expectedVersion string
+		wantErrIs       error
+	}{
+		{
+			// The simulator reports the API version 6.5, which is older than the govmomi default.
+			name:            "Negotiated version",
+			expectedVersion: "6.5",
+		},
+		{
+			name:            "Pinned version",
+			opts:            []SessionOption{WithAPIVersion("6.7")},
+			expectedVersion: "6.7",
+		},
+		{
+			name:      "Malformed version",
+			opts:      []SessionOption{WithAPIVersion("6.7u3")},
+			wantErrIs: ErrInvalidAPIVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+
+			ctx := context.Background()
+			session, err := newSession(ctx, dc, "", "", nil, tt.opts...)
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("expected error %v, got %v", tt.wantErrIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+
+			if session.Client.Client.Version != tt.expectedVersion {
+				t.Errorf("expected API version %q, got %q", tt.expectedVersion, session.Client.Client.Version)
+			}
+		})
+	}
+}
+
+func TestIPv6Endpoint(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is unavailable: %v", err)
+	}
+	l.Close()
+
+	model := simulator.VPX()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{Host: "[::1]:0"}
+	sim := vSphereSimulator{t: t, model: model, server: model.Service.NewServer()}
+	defer sim.tearDown()
+
+	// The certificate of the simulator is only valid for the IP address, so verification
+	// succeeds only if the IPv6 literal is used as host to verify.
+	pool := x509.NewCertPool()
+	pool.AddCert(sim.server.Certificate())
+
+	port := sim.server.URL.Port()
+	for _, endpoint := range []string{
+		"https://[::1]:" + port,
+		"https://[::1]:" + port + "/sdk",
+		"[::1]:" + port,
+	} {
+		t.Run(endpoint, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			dc.Endpoint = endpoint
+
+			ctx := context.Background()
+			if err := ProbeEndpoint(ctx, dc, pool); err != nil {
+				t.Fatalf("failed to probe endpoint: %v", err)
+			}
+
+			session, err := newSession(ctx, dc, "", "", pool)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+
+			if host := session.Client.URL().Hostname(); host != "::1" {
+				t.Errorf("expected host %q, got %q", "::1", host)
+			}
+		})
+	}
+}
+
+func TestLocale(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	tests := []struct {
+		name           string
+		opts           []SessionOption
+		expectedLocale string
+	}{
+		{
+			name:           "Default locale",
+			expectedLocale: "en_US",
+		},
+		{
+			name:           "Configured locale",
+			opts:           []SessionOption{WithLocale("de_DE")},
+			expectedLocale: "de_DE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+
+			ctx := context.Background()
+			session, err := newSession(ctx, dc, "", "", nil, tt.opts...)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+
+			userSession, err := session.Client.SessionManager.UserSession(ctx)
+			if err != nil {
+				t.Fatalf("failed to get user session: %v", err)
+			}
+			if userSession.Locale != tt.expectedLocale {
+				t.Errorf("expected locale %q, got %q", tt.expectedLocale, userSession.Locale)
+			}
+		})
+	}
+}
+
+func TestCompareAPIVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{a: "6.7", b: "7.0", expected: -1},
+		{a: "7.0", b: "7.0", expected: 0},
+		{a: "7.0.1", b: "7.0", expected: 1},
+		{a: "10.0", b: "9.0", expected: 1},
+	}
+	for _, tt := range tests {
+		if got := compareAPIVersions(tt.a, tt.b); got != tt.expected {
+			t.Errorf("compareAPIVersions(%q, %q) = %d, expected %d", tt.a, tt.b, got, tt.expected)
+		}
+	}
+}
+
+func TestRESTReauthentication(t *testing.T) {
+	sim := vSphereSimulator{t: t, user: url.UserPassword("user", "pass")}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.InfraManagementUser = nil
+
+	ctx := context.Background()
+	restSession, err := newRESTSession(ctx, dc, "user", "pass", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	session, err := newSession(ctx, dc, "user", "pass", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// expire ends the REST session on the vCenter side, as if it timed out.
+	expire := func() string {
+		id := restSession.Client.SessionID()
+		other := newRESTClient(session.Client.Client)
+		other.SessionID(id)
+		if err := other.Logout(ctx); err != nil {
+			t.Fatalf("failed to expire the REST session: %v", err)
+		}
+		return id
+	}
+
+	// Both requests without and with a body must be retried.
+	expiredID := expire()
+	if _, err := tags.NewManager(restSession.Client).GetCategories(ctx); err != nil {
+		t.Fatalf("expected the categories to be listed after logging in again, got %v", err)
+	}
+	if restSession.Client.SessionID() == expiredID {
+		t.Error("expected the client to use a new session")
+	}
+
+	expire()
+	if _, err := createTagCategory(ctx, restSession, "cluster-test", "test"); err != nil {
+		t.Fatalf("expected the category to be created after logging in again, got %v", err)
+	}
+
+	// The request fails if logging in again fails, e.g. because the credentials were revoked meanwhile.
+	restSession.Client.Transport.(*reauthRoundTripper).user = url.UserPassword("user", "")
+	expire()
+	if _, err := tags.NewManager(restSession.Client).GetCategories(ctx); !isRESTUnauthorized(err) {
+		t.Errorf("expected the request to be rejected, got %v", err)
+	}
+}
+
+// isRESTUnauthorized returns true if the REST API rejected the request for lacking a valid session.
+func isRESTUnauthorized(err error) bool {
+	return err != nil && strings.HasSuffix(err.Error(), ": 401 Unauthorized")
+}
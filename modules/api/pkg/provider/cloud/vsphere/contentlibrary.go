@@ -0,0 +1,92 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/vmware/govmomi/vapi/library"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// ContentLibrary represents a vsphere content library.
+type ContentLibrary struct {
+	ID   string
+	Name string
+	Type string
+}
+
+// ContentLibraryItem represents an item of a vsphere content library, e.g. an OVF template.
+type ContentLibraryItem struct {
+	ID   string
+	Name string
+	Type string
+}
+
+// GetContentLibraries returns a slice of ContentLibrary of the vCenter of the datacenter from the passed cloudspec.
+func GetContentLibraries(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]ContentLibrary, error) {
+	restSession, err := newBrowseRESTSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client session: %w", err)
+	}
+	defer restSession.Logout(ctx)
+
+	libraries, err := library.NewManager(restSession.Client).GetLibraries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list content libraries: %w", err)
+	}
+
+	result := make([]ContentLibrary, 0, len(libraries))
+	for _, l := range libraries {
+		result = append(result, ContentLibrary{
+			ID:   l.ID,
+			Name: l.Name,
+			Type: l.Type,
+		})
+	}
+
+	return result, nil
+}
+
+// GetContentLibraryItems returns a slice of ContentLibraryItem of the content library with the given ID.
+// A library without items results in an empty slice.
+func GetContentLibraryItems(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, libraryID string, opts ...SessionOption) ([]ContentLibraryItem, error) {
+	restSession, err := newBrowseRESTSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client session: %w", err)
+	}
+	defer restSession.Logout(ctx)
+
+	items, err := library.NewManager(restSession.Client).GetLibraryItems(ctx, libraryID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list items of content library %q: %w", libraryID, err)
+	}
+
+	result := make([]ContentLibraryItem, 0, len(items))
+	for _, item := range items {
+		result = append(result, ContentLibraryItem{
+			ID:   item.ID,
+			Name: item.Name,
+			Type: item.Type,
+		})
+	}
+
+	return result, nil
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/vapi/library"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestGetContentLibraryItems(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	datastore, err := session.Finder.DefaultDatastore(ctx)
+	if err != nil {
+		t.Fatalf("failed to get datastore: %v", err)
+	}
+
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	manager := library.NewManager(restSession.Client)
+	createLibrary := func(name string) string {
+		id, err := manager.CreateLibrary(ctx, library.Library{
+			Name: name,
+			Type: "LOCAL",
+			Storage: []library.StorageBackings{{
+				DatastoreID: datastore.Reference().Value,
+				Type:        "DATASTORE",
+			}},
+		})
+		if err != nil {
+			t.Fatalf("failed to create content library %q: %v", name, err)
+		}
+		return id
+	}
+
+	templatesID := createLibrary("templates")
+	emptyID := createLibrary("empty")
+
+	itemID, err := manager.CreateLibraryItem(ctx, library.Item{
+		Name:      "ubuntu",
+		Type:      "ovf",
+		LibraryID: templatesID,
+	})
+	if err != nil {
+		t.Fatalf("failed to create content library item: %v", err)
+	}
+
+	libraries, err := GetContentLibraries(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list content libraries: %v", err)
+	}
+	found := map[string]ContentLibrary{}
+	for _, l := range libraries {
+		found[l.ID] = l
+	}
+	if l := found[templatesID]; l.Name != "templates" || l.Type != "LOCAL" {
+		t.Errorf("expected library %q to be listed, got %v", "templates", libraries)
+	}
+	if l := found[emptyID]; l.Name != "empty" {
+		t.Errorf("expected library %q to be listed, got %v", "empty", libraries)
+	}
+
+	items, err := GetContentLibraryItems(ctx, dc, "", "", nil, templatesID)
+	if err != nil {
+		t.Fatalf("failed to list content library items: %v", err)
+	}
+	expected := ContentLibraryItem{ID: itemID, Name: "ubuntu", Type: "ovf"}
+	if len(items) != 1 || items[0] != expected {
+		t.Errorf("expected items %v, got %v", []ContentLibraryItem{expected}, items)
+	}
+
+	items, err = GetContentLibraryItems(ctx, dc, "", "", nil, emptyID)
+	if err != nil {
+		t.Fatalf("failed to list items of an empty content library: %v", err)
+	}
+	if len(items) != 0 {
+		t.Errorf("expected no items, got %v", items)
+	}
+}
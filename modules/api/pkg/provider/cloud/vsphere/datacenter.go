@@ -0,0 +1,158 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// DatacenterInfo represents a vsphere datacenter.
+type DatacenterInfo struct {
+	Name string
+	Path string
+}
+
+// ListDatacenters returns all datacenters of the vCenter of the datacenter from the passed cloudspec,
+// including the ones nested in folders. Their paths can be passed to WithDatacenter.
+func ListDatacenters(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]DatacenterInfo, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	datacenters, err := session.Finder.DatacenterList(ctx, "/...")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't retrieve datacenter list: %w", err)
+	}
+
+	infos := make([]DatacenterInfo, 0, len(datacenters))
+	for _, datacenter := range datacenters {
+		infos = append(infos, DatacenterInfo{
+			Name: datacenter.Name(),
+			Path: datacenter.InventoryPath,
+		})
+	}
+
+	return infos, nil
+}
+
+// ValidateAcrossDatacenters checks the credentials against each of the datacenters, e.g. while onboarding a
+// vCenter. The datacenters and the results are keyed by the name of the KKP datacenter, as datacenters of
+// different vCenters may have the same name, a nil result meaning that the credentials are valid for it.
+// Datacenters of the same vCenter share a single login, different vCenters are validated concurrently. Like
+// ValidateCredentials, it ignores the infra management users of the datacenters.
+func ValidateAcrossDatacenters(ctx context.Context, dcs map[string]*kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) map[string]error {
+	results := make(map[string]error, len(dcs))
+
+	names := make([]string, 0, len(dcs))
+	for name := range dcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var vCenters []string
+	vCenterDatacenters := map[string][]string{}
+	for _, name := range names {
+		dc := dcs[name]
+		u, err := parseEndpoint(dc.Endpoint)
+		if err != nil {
+			results[name] = err
+			continue
+		}
+
+		// Datacenters skipping the certificate verification must not share the connection of others.
+		vCenter := fmt.Sprintf("%s/%t", u, dc.AllowInsecure)
+		if _, ok := vCenterDatacenters[vCenter]; !ok {
+			vCenters = append(vCenters, vCenter)
+		}
+		vCenterDatacenters[vCenter] = append(vCenterDatacenters[vCenter], name)
+	}
+
+	var (
+		lock sync.Mutex
+		wg   sync.WaitGroup
+	)
+	for _, vCenter := range vCenters {
+		wg.Add(1)
+		go func(names []string) {
+			defer wg.Done()
+
+			vCenterResults := validateVCenterDatacenters(ctx, names, dcs, username, password, caBundle, opts)
+
+			lock.Lock()
+			defer lock.Unlock()
+			for name, err := range vCenterResults {
+				results[name] = err
+			}
+		}(vCenterDatacenters[vCenter])
+	}
+	wg.Wait()
+
+	return results
+}
+
+// validateVCenterDatacenters checks the credentials against the named datacenters of the same vCenter. The first
+// datacenter which exists is used to log in, the others are only looked up within that session.
+func validateVCenterDatacenters(ctx context.Context, names []string, dcs map[string]*kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts []SessionOption) map[string]error {
+	results := make(map[string]error, len(names))
+
+	var session *Session
+	for i, name := range names {
+		dc := dcs[name]
+		if session == nil {
+			var err error
+			session, err = loginWithCredentials(ctx, dc, username, password, caBundle, opts)
+			if err != nil {
+				// Only a missing datacenter is specific to the datacenter, other errors apply to the whole vCenter.
+				var dcErr *DatacenterNotFoundError
+				if errors.As(err, &dcErr) {
+					results[name] = err
+					continue
+				}
+				for _, name := range names[i:] {
+					results[name] = err
+				}
+				return results
+			}
+			results[name] = nil
+			continue
+		}
+
+		if _, err := session.Finder.Datacenter(ctx, dc.Datacenter); err != nil {
+			if isNotFound(err) {
+				err = &DatacenterNotFoundError{Datacenter: dc.Datacenter, Err: err}
+			}
+			results[name] = err
+			continue
+		}
+		results[name] = nil
+	}
+
+	if session != nil {
+		session.Logout(ctx)
+	}
+
+	return results
+}
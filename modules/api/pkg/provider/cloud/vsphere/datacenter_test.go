@@ -0,0 +1,173 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmware/govmomi/simulator"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestMultipleDatacenters(t *testing.T) {
+	model := simulator.VPX()
+	model.Datacenter = 2
+	model.Folder = 1
+
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	datacenters, err := ListDatacenters(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list datacenters: %v", err)
+	}
+	// The simulator places the first datacenter at the root and the others into folders.
+	expected := []DatacenterInfo{{Name: "DC0", Path: "/DC0"}, {Name: "DC1", Path: "/F0/DC1"}}
+	if len(datacenters) != len(expected) || datacenters[0] != expected[0] || datacenters[1] != expected[1] {
+		t.Fatalf("expected datacenters %v, got %v", expected, datacenters)
+	}
+
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	for _, opts := range [][]SessionOption{nil, {WithSessionProvider(pool)}} {
+		for datacenter, expectedPath := range map[string]string{"": "/DC0", "DC1": "/F0/DC1"} {
+			expectedDatacenter := datacenter
+			if expectedDatacenter == "" {
+				expectedDatacenter = dc.Datacenter
+			}
+			opts := append(opts, WithDatacenter(datacenter))
+
+			networks, err := GetNetworks(ctx, dc, "", "", nil, opts...)
+			if err != nil {
+				t.Fatalf("failed to get networks of datacenter %q: %v", expectedDatacenter, err)
+			}
+			if len(networks) == 0 {
+				t.Errorf("expected networks of datacenter %q to be listed", expectedDatacenter)
+			}
+			for _, network := range networks {
+				if !strings.HasPrefix(network.AbsolutePath, expectedPath+"/") {
+					t.Errorf("expected network %q to belong to datacenter %q", network.AbsolutePath, expectedDatacenter)
+				}
+			}
+
+			datastores, err := GetDatastoreList(ctx, dc, "", "", nil, opts...)
+			if err != nil {
+				t.Fatalf("failed to get datastores of datacenter %q: %v", expectedDatacenter, err)
+			}
+			if len(datastores) == 0 {
+				t.Errorf("expected datastores of datacenter %q to be listed", expectedDatacenter)
+			}
+			for _, datastore := range datastores {
+				if !strings.HasPrefix(datastore.InventoryPath, expectedPath+"/") {
+					t.Errorf("expected datastore %q to belong to datacenter %q", datastore.InventoryPath, expectedDatacenter)
+				}
+			}
+		}
+	}
+
+	if dc.Datacenter != "DC0" {
+		t.Errorf("expected the datacenter spec to be left untouched, got %q", dc.Datacenter)
+	}
+}
+
+func TestValidateAcrossDatacenters(t *testing.T) {
+	model := simulator.VPX()
+	model.Datacenter = 2
+	model.Folder = 1
+
+	sim := vSphereSimulator{t: t, model: model, user: url.UserPassword("user", "pass")}
+	sim.setUp()
+	defer sim.tearDown()
+
+	newDatacenter := func(endpoint, name string) *kubermaticv1.DatacenterSpecVSphere {
+		dc := &kubermaticv1.DatacenterSpecVSphere{}
+		sim.fillClientInfo(dc)
+		dc.Datacenter = name
+		if endpoint != "" {
+			dc.Endpoint = endpoint
+		}
+		return dc
+	}
+	dcs := map[string]*kubermaticv1.DatacenterSpecVSphere{
+		// The missing datacenter comes first, so the login has to fall back to the next one.
+		"a-missing": newDatacenter("", "missing"),
+		"b-dc0":     newDatacenter("", "DC0"),
+		"c-dc1":     newDatacenter("", "DC1"),
+		// Datacenters of different vCenters may have the same name.
+		"d-unreachable": newDatacenter("http://127.0.0.1:1", "DC0"),
+		"e-invalid":     newDatacenter("ftp://vcenter", "invalid"),
+	}
+
+	ctx := context.Background()
+	metrics := NewMetrics()
+	results := ValidateAcrossDatacenters(ctx, dcs, "user", "pass", nil, WithLoginAttempts(1), WithMetrics(metrics))
+	if len(results) != len(dcs) {
+		t.Fatalf("expected a result for each of the %d datacenters, got %v", len(dcs), results)
+	}
+	for _, name := range []string{"b-dc0", "c-dc1"} {
+		if err := results[name]; err != nil {
+			t.Errorf("expected the credentials to be valid for datacenter %q, got %v", name, err)
+		}
+	}
+	if err := results["a-missing"]; !errors.Is(err, ErrDatacenterNotFound) {
+		t.Errorf("expected datacenter %q not to be found, got %v", "a-missing", err)
+	}
+	if err := results["d-unreachable"]; err == nil || errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("expected a connection error for datacenter %q, got %v", "d-unreachable", err)
+	}
+	if err := results["e-invalid"]; !errors.Is(err, ErrInvalidEndpoint) {
+		t.Errorf("expected an invalid endpoint error for datacenter %q, got %v", "e-invalid", err)
+	}
+
+	// Besides the unreachable vCenter, only the attempt with the missing datacenter and the one
+	// shared by both existing datacenters log in.
+	for datacenter, expected := range map[string]float64{"missing": 1, "DC0": 1, "DC1": 0} {
+		logins := testutil.ToFloat64(metrics.Logins.WithLabelValues(datacenter, operationSOAPLogin, resultSuccess))
+		if datacenter != "DC0" {
+			logins += testutil.ToFloat64(metrics.Logins.WithLabelValues(datacenter, operationSOAPLogin, resultFailure))
+		}
+		if logins != expected {
+			t.Errorf("expected %v logins for datacenter %q, got %v", expected, datacenter, logins)
+		}
+	}
+
+	// Rejected credentials are reported for every datacenter of the vCenter.
+	sameVCenter := map[string]*kubermaticv1.DatacenterSpecVSphere{
+		"a-missing": dcs["a-missing"],
+		"b-dc0":     dcs["b-dc0"],
+		"c-dc1":     dcs["c-dc1"],
+	}
+	results = ValidateAcrossDatacenters(ctx, sameVCenter, "user", "wrong", nil)
+	for name := range sameVCenter {
+		if err := results[name]; !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("expected invalid credentials for datacenter %q, got %v", name, err)
+		}
+	}
+}
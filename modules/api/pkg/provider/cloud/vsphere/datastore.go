@@ -0,0 +1,341 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// DatastoreClusterInfo represents a vsphere datastore cluster (Storage DRS pod).
+type DatastoreClusterInfo struct {
+	Name string
+	Path string
+	// FreeSpace is the free capacity of the datastore cluster in bytes.
+	FreeSpace int64
+	// Capacity is the total capacity of the datastore cluster in bytes.
+	Capacity int64
+}
+
+// DatastoreInfo represents a vsphere datastore including its usage.
+type DatastoreInfo struct {
+	Name string
+	Path string
+	// Type is the file system type of the datastore, e.g. VMFS, NFS or vsan.
+	Type string
+	// FreeSpace is the free capacity of the datastore in bytes.
+	FreeSpace int64
+	// Capacity is the total capacity of the datastore in bytes.
+	Capacity int64
+	// Accessible is false if the datastore is currently not reachable. FreeSpace and Capacity
+	// are not reliable in that case.
+	Accessible bool
+}
+
+// GetDatastoreInfoList returns a slice of DatastoreInfo of the datacenter from the passed cloudspec.
+func GetDatastoreInfoList(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]DatastoreInfo, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return getDatastoreInfoList(ctx, session)
+}
+
+func getDatastoreInfoList(ctx context.Context, session *Session) ([]DatastoreInfo, error) {
+	datastores, err := session.Finder.DatastoreList(ctx, "*")
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve datastore list: %w", err)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(datastores))
+	paths := make(map[types.ManagedObjectReference]string, len(datastores))
+	for _, datastore := range datastores {
+		refs = append(refs, datastore.Reference())
+		paths[datastore.Reference()] = datastore.InventoryPath
+	}
+
+	var dss []mo.Datastore
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"summary"}, &dss); err != nil {
+		return nil, fmt.Errorf("failed to get datastore properties: %w", err)
+	}
+
+	infos := make([]DatastoreInfo, 0, len(dss))
+	for _, ds := range dss {
+		info := DatastoreInfo{
+			Name:       ds.Summary.Name,
+			Path:       paths[ds.Reference()],
+			Type:       ds.Summary.Type,
+			Accessible: ds.Summary.Accessible,
+		}
+		// vCenter keeps reporting the last known usage for inaccessible datastores, which is misleading.
+		if info.Accessible {
+			info.FreeSpace = ds.Summary.FreeSpace
+			info.Capacity = ds.Summary.Capacity
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// SelectDatastore returns the accessible datastore of the datacenter with the most free space, if it has
+// at least minFreeBytes free. Otherwise ErrNoSuitableDatastore is returned. It is meant to pick a datastore
+// for clusters which neither specify a datastore nor a datastore cluster.
+func SelectDatastore(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, minFreeBytes int64, opts ...SessionOption) (*object.Datastore, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	infos, err := getDatastoreInfoList(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := rankDatastores(infos, minFreeBytes)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w: none of the %d datastores has %d bytes free", ErrNoSuitableDatastore, len(infos), minFreeBytes)
+	}
+
+	datastore, err := session.Finder.Datastore(ctx, candidates[0].Path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get datastore %q: %w", candidates[0].Path, err)
+	}
+
+	return datastore, nil
+}
+
+// rankDatastores returns the accessible datastores with at least minFreeBytes free, the one with the most
+// free space first. Datastores with the same free space are ordered by name, so the result is stable.
+func rankDatastores(infos []DatastoreInfo, minFreeBytes int64) []DatastoreInfo {
+	var candidates []DatastoreInfo
+	for _, info := range infos {
+		if info.Accessible && info.FreeSpace >= minFreeBytes {
+			candidates = append(candidates, info)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].FreeSpace != candidates[j].FreeSpace {
+			return candidates[i].FreeSpace > candidates[j].FreeSpace
+		}
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	return candidates
+}
+
+// tagIDPrefix is the prefix of the IDs of tags, which tells them apart from tag names.
+const tagIDPrefix = "urn:vmomi:InventoryServiceTag:"
+
+// GetDatastoreListByTag returns the datastores of the datacenter which carry the given tag, given by its ID
+// or name. As tag names are only unique within a category, all tags with the name are considered. Without
+// a tag, all datastores are returned.
+func GetDatastoreListByTag(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, tag string, opts ...SessionOption) ([]*object.Datastore, error) {
+	if tag == "" {
+		return GetDatastoreList(ctx, dc, username, password, caBundle, opts...)
+	}
+
+	// The REST session must log in as the same user as the SOAP session.
+	dc, username, password = browseCredentials(dc, username, password, newSessionOptions(opts))
+	session, err := newSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	datastores, err := session.Finder.DatastoreList(ctx, "*")
+	if err != nil {
+		if isNotFound(err) {
+			return []*object.Datastore{}, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve datastore list: %w", err)
+	}
+
+	restSession, err := newRESTSessionFromSession(ctx, session, dc, username, password, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client session: %w", err)
+	}
+	defer restSession.Logout(ctx)
+
+	tagManager := tags.NewManager(restSession.Client)
+	tagIDs, err := findTagIDs(ctx, tagManager, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	attached, err := tagManager.ListAttachedObjectsOnTags(ctx, tagIDs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the objects tagged with %q: %w", tag, err)
+	}
+
+	return filterTaggedDatastores(datastores, attached), nil
+}
+
+// findTagIDs returns the ID of the tag if an ID is given, or the IDs of all tags with the given name.
+func findTagIDs(ctx context.Context, tagManager *tags.Manager, tag string) ([]string, error) {
+	if strings.HasPrefix(tag, tagIDPrefix) {
+		tagIDs, err := tagManager.ListTags(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list tags: %w", err)
+		}
+		for _, id := range tagIDs {
+			if id == tag {
+				return []string{id}, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: %q", ErrTagNotFound, tag)
+	}
+
+	allTags, err := tagManager.GetTags(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tags: %w", err)
+	}
+
+	var tagIDs []string
+	for _, t := range allTags {
+		if t.Name == tag {
+			tagIDs = append(tagIDs, t.ID)
+		}
+	}
+	if len(tagIDs) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrTagNotFound, tag)
+	}
+
+	return tagIDs, nil
+}
+
+// filterTaggedDatastores returns the datastores which are among the tagged objects, keeping their order.
+func filterTaggedDatastores(datastores []*object.Datastore, attached []tags.AttachedObjects) []*object.Datastore {
+	tagged := map[types.ManagedObjectReference]bool{}
+	for _, objects := range attached {
+		for _, ref := range objects.ObjectIDs {
+			tagged[ref.Reference()] = true
+		}
+	}
+
+	filtered := []*object.Datastore{}
+	for _, datastore := range datastores {
+		if tagged[datastore.Reference()] {
+			filtered = append(filtered, datastore)
+		}
+	}
+
+	return filtered
+}
+
+// GetDatastoreClusters returns a slice of DatastoreClusterInfo of the datacenter from the passed cloudspec.
+func GetDatastoreClusters(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]DatastoreClusterInfo, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return getDatastoreClusters(ctx, session)
+}
+
+func getDatastoreClusters(ctx context.Context, session *Session) ([]DatastoreClusterInfo, error) {
+	storagePods, err := session.Finder.DatastoreClusterList(ctx, "*")
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve datastore cluster list: %w", err)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(storagePods))
+	paths := make(map[types.ManagedObjectReference]string, len(storagePods))
+	for _, storagePod := range storagePods {
+		refs = append(refs, storagePod.Reference())
+		paths[storagePod.Reference()] = storagePod.InventoryPath
+	}
+
+	var pods []mo.StoragePod
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "summary"}, &pods); err != nil {
+		return nil, fmt.Errorf("failed to get datastore cluster properties: %w", err)
+	}
+
+	infos := make([]DatastoreClusterInfo, 0, len(pods))
+	for _, pod := range pods {
+		info := DatastoreClusterInfo{
+			Name: pod.Name,
+			Path: paths[pod.Reference()],
+		}
+		if pod.Summary != nil {
+			info.FreeSpace = pod.Summary.FreeSpace
+			info.Capacity = pod.Summary.Capacity
+		}
+		infos = append(infos, info)
+	}
+
+	return infos, nil
+}
+
+// validateDatastore checks that the datastore exists and is accessible. Datastores become inaccessible,
+// e.g. while their hosts are in maintenance, which is worth telling apart from a misconfiguration.
+// The summary of the datastore is returned, so callers can check its free space, along with its inventory path.
+func validateDatastore(ctx context.Context, session *Session, name string) (types.DatastoreSummary, string, error) {
+	datastore, err := session.Finder.Datastore(ctx, name)
+	if err != nil {
+		if isNotFound(err) {
+			return types.DatastoreSummary{}, "", fmt.Errorf("%w: %s", ErrDatastoreNotFound, err.Error())
+		}
+		return types.DatastoreSummary{}, "", err
+	}
+
+	var ds mo.Datastore
+	if err := datastore.Properties(ctx, datastore.Reference(), []string{"summary"}, &ds); err != nil {
+		return types.DatastoreSummary{}, "", fmt.Errorf("failed to get datastore properties: %w", err)
+	}
+	if !ds.Summary.Accessible {
+		return types.DatastoreSummary{}, "", fmt.Errorf("%w: %q", ErrDatastoreInaccessible, name)
+	}
+
+	return ds.Summary, datastore.InventoryPath, nil
+}
+
+// nearlyFullDatastorePercent is the share of free space in percent below which a datastore is considered nearly full.
+const nearlyFullDatastorePercent = 10
+
+// isDatastoreNearlyFull returns true if less than nearlyFullDatastorePercent of the datastore capacity is free.
+func isDatastoreNearlyFull(summary types.DatastoreSummary) bool {
+	return summary.Capacity > 0 && summary.FreeSpace*100 < summary.Capacity*nearlyFullDatastorePercent
+}
+
+func datastoreNearlyFullWarning(name string, summary types.DatastoreSummary) string {
+	return fmt.Sprintf("datastore %q is nearly full, only %.1f%% of its capacity is free", name, float64(summary.FreeSpace)*100/float64(summary.Capacity))
+}
@@ -0,0 +1,499 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+)
+
+func TestGetDatastoreClusters(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	clusters, err := GetDatastoreClusters(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list datastore clusters: %v", err)
+	}
+
+	if len(clusters) != 1 {
+		t.Fatalf("expected exactly one datastore cluster, got %v", clusters)
+	}
+	if clusters[0].Name != "DC0_POD0" {
+		t.Errorf("expected datastore cluster %q, got %q", "DC0_POD0", clusters[0].Name)
+	}
+	if clusters[0].Path != "/DC0/datastore/DC0_POD0" {
+		t.Errorf("expected datastore cluster path %q, got %q", "/DC0/datastore/DC0_POD0", clusters[0].Path)
+	}
+	if clusters[0].FreeSpace > clusters[0].Capacity {
+		t.Errorf("expected free space %d to not exceed capacity %d", clusters[0].FreeSpace, clusters[0].Capacity)
+	}
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = getDatastoreClusters(cancelledCtx, session)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the finder error to be wrapped, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "couldn't retrieve datastore cluster list") {
+		t.Errorf("expected a descriptive error message, got %q", err.Error())
+	}
+}
+
+func TestGetDatastoreInfoList(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	datastore, err := session.Finder.Datastore(ctx, "LocalDS_0")
+	if err != nil {
+		t.Fatalf("failed to get datastore: %v", err)
+	}
+
+	info := getDatastoreInfo(ctx, t, dc, "LocalDS_0")
+	if info.Path != datastore.InventoryPath {
+		t.Errorf("expected datastore path %q, got %q", datastore.InventoryPath, info.Path)
+	}
+	if info.Type == "" {
+		t.Error("expected the datastore type to be set")
+	}
+	if !info.Accessible {
+		t.Error("expected the datastore to be accessible")
+	}
+	if info.Capacity == 0 || info.FreeSpace > info.Capacity {
+		t.Errorf("expected a sane usage, got free space %d and capacity %d", info.FreeSpace, info.Capacity)
+	}
+
+	// An inaccessible datastore must still be listed, just without usage.
+	simulator.Map.Get(datastore.Reference()).(*simulator.Datastore).Summary.Accessible = false
+
+	info = getDatastoreInfo(ctx, t, dc, "LocalDS_0")
+	if info.Accessible {
+		t.Error("expected the datastore to be inaccessible")
+	}
+	if info.FreeSpace != 0 || info.Capacity != 0 {
+		t.Errorf("expected no usage for an inaccessible datastore, got free space %d and capacity %d", info.FreeSpace, info.Capacity)
+	}
+}
+
+func getDatastoreInfo(ctx context.Context, t *testing.T, dc *kubermaticv1.DatacenterSpecVSphere, name string) DatastoreInfo {
+	infos, err := GetDatastoreInfoList(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list datastores: %v", err)
+	}
+
+	for _, info := range infos {
+		if info.Name == name {
+			return info
+		}
+	}
+
+	t.Fatalf("datastore %q is missing in %v", name, infos)
+	return DatastoreInfo{}
+}
+
+func TestProviderValidateCloudSpecDatastoreAccessibility(t *testing.T) {
+	// A second datastore is made inaccessible.
+	model := simulator.VPX()
+	model.Datastore = 2
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	ctx := context.Background()
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	datastore, err := session.Finder.Datastore(ctx, "LocalDS_1")
+	if err != nil {
+		t.Fatalf("failed to get datastore: %v", err)
+	}
+	simulator.Map.Get(datastore.Reference()).(*simulator.Datastore).Summary.Accessible = false
+
+	tests := []struct {
+		name             string
+		defaultDatastore string
+		datastore        string
+		expectedErr      error
+	}{
+		{
+			name:             "Accessible default datastore",
+			defaultDatastore: "LocalDS_0",
+		},
+		{
+			name:             "Missing default datastore",
+			defaultDatastore: "missing",
+			expectedErr:      ErrDatastoreNotFound,
+		},
+		{
+			name:             "Inaccessible default datastore",
+			defaultDatastore: "LocalDS_1",
+			expectedErr:      ErrDatastoreInaccessible,
+		},
+		{
+			name:        "Missing datastore",
+			datastore:   "missing",
+			expectedErr: ErrDatastoreNotFound,
+		},
+		{
+			name:        "Inaccessible datastore",
+			datastore:   "LocalDS_1",
+			expectedErr: ErrDatastoreInaccessible,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := dc.DeepCopy()
+			dc.DefaultDatastore = tt.defaultDatastore
+			v := &Provider{dc: dc}
+
+			err := v.ValidateCloudSpec(ctx, kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{Datastore: tt.datastore},
+			})
+			if tt.expectedErr == nil && err != nil {
+				t.Fatalf("expected the datastore to be valid, got %v", err)
+			}
+			if tt.expectedErr != nil && !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestProviderValidateCloudSpecWithWarnings(t *testing.T) {
+	// A second datastore is nearly full.
+	model := simulator.VPX()
+	model.Datastore = 2
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	ctx := context.Background()
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	datastore, err := session.Finder.Datastore(ctx, "LocalDS_1")
+	if err != nil {
+		t.Fatalf("failed to get datastore: %v", err)
+	}
+	summary := &simulator.Map.Get(datastore.Reference()).(*simulator.Datastore).Summary
+	summary.Capacity = 100 * 1024 * 1024 * 1024
+	summary.FreeSpace = 5 * 1024 * 1024 * 1024
+
+	tests := []struct {
+		name             string
+		defaultDatastore string
+		datastore        string
+		allowInsecure    bool
+		expectedWarnings []string
+	}{
+		{
+			name:      "Datastore with enough space",
+			datastore: "LocalDS_0",
+		},
+		{
+			name:             "Nearly full datastore",
+			datastore:        "LocalDS_1",
+			expectedWarnings: []string{`datastore "LocalDS_1" is nearly full, only 5.0% of its capacity is free`},
+		},
+		{
+			name:             "Nearly full default datastore",
+			defaultDatastore: "LocalDS_1",
+			expectedWarnings: []string{`datastore "LocalDS_1" is nearly full, only 5.0% of its capacity is free`},
+		},
+		{
+			name:             "Nearly full default datastore not used by the cluster",
+			defaultDatastore: "LocalDS_1",
+			datastore:        "LocalDS_0",
+		},
+		{
+			name:             "Insecure datacenter",
+			datastore:        "LocalDS_0",
+			allowInsecure:    true,
+			expectedWarnings: []string{fmt.Sprintf("the certificate of vCenter %q is not verified", redactEndpoint(dc.Endpoint))},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := dc.DeepCopy()
+			dc.DefaultDatastore = tt.defaultDatastore
+			dc.AllowInsecure = tt.allowInsecure
+			v := &Provider{dc: dc}
+			spec := kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{Datastore: tt.datastore},
+			}
+
+			result := v.ValidateCloudSpecWithWarnings(ctx, spec)
+			if len(result.Errors) > 0 {
+				t.Fatalf("expected the cloud spec to be valid, got %v", result.Err())
+			}
+			if changes := diff.ObjectDiff(tt.expectedWarnings, result.Warnings); changes != "" {
+				t.Errorf("Got warnings differ from expected ones. Diff: %v", changes)
+			}
+
+			// Warnings don't make the cloud spec invalid.
+			if err := v.ValidateCloudSpec(ctx, spec); err != nil {
+				t.Errorf("expected the cloud spec to be valid, got %v", err)
+			}
+		})
+	}
+}
+
+func TestGetDatastoreListByTag(t *testing.T) {
+	model := simulator.VPX()
+	model.Datastore = 2
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	ctx := context.Background()
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	restSession, err := newRESTSessionFromSession(ctx, session, dc, "", "")
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+	tagManager := tags.NewManager(restSession.Client)
+
+	datastores := map[string]mo.Reference{}
+	for _, name := range []string{"LocalDS_0", "LocalDS_1"} {
+		datastore, err := session.Finder.Datastore(ctx, name)
+		if err != nil {
+			t.Fatalf("failed to get datastore: %v", err)
+		}
+		datastores[name] = datastore
+	}
+
+	// Both categories have an "approved" tag, the one of the storage category is attached to the
+	// datacenter as well, which must not show up as datastore.
+	tagIDs := map[string]string{}
+	for category, attachTo := range map[string][]mo.Reference{
+		"storage": {datastores["LocalDS_0"], session.Datacenter},
+		"team":    {datastores["LocalDS_1"]},
+	} {
+		categoryID, err := tagManager.CreateCategory(ctx, &tags.Category{Name: category, Cardinality: "MULTIPLE"})
+		if err != nil {
+			t.Fatalf("failed to create tag category: %v", err)
+		}
+		tagID, err := tagManager.CreateTag(ctx, &tags.Tag{Name: "approved", CategoryID: categoryID})
+		if err != nil {
+			t.Fatalf("failed to create tag: %v", err)
+		}
+		for _, ref := range attachTo {
+			if err := tagManager.AttachTag(ctx, tagID, ref); err != nil {
+				t.Fatalf("failed to attach tag: %v", err)
+			}
+		}
+		tagIDs[category] = tagID
+
+		if category == "storage" {
+			if _, err := tagManager.CreateTag(ctx, &tags.Tag{Name: "unused", CategoryID: categoryID}); err != nil {
+				t.Fatalf("failed to create tag: %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name               string
+		tag                string
+		expectedDatastores []string
+		wantErrIs          error
+	}{
+		{
+			name:               "No tag",
+			expectedDatastores: []string{"LocalDS_0", "LocalDS_1"},
+		},
+		{
+			name:               "Tag name used in several categories",
+			tag:                "approved",
+			expectedDatastores: []string{"LocalDS_0", "LocalDS_1"},
+		},
+		{
+			name:               "Tag ID",
+			tag:                tagIDs["team"],
+			expectedDatastores: []string{"LocalDS_1"},
+		},
+		{
+			name:               "Tag without datastores",
+			tag:                "unused",
+			expectedDatastores: []string{},
+		},
+		{
+			name:      "Unknown tag",
+			tag:       "missing",
+			wantErrIs: ErrTagNotFound,
+		},
+		{
+			name:      "Unknown tag ID",
+			tag:       tagIDPrefix + "missing",
+			wantErrIs: ErrTagNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list, err := GetDatastoreListByTag(ctx, dc, "", "", nil, tt.tag)
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("expected error %v, got %v", tt.wantErrIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to list datastores: %v", err)
+			}
+
+			names := []string{}
+			for _, datastore := range list {
+				names = append(names, datastore.Name())
+			}
+			if strings.Join(names, ",") != strings.Join(tt.expectedDatastores, ",") {
+				t.Errorf("expected datastores %v, got %v", tt.expectedDatastores, names)
+			}
+		})
+	}
+}
+
+func TestSelectDatastore(t *testing.T) {
+	model := simulator.VPX()
+	model.Datastore = 3
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	ctx := context.Background()
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// The datastore with the most free space is inaccessible, so it must never be selected.
+	for name, freeSpace := range map[string]int64{"LocalDS_0": 100, "LocalDS_1": 300, "LocalDS_2": 200} {
+		datastore, err := session.Finder.Datastore(ctx, name)
+		if err != nil {
+			t.Fatalf("failed to get datastore: %v", err)
+		}
+		summary := &simulator.Map.Get(datastore.Reference()).(*simulator.Datastore).Summary
+		summary.FreeSpace = freeSpace
+		summary.Accessible = name != "LocalDS_1"
+	}
+
+	tests := []struct {
+		name              string
+		minFreeBytes      int64
+		expectedDatastore string
+	}{
+		{
+			name:              "Most free space",
+			expectedDatastore: "LocalDS_2",
+		},
+		{
+			name:              "Threshold met by one datastore",
+			minFreeBytes:      150,
+			expectedDatastore: "LocalDS_2",
+		},
+		{
+			name:         "Threshold only met by an inaccessible datastore",
+			minFreeBytes: 250,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			datastore, err := SelectDatastore(ctx, dc, "", "", nil, tt.minFreeBytes)
+			if tt.expectedDatastore == "" {
+				if !errors.Is(err, ErrNoSuitableDatastore) {
+					t.Fatalf("expected error %v, got %v", ErrNoSuitableDatastore, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to select datastore: %v", err)
+			}
+			if datastore.Name() != tt.expectedDatastore {
+				t.Errorf("expected datastore %q, got %q", tt.expectedDatastore, datastore.Name())
+			}
+		})
+	}
+
+	// Datastores with the same free space are ranked by name.
+	ranked := rankDatastores([]DatastoreInfo{
+		{Name: "b", FreeSpace: 10, Accessible: true},
+		{Name: "c", FreeSpace: 20, Accessible: true},
+		{Name: "a", FreeSpace: 10, Accessible: true},
+	}, 0)
+	var names []string
+	for _, info := range ranked {
+		names = append(names, info.Name)
+	}
+	if strings.Join(names, ",") != "c,a,b" {
+		t.Errorf("expected datastores to be ranked c,a,b, got %v", names)
+	}
+}
@@ -17,12 +17,437 @@ limitations under the License.
 package vsphere
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+
+	"k8c.io/dashboard/v2/pkg/provider"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+var (
+	// ErrNoCredentials is returned if no vSphere credentials could be found for a cluster.
+	ErrNoCredentials = errors.New("missing vSphere credentials")
+	// ErrMissingDatastore is returned if neither the datacenter nor the cluster specify where to store VMs.
+	ErrMissingDatastore = errors.New("no default datastore provided at datacenter nor datastore/datastore cluster at cluster level")
+	// ErrDatastoreConflict is returned if a cluster specifies both a datastore and a datastore cluster.
+	ErrDatastoreConflict = errors.New("either datastore or datastore cluster can be selected")
+	// ErrDatastoreNotFound is returned if a datastore does not exist in vCenter.
+	ErrDatastoreNotFound = errors.New("datastore not found")
+	// ErrDatastoreInaccessible is returned if a datastore exists, but is currently not accessible, e.g. because
+	// its hosts are in maintenance.
+	ErrDatastoreInaccessible = errors.New("datastore is not accessible")
+	// ErrAmbiguousResourcePool is returned if a resource pool name matches pools in several clusters or hosts.
+	ErrAmbiguousResourcePool = errors.New("resource pool name is ambiguous")
+	// ErrNoSuitableDatastore is returned if no accessible datastore has the requested free space.
+	ErrNoSuitableDatastore = errors.New("no datastore with enough free space")
+	// ErrStoragePolicyNotFound is returned if the storage policy of a cluster does not exist in vCenter.
+	ErrStoragePolicyNotFound = errors.New("storage policy not found")
+	// ErrInvalidRootPath is returned if the root path configured for the datacenter is malformed.
+	ErrInvalidRootPath = errors.New("invalid vSphere root path")
+	// ErrInvalidEndpoint is returned if the vCenter endpoint of a datacenter is malformed.
+	ErrInvalidEndpoint = errors.New("invalid vCenter endpoint")
+	// ErrInvalidCredentials is returned if vCenter rejected the credentials.
+	ErrInvalidCredentials = errors.New("invalid vSphere credentials")
+	// ErrInvalidInfraManagementCredentials is returned if vCenter rejected the credentials of the infra management user.
+	ErrInvalidInfraManagementCredentials = errors.New("invalid vSphere infra management user credentials")
+	// ErrSessionInvalid is returned if a vCenter session is no longer authenticated.
+	ErrSessionInvalid = errors.New("vCenter session is no longer valid")
+	// ErrDatacenterNotFound is returned as DatacenterNotFoundError if the datacenter of a datacenter spec does
+	// not exist in vCenter.
+	ErrDatacenterNotFound = errors.New("vSphere datacenter not found")
+	// ErrInvalidSessionToken is returned if a session token passed via WithSessionToken doesn't belong to an
+	// active vCenter session.
+	ErrInvalidSessionToken = errors.New("vCenter session token is not valid")
+	// ErrInvalidThumbprint is returned if a configured certificate thumbprint is malformed.
+	ErrInvalidThumbprint = errors.New("invalid certificate thumbprint")
+	// ErrInvalidTLSVersion is returned if the configured minimum TLS version is not supported.
+	ErrInvalidTLSVersion = errors.New("invalid minimum TLS version")
+	// ErrInvalidAPIVersion is returned if the configured vim25 API version is malformed.
+	ErrInvalidAPIVersion = errors.New("invalid vSphere API version")
+	// ErrThumbprintMismatch is returned if the vCenter certificate does not match the pinned thumbprint.
+	ErrThumbprintMismatch = errors.New("vCenter certificate does not match the thumbprint")
+	// ErrInvalidProxy is returned if the configured proxy URL is malformed.
+	ErrInvalidProxy = errors.New("invalid proxy URL")
+	// ErrTemplateFolderNotFound is returned if a template folder does not exist in vCenter.
+	ErrTemplateFolderNotFound = errors.New("template folder not found")
+	// ErrFolderAlreadyExists is returned if a folder cannot be moved or renamed, because its new path is taken.
+	ErrFolderAlreadyExists = errors.New("folder already exists")
+	// ErrInvalidFolderPath is returned if the folder of a cluster is not an absolute path below the root path.
+	ErrInvalidFolderPath = errors.New("invalid vSphere folder path")
+	// ErrInvalidFolderNameTemplate is returned if the template for the names of cluster folders is malformed.
+	ErrInvalidFolderNameTemplate = errors.New("invalid folder name template")
+	// ErrInvalidNetworkPattern is returned if a pattern of a network filter is malformed.
+	ErrInvalidNetworkPattern = errors.New("invalid network pattern")
+	// ErrInvalidTagCategoryID is returned if a tag category ID is not a vCenter category ID.
+	ErrInvalidTagCategoryID = errors.New("invalid tag category ID")
+	// ErrTagCategoryNotFound is returned if the tag category of a cluster does not exist in vCenter.
+	ErrTagCategoryNotFound = errors.New("tag category not found")
+	// ErrTagNotFound is returned if a tag, given by its ID or name, does not exist in vCenter.
+	ErrTagNotFound = errors.New("tag not found")
+	// ErrMissingPrivilege is returned if the vCenter user lacks a privilege needed to manage the cluster resources.
+	ErrMissingPrivilege = errors.New("missing vSphere privilege")
+	// ErrAccountLocked is returned as AccountError if vCenter refused the login, because the account is locked,
+	// e.g. after too many failed logins.
+	ErrAccountLocked = errors.New("vSphere account is locked")
+	// ErrPasswordExpired is returned as AccountError if vCenter refused the login, because the password of the
+	// account expired and must be changed.
+	ErrPasswordExpired = errors.New("vSphere account password expired")
+	// ErrInsecureConnection is returned if the certificate of vCenter would not be verified, although the
+	// provider was created with WithEnforceTLS.
+	ErrInsecureConnection = errors.New("insecure vCenter connections are forbidden by the datacenter")
 )
 
+// TimeoutError is returned if no vCenter session could be established within
+// the login timeout. It allows callers to tell connectivity problems apart
+// from authentication failures.
+type TimeoutError struct {
+	Endpoint string
+	Timeout  time.Duration
+	Err      error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %v connecting to vCenter %q: %v", e.Timeout, e.Endpoint, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// EndpointDNSError is returned by ProbeEndpoint if the host of the vCenter endpoint cannot be resolved.
+type EndpointDNSError struct {
+	Host string
+	Err  error
+}
+
+func (e *EndpointDNSError) Error() string {
+	return fmt.Sprintf("failed to resolve vCenter host %q: %v", e.Host, e.Err)
+}
+
+func (e *EndpointDNSError) Unwrap() error {
+	return e.Err
+}
+
+// EndpointTLSError is returned by ProbeEndpoint if the TLS handshake with vCenter failed, e.g. because
+// its certificate is neither signed by the CA bundle nor matches the pinned thumbprint.
+type EndpointTLSError struct {
+	Endpoint string
+	Err      error
+}
+
+func (e *EndpointTLSError) Error() string {
+	return fmt.Sprintf("TLS handshake with vCenter %q failed: %v", e.Endpoint, e.Err)
+}
+
+func (e *EndpointTLSError) Unwrap() error {
+	return e.Err
+}
+
+// EndpointHTTPError is returned by ProbeEndpoint if the endpoint answered with an HTTP error instead of
+// the service content, e.g. because it is not a vCenter SDK endpoint.
+type EndpointHTTPError struct {
+	Endpoint   string
+	StatusCode int
+	Err        error
+}
+
+func (e *EndpointHTTPError) Error() string {
+	return fmt.Sprintf("vCenter %q answered with HTTP status %d: %v", e.Endpoint, e.StatusCode, e.Err)
+}
+
+func (e *EndpointHTTPError) Unwrap() error {
+	return e.Err
+}
+
+// DatacenterNotFoundError is returned if the datacenter of a datacenter spec does not exist in vCenter,
+// which usually means that the datacenter spec is misconfigured. It matches ErrDatacenterNotFound.
+type DatacenterNotFoundError struct {
+	Datacenter string
+	Err        error
+}
+
+func (e *DatacenterNotFoundError) Error() string {
+	return fmt.Sprintf("%v %q: %v", ErrDatacenterNotFound, e.Datacenter, e.Err)
+}
+
+func (e *DatacenterNotFoundError) Unwrap() error {
+	return e.Err
+}
+
+func (e *DatacenterNotFoundError) Is(target error) bool {
+	return target == ErrDatacenterNotFound
+}
+
+// AccountError is returned if vCenter refused the login, because the account can't be used in its current state.
+// Unlike rejected credentials, this has to be fixed by an admin in vCenter. It matches its Reason, which is either
+// ErrAccountLocked or ErrPasswordExpired.
+type AccountError struct {
+	Username string
+	Reason   error
+	Err      error
+}
+
+func (e *AccountError) Error() string {
+	return fmt.Sprintf("%v for user %q: %v", e.Reason, e.Username, e.Err)
+}
+
+func (e *AccountError) Unwrap() error {
+	return e.Err
+}
+
+func (e *AccountError) Is(target error) bool {
+	return target == e.Reason
+}
+
+// FolderCollisionError is returned if the folder to be created for a cluster already exists, but belongs to
+// something else, e.g. another cluster with the same name in a different installation. It matches
+// ErrFolderAlreadyExists.
+type FolderCollisionError struct {
+	Folder  string
+	Cluster string
+}
+
+func (e *FolderCollisionError) Error() string {
+	return fmt.Sprintf("folder %q already exists and is not owned by cluster %q", e.Folder, e.Cluster)
+}
+
+func (e *FolderCollisionError) Is(target error) bool {
+	return target == ErrFolderAlreadyExists
+}
+
+// PartialResultError is returned along with the results which could be read, if reading others failed,
+// e.g. the children of some folders. Callers which can make do with incomplete results may ignore it.
+type PartialResultError struct {
+	Err error
+}
+
+func (e *PartialResultError) Error() string {
+	return fmt.Sprintf("results are incomplete: %v", e.Err)
+}
+
+func (e *PartialResultError) Unwrap() error {
+	return e.Err
+}
+
+// CleanupError is returned by CleanUpCloudProvider if some of the cleanup steps failed, e.g. because the context
+// was cancelled. The finalizers of the completed steps are removed already, so a retry resumes with the pending
+// steps. Steps are named like the operations of the metrics, e.g. "delete_folder".
+type CleanupError struct {
+	Completed []string
+	Pending   []string
+	Err       error
+}
+
+func (e *CleanupError) Error() string {
+	return fmt.Sprintf("cleanup is incomplete, pending steps %v: %v", e.Pending, e.Err)
+}
+
+func (e *CleanupError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError is returned by ValidateCloudSpec if fields of the cloud spec are invalid.
+// Its message is the one of the wrapped error, the fields allow callers to report the error
+// at the offending fields.
+type ValidationError struct {
+	// Fields are the paths of the offending fields relative to the cloud spec, e.g. "vsphere.datastore".
+	Fields []string
+	Err    error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+var _ provider.CloudSpecFieldError = &ValidationError{}
+
+// FieldErrors returns an error for every offending field below the given cloud spec path.
+func (e *ValidationError) FieldErrors(cloudPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for _, f := range e.Fields {
+		names := strings.Split(f, ".")
+		errs = append(errs, field.Invalid(cloudPath.Child(names[0], names[1:]...), field.OmitValueType{}, e.Error()))
+	}
+	return errs
+}
+
+// IsTimeout returns true if err is caused by a vCenter session timing out.
+func IsTimeout(err error) bool {
+	var e *TimeoutError
+	return errors.As(err, &e)
+}
+
+// asTimeoutError wraps err into a TimeoutError if ctx ran into its deadline.
+func asTimeoutError(ctx context.Context, endpoint string, timeout time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Endpoint: endpoint, Timeout: timeout, Err: err}
+	}
+	return err
+}
+
 func isNotFound(err error) bool {
 	var e *find.NotFoundError
 	return errors.As(err, &e)
 }
+
+// isRESTNotFound returns true if the vCenter REST API reported that the object does not exist (anymore).
+func isRESTNotFound(err error) bool {
+	// govmomi doesn't export the HTTP status of REST errors, their message ends with the status line.
+	return err != nil && strings.HasSuffix(err.Error(), ": 404 Not Found")
+}
+
+// isManagedObjectNotFound returns true if vCenter reported that the object a
+// call or task operated on does not exist (anymore).
+func isManagedObjectNotFound(err error) bool {
+	switch vimFault(err).(type) {
+	case types.ManagedObjectNotFound, *types.ManagedObjectNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// isDuplicateName returns true if vCenter refused to create an object, because an object
+// with the same name already exists.
+func isDuplicateName(err error) bool {
+	switch vimFault(err).(type) {
+	case types.DuplicateName, *types.DuplicateName:
+		return true
+	default:
+		return false
+	}
+}
+
+// isInvalidLogin returns true if vCenter rejected the credentials, including the logins
+// of accounts with an expired password.
+func isInvalidLogin(err error) bool {
+	switch vimFault(err).(type) {
+	case types.InvalidLogin, *types.InvalidLogin, types.PasswordExpired, *types.PasswordExpired:
+		return true
+	default:
+		return false
+	}
+}
+
+// isNotAuthenticated returns true if vCenter refused a call, because the session is no longer authenticated,
+// e.g. because it expired while idling.
+func isNotAuthenticated(err error) bool {
+	switch vimFault(err).(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	default:
+		return false
+	}
+}
+
+// accountError returns an AccountError if vCenter refused the login of username, because the account is locked
+// or its password expired. Other errors are returned unchanged.
+func accountError(username string, err error) error {
+	switch vimFault(err).(type) {
+	case types.PasswordExpired, *types.PasswordExpired:
+		return &AccountError{Username: username, Reason: ErrPasswordExpired, Err: err}
+	case types.InvalidLogin, *types.InvalidLogin:
+		// vCenter has no dedicated fault for locked accounts, only the message tells them apart. It is
+		// reliable, as sessions are always created with the same locale.
+		if strings.Contains(strings.ToLower(faultMessage(err)), "locked") {
+			return &AccountError{Username: username, Reason: ErrAccountLocked, Err: err}
+		}
+	}
+
+	return err
+}
+
+// isTransientError returns true if err indicates that vCenter was temporarily
+// unreachable or overloaded, so that the call is worth retrying. Rejected
+// credentials and cancelled contexts are never transient.
+func isTransientError(err error) bool {
+	if err == nil || isInvalidLogin(err) || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		if urlErr.Timeout() {
+			return true
+		}
+		switch code, _ := httpStatusCode(err); code {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		default:
+			return false
+		}
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// httpStatusCode returns the HTTP status code vCenter answered a SOAP call with, if err is such an HTTP error.
+func httpStatusCode(err error) (int, bool) {
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || urlErr.Err == nil {
+		return 0, false
+	}
+
+	// govmomi doesn't export the HTTP status, its error message is the status line.
+	status, _, _ := strings.Cut(urlErr.Err.Error(), " ")
+	code, err := strconv.Atoi(status)
+	if err != nil || len(status) != 3 {
+		return 0, false
+	}
+
+	return code, true
+}
+
+// faultMessage returns the message vCenter reported along with the fault of err, if any.
+func faultMessage(err error) string {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if soap.IsSoapFault(err) {
+			return soap.ToSoapFault(err).String
+		}
+	}
+
+	return ""
+}
+
+// vimFault returns the fault vCenter reported for err, if any. The soap errors
+// don't support unwrapping, so we have to walk the chain ourselves.
+func vimFault(err error) interface{} {
+	for ; err != nil; err = errors.Unwrap(err) {
+		var taskErr task.Error
+		switch {
+		case errors.As(err, &taskErr):
+			return taskErr.Fault()
+		case soap.IsSoapFault(err):
+			return soap.ToSoapFault(err).VimFault()
+		case soap.IsVimFault(err):
+			return soap.ToVimFault(err)
+		}
+	}
+
+	return nil
+}
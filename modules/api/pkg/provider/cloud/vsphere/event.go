@@ -0,0 +1,151 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/vmware/govmomi/event"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// maxClusterEvents bounds the number of events returned by GetClusterEvents.
+const maxClusterEvents = 100
+
+// Event is a vCenter event of the VM folder of a cluster or of a VM within it.
+type Event struct {
+	Time time.Time
+	// Type is the type of the event, e.g. "VmPoweredOnEvent".
+	Type string
+	// Object is the name of the object the event is about, e.g. the name of a VM. It is empty for events of
+	// the folder itself.
+	Object   string
+	UserName string
+	Message  string
+}
+
+// GetClusterEvents returns the most recent vCenter events, which happened since the given time, of the VM folder
+// of the cluster and the VMs within it, e.g. to debug failed provisionings of node VMs. The events are sorted
+// by time, starting with the most recent one, and at most maxClusterEvents events are returned. Like for
+// GetFolderTags, the folder is looked up by its reference if it still refers to a folder of the cluster.
+func (v *Provider) GetClusterEvents(ctx context.Context, cluster *kubermaticv1.Cluster, username, password string, since time.Time) ([]Event, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	folderPath := cluster.Spec.Cloud.VSphere.Folder
+	ref := folderRef(cluster)
+	if ref == nil && folderPath == "" {
+		return nil, errors.New("cluster has no vSphere folder")
+	}
+
+	session, err := v.newSession(ctx, v.logger(cluster), username, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	var restSession *RESTSession
+	defer func() {
+		if restSession != nil {
+			restSession.Logout(ctx)
+		}
+	}()
+	if ref, err = v.verifiedFolderRef(ctx, session, cluster, func() (*RESTSession, error) {
+		restSession, err = newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+		return restSession, err
+	}); err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		if folderPath == "" {
+			return nil, errors.New("folder reference of the cluster doesn't refer to a folder of the cluster")
+		}
+		folder, err := session.Finder.Folder(ctx, folderPath)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't open folder %q: %w", folderPath, err)
+		}
+		folderRef := folder.Reference()
+		ref = &folderRef
+	}
+
+	return getEvents(ctx, session, *ref, since, maxClusterEvents)
+}
+
+// getEvents returns the at most limit most recent events of the folder and the objects within it, e.g. the VMs,
+// since the given time. A zero time returns the most recent events regardless of their age.
+func getEvents(ctx context.Context, session *Session, folderRef types.ManagedObjectReference, since time.Time, limit int) ([]Event, error) {
+	filter := types.EventFilterSpec{
+		Entity: &types.EventFilterSpecByEntity{
+			Entity:    folderRef,
+			Recursion: types.EventFilterSpecRecursionOptionAll,
+		},
+		MaxCount: int32(limit),
+	}
+	if !since.IsZero() {
+		filter.Time = &types.EventFilterSpecByTime{BeginTime: &since}
+	}
+
+	vcenterEvents, err := event.NewManager(session.Client.Client).QueryEvents(ctx, filter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query events of %s: %w", folderRef, err)
+	}
+
+	events := make([]Event, 0, len(vcenterEvents))
+	for _, vcenterEvent := range vcenterEvents {
+		e := vcenterEvent.GetEvent()
+		events = append(events, Event{
+			Time:     e.CreatedTime,
+			Type:     reflect.Indirect(reflect.ValueOf(vcenterEvent)).Type().Name(),
+			Object:   eventObject(e),
+			UserName: e.UserName,
+			Message:  e.FullFormattedMessage,
+		})
+	}
+
+	// vCenter doesn't guarantee any order.
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if len(events) > limit {
+		events = events[:limit]
+	}
+
+	return events, nil
+}
+
+// eventObject returns the name of the most specific object the event is about.
+func eventObject(e *types.Event) string {
+	switch {
+	case e.Vm != nil:
+		return e.Vm.Name
+	case e.Host != nil:
+		return e.Host.Name
+	case e.Ds != nil:
+		return e.Ds.Name
+	case e.Net != nil:
+		return e.Net.Name
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestGetClusterEvents(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	// A proxy records the event queries of the provider.
+	var lock sync.Mutex
+	var queries [][]byte
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: sim.server.URL.Scheme, Host: sim.server.URL.Host})
+	vcenter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if bytes.Contains(body, []byte("<QueryEvents ")) {
+			lock.Lock()
+			queries = append(queries, body)
+			lock.Unlock()
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer vcenter.Close()
+	providerDC := dc.DeepCopy()
+	providerDC.Endpoint = vcenter.URL
+	v := &Provider{dc: providerDC}
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	ref, err := createVMFolder(ctx, session, "/DC0/vm/test")
+	if err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Annotations: map[string]string{folderRefAnnotationKey: ref.String()},
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{Folder: "/DC0/vm/test"},
+			},
+		},
+	}
+
+	nodeVM, err := session.Finder.VirtualMachine(ctx, "DC0_H0_VM0")
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	otherVM, err := session.Finder.VirtualMachine(ctx, "DC0_H0_VM1")
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	folder := object.NewFolder(session.Client.Client, ref)
+	task, err := folder.MoveInto(ctx, []types.ManagedObjectReference{nodeVM.Reference()})
+	if err != nil {
+		t.Fatalf("failed to move VM into the cluster folder: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to move VM into the cluster folder: %v", err)
+	}
+
+	since := time.Now()
+	for _, vm := range []*object.VirtualMachine{nodeVM, otherVM} {
+		task, err := vm.PowerOff(ctx)
+		if err != nil {
+			t.Fatalf("failed to power off VM: %v", err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("failed to power off VM: %v", err)
+		}
+	}
+
+	// The simulator returns the events of all objects for the root folder, which are only the ones of the VMs
+	// until the provider logs in.
+	rootFolder := session.Client.ServiceContent.RootFolder
+	events, err := getEvents(ctx, session, rootFolder, since, maxClusterEvents)
+	if err != nil {
+		t.Fatalf("failed to get events: %v", err)
+	}
+	objects := sets.NewString()
+	for _, event := range events {
+		if event.Time.Before(since) || event.Message == "" {
+			t.Errorf("expected a timestamped event since %v with message, got %+v", since, event)
+		}
+		objects.Insert(event.Object)
+	}
+	if changes := diff.ObjectDiff([]string{"DC0_H0_VM0", "DC0_H0_VM1"}, objects.List()); changes != "" {
+		t.Errorf("objects of the events differ from the expected ones:\n%v", changes)
+	}
+
+	// The number of events is bounded, the most recent event comes first.
+	events, err = getEvents(ctx, session, rootFolder, since, 1)
+	if err != nil {
+		t.Fatalf("failed to get events: %v", err)
+	}
+	if len(events) != 1 || events[0].Type != "VmPoweredOffEvent" || events[0].Object != "DC0_H0_VM1" {
+		t.Errorf("expected only the most recent event, got %+v", events)
+	}
+
+	// The events of the folder and everything within it are queried at once. The simulator only returns the
+	// events of the entity itself, so the events of the VMs are not returned.
+	if _, err := v.GetClusterEvents(ctx, cluster, "", "", since); err != nil {
+		t.Fatalf("failed to get cluster events: %v", err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(queries) != 1 {
+		t.Fatalf("expected a single event query, got %d", len(queries))
+	}
+	for _, expected := range []string{ref.Value, "<recursion>all</recursion>", "<maxCount>100</maxCount>"} {
+		if !bytes.Contains(queries[0], []byte(expected)) {
+			t.Errorf("expected the event query to contain %q, got %s", expected, queries[0])
+		}
+	}
+}
@@ -18,49 +18,485 @@ package vsphere
 
 import (
 	"context"
+	"crypto/x509"
 	"fmt"
 	"path"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	kruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// folderCreatePrivilege is the privilege needed to create a folder below another one.
+	folderCreatePrivilege = "Folder.Create"
+	// defaultTemplateFolder is the folder of the VM directory, which holds VM templates by convention.
+	defaultTemplateFolder = "Templates"
 )
 
-// createVMFolder creates the specified vm folder if it does not exist yet.
-func createVMFolder(ctx context.Context, session *Session, fullPath string) error {
+// systemFolderNames are the names of folders which vCenter, its services or common conventions
+// reserve for VMs not managed by users. They are created directly in the VM folder of the datacenter,
+// only there they, and all folders below them, are never offered as cluster folder.
+var systemFolderNames = sets.NewString(
+	// Agent VMs of the vSphere Cluster Services.
+	"vCLS",
+	// VMs found on hosts which are not part of the inventory.
+	"Discovered virtual machine",
+	// Supervisor namespaces of vSphere with Tanzu.
+	"Namespaces",
+	// The conventional container for VM templates, see GetTemplateFolders.
+	defaultTemplateFolder,
+)
+
+// isExcludedFolder returns true if the folder at p, or any of its parents below rootPath, is hidden,
+// or if it is located in a system folder of vmRoot, the VM folder of the datacenter. Folders whose name
+// starts with a dot are considered hidden. A root path within a system folder is honoured.
+func isExcludedFolder(p, rootPath, vmRoot string) bool {
+	relPath := strings.TrimPrefix(path.Clean(p), strings.TrimSuffix(path.Clean(rootPath), "/"))
+	for _, name := range strings.Split(relPath, "/") {
+		if strings.HasPrefix(name, ".") {
+			return true
+		}
+	}
+	for _, name := range systemFolderNames.List() {
+		systemFolder := path.Join(vmRoot, name)
+		if isSubPath(p, systemFolder) && !isSubPath(rootPath, systemFolder) {
+			return true
+		}
+	}
+	return false
+}
+
+// vmRootFolder returns the inventory path of the VM folder of the datacenter of the session.
+func vmRootFolder(session *Session) string {
+	return path.Join(session.Datacenter.InventoryPath, "vm")
+}
+
+// ExcludeClusterFolders removes the folders, which already belong to one of the given clusters,
+// and all folders below them from the list.
+func ExcludeClusterFolders(folders []Folder, clusters []kubermaticv1.Cluster) []Folder {
+	var clusterFolders []string
+	for _, cluster := range clusters {
+		if cluster.Spec.Cloud.VSphere != nil && cluster.Spec.Cloud.VSphere.Folder != "" {
+			clusterFolders = append(clusterFolders, cluster.Spec.Cloud.VSphere.Folder)
+		}
+	}
+
+	var filtered []Folder
+	for _, folder := range folders {
+		owned := false
+		for _, clusterFolder := range clusterFolders {
+			if isSubPath(folder.Path, clusterFolder) {
+				owned = true
+				break
+			}
+		}
+		if !owned {
+			filtered = append(filtered, folder)
+		}
+	}
+
+	return filtered
+}
+
+// isSubPath returns true if the inventory path p equals root or is located below it.
+func isSubPath(p, root string) bool {
+	p, root = path.Clean(p), path.Clean(root)
+	return p == root || strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/")
+}
+
+// getVMFoldersWithDepth lists the folders level by level, starting at the root path, and stops after
+// maxDepth levels. As vCenter only lists the first level when giving a path, this needs one call per
+// folder, but never touches the parts of the tree below maxDepth. Folders whose children cannot be
+// listed are skipped and reported as PartialResultError along with all other folders.
+func getVMFoldersWithDepth(ctx context.Context, session *Session, rootPath string, maxDepth int) ([]Folder, error) {
+	rootFolder, err := session.Finder.Folder(ctx, rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't find rootpath %q: %w", rootPath, err)
+	}
+
+	vmRoot := vmRootFolder(session)
+	var errs []error
+	folders := []Folder{{Path: rootPath}}
+	refs := []types.ManagedObjectReference{rootFolder.Reference()}
+	level := []string{rootPath}
+	for depth := 0; depth < maxDepth && len(level) > 0; depth++ {
+		var nextLevel []string
+		for _, parent := range level {
+			folderRefs, err := session.Finder.FolderList(ctx, path.Join(parent, "*"))
+			if err != nil {
+				// Folders without any child folders are reported as not found.
+				if isNotFound(err) {
+					continue
+				}
+				errs = append(errs, fmt.Errorf("couldn't retrieve folders below %q: %w", parent, err))
+				continue
+			}
+
+			for _, folderRef := range folderRefs {
+				// Skipping excluded folders right away saves listing their children.
+				if isExcludedFolder(folderRef.InventoryPath, rootPath, vmRoot) {
+					continue
+				}
+				folders = append(folders, Folder{Path: folderRef.InventoryPath})
+				refs = append(refs, folderRef.Reference())
+				nextLevel = append(nextLevel, folderRef.InventoryPath)
+			}
+		}
+		level = nextLevel
+	}
+
+	countFolderChildren(ctx, session, folders, refs)
+
+	if len(errs) > 0 {
+		return folders, &PartialResultError{Err: kerrors.NewAggregate(errs)}
+	}
+
+	return folders, nil
+}
+
+// countFolderChildren sets the ChildCount of the folders, refs holds the reference of each folder at the
+// same index. The children of all folders are retrieved at once instead of listing every folder. The counts
+// are only informational, so if that fails, the folders are left without counts and the error is only logged.
+func countFolderChildren(ctx context.Context, session *Session, folders []Folder, refs []types.ManagedObjectReference) {
+	if len(refs) == 0 {
+		return
+	}
+
+	var props []mo.Folder
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"childEntity"}, &props); err != nil {
+		kruntime.HandleError(fmt.Errorf("failed to count the children of the folders: %w", err))
+		return
+	}
+
+	childCounts := make(map[types.ManagedObjectReference]int, len(props))
+	for _, folder := range props {
+		childCounts[folder.Reference()] = len(folder.ChildEntity)
+	}
+	for i := range folders {
+		if count, ok := childCounts[refs[i]]; ok {
+			folders[i].ChildCount = &count
+		}
+	}
+}
+
+// createVMFolder creates the specified vm folder if it does not exist yet and returns its reference.
+// An existing folder, e.g. left behind by a previous attempt whose cluster update failed, is reused.
+func createVMFolder(ctx context.Context, session *Session, fullPath string) (types.ManagedObjectReference, error) {
 	rootPath, newFolder := path.Split(fullPath)
 
 	rootFolder, err := session.Finder.Folder(ctx, rootPath)
 	if err != nil {
-		return fmt.Errorf("couldn't find rootpath, see: %w", err)
+		return types.ManagedObjectReference{}, fmt.Errorf("couldn't find rootpath, see: %w", err)
 	}
 
-	if _, err = session.Finder.Folder(ctx, newFolder); err != nil {
-		if !isNotFound(err) {
-			return fmt.Errorf("failed to get folder %s: %w", fullPath, err)
+	folder, err := session.Finder.Folder(ctx, fullPath)
+	if err == nil {
+		return folder.Reference(), nil
+	}
+	if !isNotFound(err) {
+		return types.ManagedObjectReference{}, fmt.Errorf("failed to get folder %s: %w", fullPath, err)
+	}
+
+	if err := checkPrivileges(ctx, session, rootFolder.Reference(), folderCreatePrivilege); err != nil {
+		return types.ManagedObjectReference{}, fmt.Errorf("cannot create folder %s below %q: %w", fullPath, rootPath, err)
+	}
+
+	folder, err = rootFolder.CreateFolder(ctx, newFolder)
+	if err != nil {
+		// The folder might have been created since the lookup, e.g. by a concurrent reconciliation.
+		if !isDuplicateName(err) {
+			return types.ManagedObjectReference{}, fmt.Errorf("failed to create folder %s: %w", fullPath, err)
 		}
+		if folder, err = session.Finder.Folder(ctx, fullPath); err != nil {
+			return types.ManagedObjectReference{}, fmt.Errorf("failed to get folder %s: %w", fullPath, err)
+		}
+	}
 
-		if _, err = rootFolder.CreateFolder(ctx, newFolder); err != nil {
-			return fmt.Errorf("failed to create folder %s: %w", fullPath, err)
+	return folder.Reference(), nil
+}
+
+// folderVisibilityBackoff bounds the wait for a created folder to show up in the inventory to roughly 1.5 seconds.
+var folderVisibilityBackoff = wait.Backoff{
+	Steps:    5,
+	Duration: 100 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// waitForFolder polls the finder until the folder is visible, as vCenter may not list a folder right
+// after its creation. It returns the last lookup error if the folder is still missing once the backoff
+// is exhausted.
+func waitForFolder(ctx context.Context, session *Session, fullPath string, backoff wait.Backoff) error {
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		_, lastErr = session.Finder.Folder(ctx, fullPath)
+		if lastErr != nil && !isNotFound(lastErr) {
+			return false, lastErr
 		}
+		return lastErr == nil, nil
+	})
+	if err != nil && lastErr != nil {
+		err = lastErr
+	}
+	if err != nil {
+		return fmt.Errorf("folder %s is not visible: %w", fullPath, err)
 	}
 
 	return nil
 }
 
-// deleteVMFolder deletes the specified folder.
-func deleteVMFolder(ctx context.Context, session *Session, path string) error {
-	folder, err := session.Finder.Folder(ctx, path)
+// CheckFolderCollision returns a FolderCollisionError if the folder at desiredPath already exists and is not
+// owned by the cluster, see checkFolderCollision. InitializeCloudProvider performs the same check before
+// creating the folder of a cluster, it allows to detect collisions before the cluster is created.
+func CheckFolderCollision(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, cluster *kubermaticv1.Cluster, desiredPath string, opts ...SessionOption) error {
+	session, err := newSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	var restSession *RESTSession
+	defer func() {
+		if restSession != nil {
+			restSession.Logout(ctx)
+		}
+	}()
+
+	return checkFolderCollision(ctx, session, cluster, desiredPath, func() (*RESTSession, error) {
+		restSession, err = newRESTSessionFromSession(ctx, session, dc, username, password, opts...)
+		return restSession, err
+	})
+}
+
+// checkFolderCollision returns a FolderCollisionError if the folder already exists and is not owned by the
+// cluster. A folder is owned by the cluster if the cluster references it or if it is tagged with the cluster
+// tag of the tag category of the cluster. Empty folders are no exception, they might have been created by
+// operators or belong to another cluster which has no VMs yet.
+func checkFolderCollision(ctx context.Context, session *Session, cluster *kubermaticv1.Cluster, folderPath string, restSession func() (*RESTSession, error)) error {
+	folder, err := session.Finder.Folder(ctx, folderPath)
 	if err != nil {
 		if isNotFound(err) {
 			return nil
 		}
-		return fmt.Errorf("couldn't open folder %q: %w", path, err)
+		return fmt.Errorf("failed to get folder %q: %w", folderPath, err)
+	}
+
+	if ref := folderRef(cluster); ref != nil && *ref == folder.Reference() {
+		return nil
+	}
+
+	if categoryID := cluster.Spec.Cloud.VSphere.TagCategoryID; categoryID != "" {
+		rs, err := restSession()
+		if err != nil {
+			return fmt.Errorf("failed to create REST client session: %w", err)
+		}
+		attachedTags, err := tags.NewManager(rs.Client).GetAttachedTags(ctx, folder.Reference())
+		if err != nil {
+			return fmt.Errorf("failed to get the tags of folder %q: %w", folderPath, err)
+		}
+		for _, tag := range attachedTags {
+			if tag.CategoryID == categoryID && tag.Name == cluster.Name {
+				return nil
+			}
+		}
+	}
+
+	return &FolderCollisionError{Folder: folderPath, Cluster: cluster.Name}
+}
+
+// checkPrivileges returns ErrMissingPrivilege naming the first of the given privileges the session user
+// does not have on the entity. Without this check vCenter would only report an unspecific permission fault
+// once the operation is attempted. Failing to fetch the privileges is not an error, as the operation
+// reports missing privileges on its own then.
+func checkPrivileges(ctx context.Context, session *Session, entity types.ManagedObjectReference, privileges ...string) error {
+	userSession, err := session.Client.SessionManager.UserSession(ctx)
+	if err != nil || userSession == nil {
+		return nil
+	}
+
+	authManager := object.NewAuthorizationManager(session.Client.Client)
+	results, err := authManager.FetchUserPrivilegeOnEntities(ctx, []types.ManagedObjectReference{entity}, userSession.UserName)
+	if err != nil || len(results) == 0 {
+		return nil
+	}
+
+	granted := sets.NewString(results[0].Privileges...)
+	for _, privilege := range privileges {
+		if !granted.Has(privilege) {
+			return fmt.Errorf("%w: user %q lacks %s", ErrMissingPrivilege, userSession.UserName, privilege)
+		}
+	}
+
+	return nil
+}
+
+// relocateVMFolder moves the folder at oldPath below the parent of newPath and renames it to the base name of newPath.
+// The folder is renamed before it is moved, so it never clashes with siblings of its old name at the new location.
+// If moving it fails, the rename is rolled back, so the folder either ends up at newPath or stays at oldPath.
+func relocateVMFolder(ctx context.Context, session *Session, oldPath, newPath string) error {
+	folder, err := session.Finder.Folder(ctx, oldPath)
+	if err != nil {
+		return fmt.Errorf("couldn't open folder %q: %w", oldPath, err)
+	}
+
+	if _, err := session.Finder.Folder(ctx, newPath); err == nil {
+		return fmt.Errorf("%w: %q", ErrFolderAlreadyExists, newPath)
+	} else if !isNotFound(err) {
+		return fmt.Errorf("failed to get folder %q: %w", newPath, err)
+	}
+
+	oldParent, oldName := path.Split(path.Clean(oldPath))
+	newParent, newName := path.Split(path.Clean(newPath))
+
+	var parent *object.Folder
+	if path.Clean(oldParent) != path.Clean(newParent) {
+		if parent, err = session.Finder.Folder(ctx, newParent); err != nil {
+			return fmt.Errorf("couldn't open folder %q: %w", newParent, err)
+		}
+	}
+
+	if oldName != newName {
+		if err := renameFolder(ctx, folder, newName); err != nil {
+			return fmt.Errorf("failed to rename folder %q: %w", oldPath, err)
+		}
+	}
+
+	if parent != nil {
+		if err := moveFolder(ctx, parent, folder); err != nil {
+			if oldName != newName {
+				if rollbackErr := renameFolder(ctx, folder, oldName); rollbackErr != nil {
+					return fmt.Errorf("failed to move folder %q: %w, restoring its name failed: %v", oldPath, err, rollbackErr)
+				}
+			}
+			return fmt.Errorf("failed to move folder %q: %w", oldPath, err)
+		}
+	}
+
+	return nil
+}
+
+// renameFolder renames the folder and waits for vCenter to complete the renaming.
+func renameFolder(ctx context.Context, folder *object.Folder, name string) error {
+	task, err := folder.Rename(ctx, name)
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+// moveFolder moves the folder into the parent and waits for vCenter to complete the move.
+func moveFolder(ctx context.Context, parent, folder *object.Folder) error {
+	task, err := parent.MoveInto(ctx, []types.ManagedObjectReference{folder.Reference()})
+	if err != nil {
+		return err
+	}
+	return task.Wait(ctx)
+}
+
+// deleteVMFolder deletes the folder with the given reference. Folders can be renamed or moved, so the
+// path is only used to find the folder if no reference is given.
+func deleteVMFolder(ctx context.Context, session *Session, ref *types.ManagedObjectReference, path string) error {
+	var folder *object.Folder
+	if ref != nil {
+		folder = object.NewFolder(session.Client.Client, *ref)
+	} else {
+		var err error
+		if folder, err = session.Finder.Folder(ctx, path); err != nil {
+			if isNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("couldn't open folder %q: %w", path, err)
+		}
 	}
 
+	// The folder might vanish between the lookup and the deletion, which is fine for us.
 	task, err := folder.Destroy(ctx)
 	if err != nil {
+		if isManagedObjectNotFound(err) {
+			return nil
+		}
 		return fmt.Errorf("failed to trigger folder deletion: %w", err)
 	}
 	if err := task.Wait(ctx); err != nil {
+		if isManagedObjectNotFound(err) {
+			return nil
+		}
 		return fmt.Errorf("failed to wait for deletion of folder: %w", err)
 	}
 
 	return nil
 }
+
+// folderRef returns the reference of the cluster folder stored in the annotations of the cluster,
+// or nil if there is none.
+func folderRef(cluster *kubermaticv1.Cluster) *types.ManagedObjectReference {
+	value, ok := cluster.Annotations[folderRefAnnotationKey]
+	if !ok {
+		return nil
+	}
+
+	ref := &types.ManagedObjectReference{}
+	if !ref.FromString(value) || ref.Type != "Folder" {
+		return nil
+	}
+	return ref
+}
+
+// clusterFolderRef returns the reference of the cluster folder stored in the annotations of the cluster, if it
+// still refers to a folder of the cluster, or nil otherwise, in which case callers fall back to the folder path of
+// the cluster spec. The annotation can be edited by users, but vCenter deletes folders along with their VMs, so
+// the folder must be located below the root path and either be located at the folder path of the cluster spec or
+// be tagged with the cluster tag. restSession is only called to check the tag and may be nil.
+func clusterFolderRef(ctx context.Context, session *Session, cluster *kubermaticv1.Cluster, rootPath string, restSession func() (*RESTSession, error)) (*types.ManagedObjectReference, error) {
+	ref := folderRef(cluster)
+	if ref == nil {
+		return nil, nil
+	}
+
+	element, err := session.Finder.Element(ctx, *ref)
+	if err != nil {
+		if isNotFound(err) || isManagedObjectNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get the path of folder %s: %w", ref, err)
+	}
+	if element.Path == path.Clean(rootPath) || !isSubPath(element.Path, rootPath) {
+		return nil, nil
+	}
+	if folderPath := cluster.Spec.Cloud.VSphere.Folder; folderPath != "" && path.Clean(folderPath) == element.Path {
+		return ref, nil
+	}
+
+	categoryID := cluster.Spec.Cloud.VSphere.TagCategoryID
+	if categoryID == "" || restSession == nil {
+		return nil, nil
+	}
+	rs, err := restSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create REST client session: %w", err)
+	}
+	attachedTags, err := tags.NewManager(rs.Client).GetAttachedTags(ctx, *ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the tags of folder %q: %w", element.Path, err)
+	}
+	for _, tag := range attachedTags {
+		if tag.CategoryID == categoryID && tag.Name == cluster.Name {
+			return ref, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -46,12 +46,12 @@ func TestCreateVMFolder(t *testing.T) {
 
 	// Cheap way to test idempotency
 	for i := 0; i < 2; i++ {
-		if err := createVMFolder(ctx, session, folder); err != nil {
+		if _, err := createVMFolder(ctx, session, folder); err != nil {
 			t.Fatal(err)
 		}
 	}
 	for i := 0; i < 2; i++ {
-		if err := deleteVMFolder(ctx, session, folder); err != nil {
+		if err := deleteVMFolder(ctx, session, nil, folder); err != nil {
 			t.Fatal(err)
 		}
 	}
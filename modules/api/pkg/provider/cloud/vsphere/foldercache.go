@@ -0,0 +1,157 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// folderCache keeps the folder listings of a provider for a short time, as the folders rarely
+// change, but are listed every time a user opens the cluster wizard. Listings are cached per
+// user, because vCenter only lists the folders a user has access to.
+type folderCache struct {
+	ttl time.Duration
+
+	lock    sync.Mutex
+	entries map[folderCacheKey]folderCacheEntry
+}
+
+type folderCacheKey struct {
+	datacenter string
+	rootPath   string
+	username   string
+	// password is hashed, so a listing is never handed out for wrong credentials.
+	password [sha256.Size]byte
+}
+
+type folderCacheEntry struct {
+	folders []Folder
+	expires time.Time
+}
+
+func newFolderCache(ttl time.Duration) *folderCache {
+	return &folderCache{
+		ttl:     ttl,
+		entries: map[folderCacheKey]folderCacheEntry{},
+	}
+}
+
+// get returns a copy of the cached listing, if it did not expire yet. A nil cache never has a listing.
+func (c *folderCache) get(key folderCacheKey) ([]Folder, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	return append([]Folder(nil), entry.folders...), true
+}
+
+func (c *folderCache) set(key folderCacheKey, folders []Folder) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries[key] = folderCacheEntry{
+		folders: append([]Folder(nil), folders...),
+		expires: time.Now().Add(c.ttl),
+	}
+}
+
+// invalidate drops all cached listings.
+func (c *folderCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = map[folderCacheKey]folderCacheEntry{}
+}
+
+// GetVMFolders returns the folders below the root path of the datacenter of the provider, see
+// GetVMFolders. If the provider was created with WithFolderCache, the listing is cached.
+func (v *Provider) GetVMFolders(ctx context.Context, username, password string) ([]Folder, error) {
+	return v.cachedVMFolders(ctx, v.dc, username, password)
+}
+
+// GetClusterVMFolders returns the folders below the root path of the cluster, which differs from the one of
+// the datacenter if it is overridden by the RootPathAnnotationKey annotation, see WithClusterRootPaths.
+func (v *Provider) GetClusterVMFolders(ctx context.Context, cluster *kubermaticv1.Cluster, username, password string) ([]Folder, error) {
+	dc, err := v.clusterDatacenter(cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	return v.cachedVMFolders(ctx, dc, username, password)
+}
+
+func (v *Provider) cachedVMFolders(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string) ([]Folder, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	// The login picks the browse user or the InfraManagementUser if set, so the key must reflect that.
+	loginDC, username, password := browseCredentials(dc, username, password, newSessionOptions(v.sessionOptions))
+	if loginDC.InfraManagementUser != nil {
+		username, password = loginDC.InfraManagementUser.Username, loginDC.InfraManagementUser.Password
+	}
+	key := folderCacheKey{
+		datacenter: dc.Datacenter,
+		rootPath:   rootPath,
+		username:   username,
+		password:   sha256.Sum256([]byte(password)),
+	}
+	if folders, ok := v.folderCache.get(key); ok {
+		return folders, nil
+	}
+
+	folders, err := GetVMFolders(ctx, dc, username, password, v.caBundle, v.sessionOptions...)
+	if err != nil {
+		// Incomplete listings are returned, but not cached.
+		return folders, err
+	}
+	v.folderCache.set(key, folders)
+
+	return folders, nil
+}
+
+// InvalidateFolderCache drops the folder listings cached by GetVMFolders. The provider does so
+// itself whenever it creates, moves or deletes a folder.
+func (v *Provider) InvalidateFolderCache() {
+	v.folderCache.invalidate()
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestProviderFolderCache(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v, err := NewCloudProvider(&kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: dc}}, nil, nil, WithFolderCache(time.Hour))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	ctx := context.Background()
+	listFolders := func() sets.String {
+		folders, err := v.GetVMFolders(ctx, "", "")
+		if err != nil {
+			t.Fatalf("failed to list folders: %v", err)
+		}
+		paths := sets.NewString()
+		for _, folder := range folders {
+			paths.Insert(folder.Path)
+		}
+		return paths
+	}
+
+	if paths := listFolders(); paths.Has("/DC0/vm/manual") {
+		t.Fatalf("expected no folder %q yet, got %v", "/DC0/vm/manual", paths.List())
+	}
+
+	// Folders created in vCenter directly only show up once the listing is invalidated.
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	if _, err := createVMFolder(ctx, session, "/DC0/vm/manual"); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	if paths := listFolders(); paths.Has("/DC0/vm/manual") {
+		t.Errorf("expected the cached listing without %q, got %v", "/DC0/vm/manual", paths.List())
+	}
+
+	// Concurrent listings share the cache, run with -race to detect data races.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := v.GetVMFolders(ctx, "", ""); err != nil {
+				t.Errorf("failed to list folders: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Creating the folder of a cluster invalidates the listing.
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+	if _, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if paths := listFolders(); !paths.HasAll("/DC0/vm/test", "/DC0/vm/manual") {
+		t.Errorf("expected the listing to include the new folders, got %v", paths.List())
+	}
+}
+
+func BenchmarkProviderGetVMFolders(b *testing.B) {
+	sim := vSphereSimulator{t: b}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		b.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	createFolderTree(ctx, b, session, "/DC0/vm", 3, 3)
+
+	// Reuse the session, so cache misses measure listing the folders rather than logging in.
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	v, err := NewCloudProvider(&kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: dc}}, nil, nil,
+		WithFolderCache(time.Hour),
+		WithSessionOptions(WithSessionProvider(pool)),
+	)
+	if err != nil {
+		b.Fatalf("failed to create provider: %v", err)
+	}
+
+	for name, invalidate := range map[string]bool{"hit": false, "miss": true} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if invalidate {
+					v.InvalidateFolderCache()
+				}
+				if _, err := v.GetVMFolders(ctx, "", ""); err != nil {
+					b.Fatalf("failed to list folders: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxFolderNameLength is the maximum length of names of vCenter inventory objects.
+const maxFolderNameLength = 80
+
+var unsafeFolderNameCharacters = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// FolderNameData is passed to the folder name template, see WithFolderNameTemplate.
+type FolderNameData struct {
+	// Name is the name of the cluster, it makes the folder name unique.
+	Name string
+	// HumanReadableName is the name of the cluster given by the user.
+	HumanReadableName string
+	// ProjectID is the ID of the project of the cluster.
+	ProjectID   string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// validateFolderNameTemplate checks that the template can be rendered and that the folder names
+// contain the cluster name, which is the only thing that makes them unique.
+func validateFolderNameTemplate(text string) error {
+	if text == "" {
+		return nil
+	}
+
+	cluster := &kubermaticv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "abcdefghij"}}
+	name, err := renderFolderName(text, cluster)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(name, cluster.Name) {
+		return fmt.Errorf("%w: the folder name %q does not contain the cluster name", ErrInvalidFolderNameTemplate, name)
+	}
+
+	return nil
+}
+
+// folderName returns the name of the folder created for the cluster. Without template, or if the
+// rendered name is unusable, e.g. because it got truncated, the cluster name is used.
+func folderName(text string, cluster *kubermaticv1.Cluster) string {
+	if text == "" {
+		return cluster.Name
+	}
+
+	name, err := renderFolderName(text, cluster)
+	if err != nil || !strings.Contains(name, cluster.Name) {
+		return cluster.Name
+	}
+	return name
+}
+
+// renderFolderName renders the template for the cluster and replaces all characters, which are not
+// safe for file system and inventory paths, with dashes.
+func renderFolderName(text string, cluster *kubermaticv1.Cluster) (string, error) {
+	tmpl, err := template.New("folder").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidFolderNameTemplate, err.Error())
+	}
+
+	data := FolderNameData{
+		Name:              cluster.Name,
+		HumanReadableName: cluster.Spec.HumanReadableName,
+		ProjectID:         cluster.Labels[kubermaticv1.ProjectIDLabelKey],
+		Labels:            cluster.Labels,
+		Annotations:       cluster.Annotations,
+	}
+
+	var name strings.Builder
+	if err := tmpl.Execute(&name, data); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidFolderNameTemplate, err.Error())
+	}
+
+	sanitized := unsafeFolderNameCharacters.ReplaceAllString(name.String(), "-")
+	sanitized = strings.Trim(sanitized, "-.")
+	if len(sanitized) > maxFolderNameLength {
+		sanitized = strings.Trim(sanitized[:maxFolderNameLength], "-.")
+	}
+
+	return sanitized, nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFolderName(t *testing.T) {
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "xyz1234567",
+			Labels: map[string]string{
+				kubermaticv1.ProjectIDLabelKey: "proj123",
+				"team":                         "platform",
+			},
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			HumanReadableName: "My Cluster/Prod",
+		},
+	}
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "No template",
+			expected: "xyz1234567",
+		},
+		{
+			name:     "Project and human readable name",
+			template: "{{ .ProjectID }}-{{ .HumanReadableName }}-{{ .Name }}",
+			expected: "proj123-My-Cluster-Prod-xyz1234567",
+		},
+		{
+			name:     "Labels",
+			template: `{{ index .Labels "team" }}_{{ .Name }}`,
+			expected: "platform_xyz1234567",
+		},
+		{
+			name:     "Missing annotation",
+			template: `{{ index .Annotations "owner" }}-{{ .Name }}`,
+			expected: "xyz1234567",
+		},
+		{
+			// Names which lost the cluster name are not unique anymore.
+			name:     "Truncated name",
+			template: strings.Repeat("a", maxFolderNameLength) + "{{ .Name }}",
+			expected: "xyz1234567",
+		},
+		{
+			name:     "Name without cluster name",
+			template: "{{ .HumanReadableName }}",
+			expected: "xyz1234567",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if name := folderName(tt.template, cluster); name != tt.expected {
+				t.Errorf("expected folder name %q, got %q", tt.expected, name)
+			}
+		})
+	}
+}
+
+func TestValidateFolderNameTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		wantErr  bool
+	}{
+		{
+			name: "No template",
+		},
+		{
+			name:     "Valid template",
+			template: "{{ .ProjectID }}-{{ .Name }}",
+		},
+		{
+			name:     "Malformed template",
+			template: "{{ .Name ",
+			wantErr:  true,
+		},
+		{
+			name:     "Unknown field",
+			template: "{{ .Unknown }}-{{ .Name }}",
+			wantErr:  true,
+		},
+		{
+			name:     "Missing cluster name",
+			template: "{{ .ProjectID }}-{{ .HumanReadableName }}",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFolderNameTemplate(tt.template)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateFolderNameTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidFolderNameTemplate) {
+				t.Errorf("expected error %v, got %v", ErrInvalidFolderNameTemplate, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// HostSystem represents a vsphere ESXi host.
+type HostSystem struct {
+	Name string
+	Path string
+	// PowerState is one of "poweredOn", "poweredOff", "standBy" or "unknown".
+	PowerState string
+	// ConnectionState is one of "connected", "disconnected" or "notResponding". The power state
+	// of hosts which are not connected is usually "unknown".
+	ConnectionState string
+}
+
+// GetHostSystems returns a slice of HostSystem of the datacenter from the passed cloudspec. Hosts are listed
+// regardless of their state, so nodes can't be pinned to hosts which are disconnected or powered off.
+func GetHostSystems(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]HostSystem, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return getHostSystems(ctx, session)
+}
+
+func getHostSystems(ctx context.Context, session *Session) ([]HostSystem, error) {
+	hostRefs, err := session.Finder.HostSystemList(ctx, "*")
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve host list: %w", err)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(hostRefs))
+	paths := make(map[types.ManagedObjectReference]string, len(hostRefs))
+	for _, hostRef := range hostRefs {
+		refs = append(refs, hostRef.Reference())
+		paths[hostRef.Reference()] = hostRef.InventoryPath
+	}
+
+	// Only the name and the runtime state are requested, they are available for disconnected hosts as well.
+	var hosts []mo.HostSystem
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "runtime.powerState", "runtime.connectionState"}, &hosts); err != nil {
+		return nil, fmt.Errorf("failed to get host properties: %w", err)
+	}
+
+	hostSystems := make([]HostSystem, 0, len(hosts))
+	for _, host := range hosts {
+		hostSystems = append(hostSystems, HostSystem{
+			Name:            host.Name,
+			Path:            paths[host.Reference()],
+			PowerState:      string(host.Runtime.PowerState),
+			ConnectionState: string(host.Runtime.ConnectionState),
+		})
+	}
+
+	return hostSystems, nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestGetHostSystems(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	// Disconnect one of the cluster hosts.
+	for _, obj := range simulator.Map.All("HostSystem") {
+		if host := obj.(*simulator.HostSystem); host.Name == "DC0_C0_H1" {
+			host.Runtime.ConnectionState = types.HostSystemConnectionStateDisconnected
+			host.Runtime.PowerState = types.HostSystemPowerStateUnknown
+		}
+	}
+
+	hosts, err := GetHostSystems(context.Background(), dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list hosts: %v", err)
+	}
+
+	found := map[string]HostSystem{}
+	for _, host := range hosts {
+		found[host.Path] = host
+	}
+
+	// The simulator creates a standalone host and three hosts per cluster.
+	for _, expected := range []HostSystem{
+		{Name: "DC0_H0", Path: "/DC0/host/DC0_H0/DC0_H0", PowerState: "poweredOn", ConnectionState: "connected"},
+		{Name: "DC0_C0_H0", Path: "/DC0/host/DC0_C0/DC0_C0_H0", PowerState: "poweredOn", ConnectionState: "connected"},
+		{Name: "DC0_C0_H1", Path: "/DC0/host/DC0_C0/DC0_C0_H1", PowerState: "unknown", ConnectionState: "disconnected"},
+		{Name: "DC0_C1_H2", Path: "/DC0/host/DC0_C1/DC0_C1_H2", PowerState: "poweredOn", ConnectionState: "connected"},
+	} {
+		if host, ok := found[expected.Path]; !ok || host != expected {
+			t.Errorf("expected host %+v, got %+v", expected, host)
+		}
+	}
+	if len(hosts) != 7 {
+		t.Errorf("expected 7 hosts, got %d: %v", len(hosts), hosts)
+	}
+}
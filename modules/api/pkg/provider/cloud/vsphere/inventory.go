@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// Inventory is everything needed to configure a cluster in a datacenter. The sections are
+// fetched independently, so each of them carries its own error and a failing section doesn't
+// hide the others.
+type Inventory struct {
+	Networks      []NetworkInfo
+	NetworksError error
+
+	Folders      []Folder
+	FoldersError error
+
+	Datastores      []DatastoreInfo
+	DatastoresError error
+
+	ResourcePools      []ResourcePool
+	ResourcePoolsError error
+}
+
+// GetInventory returns the networks, VM folders, datastores and resource pools of the datacenter
+// from the passed cloudspec. All sections are fetched concurrently using a single vCenter session,
+// but each with its own finder, as finders must not be shared across goroutines.
+// An error is only returned if the session could not be established, errors of the single
+// sections are part of the Inventory.
+func GetInventory(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*Inventory, error) {
+	options := newSessionOptions(opts)
+	filter := options.networkFilter
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	inventory := getInventory(ctx, session, dc, options.computeCluster)
+	inventory.Networks = filterNetworks(inventory.Networks, filter)
+
+	return inventory, nil
+}
+
+func getInventory(ctx context.Context, session *Session, dc *kubermaticv1.DatacenterSpecVSphere, computeCluster string) *Inventory {
+	inventory := &Inventory{}
+
+	var wg sync.WaitGroup
+	wg.Add(4)
+
+	go func() {
+		defer wg.Done()
+		inventory.Networks, inventory.NetworksError = getPossibleVMNetworks(ctx, session.withOwnFinder(), computeCluster)
+	}()
+	go func() {
+		defer wg.Done()
+		inventory.Folders, inventory.FoldersError = getVMFolders(ctx, session.withOwnFinder(), dc, 0)
+	}()
+	go func() {
+		defer wg.Done()
+		inventory.Datastores, inventory.DatastoresError = getDatastoreInfoList(ctx, session.withOwnFinder())
+	}()
+	go func() {
+		defer wg.Done()
+		inventory.ResourcePools, inventory.ResourcePoolsError = getResourcePools(ctx, session.withOwnFinder())
+	}()
+
+	wg.Wait()
+
+	return inventory
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestGetInventory(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	inventory, err := GetInventory(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get inventory: %v", err)
+	}
+
+	for section, err := range map[string]error{
+		"networks":       inventory.NetworksError,
+		"folders":        inventory.FoldersError,
+		"datastores":     inventory.DatastoresError,
+		"resource pools": inventory.ResourcePoolsError,
+	} {
+		if err != nil {
+			t.Errorf("failed to get %s: %v", section, err)
+		}
+	}
+	if len(inventory.Networks) == 0 {
+		t.Error("expected networks to be listed")
+	}
+	if len(inventory.Folders) == 0 {
+		t.Error("expected folders to be listed")
+	}
+	if len(inventory.Datastores) == 0 {
+		t.Error("expected datastores to be listed")
+	}
+
+	// A failing section must not affect the others.
+	dc.RootPath = "/DC0/vm/../vm"
+
+	inventory, err = GetInventory(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get inventory: %v", err)
+	}
+	if !errors.Is(inventory.FoldersError, ErrInvalidRootPath) {
+		t.Errorf("expected the folders to fail with an invalid root path, got %v", inventory.FoldersError)
+	}
+	if inventory.NetworksError != nil || len(inventory.Networks) == 0 {
+		t.Errorf("expected networks to be listed, got %v and error %v", inventory.Networks, inventory.NetworksError)
+	}
+	if inventory.DatastoresError != nil || len(inventory.Datastores) == 0 {
+		t.Errorf("expected datastores to be listed, got %v and error %v", inventory.Datastores, inventory.DatastoresError)
+	}
+
+	// The sections looking up the compute cluster and the folders run concurrently, each with its own finder.
+	dc.RootPath = ""
+
+	inventory, err = GetInventory(ctx, dc, "", "", nil, WithComputeCluster("DC0_C0"))
+	if err != nil {
+		t.Fatalf("failed to get inventory: %v", err)
+	}
+	if inventory.NetworksError != nil || len(inventory.Networks) == 0 {
+		t.Errorf("expected the networks of the compute cluster to be listed, got %v and error %v", inventory.Networks, inventory.NetworksError)
+	}
+	if inventory.FoldersError != nil || len(inventory.Folders) == 0 {
+		t.Errorf("expected folders to be listed, got %v and error %v", inventory.Folders, inventory.FoldersError)
+	}
+}
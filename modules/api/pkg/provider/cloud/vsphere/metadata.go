@@ -0,0 +1,179 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+const (
+	// MetadataTagCategoryProject, MetadataTagCategoryOwner and MetadataTagCategoryCluster are the tag
+	// categories of the metadata tags, see WithMetadataTags. vSphere tags have no values, so the category
+	// is the key and the tag name the value.
+	MetadataTagCategoryProject = "kkp-project"
+	MetadataTagCategoryOwner   = "kkp-owner"
+	MetadataTagCategoryCluster = "kkp-cluster"
+
+	// metadataTagsAnnotationKey holds the comma separated IDs of the metadata tags attached to the cluster folder.
+	metadataTagsAnnotationKey = "kubermatic.k8c.io/vsphere-metadata-tag-ids"
+)
+
+// metadataCategoryAssociableTypes are the types of objects metadata tags can be attached to.
+var metadataCategoryAssociableTypes = []string{"Folder"}
+
+// metadataTags returns the metadata tags of the cluster by their category. Metadata which is not known
+// for the cluster, e.g. the project of clusters created outside of the dashboard, is left out.
+func metadataTags(cluster *kubermaticv1.Cluster) map[string]string {
+	metadata := map[string]string{
+		MetadataTagCategoryProject: cluster.Labels[kubermaticv1.ProjectIDLabelKey],
+		MetadataTagCategoryOwner:   cluster.Status.UserEmail,
+		MetadataTagCategoryCluster: cluster.Name,
+	}
+	for category, value := range metadata {
+		if value == "" {
+			delete(metadata, category)
+		}
+	}
+
+	return metadata
+}
+
+// attachMetadataTags attaches the metadata tags to the object and returns their IDs. The categories and
+// tags are shared by all clusters and created if they don't exist yet.
+func attachMetadataTags(ctx context.Context, restSession *RESTSession, metadata map[string]string, ref mo.Reference) ([]string, error) {
+	tagManager := tags.NewManager(restSession.Client)
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tag categories %w", err)
+	}
+	categoryIDs := map[string]string{}
+	for _, category := range categories {
+		categoryIDs[category.Name] = category.ID
+	}
+
+	names := make([]string, 0, len(metadata))
+	for name := range metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tagIDs []string
+	for _, name := range names {
+		categoryID, ok := categoryIDs[name]
+		if !ok {
+			categoryID, err = tagManager.CreateCategory(ctx, &tags.Category{
+				Name:            name,
+				Description:     fmt.Sprintf("Metadata of the folders of KKP clusters. %s, do not modify.", managedByKubermatic),
+				Cardinality:     "SINGLE",
+				AssociableTypes: metadataCategoryAssociableTypes,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create tag category %q: %w", name, err)
+			}
+		}
+
+		tagID, err := createTag(ctx, tagManager, categoryID, metadata[name])
+		if err != nil {
+			return nil, err
+		}
+		if err := tagManager.AttachTag(ctx, tagID, ref); err != nil {
+			return nil, fmt.Errorf("failed to attach tag %q of category %q: %w", metadata[name], name, err)
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+
+	return tagIDs, nil
+}
+
+// detachMetadataTags detaches the metadata tags with the given IDs from the object, if it is known, and
+// deletes the tags no other object is tagged with. The categories are kept for other clusters.
+func detachMetadataTags(ctx context.Context, tagManager *tags.Manager, tagIDs []string, ref *types.ManagedObjectReference) error {
+	for _, tagID := range tagIDs {
+		if ref != nil {
+			if err := tagManager.DetachTag(ctx, tagID, ref); err != nil && !isRESTNotFound(err) {
+				return fmt.Errorf("failed to detach tag %q: %w", tagID, err)
+			}
+		}
+
+		refs, err := tagManager.ListAttachedObjects(ctx, tagID)
+		if err != nil {
+			if isRESTNotFound(err) {
+				continue
+			}
+			return fmt.Errorf("failed to list objects attached to tag %q: %w", tagID, err)
+		}
+		if len(refs) > 0 {
+			continue
+		}
+		if err := tagManager.DeleteTag(ctx, &tags.Tag{ID: tagID}); err != nil && !isRESTNotFound(err) {
+			return fmt.Errorf("failed to delete tag %q: %w", tagID, err)
+		}
+	}
+
+	return nil
+}
+
+// metadataTagIDs returns the IDs of the metadata tags stored in the cluster annotations. Users may edit the
+// annotation, so only tags within the metadata categories, which match the current metadata of the cluster,
+// are returned. The IDs of other tags are returned as ignored, tags which don't exist anymore are left out.
+func metadataTagIDs(ctx context.Context, tagManager *tags.Manager, cluster *kubermaticv1.Cluster) (tagIDs, ignored []string, err error) {
+	value := cluster.Annotations[metadataTagsAnnotationKey]
+	if value == "" {
+		return nil, nil, nil
+	}
+
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get tag categories %w", err)
+	}
+	categoryNames := map[string]string{}
+	for _, category := range categories {
+		categoryNames[category.ID] = category.Name
+	}
+	metadata := metadataTags(cluster)
+
+	for _, tagID := range strings.Split(value, ",") {
+		// GetTag looks up anything which isn't an ID by name.
+		if !strings.HasPrefix(tagID, "urn:") {
+			ignored = append(ignored, tagID)
+			continue
+		}
+		tag, err := tagManager.GetTag(ctx, tagID)
+		if err != nil {
+			if isRESTNotFound(err) {
+				continue
+			}
+			return nil, nil, fmt.Errorf("failed to get tag %q: %w", tagID, err)
+		}
+		if name, ok := metadata[categoryNames[tag.CategoryID]]; !ok || name != tag.Name {
+			ignored = append(ignored, tagID)
+			continue
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+
+	return tagIDs, ignored, nil
+}
@@ -0,0 +1,177 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/vapi/tags"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	kuberneteshelper "k8c.io/kubermatic/v2/pkg/kubernetes"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestMetadataTagsLifecycle(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+	WithMetadataTags()(v)
+	WithoutTagCategoryCreation()(v)
+
+	newCluster := func(name, projectID, owner string) *kubermaticv1.Cluster {
+		cluster := &kubermaticv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: kubermaticv1.ClusterSpec{
+				Cloud: kubermaticv1.CloudSpec{
+					VSphere: &kubermaticv1.VSphereCloudSpec{},
+				},
+			},
+			Status: kubermaticv1.ClusterStatus{UserEmail: owner},
+		}
+		if projectID != "" {
+			cluster.Labels = map[string]string{kubermaticv1.ProjectIDLabelKey: projectID}
+		}
+		return cluster
+	}
+	folderTags := func(cluster *kubermaticv1.Cluster) map[string]string {
+		t.Helper()
+		attached, err := v.GetFolderTags(context.Background(), cluster)
+		if err != nil {
+			t.Fatalf("failed to get folder tags: %v", err)
+		}
+		result := map[string]string{}
+		for _, tag := range attached {
+			result[tag.CategoryName] = tag.Name
+		}
+		return result
+	}
+
+	ctx := context.Background()
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+	tagManager := tags.NewManager(restSession.Client)
+
+	// Both clusters belong to the same project, so they share its tag.
+	first := newCluster("first", "project", "owner@example.com")
+	first, err = v.InitializeCloudProvider(ctx, first, testClusterUpdater(first))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	second := newCluster("second", "project", "")
+	second, err = v.InitializeCloudProvider(ctx, second, testClusterUpdater(second))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+
+	expected := map[string]string{
+		MetadataTagCategoryProject: "project",
+		MetadataTagCategoryOwner:   "owner@example.com",
+		MetadataTagCategoryCluster: "first",
+	}
+	if changes := diff.ObjectDiff(expected, folderTags(first)); changes != "" {
+		t.Errorf("folder tags differ from the expected ones:\n%v", changes)
+	}
+	// The owner is unknown, so it is not tagged.
+	expected = map[string]string{
+		MetadataTagCategoryProject: "project",
+		MetadataTagCategoryCluster: "second",
+	}
+	if changes := diff.ObjectDiff(expected, folderTags(second)); changes != "" {
+		t.Errorf("folder tags differ from the expected ones:\n%v", changes)
+	}
+	if !kuberneteshelper.HasFinalizer(first, metadataTagsCleanupFinalizer) {
+		t.Errorf("expected finalizer %q, got %v", metadataTagsCleanupFinalizer, first.Finalizers)
+	}
+
+	// Initializing again must not attach the tags a second time.
+	tagIDs := first.Annotations[metadataTagsAnnotationKey]
+	first, err = v.InitializeCloudProvider(ctx, first, testClusterUpdater(first))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider again: %v", err)
+	}
+	if first.Annotations[metadataTagsAnnotationKey] != tagIDs {
+		t.Errorf("expected tag IDs %q to be kept, got %q", tagIDs, first.Annotations[metadataTagsAnnotationKey])
+	}
+
+	// Users may edit the tag IDs, but tags which are no metadata tags of the cluster must be kept.
+	userCategoryID, err := tagManager.CreateCategory(ctx, &tags.Category{Name: "user", Cardinality: "MULTIPLE"})
+	if err != nil {
+		t.Fatalf("failed to create tag category: %v", err)
+	}
+	userTagID, err := tagManager.CreateTag(ctx, &tags.Tag{Name: "first", CategoryID: userCategoryID})
+	if err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+	first.Annotations[metadataTagsAnnotationKey] += "," + userTagID + ",user"
+
+	// The project tag is still in use by the second cluster.
+	first, err = v.CleanUpCloudProvider(ctx, first, testClusterUpdater(first))
+	if err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+	if len(first.Finalizers) != 0 || first.Annotations[metadataTagsAnnotationKey] != "" {
+		t.Errorf("expected the finalizers and tag IDs to be removed, got %+v", first.ObjectMeta)
+	}
+	remaining := func() []string {
+		t.Helper()
+		allTags, err := tagManager.GetTags(ctx)
+		if err != nil {
+			t.Fatalf("failed to get tags: %v", err)
+		}
+		var names []string
+		for _, tag := range allTags {
+			names = append(names, tag.Name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	if changes := diff.ObjectDiff([]string{"first", "project", "second"}, remaining()); changes != "" {
+		t.Errorf("remaining tags differ from the expected ones:\n%v", changes)
+	}
+
+	if _, err := v.CleanUpCloudProvider(ctx, second, testClusterUpdater(second)); err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+	if changes := diff.ObjectDiff([]string{"first"}, remaining()); changes != "" {
+		t.Errorf("expected all metadata tags to be deleted:\n%v", changes)
+	}
+	// The categories are shared by all clusters and kept.
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tag categories: %v", err)
+	}
+	if len(categories) != 4 {
+		t.Errorf("expected the metadata tag categories to be kept, got %v", categories)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	operationSOAPLogin             = "soap_login"
+	operationRESTLogin             = "rest_login"
+	operationInitialize            = "initialize"
+	operationDeleteFolder          = "delete_folder"
+	operationDeleteTagCategory     = "delete_tag_category"
+	operationDeleteAntiAffinityTag = "delete_anti_affinity_tag"
+	operationDeleteMetadataTags    = "delete_metadata_tags"
+
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+// Metrics holds the Prometheus metrics of the vSphere provider. They are not
+// registered anywhere by default, see Register. A nil *Metrics is valid and
+// records nothing.
+type Metrics struct {
+	// SessionDuration tracks how long it takes to establish a vCenter session.
+	SessionDuration *prometheus.HistogramVec
+	// Logins counts the vCenter logins by result.
+	Logins *prometheus.CounterVec
+	// Operations counts the provider operations, e.g. the cluster initialization, by result.
+	Operations *prometheus.CounterVec
+	// CleanupRetries counts how often a cleanup operation had to be retried.
+	CleanupRetries *prometheus.CounterVec
+}
+
+// NewMetrics creates the metrics of the vSphere provider.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		SessionDuration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "kubermatic_api_vsphere_session_duration_seconds",
+				Help:    "A histogram of the time it takes to establish a vCenter session.",
+				Buckets: []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+			},
+			[]string{"datacenter", "operation"},
+		),
+		Logins: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubermatic_api_vsphere_logins_total",
+				Help: "The number of vCenter logins",
+			},
+			[]string{"datacenter", "operation", "result"},
+		),
+		Operations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubermatic_api_vsphere_operations_total",
+				Help: "The number of vSphere cluster initialization and cleanup operations",
+			},
+			[]string{"datacenter", "operation", "result"},
+		),
+		CleanupRetries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: "kubermatic_api_vsphere_cleanup_retries_total",
+				Help: "The number of times a vSphere cleanup operation was retried",
+			},
+			[]string{"datacenter", "operation"},
+		),
+	}
+}
+
+// Register registers all metrics at the given registerer.
+func (m *Metrics) Register(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{m.SessionDuration, m.Logins, m.Operations, m.CleanupRetries} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Metrics) observeLogin(datacenter, operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	m.SessionDuration.WithLabelValues(datacenter, operation).Observe(time.Since(start).Seconds())
+	m.Logins.WithLabelValues(datacenter, operation, result(err)).Inc()
+}
+
+func (m *Metrics) observeOperation(datacenter, operation string, err error) {
+	if m == nil {
+		return
+	}
+	m.Operations.WithLabelValues(datacenter, operation, result(err)).Inc()
+}
+
+func (m *Metrics) observeCleanupRetry(datacenter, operation string) {
+	if m == nil {
+		return
+	}
+	m.CleanupRetries.WithLabelValues(datacenter, operation).Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+func TestMetrics(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	metrics := NewMetrics()
+	registry := prometheus.NewRegistry()
+	if err := metrics.Register(registry); err != nil {
+		t.Fatalf("failed to register metrics: %v", err)
+	}
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+		sessionOptions: []SessionOption{WithMetrics(metrics)},
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+
+	// Rejected credentials must be counted as failed login.
+	dc.InfraManagementUser = nil
+	if _, err := newSession(ctx, dc, "user", "", nil, WithMetrics(metrics), WithLoginAttempts(1)); err == nil {
+		t.Fatal("expected the login with an empty password to fail")
+	}
+
+	for _, tc := range []struct {
+		counter  prometheus.Counter
+		expected float64
+	}{
+		{counter: metrics.Logins.WithLabelValues("DC0", operationSOAPLogin, resultSuccess), expected: 2},
+		{counter: metrics.Logins.WithLabelValues("DC0", operationSOAPLogin, resultFailure), expected: 1},
+		// The folder and the tag cleanup use their own REST sessions.
+		{counter: metrics.Logins.WithLabelValues("DC0", operationRESTLogin, resultSuccess), expected: 3},
+		{counter: metrics.Operations.WithLabelValues("DC0", operationInitialize, resultSuccess), expected: 1},
+		{counter: metrics.Operations.WithLabelValues("DC0", operationDeleteFolder, resultSuccess), expected: 1},
+		{counter: metrics.Operations.WithLabelValues("DC0", operationDeleteTagCategory, resultSuccess), expected: 1},
+	} {
+		if value := testutil.ToFloat64(tc.counter); value != tc.expected {
+			t.Errorf("expected %s to be %v, got %v", tc.counter.Desc(), tc.expected, value)
+		}
+	}
+
+	if count := testutil.CollectAndCount(metrics.SessionDuration); count != 2 {
+		t.Errorf("expected the session duration to be tracked per datacenter and operation, got %d series", count)
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	var metrics *Metrics
+
+	// A provider without metrics must not panic.
+	metrics.observeLogin("DC0", operationSOAPLogin, time.Now(), nil)
+	metrics.observeOperation("DC0", operationInitialize, nil)
+	metrics.observeCleanupRetry("DC0", operationDeleteFolder)
+}
@@ -21,11 +21,24 @@ import (
 	"errors"
 	"fmt"
 	"path"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
 
 	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// Network types as reported by vCenter. They can be used to filter the networks returned by GetNetworksFiltered.
+const (
+	NetworkTypeNetwork                     = "Network"
+	NetworkTypeDistributedVirtualPortgroup = "DistributedVirtualPortgroup"
+	NetworkTypeOpaqueNetwork               = "OpaqueNetwork"
 )
 
 type NetworkInfo struct {
@@ -33,10 +46,106 @@ type NetworkInfo struct {
 	RelativePath string
 	AbsolutePath string
 	Type         string
+	// VLANID is the VLAN of the portgroup. Trunks are represented by their comma separated
+	// VLAN ranges. It is empty for opaque networks or if the VLAN could not be determined.
+	VLANID string
+	// HostCount is the number of hosts which are members of the distributed switch of a distributed
+	// portgroup, i.e. the hosts whose VMs can reach the network. It is 0 for other network types or if
+	// the members could not be determined.
+	HostCount int
+}
+
+// DVSInfo describes a distributed virtual switch of the datacenter.
+type DVSInfo struct {
+	Name string
+	UUID string
+	// Path is the absolute inventory path of the switch, e.g. "/DC0/network/DVS0".
+	Path string
+	// PortgroupCount is the number of distributed portgroups of the switch, including its uplink portgroups.
+	PortgroupCount int
+}
+
+// NetworkFilter restricts the networks returned to users, so admins can hide the portgroups which
+// are irrelevant for clusters. Patterns use the syntax of path.Match and are matched against both
+// the name and the relative path of a network. A network is returned if it matches any allow pattern
+// and no deny pattern, so deny patterns take precedence. Without allow patterns, all networks which
+// don't match a deny pattern are returned.
+type NetworkFilter struct {
+	Allow []string
+	Deny  []string
+}
+
+// validate returns an error if any of the patterns is malformed.
+func (f NetworkFilter) validate() error {
+	for _, pattern := range append(append([]string{}, f.Allow...), f.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("%w: %q", ErrInvalidNetworkPattern, pattern)
+		}
+	}
+	return nil
+}
+
+// allows returns true if the network passes the filter. The patterns must have been validated.
+func (f NetworkFilter) allows(network NetworkInfo) bool {
+	if matchesNetwork(f.Deny, network) {
+		return false
+	}
+	return len(f.Allow) == 0 || matchesNetwork(f.Allow, network)
+}
+
+func matchesNetwork(patterns []string, network NetworkInfo) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, network.Name); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, network.RelativePath); matched {
+			return true
+		}
+	}
+	return false
 }
 
-func getPossibleVMNetworks(ctx context.Context, session *Session) ([]NetworkInfo, error) {
+// filterNetworks returns the networks which pass the filter.
+func filterNetworks(networks []NetworkInfo, filter NetworkFilter) []NetworkInfo {
+	if len(filter.Allow) == 0 && len(filter.Deny) == 0 {
+		return networks
+	}
+
+	var filtered []NetworkInfo
+	for _, network := range networks {
+		if filter.allows(network) {
+			filtered = append(filtered, network)
+		}
+	}
+	return filtered
+}
+
+// groupNetworksByFolder groups the networks by the path of their parent folder, keeping their order.
+func groupNetworksByFolder(networks []NetworkInfo) map[string][]NetworkInfo {
+	folders := map[string][]NetworkInfo{}
+	for _, network := range networks {
+		folder := path.Dir(network.AbsolutePath)
+		folders[folder] = append(folders[folder], network)
+	}
+
+	return folders
+}
+
+// getPossibleVMNetworks returns all networks VMs can be attached to. If networkTypes are given, only networks of
+// these types are returned. If a compute cluster is given, only networks reachable from all its hosts are returned.
+func getPossibleVMNetworks(ctx context.Context, session *Session, computeCluster string, networkTypes ...string) ([]NetworkInfo, error) {
 	var infos []NetworkInfo
+	// refs holds the reference of the network of each info.
+	var refs []types.ManagedObjectReference
+	allowedTypes := sets.NewString(networkTypes...)
+
+	var reachable map[types.ManagedObjectReference]bool
+	if computeCluster != "" {
+		var err error
+		if reachable, err = getComputeClusterNetworks(ctx, session, computeCluster); err != nil {
+			return nil, err
+		}
+	}
 
 	datacenterFolders, err := session.Datacenter.Folders(ctx)
 	if err != nil {
@@ -47,7 +156,16 @@ func getPossibleVMNetworks(ctx context.Context, session *Session) ([]NetworkInfo
 	if err != nil {
 		return nil, err
 	}
+	networks = dedupNetworks(networks)
+	var portgroupRefs, standardRefs []types.ManagedObjectReference
 	for _, network := range networks {
+		if allowedTypes.Len() > 0 && !allowedTypes.Has(network.Reference().Type) {
+			continue
+		}
+		if reachable != nil && !reachable[network.Reference()] {
+			continue
+		}
+
 		if _, err := network.EthernetCardBackingInfo(ctx); err != nil {
 			// Some network devices cannot be used by VM's.
 			if errors.Is(err, object.ErrNotSupported) {
@@ -74,8 +192,281 @@ func getPossibleVMNetworks(ctx context.Context, session *Session) ([]NetworkInfo
 			Type:         network.Reference().Type,
 			Name:         path.Base(element.Path),
 		}
+
+		switch info.Type {
+		case NetworkTypeDistributedVirtualPortgroup:
+			portgroupRefs = append(portgroupRefs, network.Reference())
+		case NetworkTypeNetwork:
+			standardRefs = append(standardRefs, network.Reference())
+		}
+
 		infos = append(infos, info)
+		refs = append(refs, network.Reference())
+	}
+
+	// Missing VLAN IDs and host counts are not worth failing the whole list for.
+	vlanIDs, hostCounts, err := getDistributedPortgroupDetails(ctx, session, portgroupRefs)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+	standardVLANIDs, err := getStandardPortgroupVLANIDs(ctx, session, standardRefs)
+	if err != nil {
+		runtime.HandleError(err)
+	}
+	for i, ref := range refs {
+		switch infos[i].Type {
+		case NetworkTypeDistributedVirtualPortgroup:
+			infos[i].VLANID = vlanIDs[ref]
+			infos[i].HostCount = hostCounts[ref]
+		case NetworkTypeNetwork:
+			infos[i].VLANID = standardVLANIDs[ref]
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].AbsolutePath != infos[j].AbsolutePath {
+			return infos[i].AbsolutePath < infos[j].AbsolutePath
+		}
+		return infos[i].Type < infos[j].Type
+	})
+
+	return infos, nil
+}
+
+// getDistributedSwitches returns the distributed virtual switches of the datacenter, sorted by their path.
+func getDistributedSwitches(ctx context.Context, session *Session) ([]DVSInfo, error) {
+	networks, err := session.Finder.NetworkList(ctx, "*")
+	if err != nil {
+		// A datacenter without networks has no switches either.
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
 	}
 
+	var refs []types.ManagedObjectReference
+	paths := map[types.ManagedObjectReference]string{}
+	for _, network := range dedupNetworks(networks) {
+		if dvs, ok := network.(*object.DistributedVirtualSwitch); ok {
+			refs = append(refs, dvs.Reference())
+			paths[dvs.Reference()] = dvs.InventoryPath
+		}
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	var switches []mo.DistributedVirtualSwitch
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "uuid", "portgroup"}, &switches); err != nil {
+		return nil, fmt.Errorf("failed to get distributed switch properties: %w", err)
+	}
+
+	infos := make([]DVSInfo, 0, len(switches))
+	for _, dvs := range switches {
+		infos = append(infos, DVSInfo{
+			Name:           dvs.Name,
+			UUID:           dvs.Uuid,
+			Path:           paths[dvs.Reference()],
+			PortgroupCount: len(dvs.Portgroup),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Path < infos[j].Path
+	})
+
 	return infos, nil
 }
+
+// dedupNetworks removes networks listed more than once, keeping the first occurrence. The managed object ID
+// identifies a network regardless of its type, so if a distributed portgroup is also listed as standard
+// network, the distributed representation is kept. Distinct networks which merely share a name are kept.
+func dedupNetworks(networks []object.NetworkReference) []object.NetworkReference {
+	index := map[string]int{}
+	deduped := make([]object.NetworkReference, 0, len(networks))
+	for _, network := range networks {
+		ref := network.Reference()
+		i, ok := index[ref.Value]
+		if !ok {
+			index[ref.Value] = len(deduped)
+			deduped = append(deduped, network)
+			continue
+		}
+		if ref.Type == NetworkTypeDistributedVirtualPortgroup && deduped[i].Reference().Type != NetworkTypeDistributedVirtualPortgroup {
+			deduped[i] = network
+		}
+	}
+
+	return deduped
+}
+
+// getComputeClusterNetworks returns the networks attached to every host of the compute cluster, which may
+// also be a standalone host. VMs may be placed on any of the hosts, so networks which only some of the
+// hosts are attached to cannot be relied upon.
+func getComputeClusterNetworks(ctx context.Context, session *Session, computeCluster string) (map[types.ManagedObjectReference]bool, error) {
+	computeResource, err := session.Finder.ComputeResource(ctx, computeCluster)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find compute cluster %q: %w", computeCluster, err)
+	}
+
+	hosts, err := computeResource.Hosts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the hosts of compute cluster %q: %w", computeCluster, err)
+	}
+
+	// A cluster without hosts cannot reach any network.
+	reachable := map[types.ManagedObjectReference]bool{}
+	if len(hosts) == 0 {
+		return reachable, nil
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(hosts))
+	for _, host := range hosts {
+		refs = append(refs, host.Reference())
+	}
+
+	var hostSystems []mo.HostSystem
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"network"}, &hostSystems); err != nil {
+		return nil, fmt.Errorf("failed to get the networks of compute cluster %q: %w", computeCluster, err)
+	}
+
+	hostCounts := map[types.ManagedObjectReference]int{}
+	for _, host := range hostSystems {
+		// A host lists each of its networks once.
+		for _, network := range host.Network {
+			hostCounts[network]++
+		}
+	}
+	for network, count := range hostCounts {
+		if count == len(hostSystems) {
+			reachable[network] = true
+		}
+	}
+
+	return reachable, nil
+}
+
+// getDistributedPortgroupDetails returns the VLAN IDs of the distributed portgroups and the number of host
+// members of their switches. The properties of all portgroups and of all their switches are retrieved at once.
+func getDistributedPortgroupDetails(ctx context.Context, session *Session, refs []types.ManagedObjectReference) (map[types.ManagedObjectReference]string, map[types.ManagedObjectReference]int, error) {
+	vlanIDs := map[types.ManagedObjectReference]string{}
+	hostCounts := map[types.ManagedObjectReference]int{}
+	if len(refs) == 0 {
+		return vlanIDs, hostCounts, nil
+	}
+
+	var portgroups []mo.DistributedVirtualPortgroup
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"config.defaultPortConfig", "config.distributedVirtualSwitch"}, &portgroups); err != nil {
+		return nil, nil, fmt.Errorf("failed to get distributed portgroup properties: %w", err)
+	}
+
+	// Portgroups of the same distributed switch share its host members.
+	portgroupSwitches := map[types.ManagedObjectReference]types.ManagedObjectReference{}
+	switchHostCounts := map[types.ManagedObjectReference]int{}
+	var switchRefs []types.ManagedObjectReference
+	for _, portgroup := range portgroups {
+		if setting, ok := portgroup.Config.DefaultPortConfig.(*types.VMwareDVSPortSetting); ok && setting.Vlan != nil {
+			vlanIDs[portgroup.Reference()] = formatVLANSpec(setting.Vlan)
+		}
+
+		switchRef := portgroup.Config.DistributedVirtualSwitch
+		if switchRef == nil {
+			continue
+		}
+		if _, ok := switchHostCounts[*switchRef]; !ok {
+			switchHostCounts[*switchRef] = 0
+			switchRefs = append(switchRefs, *switchRef)
+		}
+		portgroupSwitches[portgroup.Reference()] = *switchRef
+	}
+	if len(switchRefs) == 0 {
+		return vlanIDs, hostCounts, nil
+	}
+
+	var switches []mo.DistributedVirtualSwitch
+	if err := pc.Retrieve(ctx, switchRefs, []string{"summary.hostMember"}, &switches); err != nil {
+		return vlanIDs, nil, fmt.Errorf("failed to get distributed switch properties: %w", err)
+	}
+	for _, dvs := range switches {
+		switchHostCounts[dvs.Reference()] = len(dvs.Summary.HostMember)
+	}
+	for portgroup, switchRef := range portgroupSwitches {
+		hostCounts[portgroup] = switchHostCounts[switchRef]
+	}
+
+	return vlanIDs, hostCounts, nil
+}
+
+// getStandardPortgroupVLANIDs returns the VLAN IDs of the standard portgroups. Standard portgroups are configured
+// per host, the VLAN is part of the host portgroup spec of the first host of the portgroup. The properties of all
+// portgroups and of all their first hosts are retrieved at once.
+func getStandardPortgroupVLANIDs(ctx context.Context, session *Session, refs []types.ManagedObjectReference) (map[types.ManagedObjectReference]string, error) {
+	vlanIDs := map[types.ManagedObjectReference]string{}
+	if len(refs) == 0 {
+		return vlanIDs, nil
+	}
+
+	var networks []mo.Network
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "host"}, &networks); err != nil {
+		return nil, fmt.Errorf("failed to get network properties: %w", err)
+	}
+
+	hostNetworks := map[types.ManagedObjectReference][]mo.Network{}
+	var hostRefs []types.ManagedObjectReference
+	for _, network := range networks {
+		if len(network.Host) == 0 {
+			continue
+		}
+		if _, ok := hostNetworks[network.Host[0]]; !ok {
+			hostRefs = append(hostRefs, network.Host[0])
+		}
+		hostNetworks[network.Host[0]] = append(hostNetworks[network.Host[0]], network)
+	}
+	if len(hostRefs) == 0 {
+		return vlanIDs, nil
+	}
+
+	var hosts []mo.HostSystem
+	if err := pc.Retrieve(ctx, hostRefs, []string{"config.network.portgroup"}, &hosts); err != nil {
+		return nil, fmt.Errorf("failed to get host properties: %w", err)
+	}
+	for _, host := range hosts {
+		if host.Config == nil || host.Config.Network == nil {
+			continue
+		}
+		for _, network := range hostNetworks[host.Reference()] {
+			for _, portgroup := range host.Config.Network.Portgroup {
+				if portgroup.Spec.Name == network.Name {
+					vlanIDs[network.Reference()] = strconv.Itoa(int(portgroup.Spec.VlanId))
+					break
+				}
+			}
+		}
+	}
+
+	return vlanIDs, nil
+}
+
+func formatVLANSpec(spec types.BaseVmwareDistributedVirtualSwitchVlanSpec) string {
+	switch vlan := spec.(type) {
+	case *types.VmwareDistributedVirtualSwitchVlanIdSpec:
+		return strconv.Itoa(int(vlan.VlanId))
+	case *types.VmwareDistributedVirtualSwitchPvlanSpec:
+		return strconv.Itoa(int(vlan.PvlanId))
+	case *types.VmwareDistributedVirtualSwitchTrunkVlanSpec:
+		ranges := make([]string, 0, len(vlan.VlanId))
+		for _, r := range vlan.VlanId {
+			if r.Start == r.End {
+				ranges = append(ranges, strconv.Itoa(int(r.Start)))
+			} else {
+				ranges = append(ranges, fmt.Sprintf("%d-%d", r.Start, r.End))
+			}
+		}
+		return strings.Join(ranges, ",")
+	default:
+		return ""
+	}
+}
@@ -20,6 +20,7 @@ package vsphere
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"testing"
@@ -78,9 +79,80 @@ func TestGetPossibleVMNetworks(t *testing.T) {
 				return networkInfos[i].AbsolutePath < networkInfos[j].AbsolutePath
 			})
 
+			// VLAN IDs and host counts depend on the environment and are covered by the simulator based tests.
+			for i := range networkInfos {
+				networkInfos[i].VLANID = ""
+				networkInfos[i].HostCount = 0
+			}
+
 			if changes := diff.ObjectDiff(test.expectedNetworkInfos, networkInfos); changes != "" {
 				t.Errorf("Got network infos differ from expected ones. Diff: %v", changes)
 			}
 		})
 	}
 }
+
+func TestFilterNetworks(t *testing.T) {
+	networks := []NetworkInfo{
+		{Name: "VM Network", RelativePath: "VM Network"},
+		{Name: "k8s-prod", RelativePath: "kubermatic/k8s-prod"},
+		{Name: "k8s-test", RelativePath: "kubermatic/k8s-test"},
+		{Name: "storage", RelativePath: "infra/storage"},
+	}
+
+	tests := []struct {
+		name          string
+		filter        NetworkFilter
+		expectedNames []string
+		expectedErr   error
+	}{
+		{
+			name:          "Empty filter",
+			expectedNames: []string{"VM Network", "k8s-prod", "k8s-test", "storage"},
+		},
+		{
+			name:          "Allow by name",
+			filter:        NetworkFilter{Allow: []string{"k8s-*"}},
+			expectedNames: []string{"k8s-prod", "k8s-test"},
+		},
+		{
+			name:          "Allow by relative path",
+			filter:        NetworkFilter{Allow: []string{"infra/*"}},
+			expectedNames: []string{"storage"},
+		},
+		{
+			name:          "Deny only",
+			filter:        NetworkFilter{Deny: []string{"VM Network", "infra/*"}},
+			expectedNames: []string{"k8s-prod", "k8s-test"},
+		},
+		{
+			name:          "Deny takes precedence over allow",
+			filter:        NetworkFilter{Allow: []string{"kubermatic/*"}, Deny: []string{"*-test"}},
+			expectedNames: []string{"k8s-prod"},
+		},
+		{
+			name:        "Malformed pattern",
+			filter:      NetworkFilter{Deny: []string{"k8s-["}},
+			expectedErr: ErrInvalidNetworkPattern,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.validate()
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			var names []string
+			for _, network := range filterNetworks(networks, tt.filter) {
+				names = append(names, network.Name)
+			}
+			if changes := diff.ObjectDiff(tt.expectedNames, names); changes != "" {
+				t.Errorf("Got networks differ from expected ones. Diff: %v", changes)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"crypto/tls"
+	"time"
+
+	"go.uber.org/zap"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	kubermaticlog "k8c.io/kubermatic/v2/pkg/log"
+)
+
+const (
+	defaultLoginTimeout  = 30 * time.Second
+	defaultLoginAttempts = 3
+	// defaultLocale makes vCenter report messages in English, regardless of the environment.
+	defaultLocale = "en_US"
+)
+
+// SessionOption configures how a vCenter session is established.
+type SessionOption func(*sessionOptions)
+
+type sessionOptions struct {
+	// pool, if set, hands out shared sessions instead of logging in on every call.
+	pool *SessionProvider
+	// keepAlive is the idle interval after which a keepalive request is sent to vCenter.
+	keepAlive time.Duration
+	// loginTimeout bounds the time it may take to establish a session.
+	loginTimeout time.Duration
+	// loginAttempts is the maximum number of login attempts if vCenter is temporarily unavailable.
+	loginAttempts int
+	// insecure skips the verification of the vCenter certificate, regardless of the datacenter setting.
+	insecure bool
+	// thumbprint, if set, pins the vCenter certificate instead of verifying it against the CA bundle.
+	thumbprint string
+	// metrics, if set, records the logins to vCenter.
+	metrics *Metrics
+	// datacenter, if set, overrides the datacenter of the datacenter spec.
+	datacenter string
+	// proxy, if set, is the URL of the proxy vCenter is connected through.
+	proxy string
+	// networkFilter restricts the networks returned by the network listings.
+	networkFilter NetworkFilter
+	// browseUser, if set, is the read-only user the inventory listings log in as.
+	browseUser *kubermaticv1.VSphereCredentials
+	// computeCluster, if set, restricts the network listings to the networks reachable from its hosts.
+	computeCluster string
+	// minTLSVersion is the minimum TLS version accepted from vCenter.
+	minTLSVersion uint16
+	// sessionToken, if set, is the cookie of an existing vCenter session which is used instead of logging in.
+	sessionToken string
+	// apiVersion, if set, pins the vim25 API version instead of negotiating it with vCenter.
+	apiVersion string
+	// soapTracer, if set, is called for every SOAP request sent to vCenter.
+	soapTracer SOAPTracer
+	// locale is the locale of the sessions, which determines the language of the messages of vCenter.
+	locale string
+	// log is the logger warnings about the session, e.g. skipped certificate verifications, are logged to.
+	log *zap.SugaredLogger
+}
+
+func newSessionOptions(opts []SessionOption) *sessionOptions {
+	options := &sessionOptions{
+		loginTimeout:  defaultLoginTimeout,
+		loginAttempts: defaultLoginAttempts,
+		minTLSVersion: tls.VersionTLS12,
+		locale:        defaultLocale,
+		log:           kubermaticlog.Logger,
+	}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// validate returns an error if options, which are only checked once a session is established,
+// are malformed. It allows to reject them at startup.
+func (o *sessionOptions) validate() error {
+	if err := validateMinTLSVersion(o.minTLSVersion); err != nil {
+		return err
+	}
+	if o.proxy != "" {
+		if _, err := parseProxy(o.proxy); err != nil {
+			return err
+		}
+	}
+	if o.thumbprint != "" {
+		if _, err := parseThumbprint(o.thumbprint); err != nil {
+			return err
+		}
+	}
+	if o.apiVersion != "" {
+		if err := validateAPIVersion(o.apiVersion); err != nil {
+			return err
+		}
+	}
+	return o.networkFilter.validate()
+}
+
+// WithSessionProvider makes the call reuse sessions from the given pool.
+func WithSessionProvider(pool *SessionProvider) SessionOption {
+	return func(o *sessionOptions) {
+		o.pool = pool
+	}
+}
+
+// WithKeepAlive sends a keepalive request to vCenter after the given interval
+// of inactivity, so sessions don't expire during long operations, e.g. the
+// cleanup of a cluster. Sessions of a SessionProvider use its keepalive
+// interval instead.
+func WithKeepAlive(idle time.Duration) SessionOption {
+	return func(o *sessionOptions) {
+		o.keepAlive = idle
+	}
+}
+
+// WithLoginTimeout sets the time after which establishing a session is given
+// up. It defaults to 30 seconds.
+func WithLoginTimeout(timeout time.Duration) SessionOption {
+	return func(o *sessionOptions) {
+		if timeout > 0 {
+			o.loginTimeout = timeout
+		}
+	}
+}
+
+// WithLoginAttempts sets how often a login is attempted if vCenter is
+// temporarily unavailable. Authentication failures are never retried. It
+// defaults to 3, all attempts share the login timeout.
+func WithLoginAttempts(attempts int) SessionOption {
+	return func(o *sessionOptions) {
+		if attempts > 0 {
+			o.loginAttempts = attempts
+		}
+	}
+}
+
+// WithThumbprint pins the vCenter server certificate by its SHA-1 or SHA-256
+// thumbprint. This is meant for self-signed certificates, for which no CA
+// bundle is available, and takes precedence over the CA bundle and
+// AllowInsecure.
+func WithThumbprint(thumbprint string) SessionOption {
+	return func(o *sessionOptions) {
+		o.thumbprint = thumbprint
+	}
+}
+
+// WithInsecure skips the verification of the vCenter certificate for this
+// call only, like AllowInsecure does for the whole datacenter. It is meant for
+// admins troubleshooting certificate issues and logs a warning when used.
+func WithInsecure() SessionOption {
+	return func(o *sessionOptions) {
+		o.insecure = true
+	}
+}
+
+// WithMetrics records the vCenter logins, and for the provider its
+// initialization and cleanup operations, in the given metrics.
+func WithMetrics(metrics *Metrics) SessionOption {
+	return func(o *sessionOptions) {
+		o.metrics = metrics
+	}
+}
+
+// WithDatacenter binds the session to the given datacenter of the vCenter
+// instead of the one configured in the datacenter spec. It is meant for
+// listing the inventory of other datacenters, see ListDatacenters, as
+// settings like the root path still refer to the configured datacenter.
+func WithDatacenter(datacenter string) SessionOption {
+	return func(o *sessionOptions) {
+		o.datacenter = datacenter
+	}
+}
+
+// WithProxy connects to vCenter through the given HTTP(S) or SOCKS5 proxy,
+// e.g. "http://proxy.example.com:3128" or "socks5://proxy.example.com:1080".
+// HTTPS endpoints are tunneled with CONNECT, so the vCenter certificate is
+// still verified end to end. Without this option, the proxy is taken from the
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+func WithProxy(proxy string) SessionOption {
+	return func(o *sessionOptions) {
+		o.proxy = proxy
+	}
+}
+
+// WithNetworkFilter restricts the networks returned by GetNetworks,
+// GetNetworksFiltered and GetInventory. It is meant to be configured per
+// datacenter, an empty filter returns all networks.
+func WithNetworkFilter(filter NetworkFilter) SessionOption {
+	return func(o *sessionOptions) {
+		o.networkFilter = filter
+	}
+}
+
+// WithBrowseUser sets a read-only user the inventory listings, e.g. GetNetworks
+// and GetDatastoreList, log in as instead of the infra management user or the
+// given user. Operations which provision or delete resources keep using the
+// privileged user. It is meant to be configured per datacenter.
+func WithBrowseUser(username, password string) SessionOption {
+	return func(o *sessionOptions) {
+		o.browseUser = &kubermaticv1.VSphereCredentials{Username: username, Password: password}
+	}
+}
+
+// WithComputeCluster restricts the networks returned by GetNetworks,
+// GetNetworksFiltered and GetInventory to the networks attached to every
+// host of the given compute cluster or standalone host, e.g. the cluster
+// of the datacenter spec, so only networks usable by the nodes are offered.
+func WithComputeCluster(cluster string) SessionOption {
+	return func(o *sessionOptions) {
+		o.computeCluster = cluster
+	}
+}
+
+// WithSessionToken reuses a vCenter session acquired outside of KKP, e.g. by
+// an SSO frontend, instead of logging in with a username and password. The
+// token is the value of the vmware_soap_session cookie and takes precedence
+// over all credentials, including the infra management user. The session is
+// owned by whoever acquired it, so it is neither pooled nor logged out. REST
+// sessions, e.g. for tagging, still log in with the credentials.
+func WithSessionToken(token string) SessionOption {
+	return func(o *sessionOptions) {
+		o.sessionToken = token
+	}
+}
+
+// WithMinTLSVersion sets the minimum TLS version accepted from vCenter, either
+// tls.VersionTLS12 or tls.VersionTLS13. It defaults to TLS 1.2.
+func WithMinTLSVersion(version uint16) SessionOption {
+	return func(o *sessionOptions) {
+		o.minTLSVersion = version
+	}
+}
+
+// WithAPIVersion pins the vim25 API version, e.g. "6.7", used to talk to
+// vCenter. By default the newest version supported by both vCenter and the
+// client is negotiated, which only needs to be overridden if vCenter reports
+// versions it does not accept.
+func WithAPIVersion(version string) SessionOption {
+	return func(o *sessionOptions) {
+		o.apiVersion = version
+	}
+}
+
+// WithLocale sets the locale of the sessions, e.g. "de_DE", which determines
+// the language of the messages, e.g. of faults, reported by vCenter. It
+// defaults to "en_US", so the messages don't depend on the environment.
+// Sessions resumed from a token keep their locale.
+func WithLocale(locale string) SessionOption {
+	return func(o *sessionOptions) {
+		if locale != "" {
+			o.locale = locale
+		}
+	}
+}
+
+// WithSessionLogger logs warnings about the sessions, e.g. skipped certificate
+// verifications, to the given logger instead of the global one. Providers pass
+// the logger given via WithLogger.
+func WithSessionLogger(log *zap.SugaredLogger) SessionOption {
+	return func(o *sessionOptions) {
+		if log != nil {
+			o.log = log
+		}
+	}
+}
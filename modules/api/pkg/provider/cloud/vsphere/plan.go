@@ -0,0 +1,187 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/vmware/govmomi/vapi/tags"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	kuberneteshelper "k8c.io/kubermatic/v2/pkg/kubernetes"
+)
+
+// InitializationPlan describes the resources InitializeCloudProvider creates for a cluster.
+// Resources the cluster already has are left empty.
+type InitializationPlan struct {
+	// Folder is the path of the VM folder of the cluster.
+	Folder string
+	// FolderExists is set if the folder already exists. Unless it is owned by the cluster, see
+	// checkFolderCollision, the initialization fails with a FolderCollisionError.
+	FolderExists bool
+
+	// TagCategory is the name of the tag category of the cluster.
+	TagCategory string
+	// TagCategoryExists is set if the tag category already exists. It would be adopted by
+	// the cluster and deleted along with it.
+	TagCategoryExists bool
+
+	// AntiAffinityTag is the name of the anti-affinity tag of the cluster, see WithAntiAffinityTag.
+	AntiAffinityTag string
+	// AntiAffinityTagExists is set if the tag already exists in the tag category.
+	AntiAffinityTagExists bool
+
+	// MetadataTags are the tags to attach to the VM folder of the cluster by their category, see WithMetadataTags.
+	MetadataTags map[string]string
+}
+
+// IsEmpty returns true if nothing needs to be created for the cluster.
+func (p *InitializationPlan) IsEmpty() bool {
+	return p.Folder == "" && p.TagCategory == "" && p.AntiAffinityTag == "" && len(p.MetadataTags) == 0
+}
+
+// PlanInitialization returns what InitializeCloudProvider would create for the cluster and
+// whether any of it collides with existing resources. Nothing is created and the cluster is
+// not updated.
+func (v *Provider) PlanInitialization(ctx context.Context, cluster *kubermaticv1.Cluster) (*InitializationPlan, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	plan, err := v.planInitialization(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if plan.IsEmpty() {
+		return plan, nil
+	}
+
+	username, password, err := GetCredentialsForCluster(cluster.Spec.Cloud, v.secretKeySelector, v.dc)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := v.newSession(ctx, v.logger(cluster), username, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	if plan.Folder != "" {
+		if _, err := session.Finder.Folder(ctx, plan.Folder); err == nil {
+			plan.FolderExists = true
+		} else if !isNotFound(err) {
+			return nil, fmt.Errorf("failed to get folder %q: %w", plan.Folder, err)
+		}
+	}
+
+	if plan.TagCategory != "" || plan.AntiAffinityTag != "" {
+		restSession, err := newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create REST client session: %w", err)
+		}
+		defer restSession.Logout(ctx)
+
+		if err := checkTagCollisions(ctx, tags.NewManager(restSession.Client), cluster, plan); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// planInitialization determines the resources InitializeCloudProvider needs to create for the cluster.
+// It is shared by InitializeCloudProvider and PlanInitialization and doesn't contact vCenter.
+func (v *Provider) planInitialization(cluster *kubermaticv1.Cluster) (*InitializationPlan, error) {
+	dc, err := v.clusterDatacenter(cluster)
+	if err != nil {
+		return nil, err
+	}
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cloud specs are only validated against the root path of the datacenter, as they don't tell the cluster.
+	if folder := cluster.Spec.Cloud.VSphere.Folder; folder != "" && v.clusterRootPaths {
+		if err := validateFolderPath(rootPath, folder); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &InitializationPlan{}
+	if cluster.Spec.Cloud.VSphere.Folder == "" {
+		// If the user did not specify a folder, we create a own folder for this cluster to improve
+		// the VM management in vCenter
+		plan.Folder = path.Join(rootPath, folderName(v.folderNameTemplate, cluster))
+	}
+	if cluster.Spec.Cloud.VSphere.TagCategoryID == "" && !v.disableTagCategoryCreation {
+		// If the user did not specify a tag category, we create an own default for this cluster
+		plan.TagCategory = categoryName(v.tagCategoryPrefix, cluster)
+	}
+	// The anti-affinity tag needs a category to live in.
+	hasTagCategory := cluster.Spec.Cloud.VSphere.TagCategoryID != "" || plan.TagCategory != ""
+	if v.antiAffinityTag && hasTagCategory && cluster.Annotations[AntiAffinityTagAnnotationKey] == "" {
+		plan.AntiAffinityTag = antiAffinityTagName(cluster)
+	}
+	// Only folders created by KKP are tagged, the tags are attached once.
+	createdFolder := plan.Folder != "" || kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer)
+	if v.metadataTags && createdFolder && !kuberneteshelper.HasFinalizer(cluster, metadataTagsCleanupFinalizer) {
+		if metadata := metadataTags(cluster); len(metadata) > 0 {
+			plan.MetadataTags = metadata
+		}
+	}
+
+	return plan, nil
+}
+
+// checkTagCollisions looks up the tag category and the anti-affinity tag of the plan in vCenter.
+func checkTagCollisions(ctx context.Context, tagManager *tags.Manager, cluster *kubermaticv1.Cluster, plan *InitializationPlan) error {
+	categoryID := cluster.Spec.Cloud.VSphere.TagCategoryID
+	if plan.TagCategory != "" {
+		categories, err := tagManager.GetCategories(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to get tag categories %w", err)
+		}
+		for _, category := range categories {
+			if category.Name == plan.TagCategory {
+				plan.TagCategoryExists = true
+				categoryID = category.ID
+				break
+			}
+		}
+	}
+
+	// A new category has no tags yet.
+	if plan.AntiAffinityTag == "" || categoryID == "" {
+		return nil
+	}
+
+	categoryTags, err := tagManager.GetTagsForCategory(ctx, categoryID)
+	if err != nil {
+		return fmt.Errorf("failed to get tags for category %q: %w", categoryID, err)
+	}
+	for _, tag := range categoryTags {
+		if tag.Name == plan.AntiAffinityTag {
+			plan.AntiAffinityTagExists = true
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/vmware/govmomi/vapi/tags"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPlanInitialization(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+	WithAntiAffinityTag()(v)
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+	tagManager := tags.NewManager(restSession.Client)
+
+	plan, err := v.PlanInitialization(ctx, cluster)
+	if err != nil {
+		t.Fatalf("failed to plan initialization: %v", err)
+	}
+	expected := InitializationPlan{
+		Folder:          "/DC0/vm/test",
+		TagCategory:     "clustertest",
+		AntiAffinityTag: "test-anti-affinity",
+	}
+	if changes := diff.ObjectDiff(expected, *plan); changes != "" {
+		t.Errorf("plan differs from the expected one:\n%v", changes)
+	}
+
+	// The dry-run must neither touch vCenter nor the cluster.
+	if _, err := session.Finder.Folder(ctx, plan.Folder); !isNotFound(err) {
+		t.Errorf("expected folder %q not to be created, got %v", plan.Folder, err)
+	}
+	categories, err := tagManager.GetCategories(ctx)
+	if err != nil {
+		t.Fatalf("failed to get tag categories: %v", err)
+	}
+	if len(categories) != 0 {
+		t.Errorf("expected no tag categories to be created, got %v", categories)
+	}
+	if len(cluster.Finalizers) != 0 || len(cluster.Annotations) != 0 || cluster.Spec.Cloud.VSphere.Folder != "" {
+		t.Errorf("expected the cluster to be left untouched, got %+v", cluster)
+	}
+
+	// Existing resources are reported as collisions.
+	if _, err := createVMFolder(ctx, session, plan.Folder); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	categoryID, err := createTagCategory(ctx, restSession, plan.TagCategory, cluster.Name)
+	if err != nil {
+		t.Fatalf("failed to create tag category: %v", err)
+	}
+	if _, err := createTag(ctx, tagManager, categoryID, plan.AntiAffinityTag); err != nil {
+		t.Fatalf("failed to create tag: %v", err)
+	}
+
+	plan, err = v.PlanInitialization(ctx, cluster)
+	if err != nil {
+		t.Fatalf("failed to plan initialization: %v", err)
+	}
+	if !plan.FolderExists || !plan.TagCategoryExists || !plan.AntiAffinityTagExists {
+		t.Errorf("expected all resources to collide, got %+v", *plan)
+	}
+
+	// The real initialization follows the plan, but refuses to adopt the folder.
+	if _, err := v.InitializeCloudProvider(ctx, cluster.DeepCopy(), testClusterUpdater(cluster.DeepCopy())); !errors.Is(err, ErrFolderAlreadyExists) {
+		t.Fatalf("expected the initialization to fail with %v, got %v", ErrFolderAlreadyExists, err)
+	}
+	if err := deleteVMFolder(ctx, session, nil, plan.Folder); err != nil {
+		t.Fatalf("failed to delete folder: %v", err)
+	}
+
+	cluster, err = v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if cluster.Spec.Cloud.VSphere.Folder != plan.Folder || cluster.Spec.Cloud.VSphere.TagCategoryID != categoryID {
+		t.Errorf("expected folder %q and tag category %q, got %+v", plan.Folder, categoryID, cluster.Spec.Cloud.VSphere)
+	}
+
+	plan, err = v.PlanInitialization(ctx, cluster)
+	if err != nil {
+		t.Fatalf("failed to plan initialization: %v", err)
+	}
+	if !plan.IsEmpty() {
+		t.Errorf("expected an empty plan for an initialized cluster, got %+v", *plan)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+const (
+	defaultSessionTTL       = 30 * time.Minute
+	defaultSessionKeepAlive = 5 * time.Minute
+)
+
+// SessionProvider hands out reusable vCenter sessions, so that frequently
+// called helpers like GetNetworks do not have to log in on every call.
+// Sessions are cached per endpoint, datacenter and user, kept alive in the
+// background and transparently recreated once they expired or got invalidated.
+// Sessions dropped from the pool are only logged out once all callers using
+// them logged them out.
+type SessionProvider struct {
+	ttl       time.Duration
+	keepAlive time.Duration
+
+	// lock guards the sessions and their users, it is never held during calls to vCenter.
+	lock     sync.Mutex
+	sessions map[sessionKey]*pooledSession
+}
+
+type sessionKey struct {
+	endpoint   string
+	datacenter string
+	username   string
+	// password is hashed, so rotated credentials never get a session for the old ones.
+	password [sha256.Size]byte
+	// insecure keeps sessions without certificate verification apart from regular ones.
+	insecure bool
+	// caBundle, thumbprint, proxy and minTLSVersion keep sessions established under different TLS and proxy
+	// policies apart, so a session is never handed out to callers asking for a stricter policy. CA bundles
+	// are compared by identity, callers are expected to load their bundle once.
+	caBundle      *x509.CertPool
+	thumbprint    string
+	proxy         string
+	minTLSVersion uint16
+	// apiVersion keeps sessions pinned to an API version apart from negotiated ones.
+	apiVersion string
+	locale     string
+}
+
+type pooledSession struct {
+	key     sessionKey
+	session *Session
+	expires time.Time
+	// users is the number of callers which got the session and did not log it out yet.
+	users int
+	// dropped is set once the session is removed from the pool, it is logged out as soon as it has no users.
+	dropped bool
+}
+
+// sessionLease is held by every session handed out by a SessionProvider.
+type sessionLease struct {
+	pool  *SessionProvider
+	entry *pooledSession
+	once  sync.Once
+}
+
+// release returns the session to the pool. Releasing a lease more than once has no effect.
+func (l *sessionLease) release(ctx context.Context) {
+	l.once.Do(func() {
+		l.pool.release(ctx, l.entry)
+	})
+}
+
+// NewSessionProvider returns a SessionProvider that keeps sessions for at most
+// ttl and sends a keepalive request after keepAlive of inactivity.
+// Zero values select the defaults.
+func NewSessionProvider(ttl, keepAlive time.Duration) *SessionProvider {
+	if ttl == 0 {
+		ttl = defaultSessionTTL
+	}
+	if keepAlive == 0 {
+		keepAlive = defaultSessionKeepAlive
+	}
+
+	return &SessionProvider{
+		ttl:       ttl,
+		keepAlive: keepAlive,
+		sessions:  map[sessionKey]*pooledSession{},
+	}
+}
+
+// Session returns a pooled session for the given datacenter and user. The
+// caller must log the returned session out once it is done with it, which
+// returns it to the pool. Every returned session has its own Finder, as
+// finders must not be shared between goroutines.
+func (p *SessionProvider) Session(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*Session, error) {
+	return p.session(ctx, dc, username, password, caBundle, newSessionOptions(opts))
+}
+
+func (p *SessionProvider) session(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, options *sessionOptions) (*Session, error) {
+	// Tracers cannot be compared and must never see the requests of other callers, traced sessions are
+	// therefore not pooled.
+	if options.soapTracer != nil {
+		loginOptions := *options
+		loginOptions.pool = nil
+		return login(ctx, dc, username, password, caBundle, &loginOptions)
+	}
+
+	// login will pick the InfraManagementUser if set, so the key must reflect that.
+	if dc.InfraManagementUser != nil {
+		username, password = dc.InfraManagementUser.Username, dc.InfraManagementUser.Password
+	}
+
+	key := sessionKey{
+		endpoint:      dc.Endpoint,
+		datacenter:    dc.Datacenter,
+		username:      username,
+		password:      sha256.Sum256([]byte(password)),
+		insecure:      dc.AllowInsecure || options.insecure,
+		caBundle:      caBundle,
+		thumbprint:    options.thumbprint,
+		proxy:         options.proxy,
+		minTLSVersion: options.minTLSVersion,
+		apiVersion:    options.apiVersion,
+		locale:        options.locale,
+	}
+
+	if cached := p.acquire(ctx, key); cached != nil {
+		if cached.session.IsValid(ctx) {
+			return p.lease(cached), nil
+		}
+
+		p.drop(cached)
+		p.release(ctx, cached)
+	}
+
+	loginOptions := *options
+	loginOptions.pool = nil
+	loginOptions.keepAlive = p.keepAlive
+
+	session, err := login(ctx, dc, username, password, caBundle, &loginOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &pooledSession{
+		key:     key,
+		session: session,
+		expires: time.Now().Add(p.ttl),
+		users:   1,
+	}
+
+	// Another caller might have pooled a session for the same key meanwhile, it is replaced.
+	p.lock.Lock()
+	var replaced *pooledSession
+	if existing, ok := p.sessions[key]; ok && p.dropLocked(existing) {
+		replaced = existing
+	}
+	p.sessions[key] = entry
+	p.lock.Unlock()
+
+	if replaced != nil {
+		replaced.session.logout(ctx)
+	}
+
+	return p.lease(entry), nil
+}
+
+// acquire returns the pooled session for the key and registers the caller as its user, or nil if there
+// is none. Expired sessions are dropped.
+func (p *SessionProvider) acquire(ctx context.Context, key sessionKey) *pooledSession {
+	p.lock.Lock()
+	cached, ok := p.sessions[key]
+	if !ok {
+		p.lock.Unlock()
+		return nil
+	}
+	if time.Now().After(cached.expires) {
+		logout := p.dropLocked(cached)
+		p.lock.Unlock()
+		if logout {
+			cached.session.logout(ctx)
+		}
+		return nil
+	}
+	cached.users++
+	p.lock.Unlock()
+
+	return cached
+}
+
+// lease returns a session for a user of the pooled session, which has its own Finder.
+func (p *SessionProvider) lease(entry *pooledSession) *Session {
+	return &Session{
+		Client:     entry.session.Client,
+		Finder:     newFinder(entry.session.Client, entry.session.Datacenter),
+		Datacenter: entry.session.Datacenter,
+		lease:      &sessionLease{pool: p, entry: entry},
+	}
+}
+
+// release unregisters a user of the pooled session and logs the session out, if it was dropped from the
+// pool and this was its last user.
+func (p *SessionProvider) release(ctx context.Context, entry *pooledSession) {
+	p.lock.Lock()
+	entry.users--
+	logout := entry.dropped && entry.users == 0
+	p.lock.Unlock()
+
+	if logout {
+		entry.session.logout(ctx)
+	}
+}
+
+// drop removes the session from the pool, so it is logged out once its last user released it.
+func (p *SessionProvider) drop(entry *pooledSession) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.dropLocked(entry)
+}
+
+// dropLocked removes the session from the pool and returns true if it is not used by anyone, in which
+// case the caller must log it out. The caller must hold the lock.
+func (p *SessionProvider) dropLocked(entry *pooledSession) bool {
+	if p.sessions[entry.key] == entry {
+		delete(p.sessions, entry.key)
+	}
+	if entry.dropped {
+		return false
+	}
+	entry.dropped = true
+
+	return entry.users == 0
+}
+
+// discard drops the session from the pool, e.g. because vCenter reported it to be no longer authenticated,
+// so the next call establishes a new session. The session is logged out once all its users, including the
+// caller, logged it out. Only the removal happens under the lock, the logout never does, so a slow vCenter
+// doesn't block the other users of the pool.
+func (p *SessionProvider) discard(session *Session) {
+	if session.lease == nil {
+		return
+	}
+	p.drop(session.lease.entry)
+}
+
+// Close drops all pooled sessions. Sessions which are not in use are logged out right away, the others as
+// soon as their users log them out. The SessionProvider can still be used afterwards and will establish new
+// sessions on demand.
+func (p *SessionProvider) Close(ctx context.Context) {
+	p.closeSessions(ctx, func(sessionKey) bool {
+		return true
+	})
+}
+
+// closeSessions drops the pooled sessions whose key matches, like Close.
+func (p *SessionProvider) closeSessions(ctx context.Context, matches func(sessionKey) bool) {
+	var unused []*Session
+
+	p.lock.Lock()
+	for key, cached := range p.sessions {
+		if matches(key) && p.dropLocked(cached) {
+			unused = append(unused, cached.session)
+		}
+	}
+	p.lock.Unlock()
+
+	for _, session := range unused {
+		session.logout(ctx)
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"go.uber.org/goleak"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestSessionProvider(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	first, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool))
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+
+	// Logout must return pooled sessions to the pool instead of logging them out.
+	first.Logout(ctx)
+
+	second, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool))
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	if first.Client != second.Client {
+		t.Fatal("expected the pooled session to be reused")
+	}
+	if first.Finder == second.Finder {
+		t.Fatal("expected every user of the pooled session to get its own finder")
+	}
+	if !second.IsValid(ctx) {
+		t.Fatal("expected the pooled session to be active")
+	}
+
+	// Invalidate the session behind the pool's back, the next call must log in again.
+	second.logout(ctx)
+	second.Logout(ctx)
+
+	third, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool))
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	if third.Client == second.Client {
+		t.Fatal("expected a stale session to be replaced")
+	}
+	if !third.IsValid(ctx) {
+		t.Fatal("expected the recreated session to be active")
+	}
+
+	// Sessions in use are only logged out once their users are done with them.
+	pool.Close(ctx)
+	if !third.IsValid(ctx) {
+		t.Fatal("expected Close to keep sessions in use")
+	}
+	third.Logout(ctx)
+	if third.IsValid(ctx) {
+		t.Fatal("expected Close to log out pooled sessions")
+	}
+}
+
+func TestSessionProviderDiscard(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	first, err := pool.Session(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	second, err := pool.Session(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+
+	// Discarding the session must not log it out while another caller still uses it.
+	pool.discard(first)
+	first.Logout(ctx)
+	if !second.IsValid(ctx) {
+		t.Fatal("expected the discarded session to stay active while it is in use")
+	}
+
+	third, err := pool.Session(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	defer third.Logout(ctx)
+	if third.Client == second.Client {
+		t.Fatal("expected the discarded session to be replaced")
+	}
+
+	second.Logout(ctx)
+	if second.IsValid(ctx) {
+		t.Fatal("expected the discarded session to be logged out once it is no longer used")
+	}
+}
+
+func TestSessionProviderDiscardLogout(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	// A proxy holds the logout of the discarded session.
+	logoutHeld := make(chan struct{})
+	releaseLogout := make(chan struct{})
+	var holdOnce sync.Once
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: sim.server.URL.Scheme, Host: sim.server.URL.Host})
+	vcenter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if bytes.Contains(body, []byte("<Logout ")) {
+			holdOnce.Do(func() { close(logoutHeld) })
+			<-releaseLogout
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer vcenter.Close()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.Endpoint = vcenter.URL
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	discarded, err := pool.Session(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	pool.discard(discarded)
+
+	// The discarded session is logged out by its last user, without blocking the pool meanwhile.
+	loggedOut := make(chan struct{})
+	go func() {
+		defer close(loggedOut)
+		discarded.Logout(ctx)
+	}()
+	<-logoutHeld
+
+	sessions := make(chan *Session, 1)
+	go func() {
+		session, err := pool.Session(ctx, dc, "", "", nil)
+		if err != nil {
+			t.Errorf("failed to get pooled session: %v", err)
+		}
+		sessions <- session
+	}()
+	var replacement *Session
+	select {
+	case replacement = <-sessions:
+		close(releaseLogout)
+	case <-time.After(10 * time.Second):
+		t.Error("expected the pool not to be blocked by the logout of the discarded session")
+		close(releaseLogout)
+		replacement = <-sessions
+	}
+	<-loggedOut
+
+	if replacement == nil {
+		return
+	}
+	defer replacement.Logout(ctx)
+	if replacement.Client == discarded.Client {
+		t.Error("expected the discarded session to be replaced")
+	}
+	if !replacement.IsValid(ctx) {
+		t.Error("expected the replacement to be valid")
+	}
+}
+
+func TestSessionProviderExpiry(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Nanosecond, time.Minute)
+	defer pool.Close(ctx)
+
+	first, err := pool.Session(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+
+	second, err := pool.Session(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	defer second.Logout(ctx)
+	if first.Client == second.Client {
+		t.Fatal("expected an expired session to be replaced")
+	}
+
+	first.Logout(ctx)
+	if first.IsValid(ctx) {
+		t.Fatal("expected the expired session to be logged out")
+	}
+}
+
+func TestProviderClose(t *testing.T) {
+	// Closing the pool must stop the keepalive goroutines of its sessions, which stop asynchronously.
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	model := simulator.VPX()
+	model.Datacenter = 2
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.RootPath = "/DC0/vm"
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	v, err := NewCloudProvider(&kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: dc}}, nil, nil,
+		WithSessionOptions(WithSessionProvider(pool)),
+		WithFolderCache(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	// The pool is shared with another datacenter, whose session must outlive the provider.
+	otherDC := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(otherDC)
+	otherDC.Datacenter = "DC1"
+	other, err := pool.Session(ctx, otherDC, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	other.Logout(ctx)
+
+	if _, err := v.GetVMFolders(ctx, "", ""); err != nil {
+		t.Fatalf("failed to list folders: %v", err)
+	}
+	if len(pool.sessions) != 2 || len(v.folderCache.entries) == 0 {
+		t.Fatal("expected the provider to pool its session and cache the folders")
+	}
+
+	// Closing is idempotent.
+	for i := 0; i < 2; i++ {
+		if err := v.Close(ctx); err != nil {
+			t.Fatalf("failed to close provider: %v", err)
+		}
+	}
+
+	if len(pool.sessions) != 1 {
+		t.Errorf("expected only the session of the provider to be logged out, got %d sessions", len(pool.sessions))
+	}
+	for key := range pool.sessions {
+		if key.datacenter != otherDC.Datacenter {
+			t.Errorf("expected the session of datacenter %q to be kept, got %q", otherDC.Datacenter, key.datacenter)
+		}
+	}
+	if !other.IsValid(ctx) {
+		t.Error("expected the session of the other datacenter to stay active")
+	}
+	if len(v.folderCache.entries) != 0 {
+		t.Errorf("expected the folder cache to be cleared, got %d entries", len(v.folderCache.entries))
+	}
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// ProbeEndpoint checks that the vCenter endpoint of the datacenter is reachable, without logging in.
+// It performs the TLS handshake and fetches the service content of the SDK, so network problems can be
+// told apart from rejected credentials. Failures are reported as EndpointDNSError, EndpointTLSError or
+// EndpointHTTPError, or as TimeoutError if vCenter didn't answer within the login timeout.
+func ProbeEndpoint(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, caBundle *x509.CertPool, opts ...SessionOption) error {
+	options := newSessionOptions(opts)
+
+	soapClient, err := newSOAPClient(dc, caBundle, options)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, options.loginTimeout)
+	defer cancel()
+
+	req := types.RetrieveServiceContent{
+		This: types.ManagedObjectReference{Type: "ServiceInstance", Value: "ServiceInstance"},
+	}
+	if _, err := methods.RetrieveServiceContent(ctx, soapClient, &req); err != nil {
+		return asTimeoutError(ctx, dc.Endpoint, options.loginTimeout, probeError(soapClient.URL().Hostname(), dc.Endpoint, err))
+	}
+
+	return nil
+}
+
+// probeError wraps err into the error type matching the stage of the probe which failed.
+func probeError(host, endpoint string, err error) error {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return &EndpointDNSError{Host: host, Err: err}
+	}
+	if isTLSError(err) {
+		return &EndpointTLSError{Endpoint: endpoint, Err: err}
+	}
+	if code, ok := httpStatusCode(err); ok {
+		return &EndpointHTTPError{Endpoint: endpoint, StatusCode: code, Err: err}
+	}
+
+	return fmt.Errorf("failed to connect to vCenter %q: %w", endpoint, err)
+}
+
+// isTLSError returns true if err was caused by a failed TLS handshake.
+func isTLSError(err error) bool {
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		hostnameErr         x509.HostnameError
+		invalidCertErr      x509.CertificateInvalidError
+		recordHeaderErr     tls.RecordHeaderError
+	)
+
+	return errors.Is(err, ErrThumbprintMismatch) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidCertErr) ||
+		errors.As(err, &recordHeaderErr)
+}
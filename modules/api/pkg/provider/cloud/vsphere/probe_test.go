@@ -0,0 +1,123 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestProbeEndpoint(t *testing.T) {
+	sim := newTLSSimulator(t)
+	defer sim.tearDown()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(sim.server.Certificate())
+
+	// notSDK is a TLS endpoint, but no vCenter.
+	notSDK := httptest.NewTLSServer(http.NotFoundHandler())
+	defer notSDK.Close()
+	notSDKPool := x509.NewCertPool()
+	notSDKPool.AddCert(notSDK.Certificate())
+
+	tests := []struct {
+		name     string
+		endpoint string
+		caBundle *x509.CertPool
+		opts     []SessionOption
+		checkErr func(t *testing.T, err error)
+	}{
+		{
+			name:     "Reachable",
+			endpoint: sim.server.URL.String(),
+			caBundle: pool,
+			checkErr: func(t *testing.T, err error) {
+				if err != nil {
+					t.Errorf("expected the endpoint to be reachable, got %v", err)
+				}
+			},
+		},
+		{
+			name:     "Self-signed certificate",
+			endpoint: sim.server.URL.String(),
+			caBundle: x509.NewCertPool(),
+			checkErr: func(t *testing.T, err error) {
+				var tlsErr *EndpointTLSError
+				if !errors.As(err, &tlsErr) {
+					t.Fatalf("expected a TLS error, got %v", err)
+				}
+				var unknownAuthorityErr x509.UnknownAuthorityError
+				if !errors.As(err, &unknownAuthorityErr) {
+					t.Errorf("expected the certificate to be signed by an unknown authority, got %v", err)
+				}
+			},
+		},
+		{
+			name:     "Thumbprint mismatch",
+			endpoint: sim.server.URL.String(),
+			opts:     []SessionOption{WithThumbprint(strings.Repeat("00:", 19) + "00")},
+			checkErr: func(t *testing.T, err error) {
+				var tlsErr *EndpointTLSError
+				if !errors.As(err, &tlsErr) || !errors.Is(err, ErrThumbprintMismatch) {
+					t.Errorf("expected a TLS error caused by %v, got %v", ErrThumbprintMismatch, err)
+				}
+			},
+		},
+		{
+			name:     "No SDK",
+			endpoint: notSDK.URL,
+			caBundle: notSDKPool,
+			checkErr: func(t *testing.T, err error) {
+				var httpErr *EndpointHTTPError
+				if !errors.As(err, &httpErr) {
+					t.Fatalf("expected an HTTP error, got %v", err)
+				}
+				if httpErr.StatusCode != http.StatusNotFound {
+					t.Errorf("expected HTTP status %d, got %d", http.StatusNotFound, httpErr.StatusCode)
+				}
+			},
+		},
+		{
+			name:     "Unknown host",
+			endpoint: "https://vcenter.invalid",
+			opts:     []SessionOption{WithLoginTimeout(5 * time.Second)},
+			checkErr: func(t *testing.T, err error) {
+				var dnsErr *EndpointDNSError
+				if !errors.As(err, &dnsErr) {
+					t.Fatalf("expected a DNS error, got %v", err)
+				}
+				if dnsErr.Host != "vcenter.invalid" {
+					t.Errorf("expected host %q, got %q", "vcenter.invalid", dnsErr.Host)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{Endpoint: tt.endpoint}
+			tt.checkErr(t, ProbeEndpoint(context.Background(), dc, tt.caBundle, tt.opts...))
+		})
+	}
+}
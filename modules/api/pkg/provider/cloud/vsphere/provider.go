@@ -21,358 +21,2062 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"sync"
+	"time"
 
+	providerconfig "github.com/kubermatic/machine-controller/pkg/providerconfig/types"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
 	"github.com/vmware/govmomi/object"
 	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vapi/tags"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 
 	"k8c.io/dashboard/v2/pkg/provider"
 	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
 	kuberneteshelper "k8c.io/kubermatic/v2/pkg/kubernetes"
+	kubermaticlog "k8c.io/kubermatic/v2/pkg/log"
 	"k8c.io/kubermatic/v2/pkg/resources"
 
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	kruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const (
 	folderCleanupFinalizer = "kubermatic.k8c.io/cleanup-vsphere-folder"
 	// categoryCleanupFinilizer will instruct the deletion of the default category tag.
 	tagCategoryCleanupFinilizer = "kubermatic.k8c.io/cleanup-vsphere-tag-category"
+	// antiAffinityTagCleanupFinalizer will instruct the deletion of the anti-affinity tag.
+	antiAffinityTagCleanupFinalizer = "kubermatic.k8c.io/cleanup-vsphere-anti-affinity-tag"
+	// metadataTagsCleanupFinalizer will instruct the detachment of the metadata tags from the cluster folder.
+	metadataTagsCleanupFinalizer = "kubermatic.k8c.io/cleanup-vsphere-metadata-tags"
+	// tagCategoryIDAnnotationKey holds the ID of the tag category created for the cluster. Users may change the
+	// tag category of the spec, so the category is only deleted if its ID matches.
+	tagCategoryIDAnnotationKey = "kubermatic.k8c.io/vsphere-tag-category-id"
+	// folderRefAnnotationKey holds the managed object reference of the folder created for the cluster,
+	// which stays the same if the folder gets renamed in vCenter.
+	folderRefAnnotationKey = "kubermatic.k8c.io/vsphere-folder-ref"
 
 	defaultCategory = "cluster"
+
+	// logoutTimeout bounds the logout, which is done independently of the caller's context.
+	logoutTimeout = 10 * time.Second
+
+	// AntiAffinityTagAnnotationKey holds the ID of the tag which DRS anti-affinity rules use to
+	// spread the node VMs of the cluster across hosts. It is only set if the provider was created
+	// with WithAntiAffinityTag.
+	AntiAffinityTagAnnotationKey = "kubermatic.k8c.io/vsphere-anti-affinity-tag-id"
+
+	// RootPathAnnotationKey overrides the root path of the datacenter for a single cluster, e.g. to group the
+	// folders of the clusters of a project. Users may edit the annotation, so the override must be located in
+	// the folder named after the ID of the cluster's project below the root path of the datacenter, i.e.
+	// "<root path>/<project ID>". It must be set before the cluster folder is created and is only respected if
+	// the provider was created with WithClusterRootPaths.
+	RootPathAnnotationKey = "kubermatic.k8c.io/vsphere-root-path"
+
+	// CSIUsername and CSIPassword are the keys of the optional, usually lower-privileged
+	// user in the cluster credentials secret, used for the CSI driver and cloud-controller-manager.
+	CSIUsername = "csiUsername"
+	CSIPassword = "csiPassword"
 )
 
+// defaultCleanupBackoff retries transient vCenter errors during cleanup for roughly 7 seconds.
+var defaultCleanupBackoff = wait.Backoff{
+	Steps:    4,
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+}
+
+// loginBackoff spaces out login attempts if vCenter is temporarily unavailable.
+// The number of steps is taken from the session options.
+var loginBackoff = wait.Backoff{
+	Duration: 500 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.5,
+	Cap:      5 * time.Second,
+}
+
 // Provider represents the vsphere provider.
 type Provider struct {
 	dc                *kubermaticv1.DatacenterSpecVSphere
 	secretKeySelector provider.SecretKeySelectorValueFunc
 	caBundle          *x509.CertPool
+	sessionOptions    []SessionOption
+	cleanupBackoff    *wait.Backoff
+	// allowFolderRelocation permits changing the folder of existing clusters.
+	allowFolderRelocation bool
+	// tagCategoryPrefix is prepended to the cluster name to name the tag category of the cluster.
+	tagCategoryPrefix string
+	// defaultResourcePool is set for clusters which don't specify a resource pool.
+	defaultResourcePool string
+	// antiAffinityTag enables the creation of an anti-affinity tag per cluster.
+	antiAffinityTag bool
+	// disableTagCategoryCreation skips the creation of tag categories for clusters.
+	disableTagCategoryCreation bool
+	// folderNameTemplate is the template for the names of the folders created for clusters.
+	folderNameTemplate string
+	// sessionTimeout, if set, bounds how long a call of the provider may take, including the login.
+	sessionTimeout time.Duration
+	log            *zap.SugaredLogger
+	// infraManagementUserRef, if set, references the secret holding the infra management user of the datacenter.
+	infraManagementUserRef *providerconfig.GlobalSecretKeySelector
+	// folderCache, if set, caches the folder listings of GetVMFolders.
+	folderCache *folderCache
+	// clusterRootPaths permits clusters to override the root path via the RootPathAnnotationKey annotation.
+	clusterRootPaths bool
+	// metadataTags enables tagging the cluster folders with the project, owner and name of their clusters.
+	metadataTags bool
+	// enforceTLS forbids connections to vCenter which don't verify its certificate.
+	enforceTLS bool
 }
 
 // Folder represents a vsphere folder.
 type Folder struct {
 	Path string
+	// ChildCount is the number of direct children of the folder, i.e. its subfolders, VMs and vApps.
+	// It is nil if the children could not be counted.
+	ChildCount *int
+}
+
+// Option configures optional behaviour of the Provider.
+type Option func(*Provider)
+
+// WithSessionOptions sets the options used for every vCenter session the
+// provider establishes, e.g. to share sessions via a SessionProvider.
+func WithSessionOptions(opts ...SessionOption) Option {
+	return func(p *Provider) {
+		p.sessionOptions = append(p.sessionOptions, opts...)
+	}
+}
+
+// WithCleanupBackoff sets the backoff used to retry the deletion of vSphere
+// resources in CleanUpCloudProvider.
+func WithCleanupBackoff(backoff wait.Backoff) Option {
+	return func(p *Provider) {
+		p.cleanupBackoff = &backoff
+	}
+}
+
+// WithFolderRelocation permits changing the folder of existing clusters to the
+// location of their folder in ValidateClusterUpdate. The folder itself is moved
+// by RelocateClusterFolder.
+func WithFolderRelocation() Option {
+	return func(p *Provider) {
+		p.allowFolderRelocation = true
+	}
+}
+
+// WithDefaultTagCategory sets the prefix of the tag categories created for
+// clusters of the datacenter, the cluster name is appended to it. It defaults
+// to "cluster".
+func WithDefaultTagCategory(prefix string) Option {
+	return func(p *Provider) {
+		p.tagCategoryPrefix = prefix
+	}
+}
+
+// WithDefaultResourcePool sets the resource pool used for clusters which don't
+// specify one. Like the default datastore, it is validated by ValidateCloudSpec
+// even for clusters which specify their own resource pool.
+func WithDefaultResourcePool(resourcePool string) Option {
+	return func(p *Provider) {
+		p.defaultResourcePool = resourcePool
+	}
+}
+
+// WithoutTagCategoryCreation skips the creation of a tag category for clusters
+// which don't specify one, so datacenters not using tags need neither the REST
+// API nor the tagging privileges. Categories created before are still deleted
+// along with their clusters. Without category, no anti-affinity tag is created
+// either.
+func WithoutTagCategoryCreation() Option {
+	return func(p *Provider) {
+		p.disableTagCategoryCreation = true
+	}
+}
+
+// WithAntiAffinityTag creates a tag for every cluster in its tag category, which
+// is meant to be attached to the node VMs and referenced by DRS anti-affinity
+// rules. Its ID is stored in the AntiAffinityTagAnnotationKey annotation.
+func WithAntiAffinityTag() Option {
+	return func(p *Provider) {
+		p.antiAffinityTag = true
+	}
+}
+
+// WithMetadataTags tags the folders created for clusters with the ID of their
+// project, the email of their owner and their name, e.g. for cost allocation.
+// The tags live in the MetadataTagCategoryProject, MetadataTagCategoryOwner and
+// MetadataTagCategoryCluster categories, which are shared by all clusters.
+// Metadata not known for a cluster is not tagged.
+func WithMetadataTags() Option {
+	return func(p *Provider) {
+		p.metadataTags = true
+	}
+}
+
+// WithFolderNameTemplate sets the Go template for the names of the folders
+// created for clusters, which defaults to the cluster name. The template is
+// rendered with FolderNameData, e.g. "{{ .ProjectID }}-{{ .HumanReadableName }}-{{ .Name }}",
+// and must contain the cluster name to keep the folder names unique. Characters
+// other than letters, digits, dots, dashes and underscores are replaced by
+// dashes. Folders named by a template are never pruned by PruneOrphanedFolders.
+// ReconcileCluster renames the folders if their rendered names change.
+func WithFolderNameTemplate(tmpl string) Option {
+	return func(p *Provider) {
+		p.folderNameTemplate = tmpl
+	}
+}
+
+// WithLogger sets the logger for the lifecycle events of clusters, e.g. the
+// creation and deletion of their folders and tags. It defaults to the global
+// logger.
+func WithLogger(log *zap.SugaredLogger) Option {
+	return func(p *Provider) {
+		p.log = log
+	}
+}
+
+// WithSessionTimeout bounds how long every call of the provider may interact
+// with vCenter, including the login, so an unresponsive vCenter cannot block
+// the reconciliation of clusters. The login itself is additionally bounded by
+// the login timeout of the session options. Calls are not bounded by default.
+func WithSessionTimeout(timeout time.Duration) Option {
+	return func(p *Provider) {
+		p.sessionTimeout = timeout
+	}
+}
+
+// WithInfraManagementUserReference reads the infra management user of the
+// datacenter from the referenced secret instead of the Datacenter, see
+// ResolveInfraManagementUser.
+func WithInfraManagementUserReference(ref *providerconfig.GlobalSecretKeySelector) Option {
+	return func(p *Provider) {
+		p.infraManagementUserRef = ref
+	}
+}
+
+// WithFolderCache caches the folder listings of Provider.GetVMFolders for the
+// given time. The cache belongs to the provider and is invalidated whenever the
+// provider creates, moves or deletes a folder, changes made in vCenter directly
+// show up once the listing expired.
+func WithFolderCache(ttl time.Duration) Option {
+	return func(p *Provider) {
+		if ttl > 0 {
+			p.folderCache = newFolderCache(ttl)
+		}
+	}
+}
+
+// WithClusterRootPaths permits clusters to override the root path of the
+// datacenter via the RootPathAnnotationKey annotation. The root paths of
+// clusters are located below the root path of the datacenter, so cloud specs,
+// which don't tell the cluster, are validated against the root path of the
+// datacenter, and InitializeCloudProvider checks the folder of the cluster
+// against its own root path.
+func WithClusterRootPaths() Option {
+	return func(p *Provider) {
+		p.clusterRootPaths = true
+	}
+}
+
+// WithEnforceTLS forbids connecting to vCenter without verifying its
+// certificate, overriding AllowInsecure of the datacenter as well as
+// WithInsecure. Clusters of such a datacenter are rejected by DefaultCloudSpec
+// and ValidateCloudSpec with ErrInsecureConnection instead of silently
+// connecting insecurely, and no sessions are established for them.
+func WithEnforceTLS() Option {
+	return func(p *Provider) {
+		p.enforceTLS = true
+	}
 }
 
 // NewCloudProvider creates a new vSphere provider.
-func NewCloudProvider(dc *kubermaticv1.Datacenter, secretKeyGetter provider.SecretKeySelectorValueFunc, caBundle *x509.CertPool) (*Provider, error) {
+func NewCloudProvider(dc *kubermaticv1.Datacenter, secretKeyGetter provider.SecretKeySelectorValueFunc, caBundle *x509.CertPool, opts ...Option) (*Provider, error) {
 	if dc.Spec.VSphere == nil {
 		return nil, errors.New("datacenter is not a vSphere datacenter")
 	}
-	return &Provider{
+	p := &Provider{
 		dc:                dc.Spec.VSphere,
 		secretKeySelector: secretKeyGetter,
 		caBundle:          caBundle,
-	}, nil
+		log:               kubermaticlog.Logger,
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	// Loggers passed explicitly via WithSessionOptions take precedence.
+	p.sessionOptions = append([]SessionOption{WithSessionLogger(p.log)}, p.sessionOptions...)
+	if err := validateFolderNameTemplate(p.folderNameTemplate); err != nil {
+		return nil, err
+	}
+	if p.infraManagementUserRef != nil {
+		infraDC, err := ResolveInfraManagementUser(p.dc, p.infraManagementUserRef, secretKeyGetter)
+		if err != nil {
+			return nil, err
+		}
+		p.dc = infraDC
+	}
+	if err := newSessionOptions(p.sessionOptions).validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
-var _ provider.CloudProvider = &Provider{}
+var _ provider.ReconcilingCloudProvider = &Provider{}
+var _ provider.ClusterUpdateValidatingCloudProvider = &Provider{}
+
+// Close releases the resources held by the provider, it is meant to be called once the datacenter is removed or
+// the process shuts down. It logs out the sessions of its datacenter pooled by the SessionProvider given via
+// WithSessionOptions, which also stops their keepalive goroutines, and clears the folder cache. Sessions of other
+// datacenters sharing the SessionProvider are kept. Close can be called multiple times and the provider remains
+// usable afterwards.
+func (v *Provider) Close(ctx context.Context) error {
+	// The pool may be shared with providers of other datacenters, whose sessions must be kept.
+	if pool := newSessionOptions(v.sessionOptions).pool; pool != nil {
+		pool.closeSessions(ctx, func(key sessionKey) bool {
+			return key.endpoint == v.dc.Endpoint && key.datacenter == v.dc.Datacenter
+		})
+	}
+	v.InvalidateFolderCache()
+
+	return nil
+}
 
 type Session struct {
 	Client     *govmomi.Client
 	Finder     *find.Finder
 	Datacenter *object.Datacenter
+
+	// lease is set for sessions handed out by a SessionProvider, which takes
+	// care of logging them out once they are no longer used.
+	lease *sessionLease
+	// external is set for sessions resumed from a session token, they are
+	// owned by whoever acquired the token.
+	external bool
+}
+
+// Logout closes the idling vCenter connections.
+// Sessions handed out by a SessionProvider are returned to it instead, as they are shared,
+// and sessions resumed from a session token are left untouched.
+// The logout is attempted even if ctx is already done, e.g. because the request got
+// cancelled, so the session is not leaked on vCenter.
+func (s *Session) Logout(ctx context.Context) {
+	if s.lease != nil {
+		s.lease.release(ctx)
+		return
+	}
+	if s.external {
+		return
+	}
+	s.logout(ctx)
+}
+
+// withOwnFinder returns a copy of the session with its own finder, for use by another goroutine. The copy
+// shares the vCenter session, which stays owned by the original session, so the copy must not be logged out.
+func (s *Session) withOwnFinder() *Session {
+	return &Session{
+		Client:     s.Client,
+		Finder:     newFinder(s.Client, s.Datacenter),
+		Datacenter: s.Datacenter,
+		external:   true,
+	}
+}
+
+func (s *Session) logout(_ context.Context) {
+	ctx, cancel := context.WithTimeout(context.Background(), logoutTimeout)
+	defer cancel()
+
+	if err := s.Client.Logout(ctx); err != nil {
+		kruntime.HandleError(fmt.Errorf("vSphere client failed to logout: %w", err))
+	}
+}
+
+// IsValid returns true if the session is still authenticated against vCenter.
+// It is a cheap check to decide whether a long-lived session can be reused.
+func (s *Session) IsValid(ctx context.Context) bool {
+	userSession, err := s.Client.SessionManager.UserSession(ctx)
+	return err == nil && userSession != nil
+}
+
+// Keepalive pings vCenter every interval, so the session does not expire while idling.
+// It blocks until ctx is done or the session turned invalid and is meant to be run in a goroutine.
+func (s *Session) Keepalive(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if !s.IsValid(ctx) {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				return ErrSessionInvalid
+			}
+		}
+	}
+}
+
+// browseCredentials returns the datacenter spec and credentials the inventory listings log in with. The browse
+// user configured via WithBrowseUser takes precedence over the infra management user, which in turn takes
+// precedence over the given user.
+func browseCredentials(dc *kubermaticv1.DatacenterSpecVSphere, username, password string, options *sessionOptions) (*kubermaticv1.DatacenterSpecVSphere, string, string) {
+	if options.browseUser == nil {
+		return dc, username, password
+	}
+
+	// The login picks the InfraManagementUser if set, so it must not be part of the spec.
+	dc = dc.DeepCopy()
+	dc.InfraManagementUser = nil
+
+	return dc, options.browseUser.Username, options.browseUser.Password
+}
+
+// newBrowseSession creates a session for listing the inventory of the datacenter, see WithBrowseUser.
+func newBrowseSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*Session, error) {
+	dc, username, password = browseCredentials(dc, username, password, newSessionOptions(opts))
+	return newSession(ctx, dc, username, password, caBundle, opts...)
+}
+
+// withBrowseSession calls fn with a browse session, see newBrowseSession. Sessions may expire on vCenter while
+// idling, which a pooled session can still pass its validity check right before. If fn fails, because the session
+// is no longer authenticated, the session is re-established and fn retried once. Sessions resumed from a session
+// token cannot be re-established, so their errors are returned as is.
+func withBrowseSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts []SessionOption, fn func(*Session) error) error {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+
+	err = fn(session)
+	options := newSessionOptions(opts)
+	if !isNotAuthenticated(err) || options.sessionToken != "" {
+		session.Logout(ctx)
+		return err
+	}
+
+	// The pool must not hand out the unauthenticated session again.
+	if session.lease != nil {
+		session.lease.pool.discard(session)
+	}
+	session.Logout(ctx)
+
+	session, err = newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to re-establish vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return fn(session)
+}
+
+func newSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*Session, error) {
+	options := newSessionOptions(opts)
+	if options.datacenter != "" && options.datacenter != dc.Datacenter {
+		dc = dc.DeepCopy()
+		dc.Datacenter = options.datacenter
+	}
+	// Sessions resumed from a token are cheap and not ours to share.
+	if options.pool != nil && options.sessionToken == "" {
+		return options.pool.session(ctx, dc, username, password, caBundle, options)
+	}
+
+	return login(ctx, dc, username, password, caBundle, options)
+}
+
+// login establishes a new vCenter session, giving up once the login timeout is reached.
+func login(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, options *sessionOptions) (*Session, error) {
+	ctx, cancel := context.WithTimeout(ctx, options.loginTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var session *Session
+	err := retryLogin(ctx, options.loginAttempts, func() (err error) {
+		session, err = connect(ctx, dc, username, password, caBundle, options)
+		return err
+	})
+	options.metrics.observeLogin(dc.Datacenter, operationSOAPLogin, start, err)
+	if err != nil {
+		return nil, asTimeoutError(ctx, dc.Endpoint, options.loginTimeout, err)
+	}
+
+	return session, nil
+}
+
+// retryLogin calls fn until it succeeds, fails with a permanent error or the
+// given number of attempts is exhausted and returns the last error encountered.
+func retryLogin(ctx context.Context, attempts int, fn func() error) error {
+	backoff := loginBackoff
+	backoff.Steps = attempts
+
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		lastErr = fn()
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case isTransientError(lastErr):
+			return false, nil
+		default:
+			return false, lastErr
+		}
+	})
+	if err != nil && lastErr != nil {
+		return lastErr
+	}
+
+	return err
+}
+
+func connect(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, options *sessionOptions) (_ *Session, err error) {
+	soapClient, err := newSOAPClient(dc, caBundle, options)
+	if err != nil {
+		return nil, err
+	}
+
+	vim25Client, err := vim25.NewClient(ctx, soapClient)
+	if err != nil {
+		return nil, err
+	}
+	if err := useAPIVersion(vim25Client, options.apiVersion); err != nil {
+		return nil, err
+	}
+	if options.soapTracer != nil {
+		vim25Client.RoundTripper = &tracingRoundTripper{RoundTripper: vim25Client.RoundTripper, tracer: options.soapTracer}
+	}
+	if options.keepAlive > 0 {
+		vim25Client.RoundTripper = session.KeepAlive(vim25Client.RoundTripper, options.keepAlive)
+	}
+
+	client := &govmomi.Client{
+		Client:         vim25Client,
+		SessionManager: session.NewManager(vim25Client),
+	}
+
+	if options.sessionToken != "" {
+		if err := resumeSession(ctx, client, options.sessionToken); err != nil {
+			return nil, err
+		}
+	} else {
+		user := url.UserPassword(username, password)
+		if dc.InfraManagementUser != nil {
+			user = url.UserPassword(dc.InfraManagementUser.Username, dc.InfraManagementUser.Password)
+		}
+
+		if err = loginWithLocale(ctx, client, user, options.locale); err != nil {
+			return nil, fmt.Errorf("failed to login: %w", accountError(user.Username(), err))
+		}
+		// Sessions which are never handed out must not linger in vCenter until they expire.
+		defer func() {
+			if err != nil {
+				(&Session{Client: client}).logout(ctx)
+			}
+		}()
+	}
+
+	datacenter, err := find.NewFinder(client.Client, true).Datacenter(ctx, dc.Datacenter)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, &DatacenterNotFoundError{Datacenter: dc.Datacenter, Err: err}
+		}
+		return nil, fmt.Errorf("failed to get vSphere datacenter %q: %w", dc.Datacenter, err)
+	}
+
+	return &Session{
+		Datacenter: datacenter,
+		Finder:     newFinder(client, datacenter),
+		Client:     client,
+		external:   options.sessionToken != "",
+	}, nil
+}
+
+// newFinder returns a finder for the datacenter. Finders cache the folders of the datacenter without any
+// synchronization, so every goroutine needs its own finder.
+func newFinder(client *govmomi.Client, datacenter *object.Datacenter) *find.Finder {
+	finder := find.NewFinder(client.Client, true)
+	finder.SetDatacenter(datacenter)
+	return finder
+}
+
+// loginWithLocale logs in like the session manager of govmomi, but with the given locale instead of the
+// one taken from the environment, so the messages of vCenter, e.g. of faults, are in a known language.
+// Unlike after SessionManager.Login, SessionManager.SessionIsActive cannot be used for the session.
+func loginWithLocale(ctx context.Context, client *govmomi.Client, user *url.Userinfo, locale string) error {
+	password, _ := user.Password()
+	req := types.Login{
+		This:     *client.ServiceContent.SessionManager,
+		UserName: user.Username(),
+		Password: password,
+		Locale:   locale,
+	}
+
+	_, err := methods.Login(ctx, client.Client, &req)
+	return err
+}
+
+// resumeSession makes the client use the vCenter session with the given token and checks that the
+// session is still active.
+func resumeSession(ctx context.Context, client *govmomi.Client, token string) error {
+	client.Client.Client.Jar.SetCookies(client.URL(), []*http.Cookie{{
+		Name:  soap.SessionCookieName,
+		Value: token,
+	}})
+
+	userSession, err := client.SessionManager.UserSession(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the session of the token: %w", err)
+	}
+	if userSession == nil {
+		return ErrInvalidSessionToken
+	}
+
+	return nil
+}
+
+// ValidateCredentials checks that the given credentials are accepted by vCenter by logging in and out again.
+// It is cheap compared to ValidateCloudSpec and meant to validate credentials before any resources are selected.
+func ValidateCredentials(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) error {
+	session, err := loginWithCredentials(ctx, dc, username, password, caBundle, opts)
+	if err != nil {
+		return err
+	}
+	session.Logout(ctx)
+
+	return nil
+}
+
+// loginWithCredentials establishes a new session with exactly the given credentials and reports rejected
+// credentials as ErrInvalidCredentials. Locked accounts and expired passwords are reported as AccountError instead.
+func loginWithCredentials(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts []SessionOption) (*Session, error) {
+	// The credentials at hand are validated, so neither the InfraManagementUser nor a pooled or resumed session may be used.
+	dc = dc.DeepCopy()
+	dc.InfraManagementUser = nil
+
+	options := newSessionOptions(opts)
+	options.pool = nil
+	options.sessionToken = ""
+
+	session, err := login(ctx, dc, username, password, caBundle, options)
+	if err != nil {
+		var accountErr *AccountError
+		if isInvalidLogin(err) && !errors.As(err, &accountErr) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidCredentials, err.Error())
+		}
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+
+	return session, nil
+}
+
+// ValidateCredentialsReference checks that the credentials stored in the referenced secret are accepted by vCenter,
+// so a rotated secret can be validated before it is swapped in. Both the user and, if the secret contains a different
+// one, the infra management user are validated.
+func ValidateCredentialsReference(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, ref *providerconfig.GlobalSecretKeySelector, secretKeySelector provider.SecretKeySelectorValueFunc, caBundle *x509.CertPool, opts ...SessionOption) error {
+	if ref == nil {
+		return fmt.Errorf("%w: empty credentialsReference", ErrNoCredentials)
+	}
+
+	cloud := kubermaticv1.CloudSpec{
+		VSphere: &kubermaticv1.VSphereCloudSpec{
+			CredentialsReference: ref,
+		},
+	}
+
+	username, password, err := getUsernameAndPassword(cloud, secretKeySelector, false)
+	if err != nil {
+		return err
+	}
+	if err := ValidateCredentials(ctx, dc, username, password, caBundle, opts...); err != nil {
+		return fmt.Errorf("failed to validate user %q: %w", username, err)
+	}
+
+	infraUsername, infraPassword, err := getUsernameAndPassword(cloud, secretKeySelector, true)
+	if err != nil {
+		return err
+	}
+	if infraUsername == username && infraPassword == password {
+		return nil
+	}
+	if err := ValidateCredentials(ctx, dc, infraUsername, infraPassword, caBundle, opts...); err != nil {
+		return fmt.Errorf("failed to validate infra management user %q: %w", infraUsername, err)
+	}
+
+	return nil
+}
+
+// getVMRootPath is a helper func to get the root path for VM's
+// We extracted it because we use it in several places.
+func getVMRootPath(dc *kubermaticv1.DatacenterSpecVSphere) (string, error) {
+	// We offer a different root path though in case people would like to store all Kubermatic VM's below a certain directory
+	if dc.RootPath == "" {
+		return path.Join("/", dc.Datacenter, "vm"), nil
+	}
+
+	return resolveFolderPath(dc, dc.RootPath)
+}
+
+// clusterDatacenter returns the datacenter spec with the root path of the cluster, which may be overridden by
+// the RootPathAnnotationKey annotation if the provider was created with WithClusterRootPaths.
+func (v *Provider) clusterDatacenter(cluster *kubermaticv1.Cluster) (*kubermaticv1.DatacenterSpecVSphere, error) {
+	if !v.clusterRootPaths || cluster.Annotations[RootPathAnnotationKey] == "" {
+		return v.dc, nil
+	}
+
+	rootPath, err := clusterRootPath(v.dc, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	dc := v.dc.DeepCopy()
+	dc.RootPath = rootPath
+	return dc, nil
+}
+
+// clusterRootPath resolves the root path override of the cluster, see RootPathAnnotationKey. Relative paths are
+// interpreted relative to the VM directory of the datacenter, like the root path of the datacenter.
+func clusterRootPath(dc *kubermaticv1.DatacenterSpecVSphere, cluster *kubermaticv1.Cluster) (string, error) {
+	override := cluster.Annotations[RootPathAnnotationKey]
+	rootPath, err := resolveFolderPath(dc, override)
+	if err != nil {
+		return "", err
+	}
+
+	projectID := cluster.Labels[kubermaticv1.ProjectIDLabelKey]
+	if strings.Trim(projectID, ".") == "" {
+		return "", fmt.Errorf("%w: cluster %q doesn't belong to a project", ErrInvalidRootPath, cluster.Name)
+	}
+	dcRootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return "", err
+	}
+	if projectPath := path.Join(dcRootPath, projectID); !isSubPath(rootPath, projectPath) {
+		return "", fmt.Errorf("%w: %q of cluster %q is not below %q", ErrInvalidRootPath, override, cluster.Name, projectPath)
+	}
+
+	return rootPath, nil
+}
+
+// verifiedFolderRef returns the folder reference of the cluster if it refers to a folder of the cluster below its
+// root path, see clusterFolderRef.
+func (v *Provider) verifiedFolderRef(ctx context.Context, session *Session, cluster *kubermaticv1.Cluster, restSession func() (*RESTSession, error)) (*types.ManagedObjectReference, error) {
+	dc, err := v.clusterDatacenter(cluster)
+	if err != nil {
+		return nil, err
+	}
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return nil, err
+	}
+	return clusterFolderRef(ctx, session, cluster, rootPath, restSession)
+}
+
+// getTemplateRootPath returns the root path of the folders holding VM templates. Templates are
+// commonly kept apart from the VMs of clusters, so the template root does not depend on the root path
+// of the datacenter and defaults to the conventional "Templates" folder.
+func getTemplateRootPath(dc *kubermaticv1.DatacenterSpecVSphere, templateRoot string) (string, error) {
+	if templateRoot == "" {
+		return path.Join("/", dc.Datacenter, "vm", defaultTemplateFolder), nil
+	}
+
+	return resolveFolderPath(dc, templateRoot)
 }
 
-// Logout closes the idling vCenter connections.
-func (s *Session) Logout(ctx context.Context) {
-	if err := s.Client.Logout(ctx); err != nil {
-		kruntime.HandleError(fmt.Errorf("vSphere client failed to logout: %w", err))
+// resolveFolderPath returns the absolute inventory path of a configured folder path, which must be
+// located within the datacenter.
+func resolveFolderPath(dc *kubermaticv1.DatacenterSpecVSphere, configured string) (string, error) {
+	folderPath, err := normalizeRootPath(configured)
+	if err != nil {
+		return "", err
+	}
+	// A relative path is interpreted relative to the VM directory of the datacenter, which is
+	// ${DATACENTER_NAME}/vm.
+	if !path.IsAbs(folderPath) {
+		folderPath = path.Join("/", dc.Datacenter, "vm", folderPath)
+	}
+	if !isSubPath(folderPath, path.Join("/", dc.Datacenter)) {
+		return "", fmt.Errorf("%w: %q is not within datacenter %q", ErrInvalidRootPath, configured, dc.Datacenter)
+	}
+
+	return folderPath, nil
+}
+
+// normalizeRootPath converts the configured root path into a slash separated path without a
+// trailing slash. Empty, "." and ".." segments are rejected as they are most likely a typo.
+func normalizeRootPath(rootPath string) (string, error) {
+	normalized := strings.TrimRight(strings.ReplaceAll(rootPath, "\\", "/"), "/")
+	if normalized == "" {
+		return "", fmt.Errorf("%w: %q", ErrInvalidRootPath, rootPath)
+	}
+
+	for i, segment := range strings.Split(normalized, "/") {
+		// The first segment of an absolute path is always empty.
+		if i == 0 && segment == "" {
+			continue
+		}
+		switch segment {
+		case "":
+			return "", fmt.Errorf("%w: %q contains an empty path segment", ErrInvalidRootPath, rootPath)
+		case ".", "..":
+			return "", fmt.Errorf("%w: %q must not contain %q", ErrInvalidRootPath, rootPath, segment)
+		}
+	}
+
+	return normalized, nil
+}
+
+// InitializeCloudProvider initializes the vsphere cloud provider by setting up vm folders for the cluster.
+func (v *Provider) InitializeCloudProvider(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	cluster, err := v.initializeCloudProvider(ctx, cluster, update)
+	v.metrics().observeOperation(v.dc.Datacenter, operationInitialize, err)
+	return cluster, err
+}
+
+func (v *Provider) initializeCloudProvider(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	log := v.logger(cluster)
+
+	username, password, err := GetCredentialsForCluster(cluster.Spec.Cloud, v.secretKeySelector, v.dc)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := v.planInitialization(cluster)
+	if err != nil {
+		return nil, err
+	}
+	if plan.IsEmpty() {
+		return cluster, nil
+	}
+
+	// The folder and the tag steps share a single session, the REST session is derived from it.
+	session, err := v.newSession(ctx, log, username, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	// The REST session is only needed for tags, it is created on first use.
+	var restSession *RESTSession
+	defer func() {
+		if restSession != nil {
+			restSession.Logout(ctx)
+		}
+	}()
+	getRESTSession := func() (*RESTSession, error) {
+		if restSession == nil {
+			rs, err := newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+			if err != nil {
+				return nil, err
+			}
+			restSession = rs
+		}
+		return restSession, nil
+	}
+
+	if plan.Folder != "" {
+		if err := checkFolderCollision(ctx, session, cluster, plan.Folder, getRESTSession); err != nil {
+			return nil, err
+		}
+
+		ref, err := createVMFolder(ctx, session, plan.Folder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the VM folder %q: %w", plan.Folder, err)
+		}
+		v.InvalidateFolderCache()
+		log.Infow("Created VM folder", "folder", plan.Folder)
+
+		// Wait for the folder to be listed, so it shows up when the folders are refreshed right away.
+		if err := waitForFolder(ctx, session, plan.Folder, folderVisibilityBackoff); err != nil {
+			log.Warnw("Created VM folder is not visible yet", "folder", plan.Folder, zap.Error(err))
+		}
+
+		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
+			kuberneteshelper.AddFinalizer(cluster, folderCleanupFinalizer)
+			cluster.Spec.Cloud.VSphere.Folder = plan.Folder
+			if cluster.Annotations == nil {
+				cluster.Annotations = map[string]string{}
+			}
+			cluster.Annotations[folderRefAnnotationKey] = ref.String()
+		})
+		if err != nil {
+			// Without the reference, the folder would not be adopted by the next attempt, see checkFolderCollision.
+			if deleteErr := deleteOrphanedFolder(ctx, session, ref, plan.Folder); deleteErr != nil {
+				log.Warnw("Failed to delete the VM folder of the failed initialization", "folder", plan.Folder, zap.Error(deleteErr))
+			}
+			v.InvalidateFolderCache()
+			return nil, err
+		}
+	}
+	if plan.TagCategory != "" || plan.AntiAffinityTag != "" || len(plan.MetadataTags) > 0 {
+		restSession, err := getRESTSession()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create REST client session: %w", err)
+		}
+
+		if cluster, err = initializeTags(ctx, log, session, restSession, cluster, plan, update); err != nil {
+			return nil, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// initializeTags creates the tag category of the cluster and, if enabled, the anti-affinity tag.
+func initializeTags(ctx context.Context, log *zap.SugaredLogger, session *Session, restSession *RESTSession, cluster *kubermaticv1.Cluster, plan *InitializationPlan, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	if plan.TagCategory != "" {
+		categoryID, err := createTagCategory(ctx, restSession, plan.TagCategory, cluster.Name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create tag category: %w", err)
+		}
+		log.Infow("Created tag category", "category", plan.TagCategory, "categoryID", categoryID)
+
+		// Tag the cluster folder, so the cluster resources can be filtered by the category in vCenter.
+		if folderPath := cluster.Spec.Cloud.VSphere.Folder; folderPath != "" {
+			folder, err := session.Finder.Folder(ctx, folderPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get the VM folder %q: %w", folderPath, err)
+			}
+			if err := createAndAttachTag(ctx, restSession, cluster, categoryID, folder); err != nil {
+				return nil, fmt.Errorf("failed to tag the VM folder %q: %w", folderPath, err)
+			}
+		}
+
+		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
+			kuberneteshelper.AddFinalizer(cluster, tagCategoryCleanupFinilizer)
+			if cluster.Annotations == nil {
+				cluster.Annotations = map[string]string{}
+			}
+			cluster.Annotations[tagCategoryIDAnnotationKey] = categoryID
+			cluster.Spec.Cloud.VSphere.TagCategoryID = categoryID
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if plan.AntiAffinityTag != "" {
+		// The tag is not attached to anything here, machine-controller attaches it to the
+		// node VMs and DRS rules referencing it spread them across hosts.
+		tagID, err := createTag(ctx, tags.NewManager(restSession.Client), cluster.Spec.Cloud.VSphere.TagCategoryID, plan.AntiAffinityTag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create anti-affinity tag: %w", err)
+		}
+		log.Infow("Created anti-affinity tag", "tag", plan.AntiAffinityTag, "tagID", tagID)
+
+		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
+			kuberneteshelper.AddFinalizer(cluster, antiAffinityTagCleanupFinalizer)
+			if cluster.Annotations == nil {
+				cluster.Annotations = map[string]string{}
+			}
+			cluster.Annotations[AntiAffinityTagAnnotationKey] = tagID
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(plan.MetadataTags) > 0 {
+		folderPath := cluster.Spec.Cloud.VSphere.Folder
+		folder, err := session.Finder.Folder(ctx, folderPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the VM folder %q: %w", folderPath, err)
+		}
+		tagIDs, err := attachMetadataTags(ctx, restSession, plan.MetadataTags, folder)
+		if err != nil {
+			return nil, fmt.Errorf("failed to tag the VM folder %q with metadata: %w", folderPath, err)
+		}
+		log.Infow("Attached metadata tags", "folder", folderPath, "tags", plan.MetadataTags)
+
+		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
+			kuberneteshelper.AddFinalizer(cluster, metadataTagsCleanupFinalizer)
+			if cluster.Annotations == nil {
+				cluster.Annotations = map[string]string{}
+			}
+			cluster.Annotations[metadataTagsAnnotationKey] = strings.Join(tagIDs, ",")
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cluster, nil
+}
+
+// GetNetworks returns a slice of VSphereNetworks of the datacenter from the passed cloudspec.
+func GetNetworks(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]NetworkInfo, error) {
+	// For the GetNetworks request we use dc.Spec.VSphere.InfraManagementUser
+	// if set because that is the user which will ultimatively configure
+	// the networks - But it means users in the UI can see vsphere
+	// networks without entering credentials
+	return GetNetworksFiltered(ctx, dc, username, password, caBundle, nil, opts...)
+}
+
+// GetNetworksFiltered returns a slice of VSphereNetworks of the datacenter from the passed cloudspec,
+// restricted to the given network types. If no network types are given, networks of all types are returned.
+func GetNetworksFiltered(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, networkTypes []string, opts ...SessionOption) ([]NetworkInfo, error) {
+	for _, networkType := range networkTypes {
+		switch networkType {
+		case NetworkTypeNetwork, NetworkTypeDistributedVirtualPortgroup, NetworkTypeOpaqueNetwork:
+		default:
+			return nil, fmt.Errorf("unsupported network type %q", networkType)
+		}
+	}
+
+	options := newSessionOptions(opts)
+	filter := options.networkFilter
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+
+	var networks []NetworkInfo
+	err := withBrowseSession(ctx, dc, username, password, caBundle, opts, func(session *Session) (err error) {
+		networks, err = getPossibleVMNetworks(ctx, session, options.computeCluster, networkTypes...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return filterNetworks(networks, filter), nil
+}
+
+// GetNetworksByFolder returns the same networks as GetNetworks, grouped by the absolute path of the network
+// folder containing them, e.g. "/DC0/network/kubermatic". Large datacenters organize their networks in folders,
+// so presenting them per folder is easier to navigate than the flat list.
+func GetNetworksByFolder(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (map[string][]NetworkInfo, error) {
+	networks, err := GetNetworks(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return groupNetworksByFolder(networks), nil
+}
+
+// GetDistributedSwitches returns the distributed virtual switches of the datacenter, for operators who pick
+// a whole switch rather than one of its portgroups, which are returned by GetNetworks.
+func GetDistributedSwitches(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]DVSInfo, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return getDistributedSwitches(ctx, session)
+}
+
+// GetVMFolders returns a slice of VSphereFolders of the datacenter from the passed cloudspec.
+func GetVMFolders(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]Folder, error) {
+	return GetVMFoldersWithDepth(ctx, dc, username, password, caBundle, 0, opts...)
+}
+
+// GetVMFoldersWithDepth returns a slice of VSphereFolders of the datacenter from the passed cloudspec,
+// which are at most maxDepth levels below the root path. A maxDepth of 0 or less returns all folders.
+// System and hidden folders are left out, see isExcludedFolder. If the children of some folders cannot
+// be listed, the remaining folders are returned along with a PartialResultError.
+func GetVMFoldersWithDepth(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, maxDepth int, opts ...SessionOption) ([]Folder, error) {
+	var folders []Folder
+	err := withBrowseSession(ctx, dc, username, password, caBundle, opts, func(session *Session) (err error) {
+		folders, err = getVMFolders(ctx, session, dc, maxDepth)
+		return err
+	})
+
+	return folders, err
+}
+
+func getVMFolders(ctx context.Context, session *Session, dc *kubermaticv1.DatacenterSpecVSphere, maxDepth int) ([]Folder, error) {
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return nil, err
+	}
+
+	return listFolders(ctx, session, rootPath, maxDepth)
+}
+
+// GetTemplateFolders returns the folders below the template root, which hold the VM templates of the
+// datacenter. An empty template root defaults to the "Templates" folder of the datacenter, relative
+// template roots are located in the VM directory of the datacenter. Like GetVMFoldersWithDepth, it
+// returns at most maxDepth levels of folders, or all of them if maxDepth is 0 or less.
+func GetTemplateFolders(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, templateRoot string, maxDepth int, opts ...SessionOption) ([]Folder, error) {
+	rootPath, err := getTemplateRootPath(dc, templateRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return listFolders(ctx, session, rootPath, maxDepth)
+}
+
+// ValidateTemplateFolder checks that the template folder is located below the template root and
+// exists in vCenter. See GetTemplateFolders for the defaults of the template root.
+func ValidateTemplateFolder(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, templateRoot, folder string, opts ...SessionOption) error {
+	rootPath, err := getTemplateRootPath(dc, templateRoot)
+	if err != nil {
+		return err
+	}
+	if !isSubPath(folder, rootPath) {
+		return fmt.Errorf("template folder %q is not below the template root %q", folder, rootPath)
+	}
+
+	session, err := newSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	if _, err := session.Finder.Folder(ctx, folder); err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("%w: %q", ErrTemplateFolderNotFound, folder)
+		}
+		return fmt.Errorf("failed to get template folder %q: %w", folder, err)
+	}
+
+	return nil
+}
+
+// listFolders returns the folders below the root path, which are not excluded by isExcludedFolder.
+func listFolders(ctx context.Context, session *Session, rootPath string, maxDepth int) ([]Folder, error) {
+	if maxDepth > 0 {
+		return getVMFoldersWithDepth(ctx, session, rootPath, maxDepth)
+	}
+
+	// We simply list all folders & filter out afterwards.
+	// Filtering here is not possible as vCenter only lists the first level when giving a path.
+	// vCenter only lists folders recursively if you just specify "*".
+	folderRefs, err := session.Finder.FolderList(ctx, "*")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't retrieve folder list: %w", err)
+	}
+
+	vmRoot := vmRootFolder(session)
+	var folders []Folder
+	var refs []types.ManagedObjectReference
+	for _, folderRef := range folderRefs {
+		// We filter by rootPath. If someone configures it, we should respect it.
+		if !isSubPath(folderRef.InventoryPath, rootPath) || isExcludedFolder(folderRef.InventoryPath, rootPath, vmRoot) {
+			continue
+		}
+		folder := Folder{Path: folderRef.Common.InventoryPath}
+		folders = append(folders, folder)
+		refs = append(refs, folderRef.Reference())
+	}
+
+	countFolderChildren(ctx, session, folders, refs)
+
+	return folders, nil
+}
+
+// DefaultCloudSpec adds defaults to the cloud spec. The default datastore of the datacenter is
+// only used if the cluster specifies neither a datastore nor a datastore cluster, and values
+// supplied by the user are never overridden.
+func (v *Provider) DefaultCloudSpec(_ context.Context, spec *kubermaticv1.CloudSpec) error {
+	if spec.VSphere == nil {
+		return errors.New("'vsphere' spec is empty")
+	}
+
+	if err := v.validateTLSPolicy(); err != nil {
+		return err
+	}
+
+	if spec.VSphere.Datastore == "" && spec.VSphere.DatastoreCluster == "" {
+		spec.VSphere.Datastore = v.dc.DefaultDatastore
+	}
+	if spec.VSphere.ResourcePool == "" {
+		spec.VSphere.ResourcePool = v.defaultResourcePool
+	}
+
+	return nil
+}
+
+// ValidationResult is the outcome of ValidateCloudSpecWithWarnings. Errors make the cloud spec unusable, while
+// warnings point out concerns which don't prevent creating the cluster, e.g. a datastore which is nearly full.
+type ValidationResult struct {
+	Errors   []error
+	Warnings []string
+	// ResolvedPaths are the inventory paths of the objects the cloud spec refers to by the paths of their
+	// fields relative to the cloud spec, e.g. "vsphere.datastore": "/DC0/datastore/LocalDS_0". Names
+	// may match objects anywhere in the datacenter, so the paths tell which object was found. Defaults of
+	// the datacenter are reported for the fields they apply to, objects which were not found are left out.
+	ResolvedPaths map[string]string
+}
+
+// Err returns the errors of the result as a single error, or nil if the cloud spec is valid.
+// A single error is returned as is.
+func (r *ValidationResult) Err() error {
+	return kerrors.Reduce(kerrors.NewAggregate(r.Errors))
+}
+
+// ValidateCloudSpec validates whether a vsphere client can be constructed for
+// the passed cloudspec and perform some additional checks on datastore config.
+func (v *Provider) ValidateCloudSpec(ctx context.Context, spec kubermaticv1.CloudSpec) error {
+	return v.ValidateCloudSpecWithWarnings(ctx, spec).Err()
+}
+
+// ValidateCloudSpecWithWarnings performs the same checks as ValidateCloudSpec, but additionally reports
+// concerns which are no reason to reject the cloud spec as warnings, so they can be shown without blocking.
+func (v *Provider) ValidateCloudSpecWithWarnings(ctx context.Context, spec kubermaticv1.CloudSpec) *ValidationResult {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	log := v.logger(nil)
+	result := &ValidationResult{}
+
+	if err := v.validateTLSPolicy(); err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+	if v.insecure() {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("the certificate of vCenter %q is not verified", redactEndpoint(v.dc.Endpoint)))
+	}
+
+	username, password, err := GetCredentialsForCluster(spec, v.secretKeySelector, v.dc)
+	if err != nil {
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+
+	if v.dc.DefaultDatastore == "" && spec.VSphere.DatastoreCluster == "" && spec.VSphere.Datastore == "" {
+		result.Errors = append(result.Errors, ErrMissingDatastore)
+		return result
+	}
+
+	if spec.VSphere.DatastoreCluster != "" && spec.VSphere.Datastore != "" {
+		result.Errors = append(result.Errors, &ValidationError{
+			Fields: []string{"vsphere.datastore", "vsphere.datastoreCluster"},
+			Err:    ErrDatastoreConflict,
+		})
+		return result
+	}
+
+	session, err := v.newSession(ctx, log, username, password)
+	if err != nil {
+		// Everything but the cloud provider functionality runs as the infra management user, so
+		// make clear that it is not the cluster user which was rejected. Account errors name the user already.
+		var accountErr *AccountError
+		if isInvalidLogin(err) && !errors.As(err, &accountErr) && usesInfraManagementUser(spec, v.secretKeySelector, v.dc) {
+			err = fmt.Errorf("%w: %s", ErrInvalidInfraManagementCredentials, err.Error())
+		} else {
+			err = fmt.Errorf("failed to create vCenter session: %w", err)
+		}
+		result.Errors = append(result.Errors, err)
+		return result
+	}
+	defer session.Logout(ctx)
+
+	// The checks are independent of each other, so they are run concurrently and all problems
+	// are reported at once. Every check gets its own finder, as finders must not be shared between goroutines.
+	var checks []validationCheck
+
+	if ds := v.dc.DefaultDatastore; ds != "" {
+		// The default datastore only stores the VMs of clusters which don't select a datastore themselves.
+		usedByCluster := spec.VSphere.Datastore == "" && spec.VSphere.DatastoreCluster == ""
+		checks = append(checks, func(session *Session, report *checkReport) error {
+			summary, dsPath, err := validateDatastore(ctx, session, ds)
+			if err != nil {
+				return fmt.Errorf("failed to get default datastore provided by datacenter spec %q: %w", ds, err)
+			}
+			if usedByCluster {
+				report.resolve("vsphere.datastore", dsPath)
+				if isDatastoreNearlyFull(summary) {
+					report.warn(datastoreNearlyFullWarning(ds, summary))
+				}
+			}
+			return nil
+		})
+	}
+
+	if rp := v.defaultResourcePool; rp != "" {
+		// Like the default datastore, the default resource pool only applies to clusters without one.
+		usedByCluster := spec.VSphere.ResourcePool == ""
+		checks = append(checks, func(session *Session, report *checkReport) error {
+			rpPath, err := validateResourcePool(ctx, session, rp)
+			if err != nil {
+				return fmt.Errorf("failed to get default resource pool of the datacenter %q: %w", rp, err)
+			}
+			if usedByCluster {
+				report.resolve("vsphere.resourcePool", rpPath)
+			}
+			return nil
+		})
+	}
+
+	if rp := spec.VSphere.ResourcePool; rp != "" {
+		checks = append(checks, func(session *Session, report *checkReport) error {
+			rpPath, err := validateResourcePool(ctx, session, rp)
+			if err != nil {
+				return fmt.Errorf("failed to get resource pool %s: %w", rp, err)
+			}
+			report.resolve("vsphere.resourcePool", rpPath)
+			return nil
+		})
+	}
+
+	if dc := spec.VSphere.DatastoreCluster; dc != "" {
+		checks = append(checks, func(session *Session, report *checkReport) error {
+			pod, err := session.Finder.DatastoreCluster(ctx, dc)
+			if err != nil {
+				return fmt.Errorf("failed to get datastore cluster provided by cluster spec %q: %w", dc, err)
+			}
+			report.resolve("vsphere.datastoreCluster", pod.InventoryPath)
+			return nil
+		})
+	}
+
+	if ds := spec.VSphere.Datastore; ds != "" {
+		checks = append(checks, func(session *Session, report *checkReport) error {
+			summary, dsPath, err := validateDatastore(ctx, session, ds)
+			if err != nil {
+				return fmt.Errorf("failed to get datastore provided by cluster spec %q: %w", ds, err)
+			}
+			report.resolve("vsphere.datastore", dsPath)
+			if isDatastoreNearlyFull(summary) {
+				report.warn(datastoreNearlyFullWarning(ds, summary))
+			}
+			return nil
+		})
+	}
+
+	// The storage policy complements the datastore selection, as it is used for volumes provisioned by the CSI driver.
+	storagePolicy := spec.VSphere.StoragePolicy
+	if storagePolicy == "" {
+		storagePolicy = v.dc.DefaultStoragePolicy
+	}
+	if storagePolicy != "" {
+		checks = append(checks, func(session *Session, _ *checkReport) error {
+			if err := validateStoragePolicy(ctx, session, storagePolicy); err != nil {
+				return fmt.Errorf("failed to validate storage policy: %w", err)
+			}
+			return nil
+		})
+	}
+
+	if folder := spec.VSphere.Folder; folder != "" {
+		checks = append(checks, func(session *Session, report *checkReport) error {
+			rootPath, err := getVMRootPath(v.dc)
+			if err != nil {
+				return err
+			}
+			if err := validateFolderPath(rootPath, folder); err != nil {
+				return err
+			}
+			vmFolder, err := session.Finder.Folder(ctx, folder)
+			if err != nil {
+				return fmt.Errorf("failed to get folder provided by cluster spec %q: %w", folder, err)
+			}
+			report.resolve("vsphere.folder", vmFolder.InventoryPath)
+			return nil
+		})
+	}
+
+	checkResult := runChecks(session, checks)
+	result.Errors = append(result.Errors, checkResult.Errors...)
+	result.Warnings = append(result.Warnings, checkResult.Warnings...)
+	result.ResolvedPaths = checkResult.ResolvedPaths
+
+	return result
+}
+
+// validationCheck is a single check of ValidateCloudSpecWithWarnings. It returns the error which makes the
+// cloud spec invalid and reports concerns which are no reason to reject the cloud spec, as well as the
+// inventory paths of the objects it found, via the report.
+type validationCheck func(session *Session, report *checkReport) error
+
+// checkReport collects the warnings and resolved paths of a single check, so checks don't share any state.
+type checkReport struct {
+	warnings      []string
+	resolvedPaths map[string]string
+}
+
+func (r *checkReport) warn(warning string) {
+	r.warnings = append(r.warnings, warning)
+}
+
+func (r *checkReport) resolve(field, inventoryPath string) {
+	if r.resolvedPaths == nil {
+		r.resolvedPaths = map[string]string{}
+	}
+	r.resolvedPaths[field] = inventoryPath
+}
+
+// runChecks runs the checks concurrently, each with its own finder of the session, and collects their
+// errors and warnings in the order of the checks.
+func runChecks(session *Session, checks []validationCheck) *ValidationResult {
+	errs := make([]error, len(checks))
+	reports := make([]checkReport, len(checks))
+
+	var wg sync.WaitGroup
+	wg.Add(len(checks))
+	for i, check := range checks {
+		go func(i int, check validationCheck) {
+			defer wg.Done()
+			errs[i] = check(session.withOwnFinder(), &reports[i])
+		}(i, check)
+	}
+	wg.Wait()
+
+	result := &ValidationResult{}
+	for i := range checks {
+		if errs[i] != nil {
+			result.Errors = append(result.Errors, errs[i])
+		}
+		result.Warnings = append(result.Warnings, reports[i].warnings...)
+		for field, inventoryPath := range reports[i].resolvedPaths {
+			if result.ResolvedPaths == nil {
+				result.ResolvedPaths = map[string]string{}
+			}
+			result.ResolvedPaths[field] = inventoryPath
+		}
+	}
+
+	return result
+}
+
+// CleanUpCloudProvider we always check if the folder is there and remove it if yes because we know its absolute path
+// This covers cases where the finalizer was not added
+// We also remove the finalizer if either the folder is not present or we successfully deleted it.
+// The folder and the tags are cleaned up concurrently, so a slow folder deletion doesn't delay the tags.
+// If a cleanup step fails, a CleanupError reports which steps are completed and which are still pending.
+func (v *Provider) CleanUpCloudProvider(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	log := v.logger(cluster)
+
+	username, password, err := GetCredentialsForCluster(cluster.Spec.Cloud, v.secretKeySelector, v.dc)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := v.newSession(ctx, log, username, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	// The steps only read this copy, as the cluster is updated concurrently whenever a step completes.
+	snapshot := cluster.DeepCopy()
+	progress := &cleanupProgress{cluster: cluster, update: update}
+
+	// newRESTSession opens a REST session if it is needed. The REST API is only needed for tags, which
+	// datacenters might not use at all. If it is unavailable, the tags are left to the next attempt, but
+	// the folder is cleaned up nevertheless.
+	newRESTSession := func(needed bool) *RESTSession {
+		if !needed {
+			return nil
+		}
+		restSession, err := newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+		if err != nil {
+			progress.addError(fmt.Errorf("failed to create REST client session: %w", err))
+			return nil
+		}
+		return restSession
+	}
+
+	// step runs a cleanup step if the cluster has its finalizer. Steps failing permanently are recorded as pending,
+	// only errors updating the cluster are returned.
+	step := func(operation, finalizer, description string, restSession *RESTSession, needsREST bool, fn func() error, modify func(*kubermaticv1.Cluster)) error {
+		if !kuberneteshelper.HasFinalizer(snapshot, finalizer) {
+			return nil
+		}
+		if needsREST && restSession == nil {
+			progress.fail(operation, nil)
+			return nil
+		}
+		if err := v.retryCleanup(ctx, log, operation, fn); err != nil {
+			progress.fail(operation, fmt.Errorf("failed to %s: %w", description, err))
+			return nil
+		}
+		return progress.complete(ctx, operation, func(cluster *kubermaticv1.Cluster) {
+			kuberneteshelper.RemoveFinalizer(cluster, finalizer)
+			if modify != nil {
+				modify(cluster)
+			}
+		})
+	}
+
+	// Both cleanups are attempted even if one of them fails, so a permanently failing
+	// folder deletion does not leave the tag category behind and vice versa. Each of them
+	// uses its own REST session.
+	var g errgroup.Group
+	g.Go(func() error {
+		// The folder reference is verified by the cluster tag, in case the folder was moved.
+		verifyByTag := kuberneteshelper.HasFinalizer(snapshot, folderCleanupFinalizer) && folderRef(snapshot) != nil && snapshot.Spec.Cloud.VSphere.TagCategoryID != ""
+		restSession := newRESTSession(kuberneteshelper.HasFinalizer(snapshot, metadataTagsCleanupFinalizer) || verifyByTag)
+		if restSession != nil {
+			defer restSession.Logout(ctx)
+		}
+
+		// The metadata tags are detached before the folder is deleted, which drops the reference to it. The
+		// tags themselves are shared by the clusters of a project or owner and only deleted once unused.
+		err := step(operationDeleteMetadataTags, metadataTagsCleanupFinalizer, "delete metadata tags", restSession, true, func() error {
+			tagManager := tags.NewManager(restSession.Client)
+			tagIDs, ignored, err := metadataTagIDs(ctx, tagManager, snapshot)
+			if err != nil {
+				return err
+			}
+			if len(ignored) > 0 {
+				log.Warnw("Ignoring metadata tags, which don't belong to the cluster", "tagIDs", ignored)
+			}
+			ref, err := v.verifiedFolderRef(ctx, session, snapshot, func() (*RESTSession, error) { return restSession, nil })
+			if err != nil {
+				return err
+			}
+			if err := detachMetadataTags(ctx, tagManager, tagIDs, ref); err != nil {
+				return err
+			}
+			log.Infow("Detached metadata tags", "tagIDs", tagIDs)
+			return nil
+		}, func(cluster *kubermaticv1.Cluster) {
+			delete(cluster.Annotations, metadataTagsAnnotationKey)
+		})
+		if err != nil {
+			return err
+		}
+
+		folder := snapshot.Spec.Cloud.VSphere.Folder
+		return step(operationDeleteFolder, folderCleanupFinalizer, fmt.Sprintf("delete VM folder %q", folder), restSession, false, func() error {
+			var tagSession func() (*RESTSession, error)
+			if restSession != nil {
+				tagSession = func() (*RESTSession, error) { return restSession, nil }
+			}
+			ref, err := v.verifiedFolderRef(ctx, session, snapshot, tagSession)
+			if err != nil {
+				return err
+			}
+			if ref == nil && folderRef(snapshot) != nil {
+				log.Warnw("Ignoring folder reference, which doesn't refer to a folder of the cluster", "folderRef", snapshot.Annotations[folderRefAnnotationKey])
+			}
+			if err := deleteVMFolder(ctx, session, ref, folder); err != nil {
+				return err
+			}
+			v.InvalidateFolderCache()
+			log.Infow("Deleted VM folder", "folder", folder)
+			return nil
+		}, func(cluster *kubermaticv1.Cluster) {
+			delete(cluster.Annotations, folderRefAnnotationKey)
+		})
+	})
+	g.Go(func() error {
+		restSession := newRESTSession(kuberneteshelper.HasAnyFinalizer(snapshot, antiAffinityTagCleanupFinalizer, tagCategoryCleanupFinilizer))
+		if restSession != nil {
+			defer restSession.Logout(ctx)
+		}
+
+		// The anti-affinity tag goes first, as it might belong to a category which is not ours.
+		tagID := snapshot.Annotations[AntiAffinityTagAnnotationKey]
+		err := step(operationDeleteAntiAffinityTag, antiAffinityTagCleanupFinalizer, "delete anti-affinity tag", restSession, true, func() error {
+			deleted, err := deleteTag(ctx, tags.NewManager(restSession.Client), tagID, snapshot.Spec.Cloud.VSphere.TagCategoryID, antiAffinityTagName(snapshot))
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				log.Warnw("Ignoring anti-affinity tag, which doesn't belong to the cluster", "tagID", tagID)
+				return nil
+			}
+			log.Infow("Deleted anti-affinity tag", "tagID", tagID)
+			return nil
+		}, func(cluster *kubermaticv1.Cluster) {
+			delete(cluster.Annotations, AntiAffinityTagAnnotationKey)
+		})
+		if err != nil {
+			return err
+		}
+
+		return step(operationDeleteTagCategory, tagCategoryCleanupFinilizer, "delete tag category", restSession, true, func() error {
+			categoryID := snapshot.Spec.Cloud.VSphere.TagCategoryID
+			deleted, err := deleteTagCategory(ctx, restSession, snapshot, categoryName(v.tagCategoryPrefix, snapshot))
+			if err != nil {
+				return err
+			}
+			if !deleted {
+				log.Warnw("Ignoring tag category, which doesn't belong to the cluster", "categoryID", categoryID)
+				return nil
+			}
+			log.Infow("Deleted tag category", "categoryID", categoryID)
+			return nil
+		}, func(cluster *kubermaticv1.Cluster) {
+			delete(cluster.Annotations, tagCategoryIDAnnotationKey)
+		})
+	})
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return progress.result()
+}
+
+// cleanupSteps are the steps of CleanUpCloudProvider, in the order they are reported by CleanupError.
+var cleanupSteps = []string{operationDeleteMetadataTags, operationDeleteFolder, operationDeleteAntiAffinityTag, operationDeleteTagCategory}
+
+// cleanupProgress records the outcomes of the cleanup steps, which run concurrently, and serializes the
+// updates of the cluster.
+type cleanupProgress struct {
+	lock    sync.Mutex
+	cluster *kubermaticv1.Cluster
+	update  provider.ClusterUpdater
+	// errs are the errors not belonging to a single step.
+	errs []error
+	// outcomes holds the error of every failed step, which is nil if the step failed, because it couldn't be
+	// run at all. Completed steps are recorded in completed.
+	outcomes  map[string]error
+	completed map[string]bool
+}
+
+// fail records that the step failed with err, err may be nil if the cause is recorded already.
+func (p *cleanupProgress) fail(operation string, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.outcomes == nil {
+		p.outcomes = map[string]error{}
+	}
+	p.outcomes[operation] = err
+}
+
+// addError records an error not belonging to a single step.
+func (p *cleanupProgress) addError(err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.errs = append(p.errs, err)
+}
+
+// complete updates the cluster with modify and records the step as completed.
+func (p *cleanupProgress) complete(ctx context.Context, operation string, modify func(*kubermaticv1.Cluster)) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	cluster, err := p.update(ctx, p.cluster.Name, modify)
+	if err != nil {
+		return err
+	}
+	p.cluster = cluster
+	if p.completed == nil {
+		p.completed = map[string]bool{}
+	}
+	p.completed[operation] = true
+
+	return nil
+}
+
+// result returns the updated cluster, or a CleanupError if any of the steps failed.
+func (p *cleanupProgress) result() (*kubermaticv1.Cluster, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	errs := p.errs
+	var completed, pending []string
+	for _, operation := range cleanupSteps {
+		if p.completed[operation] {
+			completed = append(completed, operation)
+		}
+		if err, failed := p.outcomes[operation]; failed {
+			pending = append(pending, operation)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, &CleanupError{Completed: completed, Pending: pending, Err: kerrors.NewAggregate(errs)}
+	}
+
+	return p.cluster, nil
+}
+
+// retryCleanup calls fn until it succeeds or the cleanup backoff is exhausted
+// and returns the last error encountered.
+func (v *Provider) retryCleanup(ctx context.Context, log *zap.SugaredLogger, operation string, fn func() error) error {
+	backoff := defaultCleanupBackoff
+	if v.cleanupBackoff != nil {
+		backoff = *v.cleanupBackoff
+	}
+
+	metrics := v.metrics()
+	attempts := 0
+
+	var lastErr error
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func() (bool, error) {
+		if attempts > 0 {
+			log.Debugw("Retrying cleanup", "operation", operation, zap.Error(lastErr))
+			metrics.observeCleanupRetry(v.dc.Datacenter, operation)
+		}
+		attempts++
+
+		lastErr = fn()
+		return lastErr == nil, nil
+	})
+	if err != nil && lastErr != nil {
+		err = lastErr
+	}
+
+	metrics.observeOperation(v.dc.Datacenter, operation, err)
+	return err
+}
+
+// logger returns the logger of the provider with the datacenter and, if given, the cluster as fields.
+func (v *Provider) logger(cluster *kubermaticv1.Cluster) *zap.SugaredLogger {
+	log := v.log
+	if log == nil {
+		log = kubermaticlog.Logger
+	}
+
+	log = log.With("datacenter", v.dc.Datacenter)
+	if cluster != nil {
+		log = log.With("cluster", cluster.Name)
 	}
+	return log
 }
 
-func newSession(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool) (*Session, error) {
-	u, err := url.Parse(fmt.Sprintf("%s/sdk", dc.Endpoint))
-	if err != nil {
+// newSession opens a vCenter session for the datacenter of the provider. The credentials are never logged.
+func (v *Provider) newSession(ctx context.Context, log *zap.SugaredLogger, username, password string) (*Session, error) {
+	if err := v.validateTLSPolicy(); err != nil {
 		return nil, err
 	}
 
-	// creating the govmoni Client in roundabout way because we need to set the proper CA bundle: reference https://github.com/vmware/govmomi/issues/1200
-	soapClient := soap.NewClient(u, dc.AllowInsecure)
-	// set our CA bundle
-	soapClient.DefaultTransport().TLSClientConfig.RootCAs = caBundle
-
-	vim25Client, err := vim25.NewClient(ctx, soapClient)
+	session, err := newSession(ctx, v.dc, username, password, v.caBundle, v.sessionOptions...)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &govmomi.Client{
-		Client:         vim25Client,
-		SessionManager: session.NewManager(vim25Client),
-	}
+	log.Debugw("Opened vCenter session", "endpoint", redactEndpoint(v.dc.Endpoint))
+	return session, nil
+}
 
-	user := url.UserPassword(username, password)
-	if dc.InfraManagementUser != nil {
-		user = url.UserPassword(dc.InfraManagementUser.Username, dc.InfraManagementUser.Password)
-	}
+// insecure returns true if the certificate of vCenter is not verified, either for the whole datacenter or
+// for the sessions of the provider.
+func (v *Provider) insecure() bool {
+	return v.dc.AllowInsecure || newSessionOptions(v.sessionOptions).insecure
+}
 
-	if err = client.Login(ctx, user); err != nil {
-		return nil, fmt.Errorf("failed to login: %w", err)
+// validateTLSPolicy returns ErrInsecureConnection if the certificate of vCenter would not be verified,
+// although the provider was created with WithEnforceTLS.
+func (v *Provider) validateTLSPolicy() error {
+	if !v.enforceTLS || !v.insecure() {
+		return nil
 	}
+	return &ValidationError{Fields: []string{"vsphere"}, Err: ErrInsecureConnection}
+}
 
-	finder := find.NewFinder(client.Client, true)
-	datacenter, err := finder.Datacenter(ctx, dc.Datacenter)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get vSphere datacenter %q: %w", dc.Datacenter, err)
+// withSessionTimeout bounds the context by the session timeout, if one is configured.
+func (v *Provider) withSessionTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if v.sessionTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	finder.SetDatacenter(datacenter)
+	return context.WithTimeout(ctx, v.sessionTimeout)
+}
 
-	return &Session{
-		Datacenter: datacenter,
-		Finder:     finder,
-		Client:     client,
-	}, nil
+// metrics returns the metrics configured via the session options, if any.
+func (v *Provider) metrics() *Metrics {
+	return newSessionOptions(v.sessionOptions).metrics
 }
 
-// getVMRootPath is a helper func to get the root path for VM's
-// We extracted it because we use it in several places.
-func getVMRootPath(dc *kubermaticv1.DatacenterSpecVSphere) string {
-	// Each datacenter root directory for VM's is: ${DATACENTER_NAME}/vm
-	rootPath := path.Join("/", dc.Datacenter, "vm")
-	// We offer a different root path though in case people would like to store all Kubermatic VM's below a certain directory
-	if dc.RootPath != "" {
-		rootPath = path.Clean(dc.RootPath)
-	}
-	return rootPath
+// ValidateCloudSpecUpdate verifies whether an update of cloud spec is valid and permitted. A changed folder can only
+// be verified along with the cluster, see ValidateClusterUpdate, so it is rejected.
+func (v *Provider) ValidateCloudSpecUpdate(ctx context.Context, oldSpec kubermaticv1.CloudSpec, newSpec kubermaticv1.CloudSpec) error {
+	return v.validateCloudSpecUpdate(ctx, nil, oldSpec, newSpec)
 }
 
-// InitializeCloudProvider initializes the vsphere cloud provider by setting up vm folders for the cluster.
-func (v *Provider) InitializeCloudProvider(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
-	username, password, err := GetCredentialsForCluster(cluster.Spec.Cloud, v.secretKeySelector, v.dc)
-	if err != nil {
-		return nil, err
+// ValidateClusterUpdate verifies whether an update of the cloud spec of the cluster is valid and permitted. If the
+// provider was created with WithFolderRelocation, the folder may only be changed to the path the folder of the
+// cluster is located at, e.g. because it was relocated in vCenter. Other folders would be deleted by the cleanup.
+func (v *Provider) ValidateClusterUpdate(ctx context.Context, oldCluster, newCluster *kubermaticv1.Cluster) error {
+	return v.validateCloudSpecUpdate(ctx, oldCluster, oldCluster.Spec.Cloud, newCluster.Spec.Cloud)
+}
+
+func (v *Provider) validateCloudSpecUpdate(ctx context.Context, oldCluster *kubermaticv1.Cluster, oldSpec kubermaticv1.CloudSpec, newSpec kubermaticv1.CloudSpec) error {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	if oldSpec.VSphere == nil || newSpec.VSphere == nil {
+		return errors.New("'vsphere' spec is empty")
 	}
-	rootPath := getVMRootPath(v.dc)
-	if cluster.Spec.Cloud.VSphere.Folder == "" {
-		session, err := newSession(ctx, v.dc, username, password, v.caBundle)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+
+	if oldSpec.VSphere.Folder != "" && oldSpec.VSphere.Folder != newSpec.VSphere.Folder {
+		if !v.allowFolderRelocation {
+			return fmt.Errorf("updating vSphere folder is not supported (was %s, updated to %s)", oldSpec.VSphere.Folder, newSpec.VSphere.Folder)
 		}
-		defer session.Logout(ctx)
-		// If the user did not specify a folder, we create a own folder for this cluster to improve
-		// the VM management in vCenter
-		clusterFolder := path.Join(rootPath, cluster.Name)
-		if err := createVMFolder(ctx, session, clusterFolder); err != nil {
-			return nil, fmt.Errorf("failed to create the VM folder %q: %w", clusterFolder, err)
+		if newSpec.VSphere.Folder == "" {
+			return errors.New("vSphere folder must not be removed")
 		}
-
-		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
-			kuberneteshelper.AddFinalizer(cluster, folderCleanupFinalizer)
-			cluster.Spec.Cloud.VSphere.Folder = clusterFolder
-		})
-		if err != nil {
-			return nil, err
+		if oldCluster == nil {
+			return fmt.Errorf("updating vSphere folder requires the cluster to verify the folder (was %s, updated to %s)", oldSpec.VSphere.Folder, newSpec.VSphere.Folder)
 		}
-	}
-	if cluster.Spec.Cloud.VSphere.TagCategoryID == "" {
-		restSession, err := newRESTSession(ctx, v.dc, username, password, v.caBundle)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create REST client session: %w", err)
+		if err := v.validateFolderUpdate(ctx, oldCluster, newSpec); err != nil {
+			return err
 		}
-		defer restSession.Logout(ctx)
+	}
 
-		// If the user did not specify a tag category, we create an own default for this cluster
-		categoryID, err := createTagCategory(ctx, restSession, cluster)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create tag category: %w", err)
-		}
-		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
-			kuberneteshelper.AddFinalizer(cluster, tagCategoryCleanupFinilizer)
-			cluster.Spec.Cloud.VSphere.TagCategoryID = categoryID
-		})
-		if err != nil {
-			return nil, err
+	// The category is only looked up if it changes, so a category deleted in vCenter
+	// doesn't block unrelated updates of the cluster.
+	if categoryID := newSpec.VSphere.TagCategoryID; categoryID != "" && categoryID != oldSpec.VSphere.TagCategoryID {
+		if err := v.validateTagCategory(ctx, newSpec, categoryID); err != nil {
+			return fmt.Errorf("failed to validate tag category: %w", err)
 		}
 	}
 
-	return cluster, nil
+	return nil
 }
 
-// TODO: Hey, you! Yes, you! Why don't you implement reconciling for vSphere? Would be really cool :)
-// func (v *Provider) ReconcileCluster(cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
-// 	return cluster, nil
-// }
-
-// GetNetworks returns a slice of VSphereNetworks of the datacenter from the passed cloudspec.
-func GetNetworks(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool) ([]NetworkInfo, error) {
-	// For the GetNetworks request we use dc.Spec.VSphere.InfraManagementUser
-	// if set because that is the user which will ultimatively configure
-	// the networks - But it means users in the UI can see vsphere
-	// networks without entering credentials
-	session, err := newSession(ctx, dc, username, password, caBundle)
+// validateFolderUpdate checks that the new folder of the spec is the folder of the cluster, which is identified by
+// the folder reference of the cluster before the update, see verifiedFolderRef.
+func (v *Provider) validateFolderUpdate(ctx context.Context, cluster *kubermaticv1.Cluster, spec kubermaticv1.CloudSpec) error {
+	newFolder := spec.VSphere.Folder
+	dc, err := v.clusterDatacenter(cluster)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+		return err
+	}
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return err
+	}
+	if err := validateFolderPath(rootPath, newFolder); err != nil {
+		return err
 	}
-	defer session.Logout(ctx)
 
-	return getPossibleVMNetworks(ctx, session)
-}
+	username, password, err := GetCredentialsForCluster(spec, v.secretKeySelector, v.dc)
+	if err != nil {
+		return err
+	}
 
-// GetVMFolders returns a slice of VSphereFolders of the datacenter from the passed cloudspec.
-func GetVMFolders(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool) ([]Folder, error) {
-	session, err := newSession(ctx, dc, username, password, caBundle)
+	session, err := v.newSession(ctx, v.logger(cluster), username, password)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+		return fmt.Errorf("failed to create vCenter session: %w", err)
 	}
 	defer session.Logout(ctx)
 
-	// We simply list all folders & filter out afterwards.
-	// Filtering here is not possible as vCenter only lists the first level when giving a path.
-	// vCenter only lists folders recursively if you just specify "*".
-	folderRefs, err := session.Finder.FolderList(ctx, "*")
+	var restSession *RESTSession
+	defer func() {
+		if restSession != nil {
+			restSession.Logout(ctx)
+		}
+	}()
+	ref, err := v.verifiedFolderRef(ctx, session, cluster, func() (*RESTSession, error) {
+		restSession, err = newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+		return restSession, err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("couldn't retrieve folder list: %w", err)
+		return err
+	}
+	if ref == nil {
+		return fmt.Errorf("updating vSphere folder is not supported, as the folder of the cluster is unknown (was %s, updated to %s)", cluster.Spec.Cloud.VSphere.Folder, newFolder)
 	}
 
-	rootPath := getVMRootPath(dc)
-	var folders []Folder
-	for _, folderRef := range folderRefs {
-		// We filter by rootPath. If someone configures it, we should respect it.
-		if !strings.HasPrefix(folderRef.InventoryPath, rootPath+"/") && folderRef.InventoryPath != rootPath {
-			continue
+	folder, err := session.Finder.Folder(ctx, newFolder)
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("vSphere folder %q doesn't exist, the folder of the cluster must be relocated first", newFolder)
 		}
-		folder := Folder{Path: folderRef.Common.InventoryPath}
-		folders = append(folders, folder)
+		return fmt.Errorf("couldn't open folder %q: %w", newFolder, err)
+	}
+	if folder.Reference() != *ref {
+		return fmt.Errorf("vSphere folder %q is not the folder of the cluster", newFolder)
 	}
 
-	return folders, nil
-}
-
-// DefaultCloudSpec adds defaults to the cloud spec.
-func (v *Provider) DefaultCloudSpec(_ context.Context, _ *kubermaticv1.CloudSpec) error {
 	return nil
 }
 
-// ValidateCloudSpec validates whether a vsphere client can be constructed for
-// the passed cloudspec and perform some additional checks on datastore config.
-func (v *Provider) ValidateCloudSpec(ctx context.Context, spec kubermaticv1.CloudSpec) error {
+// validateTagCategory checks that the tag category exists, using the credentials of the cloud spec.
+func (v *Provider) validateTagCategory(ctx context.Context, spec kubermaticv1.CloudSpec, categoryID string) error {
+	if err := validateTagCategoryID(categoryID); err != nil {
+		return err
+	}
+
 	username, password, err := GetCredentialsForCluster(spec, v.secretKeySelector, v.dc)
 	if err != nil {
 		return err
 	}
 
-	if v.dc.DefaultDatastore == "" && spec.VSphere.DatastoreCluster == "" && spec.VSphere.Datastore == "" {
-		return errors.New("no default datastore provided at datacenter nor datastore/datastore cluster at cluster level")
+	session, err := v.newSession(ctx, v.logger(nil), username, password)
+	if err != nil {
+		return fmt.Errorf("failed to create vCenter session: %w", err)
 	}
+	defer session.Logout(ctx)
 
-	if spec.VSphere.DatastoreCluster != "" && spec.VSphere.Datastore != "" {
-		return errors.New("either datastore or datastore cluster can be selected")
+	restSession, err := newRESTSessionFromSession(ctx, session, v.dc, username, password, v.sessionOptions...)
+	if err != nil {
+		return fmt.Errorf("failed to create REST client session: %w", err)
 	}
+	defer restSession.Logout(ctx)
 
-	session, err := newSession(ctx, v.dc, username, password, v.caBundle)
+	return validateTagCategory(ctx, restSession, categoryID)
+}
+
+// ReconcileCluster initializes the cluster like InitializeCloudProvider and renames the folder created for
+// the cluster, if the name rendered from the folder name template changed, e.g. together with the
+// human-readable name of the cluster.
+func (v *Provider) ReconcileCluster(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, update)
 	if err != nil {
-		return fmt.Errorf("failed to create vCenter session: %w", err)
+		return nil, err
 	}
-	defer session.Logout(ctx)
 
-	if ds := v.dc.DefaultDatastore; ds != "" {
-		if _, err := session.Finder.Datastore(ctx, ds); err != nil {
-			return fmt.Errorf("failed to get default datastore provided by datacenter spec %q: %w", ds, err)
-		}
-	}
+	return v.reconcileFolderName(ctx, cluster, update)
+}
 
-	if rp := spec.VSphere.ResourcePool; rp != "" {
-		if _, err := session.Finder.ResourcePool(ctx, rp); err != nil {
-			return fmt.Errorf("failed to get resource pool %s: %w", rp, err)
-		}
+// reconcileFolderName renames the folder created for the cluster to the name rendered from the folder name
+// template. Folders chosen by the user are never renamed, and neither are folders whose new name is taken.
+func (v *Provider) reconcileFolderName(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	folder := cluster.Spec.Cloud.VSphere.Folder
+	if v.folderNameTemplate == "" || folder == "" || folderRef(cluster) == nil || !kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer) {
+		return cluster, nil
 	}
 
-	if dc := spec.VSphere.DatastoreCluster; dc != "" {
-		if _, err := session.Finder.DatastoreCluster(ctx, spec.VSphere.DatastoreCluster); err != nil {
-			return fmt.Errorf("failed to get datastore cluster provided by cluster spec %q: %w", dc, err)
-		}
+	newFolder := path.Join(path.Dir(path.Clean(folder)), folderName(v.folderNameTemplate, cluster))
+	if newFolder == path.Clean(folder) {
+		return cluster, nil
 	}
 
-	if ds := spec.VSphere.Datastore; ds != "" {
-		if _, err = session.Finder.Datastore(ctx, ds); err != nil {
-			return fmt.Errorf("failed to get datastore cluster provided by cluste spec %q: %w", ds, err)
+	renamed, err := v.RelocateClusterFolder(ctx, cluster, newFolder, update)
+	if err != nil {
+		if errors.Is(err, ErrFolderAlreadyExists) {
+			v.logger(cluster).Warnw("Not renaming VM folder, as the new name is taken", "folder", folder, "newFolder", newFolder)
+			return cluster, nil
 		}
+		return nil, err
 	}
 
-	return nil
+	return renamed, nil
 }
 
-// CleanUpCloudProvider we always check if the folder is there and remove it if yes because we know its absolute path
-// This covers cases where the finalizer was not added
-// We also remove the finalizer if either the folder is not present or we successfully deleted it.
-func (v *Provider) CleanUpCloudProvider(ctx context.Context, cluster *kubermaticv1.Cluster, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+// RelocateClusterFolder moves and/or renames the VM folder of the cluster to newFolder and updates the cluster
+// spec accordingly, so the cleanup will delete the folder at its new location.
+func (v *Provider) RelocateClusterFolder(ctx context.Context, cluster *kubermaticv1.Cluster, newFolder string, update provider.ClusterUpdater) (*kubermaticv1.Cluster, error) {
+	ctx, cancel := v.withSessionTimeout(ctx)
+	defer cancel()
+
+	log := v.logger(cluster)
+
+	oldFolder := cluster.Spec.Cloud.VSphere.Folder
+	if oldFolder == "" {
+		return nil, errors.New("cluster has no vSphere folder")
+	}
+
+	newFolder = path.Clean(newFolder)
+	if newFolder == path.Clean(oldFolder) {
+		return cluster, nil
+	}
+	dc, err := v.clusterDatacenter(cluster)
+	if err != nil {
+		return nil, err
+	}
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateFolderPath(rootPath, newFolder); err != nil {
+		return nil, err
+	}
+	if isSubPath(newFolder, oldFolder) {
+		return nil, fmt.Errorf("folder %q cannot be moved into itself", oldFolder)
+	}
+
 	username, password, err := GetCredentialsForCluster(cluster.Spec.Cloud, v.secretKeySelector, v.dc)
 	if err != nil {
 		return nil, err
 	}
 
-	session, err := newSession(ctx, v.dc, username, password, v.caBundle)
+	session, err := v.newSession(ctx, log, username, password)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
 	}
 	defer session.Logout(ctx)
 
-	restSession, err := newRESTSession(ctx, v.dc, username, password, v.caBundle)
+	err = relocateVMFolder(ctx, session, oldFolder, newFolder)
+	// The folder might have been renamed even if moving it failed and restoring its name failed too.
+	v.InvalidateFolderCache()
 	if err != nil {
-		return nil, fmt.Errorf("failed to create REST client session: %w", err)
+		return nil, fmt.Errorf("failed to relocate the VM folder %q to %q: %w", oldFolder, newFolder, err)
 	}
-	defer restSession.Logout(ctx)
+	log.Infow("Relocated VM folder", "from", oldFolder, "to", newFolder)
 
-	if kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer) {
-		if err := deleteVMFolder(ctx, session, cluster.Spec.Cloud.VSphere.Folder); err != nil {
-			return nil, err
-		}
-		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
-			kuberneteshelper.RemoveFinalizer(cluster, folderCleanupFinalizer)
-		})
-		if err != nil {
-			return nil, err
+	return update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
+		cluster.Spec.Cloud.VSphere.Folder = newFolder
+	})
+}
+
+// validateFolderPath checks that the folder is an absolute path below the root path. Paths with "." or ".."
+// segments are rejected, even if they resolve to a folder below the root path, as they would be passed to
+// vCenter as they are. Invalid paths are reported as ValidationError matching ErrInvalidFolderPath.
+func validateFolderPath(rootPath, folder string) error {
+	invalid := func(format string, args ...interface{}) error {
+		return &ValidationError{
+			Fields: []string{"vsphere.folder"},
+			Err:    fmt.Errorf("%w: %s", ErrInvalidFolderPath, fmt.Sprintf(format, args...)),
 		}
 	}
-	if kuberneteshelper.HasFinalizer(cluster, tagCategoryCleanupFinilizer) {
-		if err := deleteTagCategory(ctx, restSession, cluster); err != nil {
-			return nil, err
-		}
-		cluster, err = update(ctx, cluster.Name, func(cluster *kubermaticv1.Cluster) {
-			kuberneteshelper.RemoveFinalizer(cluster, tagCategoryCleanupFinilizer)
-		})
-		if err != nil {
-			return nil, err
-		}
+	if !path.IsAbs(folder) {
+		return invalid("%q provided by cluster spec is not an absolute path", folder)
 	}
-
-	return cluster, nil
-}
-
-// ValidateCloudSpecUpdate verifies whether an update of cloud spec is valid and permitted.
-func (v *Provider) ValidateCloudSpecUpdate(_ context.Context, oldSpec kubermaticv1.CloudSpec, newSpec kubermaticv1.CloudSpec) error {
-	if oldSpec.VSphere == nil || newSpec.VSphere == nil {
-		return errors.New("'vsphere' spec is empty")
+	for _, segment := range strings.Split(folder, "/") {
+		if segment == "." || segment == ".." {
+			return invalid("%q provided by cluster spec must not contain %q", folder, segment)
+		}
 	}
-
-	if oldSpec.VSphere.Folder != "" && oldSpec.VSphere.Folder != newSpec.VSphere.Folder {
-		return fmt.Errorf("updating vSphere folder is not supported (was %s, updated to %s)", oldSpec.VSphere.Folder, newSpec.VSphere.Folder)
+	if !isSubPath(folder, rootPath) {
+		return invalid("%q provided by cluster spec is not below the root path %q", folder, rootPath)
 	}
 
 	return nil
 }
 
 // GetDatastoreList returns a slice of Datastore of the datacenter from the passed cloudspec.
-func GetDatastoreList(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool) ([]*object.Datastore, error) {
-	session, err := newSession(ctx, dc, username, password, caBundle)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
-	}
-	defer session.Logout(ctx)
+func GetDatastoreList(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]*object.Datastore, error) {
+	var datastoreList []*object.Datastore
+	err := withBrowseSession(ctx, dc, username, password, caBundle, opts, func(session *Session) (err error) {
+		if datastoreList, err = session.Finder.DatastoreList(ctx, "*"); err != nil {
+			return fmt.Errorf("couldn't retrieve datastore list: %w", err)
+		}
+		return nil
+	})
 
-	datastoreList, err := session.Finder.DatastoreList(ctx, "*")
-	if err != nil {
-		return nil, fmt.Errorf("couldn't retrieve datastore list: %w", err)
-	}
+	return datastoreList, err
+}
+
+// CredentialSource tells where a username or password was read from.
+type CredentialSource string
+
+const (
+	// CredentialSourceDatacenterInfraManagementUser is the infra management user of the datacenter.
+	CredentialSourceDatacenterInfraManagementUser CredentialSource = "DatacenterInfraManagementUser"
+	// CredentialSourceClusterInfraManagementUser is the inline infra management user of the cluster.
+	CredentialSourceClusterInfraManagementUser CredentialSource = "ClusterInfraManagementUser"
+	// CredentialSourceCluster is the inline user of the cluster.
+	CredentialSourceCluster CredentialSource = "Cluster"
+	// CredentialSourceSecretInfraManagementUser is the infra management user key of the credentials secret.
+	CredentialSourceSecretInfraManagementUser CredentialSource = "SecretInfraManagementUser"
+	// CredentialSourceSecret is the user key of the credentials secret.
+	CredentialSourceSecret CredentialSource = "Secret"
+)
 
-	return datastoreList, nil
+// ResolvedCredentials are the credentials used for a cluster, together with their source. The username
+// and password may come from different sources, e.g. an inline username and a password from the secret.
+type ResolvedCredentials struct {
+	Username       string
+	Password       string
+	UsernameSource CredentialSource
+	PasswordSource CredentialSource
 }
 
 // Precedence if not infraManagementUser:
@@ -384,79 +2088,201 @@ func GetDatastoreList(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSpher
 // * User form clusters secret infraManagementUser
 // * User from clusters secret.
 func getUsernameAndPassword(cloud kubermaticv1.CloudSpec, secretKeySelector provider.SecretKeySelectorValueFunc, infraManagementUser bool) (username, password string, err error) {
+	creds, err := resolveUsernameAndPassword(cloud, secretKeySelector, infraManagementUser)
+	if err != nil {
+		return "", "", err
+	}
+
+	return creds.Username, creds.Password, nil
+}
+
+// resolveUsernameAndPassword implements getUsernameAndPassword, keeping track of the credential sources.
+func resolveUsernameAndPassword(cloud kubermaticv1.CloudSpec, secretKeySelector provider.SecretKeySelectorValueFunc, infraManagementUser bool) (*ResolvedCredentials, error) {
+	creds := &ResolvedCredentials{}
 	if infraManagementUser {
-		username = cloud.VSphere.InfraManagementUser.Username
-		password = cloud.VSphere.InfraManagementUser.Password
+		creds.Username = cloud.VSphere.InfraManagementUser.Username
+		creds.UsernameSource = CredentialSourceClusterInfraManagementUser
+		creds.Password = cloud.VSphere.InfraManagementUser.Password
+		creds.PasswordSource = CredentialSourceClusterInfraManagementUser
 	}
-	if username == "" {
-		username = cloud.VSphere.Username
+	if creds.Username == "" {
+		creds.Username = cloud.VSphere.Username
+		creds.UsernameSource = CredentialSourceCluster
 	}
-	if password == "" {
-		password = cloud.VSphere.Password
+	if creds.Password == "" {
+		creds.Password = cloud.VSphere.Password
+		creds.PasswordSource = CredentialSourceCluster
 	}
 
-	if username != "" && password != "" {
-		return username, password, nil
+	if creds.Username != "" && creds.Password != "" {
+		return creds, nil
 	}
 
 	if cloud.VSphere.CredentialsReference == nil {
-		return "", "", errors.New("cluster contains no password an and empty credentialsReference")
+		return nil, fmt.Errorf("%w: cluster contains no password an and empty credentialsReference", ErrNoCredentials)
 	}
 
-	if username == "" && infraManagementUser {
-		username, err = secretKeySelector(cloud.VSphere.CredentialsReference, resources.VsphereInfraManagementUserUsername)
-		if err != nil {
-			return "", "", err
+	// read sets the value from the key of the secret, unless it is set already.
+	read := func(value *string, source *CredentialSource, key string, keySource CredentialSource) error {
+		if *value != "" {
+			return nil
 		}
-	}
-	if username == "" {
-		username, err = secretKeySelector(cloud.VSphere.CredentialsReference, resources.VsphereUsername)
+		v, err := secretKeySelector(cloud.VSphere.CredentialsReference, key)
 		if err != nil {
-			return "", "", err
+			return err
 		}
+		*value, *source = v, keySource
+		return nil
 	}
 
-	if password == "" && infraManagementUser {
-		password, err = secretKeySelector(cloud.VSphere.CredentialsReference, resources.VsphereInfraManagementUserPassword)
-		if err != nil {
-			return "", "", err
+	if infraManagementUser {
+		if err := read(&creds.Username, &creds.UsernameSource, resources.VsphereInfraManagementUserUsername, CredentialSourceSecretInfraManagementUser); err != nil {
+			return nil, err
 		}
 	}
+	if err := read(&creds.Username, &creds.UsernameSource, resources.VsphereUsername, CredentialSourceSecret); err != nil {
+		return nil, err
+	}
 
-	if password == "" {
-		password, err = secretKeySelector(cloud.VSphere.CredentialsReference, resources.VspherePassword)
-		if err != nil {
-			return "", "", err
+	if infraManagementUser {
+		if err := read(&creds.Password, &creds.PasswordSource, resources.VsphereInfraManagementUserPassword, CredentialSourceSecretInfraManagementUser); err != nil {
+			return nil, err
 		}
 	}
+	if err := read(&creds.Password, &creds.PasswordSource, resources.VspherePassword, CredentialSourceSecret); err != nil {
+		return nil, err
+	}
 
-	if username == "" {
-		return "", "", errors.New("unable to get username")
+	if creds.Username == "" {
+		return nil, fmt.Errorf("%w: unable to get username", ErrNoCredentials)
 	}
 
-	if password == "" {
-		return "", "", errors.New("unable to get password")
+	if creds.Password == "" {
+		return nil, fmt.Errorf("%w: unable to get password", ErrNoCredentials)
 	}
 
-	return username, password, nil
+	return creds, nil
 }
 
 func GetCredentialsForCluster(cloud kubermaticv1.CloudSpec, secretKeySelector provider.SecretKeySelectorValueFunc, dc *kubermaticv1.DatacenterSpecVSphere) (string, string, error) {
-	var username, password string
-	var err error
+	creds, err := ResolveCredentialsWithSource(cloud, secretKeySelector, dc)
+	if err != nil {
+		return "", "", err
+	}
+
+	return creds.Username, creds.Password, nil
+}
 
+// ResolveCredentialsWithSource returns the same credentials as GetCredentialsForCluster, along with the source
+// of the username and password, so users can be shown whether inline values or the secret are used.
+func ResolveCredentialsWithSource(cloud kubermaticv1.CloudSpec, secretKeySelector provider.SecretKeySelectorValueFunc, dc *kubermaticv1.DatacenterSpecVSphere) (*ResolvedCredentials, error) {
 	// InfraManagementUser from Datacenter
 	if dc != nil && dc.InfraManagementUser != nil {
 		if dc.InfraManagementUser.Username != "" && dc.InfraManagementUser.Password != "" {
-			return dc.InfraManagementUser.Username, dc.InfraManagementUser.Password, nil
+			return &ResolvedCredentials{
+				Username:       dc.InfraManagementUser.Username,
+				Password:       dc.InfraManagementUser.Password,
+				UsernameSource: CredentialSourceDatacenterInfraManagementUser,
+				PasswordSource: CredentialSourceDatacenterInfraManagementUser,
+			}, nil
 		}
 	}
 
 	// InfraManagementUser from Cluster
-	username, password, err = getUsernameAndPassword(cloud, secretKeySelector, true)
+	return resolveUsernameAndPassword(cloud, secretKeySelector, true)
+}
+
+// ResolveInfraManagementUser returns a copy of the datacenter spec with the infra management user read from
+// the referenced secret, so its password doesn't need to be stored in plaintext in the Datacenter. The secret
+// uses the same keys as the cluster credentials secret and has to provide both of them, as the username and the
+// password must belong to the same user. Only if the secret has neither of the keys, the datacenter spec is returned
+// unchanged with its inline credentials, as it is for a nil reference.
+func ResolveInfraManagementUser(dc *kubermaticv1.DatacenterSpecVSphere, ref *providerconfig.GlobalSecretKeySelector, secretKeySelector provider.SecretKeySelectorValueFunc) (*kubermaticv1.DatacenterSpecVSphere, error) {
+	if ref == nil {
+		return dc, nil
+	}
+
+	// read returns the value of the key from the secret, a missing key being an empty value.
+	read := func(key string) (string, error) {
+		value, err := secretKeySelector(ref, key)
+		if err != nil && !errors.Is(err, provider.ErrSecretKeyNotFound) {
+			return "", fmt.Errorf("failed to read %q of the infra management user: %w", key, err)
+		}
+		return value, nil
+	}
+
+	username, err := read(resources.VsphereInfraManagementUserUsername)
 	if err != nil {
-		return "", "", err
+		return nil, err
+	}
+	password, err := read(resources.VsphereInfraManagementUserPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	if username == "" && password == "" {
+		if dc.InfraManagementUser == nil || dc.InfraManagementUser.Username == "" || dc.InfraManagementUser.Password == "" {
+			return nil, fmt.Errorf("%w: infra management user has neither a secret nor inline credentials", ErrNoCredentials)
+		}
+		return dc, nil
+	}
+	if username == "" {
+		return nil, fmt.Errorf("%w: secret of the infra management user has no %q", ErrNoCredentials, resources.VsphereInfraManagementUserUsername)
+	}
+	if password == "" {
+		return nil, fmt.Errorf("%w: secret of the infra management user has no %q", ErrNoCredentials, resources.VsphereInfraManagementUserPassword)
+	}
+
+	resolved := dc.DeepCopy()
+	resolved.InfraManagementUser = &kubermaticv1.VSphereCredentials{
+		Username: username,
+		Password: password,
+	}
+
+	return resolved, nil
+}
+
+// usesInfraManagementUser returns true if GetCredentialsForCluster returns the credentials of an
+// infra management user, configured either for the datacenter or the cluster, instead of the cluster user.
+func usesInfraManagementUser(cloud kubermaticv1.CloudSpec, secretKeySelector provider.SecretKeySelectorValueFunc, dc *kubermaticv1.DatacenterSpecVSphere) bool {
+	if dc != nil && dc.InfraManagementUser != nil && dc.InfraManagementUser.Username != "" && dc.InfraManagementUser.Password != "" {
+		return true
+	}
+
+	infraUsername, infraPassword, err := getUsernameAndPassword(cloud, secretKeySelector, true)
+	if err != nil {
+		return false
+	}
+	username, password, err := getUsernameAndPassword(cloud, secretKeySelector, false)
+	if err != nil {
+		return false
+	}
+
+	return infraUsername != username || infraPassword != password
+}
+
+// GetCSICredentialsForCluster returns the credentials for the CSI driver and cloud-controller-manager.
+// Precedence:
+// * CSI user from clusters secret
+// * User from cluster
+// * User from clusters secret.
+// The infra management user is never used, as it is meant for everything except the cloud provider functionality.
+func GetCSICredentialsForCluster(cloud kubermaticv1.CloudSpec, secretKeySelector provider.SecretKeySelectorValueFunc) (string, string, error) {
+	if cloud.VSphere.CredentialsReference != nil {
+		// The CSI keys are optional, so any error while reading them just means we fall back to
+		// the main user. A secret that cannot be read at all will fail the fallback lookup anyway.
+		username, _ := secretKeySelector(cloud.VSphere.CredentialsReference, CSIUsername)
+		password, _ := secretKeySelector(cloud.VSphere.CredentialsReference, CSIPassword)
+
+		switch {
+		case username != "" && password != "":
+			return username, password, nil
+		case username != "":
+			return "", "", fmt.Errorf("%w: CSI user %q is configured without a password", ErrNoCredentials, username)
+		case password != "":
+			return "", "", fmt.Errorf("%w: CSI password is configured without a user", ErrNoCredentials)
+		}
 	}
 
-	return username, password, nil
+	return getUsernameAndPassword(cloud, secretKeySelector, false)
 }
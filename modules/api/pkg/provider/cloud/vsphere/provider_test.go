@@ -17,20 +17,56 @@ limitations under the License.
 package vsphere
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/vmware/govmomi/object"
+	_ "github.com/vmware/govmomi/pbm/simulator"
 	"github.com/vmware/govmomi/simulator"
+	_ "github.com/vmware/govmomi/vapi/simulator"
+	"github.com/vmware/govmomi/vapi/tags"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 
 	providerconfig "github.com/kubermatic/machine-controller/pkg/providerconfig/types"
 	"k8c.io/dashboard/v2/pkg/provider"
 	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	kuberneteshelper "k8c.io/kubermatic/v2/pkg/kubernetes"
 	"k8c.io/kubermatic/v2/pkg/resources"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/wait"
 )
 
 const (
-	fakeStoragePolicy = "fake_storage_policy"
+	// fakeStoragePolicy is one of the storage policies the PBM simulator comes with.
+	fakeStoragePolicy = "vSAN Default Storage Policy"
 )
 
 func TestGetCredentialsForCluster(t *testing.T) {
@@ -41,7 +77,7 @@ func TestGetCredentialsForCluster(t *testing.T) {
 		dc                *kubermaticv1.DatacenterSpecVSphere
 		expectedUser      string
 		expectedPassword  string
-		expectedError     string
+		expectedError     error
 	}{
 		{
 			name:             "User from cluster",
@@ -119,6 +155,17 @@ func TestGetCredentialsForCluster(t *testing.T) {
 			expectedUser:     "dc-user",
 			expectedPassword: "dc-pass",
 		},
+		{
+			name:          "No credentials at all",
+			cloudspec:     testVsphereCloudSpec("", "", "", "", false),
+			expectedError: ErrNoCredentials,
+		},
+		{
+			name:              "Secret without credentials",
+			cloudspec:         testVsphereCloudSpec("", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{}),
+			expectedError:     ErrNoCredentials,
+		},
 	}
 
 	for _, tc := range tcs {
@@ -131,8 +178,216 @@ func TestGetCredentialsForCluster(t *testing.T) {
 				}
 			}()
 			user, password, err := GetCredentialsForCluster(tc.cloudspec, tc.secretKeySelector, tc.dc)
-			if (tc.expectedError == "" && err != nil) || (tc.expectedError != "" && err == nil) {
-				t.Fatalf("Expected error %q, got error %v", tc.expectedError, err)
+			if (tc.expectedError == nil && err != nil) || !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Expected error %v, got error %v", tc.expectedError, err)
+			}
+			if user != tc.expectedUser {
+				t.Errorf("expected user %q, got user %q", tc.expectedUser, user)
+			}
+			if password != tc.expectedPassword {
+				t.Errorf("expected password %q, got password %q", tc.expectedPassword, password)
+			}
+		})
+	}
+}
+
+func TestResolveCredentialsWithSource(t *testing.T) {
+	tcs := []struct {
+		name              string
+		cloudspec         kubermaticv1.CloudSpec
+		secretKeySelector provider.SecretKeySelectorValueFunc
+		dc                *kubermaticv1.DatacenterSpecVSphere
+		expected          *ResolvedCredentials
+		expectedError     error
+	}{
+		{
+			name:      "Datacenter infra management user",
+			cloudspec: testVsphereCloudSpec("user", "pass", "", "", false),
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				InfraManagementUser: &kubermaticv1.VSphereCredentials{Username: "dc-user", Password: "dc-pass"},
+			},
+			expected: &ResolvedCredentials{
+				Username:       "dc-user",
+				Password:       "dc-pass",
+				UsernameSource: CredentialSourceDatacenterInfraManagementUser,
+				PasswordSource: CredentialSourceDatacenterInfraManagementUser,
+			},
+		},
+		{
+			name:      "Cluster infra management user",
+			cloudspec: testVsphereCloudSpec("user", "pass", "infra-user", "infra-pass", false),
+			expected: &ResolvedCredentials{
+				Username:       "infra-user",
+				Password:       "infra-pass",
+				UsernameSource: CredentialSourceClusterInfraManagementUser,
+				PasswordSource: CredentialSourceClusterInfraManagementUser,
+			},
+		},
+		{
+			name:      "Inline cluster user",
+			cloudspec: testVsphereCloudSpec("user", "pass", "", "", false),
+			expected: &ResolvedCredentials{
+				Username:       "user",
+				Password:       "pass",
+				UsernameSource: CredentialSourceCluster,
+				PasswordSource: CredentialSourceCluster,
+			},
+		},
+		{
+			name:      "Secret infra management user key",
+			cloudspec: testVsphereCloudSpec("", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				resources.VsphereInfraManagementUserUsername: "infra-user",
+				resources.VsphereInfraManagementUserPassword: "infra-pass",
+				resources.VsphereUsername:                    "user",
+				resources.VspherePassword:                    "pass",
+			}),
+			expected: &ResolvedCredentials{
+				Username:       "infra-user",
+				Password:       "infra-pass",
+				UsernameSource: CredentialSourceSecretInfraManagementUser,
+				PasswordSource: CredentialSourceSecretInfraManagementUser,
+			},
+		},
+		{
+			name:      "Secret user key",
+			cloudspec: testVsphereCloudSpec("", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				resources.VsphereUsername: "user",
+				resources.VspherePassword: "pass",
+			}),
+			expected: &ResolvedCredentials{
+				Username:       "user",
+				Password:       "pass",
+				UsernameSource: CredentialSourceSecret,
+				PasswordSource: CredentialSourceSecret,
+			},
+		},
+		{
+			name:      "Inline username and password from secret",
+			cloudspec: testVsphereCloudSpec("user", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				resources.VspherePassword: "pass",
+			}),
+			expected: &ResolvedCredentials{
+				Username:       "user",
+				Password:       "pass",
+				UsernameSource: CredentialSourceCluster,
+				PasswordSource: CredentialSourceSecret,
+			},
+		},
+		{
+			name:          "No credentials at all",
+			cloudspec:     testVsphereCloudSpec("", "", "", "", false),
+			expectedError: ErrNoCredentials,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			creds, err := ResolveCredentialsWithSource(tc.cloudspec, tc.secretKeySelector, tc.dc)
+			if (tc.expectedError == nil && err != nil) || !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Expected error %v, got error %v", tc.expectedError, err)
+			}
+			if changes := diff.ObjectDiff(tc.expected, creds); changes != "" {
+				t.Errorf("unexpected credentials (-want +got):\n%s", changes)
+			}
+		})
+	}
+}
+
+func TestGetCSICredentialsForCluster(t *testing.T) {
+	tcs := []struct {
+		name              string
+		cloudspec         kubermaticv1.CloudSpec
+		secretKeySelector provider.SecretKeySelectorValueFunc
+		expectedUser      string
+		expectedPassword  string
+		expectedError     error
+	}{
+		{
+			name:      "CSI user from secret",
+			cloudspec: testVsphereCloudSpec("", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				CSIUsername:               "csi-user",
+				CSIPassword:               "csi-pass",
+				resources.VsphereUsername: "user",
+				resources.VspherePassword: "pass",
+			}),
+			expectedUser:     "csi-user",
+			expectedPassword: "csi-pass",
+		},
+		{
+			name:      "CSI user from secret takes precedence over user from cluster",
+			cloudspec: testVsphereCloudSpec("user", "pass", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				CSIUsername: "csi-user",
+				CSIPassword: "csi-pass",
+			}),
+			expectedUser:     "csi-user",
+			expectedPassword: "csi-pass",
+		},
+		{
+			name:      "Fallback to user from cluster",
+			cloudspec: testVsphereCloudSpec("user", "pass", "infra-user", "infra-pass", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				resources.VsphereInfraManagementUserUsername: "secret-infra-user",
+				resources.VsphereInfraManagementUserPassword: "secret-infra-pass",
+			}),
+			expectedUser:     "user",
+			expectedPassword: "pass",
+		},
+		{
+			name:      "Fallback to user from secret",
+			cloudspec: testVsphereCloudSpec("", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				resources.VsphereUsername:                    "user",
+				resources.VspherePassword:                    "pass",
+				resources.VsphereInfraManagementUserUsername: "infra-user",
+				resources.VsphereInfraManagementUserPassword: "infra-pass",
+			}),
+			expectedUser:     "user",
+			expectedPassword: "pass",
+		},
+		{
+			name:             "Fallback to user from cluster without credentials reference",
+			cloudspec:        testVsphereCloudSpec("user", "pass", "", "", false),
+			expectedUser:     "user",
+			expectedPassword: "pass",
+		},
+		{
+			name:      "CSI user without password",
+			cloudspec: testVsphereCloudSpec("user", "pass", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				CSIUsername: "csi-user",
+			}),
+			expectedError: ErrNoCredentials,
+		},
+		{
+			name:      "CSI password without user",
+			cloudspec: testVsphereCloudSpec("user", "pass", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{
+				CSIPassword: "csi-pass",
+			}),
+			expectedError: ErrNoCredentials,
+		},
+		{
+			name:              "No credentials at all",
+			cloudspec:         testVsphereCloudSpec("", "", "", "", true),
+			secretKeySelector: testSecretKeySelectorValueFuncFactory(map[string]string{}),
+			expectedError:     ErrNoCredentials,
+		},
+	}
+
+	for _, tc := range tcs {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			user, password, err := GetCSICredentialsForCluster(tc.cloudspec, tc.secretKeySelector)
+			if (tc.expectedError == nil && err != nil) || !errors.Is(err, tc.expectedError) {
+				t.Fatalf("Expected error %v, got error %v", tc.expectedError, err)
 			}
 			if user != tc.expectedUser {
 				t.Errorf("expected user %q, got user %q", tc.expectedUser, user)
@@ -144,6 +399,111 @@ func TestGetCredentialsForCluster(t *testing.T) {
 	}
 }
 
+func TestResolveInfraManagementUser(t *testing.T) {
+	ref := &providerconfig.GlobalSecretKeySelector{}
+
+	tests := []struct {
+		name             string
+		inline           *kubermaticv1.VSphereCredentials
+		secret           map[string]string
+		expectedUser     string
+		expectedPassword string
+		expectedErr      error
+	}{
+		{
+			name:   "Credentials from secret",
+			inline: &kubermaticv1.VSphereCredentials{Username: "inline-user", Password: "inline-pass"},
+			secret: map[string]string{
+				resources.VsphereInfraManagementUserUsername: "secret-user",
+				resources.VsphereInfraManagementUserPassword: "secret-pass",
+			},
+			expectedUser:     "secret-user",
+			expectedPassword: "secret-pass",
+		},
+		{
+			// The inline user must not be combined with the password of the secret.
+			name:   "Password from secret and inline user",
+			inline: &kubermaticv1.VSphereCredentials{Username: "inline-user", Password: "inline-pass"},
+			secret: map[string]string{
+				resources.VsphereInfraManagementUserPassword: "secret-pass",
+			},
+			expectedErr: ErrNoCredentials,
+		},
+		{
+			name:             "Inline credentials as fallback",
+			inline:           &kubermaticv1.VSphereCredentials{Username: "inline-user", Password: "inline-pass"},
+			expectedUser:     "inline-user",
+			expectedPassword: "inline-pass",
+		},
+		{
+			name: "No password",
+			secret: map[string]string{
+				resources.VsphereInfraManagementUserUsername: "secret-user",
+			},
+			expectedErr: ErrNoCredentials,
+		},
+		{
+			name:        "No credentials",
+			expectedErr: ErrNoCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{InfraManagementUser: tt.inline}
+			resolved, err := ResolveInfraManagementUser(dc, ref, testSecretKeySelectorValueFuncFactory(tt.secret))
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+			}
+			if err != nil {
+				return
+			}
+
+			if resolved.InfraManagementUser.Username != tt.expectedUser || resolved.InfraManagementUser.Password != tt.expectedPassword {
+				t.Errorf("expected %s:%s, got %s:%s", tt.expectedUser, tt.expectedPassword, resolved.InfraManagementUser.Username, resolved.InfraManagementUser.Password)
+			}
+			if tt.inline != nil && dc.InfraManagementUser != tt.inline {
+				t.Error("expected the datacenter spec to be left unchanged")
+			}
+		})
+	}
+
+	// Only missing keys fall back to the inline credentials, other errors reading the secret are returned.
+	dc := &kubermaticv1.DatacenterSpecVSphere{InfraManagementUser: &kubermaticv1.VSphereCredentials{Username: "inline-user", Password: "inline-pass"}}
+	for _, tt := range []struct {
+		selectorErr error
+		expectedErr error
+	}{
+		{selectorErr: fmt.Errorf("secret has no key: %w", provider.ErrSecretKeyNotFound)},
+		{selectorErr: errSecretUnavailable, expectedErr: errSecretUnavailable},
+	} {
+		selectorErr := tt.selectorErr
+		resolved, err := ResolveInfraManagementUser(dc, ref, func(*providerconfig.GlobalSecretKeySelector, string) (string, error) {
+			return "", selectorErr
+		})
+		if !errors.Is(err, tt.expectedErr) {
+			t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+		}
+		if err == nil && resolved.InfraManagementUser.Username != "inline-user" {
+			t.Errorf("expected the inline credentials to be used, got user %q", resolved.InfraManagementUser.Username)
+		}
+	}
+
+	// The provider must log in with the user from the secret.
+	selector := testSecretKeySelectorValueFuncFactory(map[string]string{
+		resources.VsphereInfraManagementUserUsername: "secret-user",
+		resources.VsphereInfraManagementUserPassword: "secret-pass",
+	})
+	v, err := NewCloudProvider(&kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: dc}}, selector, nil, WithInfraManagementUserReference(ref))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	if username, password, _ := GetCredentialsForCluster(kubermaticv1.CloudSpec{}, nil, v.dc); username != "secret-user" || password != "secret-pass" {
+		t.Errorf("expected the provider to use secret-user:secret-pass, got %s:%s", username, password)
+	}
+}
+
+var errSecretUnavailable = errors.New("secret is unavailable")
+
 func testSecretKeySelectorValueFuncFactory(values map[string]string) provider.SecretKeySelectorValueFunc {
 	return func(_ *providerconfig.GlobalSecretKeySelector, key string) (string, error) {
 		if val, ok := values[key]; ok {
@@ -177,6 +537,10 @@ func TestProviderValidateCloudSpec(t *testing.T) {
 		dc      *kubermaticv1.DatacenterSpecVSphere
 		spec    kubermaticv1.CloudSpec
 		wantErr bool
+		// wantErrIs optionally asserts the type of the returned error.
+		wantErrIs error
+		// defaultResourcePool is the default resource pool of the provider.
+		defaultResourcePool string
 	}{
 		{
 			name: "No datastore at Datacenter level nor datastore or datastore cluster at cluster level",
@@ -184,7 +548,8 @@ func TestProviderValidateCloudSpec(t *testing.T) {
 			spec: kubermaticv1.CloudSpec{
 				VSphere: &kubermaticv1.VSphereCloudSpec{},
 			},
-			wantErr: true,
+			wantErr:   true,
+			wantErrIs: ErrMissingDatastore,
 		},
 		{
 			name: "No datastore at Datacenter level but datastore at cluster level",
@@ -214,7 +579,8 @@ func TestProviderValidateCloudSpec(t *testing.T) {
 					DatastoreCluster: "DC0_POD0",
 				},
 			},
-			wantErr: true,
+			wantErr:   true,
+			wantErrIs: ErrDatastoreConflict,
 		},
 		{
 			name: "Default datastore at datacenter level",
@@ -284,43 +650,4025 @@ func TestProviderValidateCloudSpec(t *testing.T) {
 			},
 			wantErr: true,
 		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			sim := vSphereSimulator{t: t}
-			sim.setUp()
-			defer sim.tearDown()
-			sim.fillClientInfo(tt.dc)
-			v := &Provider{
-				dc: tt.dc,
-			}
-			if err := v.ValidateCloudSpec(context.Background(), tt.spec); (err != nil) != tt.wantErr {
-				t.Errorf("Provider.ValidateCloudSpec() error = %v, wantErr %v", err, tt.wantErr)
-			}
-		})
-	}
-}
-
-// The following resources are made available:
-// * Datastore named: LocalDS_0
-// * Datastore cluster named: DC0_POD0.
-type vSphereSimulator struct {
-	t      *testing.T
-	model  *simulator.Model
-	server *simulator.Server
-}
-
-func (v *vSphereSimulator) setUp() {
-	v.model = simulator.VPX()
-	// Pod == StoragePod == DatastoreCluster
-	v.model.Pod++
-	v.model.Cluster++
-
-	err := v.model.Create()
-	if err != nil {
-		v.t.Fatal(err)
-	}
-
+		{
+			name: "Non existing storage policy at cluster level",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore:     "LocalDS_0",
+				DefaultStoragePolicy: fakeStoragePolicy,
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					StoragePolicy: "i-do-not-exist",
+				},
+			},
+			wantErr:   true,
+			wantErrIs: ErrStoragePolicyNotFound,
+		},
+		{
+			name: "Non existing default storage policy at datacenter level",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore:     "LocalDS_0",
+				DefaultStoragePolicy: "i-do-not-exist",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+			wantErr:   true,
+			wantErrIs: ErrStoragePolicyNotFound,
+		},
+		{
+			name: "Storage policy together with datastore cluster at cluster level",
+			dc:   &kubermaticv1.DatacenterSpecVSphere{},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					DatastoreCluster: "DC0_POD0",
+					StoragePolicy:    "VM Encryption Policy",
+				},
+			},
+		},
+		{
+			name: "Storage policy with both datastore and datastore cluster at cluster level",
+			dc:   &kubermaticv1.DatacenterSpecVSphere{},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Datastore:        "LocalDS_0",
+					DatastoreCluster: "DC0_POD0",
+					StoragePolicy:    fakeStoragePolicy,
+				},
+			},
+			wantErr:   true,
+			wantErrIs: ErrDatastoreConflict,
+		},
+		{
+			name: "Storage policy without any datastore",
+			dc:   &kubermaticv1.DatacenterSpecVSphere{},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					StoragePolicy: fakeStoragePolicy,
+				},
+			},
+			wantErr:   true,
+			wantErrIs: ErrMissingDatastore,
+		},
+		{
+			name: "Existing folder below the root path",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore:     "LocalDS_0",
+				DefaultStoragePolicy: fakeStoragePolicy,
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/vm",
+				},
+			},
+		},
+		{
+			name: "Non existing folder below the root path",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/vm/i-do-not-exist",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Existing folder outside of the root path",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/host",
+				},
+			},
+			wantErr: true,
+		},
+		{
+			name: "Folder sharing a prefix with the root path",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/vm-other",
+				},
+			},
+			wantErr:   true,
+			wantErrIs: ErrInvalidFolderPath,
+		},
+		{
+			name: "Folder traversing out of the root path",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/vm/../host",
+				},
+			},
+			wantErr:   true,
+			wantErrIs: ErrInvalidFolderPath,
+		},
+		{
+			name: "Default resource pool of the datacenter",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+			defaultResourcePool: "/DC0/host/DC0_C0/Resources",
+		},
+		{
+			name: "Resource pool at cluster level overrides the default resource pool",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					ResourcePool: "/DC0/host/DC0_C1/Resources",
+				},
+			},
+			defaultResourcePool: "/DC0/host/DC0_C0/Resources",
+		},
+		{
+			name: "Non existing resource pool at cluster level overriding the default resource pool",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					ResourcePool: "missing-pool",
+				},
+			},
+			defaultResourcePool: "/DC0/host/DC0_C0/Resources",
+			wantErr:             true,
+		},
+		{
+			name: "Non existing default resource pool of the datacenter",
+			dc: &kubermaticv1.DatacenterSpecVSphere{
+				DefaultDatastore: "LocalDS_0",
+			},
+			spec: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					ResourcePool: "/DC0/host/DC0_C0/Resources",
+				},
+			},
+			defaultResourcePool: "missing-pool",
+			wantErr:             true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := vSphereSimulator{t: t}
+			sim.setUp()
+			defer sim.tearDown()
+			sim.fillClientInfo(tt.dc)
+			v := &Provider{
+				dc:                  tt.dc,
+				defaultResourcePool: tt.defaultResourcePool,
+			}
+			err := v.ValidateCloudSpec(context.Background(), tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Provider.ValidateCloudSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Provider.ValidateCloudSpec() error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestProviderValidateCloudSpecAggregatesErrors(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+
+	spec := kubermaticv1.CloudSpec{
+		VSphere: &kubermaticv1.VSphereCloudSpec{
+			Datastore:     "missing-datastore",
+			ResourcePool:  "missing-pool",
+			StoragePolicy: "missing-policy",
+			Folder:        "/DC0/vm/missing-folder",
+		},
+	}
+
+	err := v.ValidateCloudSpec(context.Background(), spec)
+	if err == nil {
+		t.Fatal("expected the cloud spec to be invalid")
+	}
+
+	var aggregate kerrors.Aggregate
+	if !errors.As(err, &aggregate) || len(aggregate.Errors()) != 4 {
+		t.Fatalf("expected all four problems to be reported, got %v", err)
+	}
+	for _, name := range []string{"missing-pool", "missing-datastore", "missing-policy", "missing-folder"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected %q to be reported, got %v", name, err)
+		}
+	}
+	if !errors.Is(err, ErrStoragePolicyNotFound) {
+		t.Errorf("expected the errors to be matchable, got %v", err)
+	}
+
+	// A single problem is not wrapped into an aggregate.
+	spec.VSphere = &kubermaticv1.VSphereCloudSpec{Datastore: "LocalDS_0", ResourcePool: "missing-pool"}
+	err = v.ValidateCloudSpec(context.Background(), spec)
+	if err == nil || errors.As(err, &aggregate) {
+		t.Errorf("expected a single error, got %v", err)
+	}
+}
+
+func TestProviderValidateCloudSpecFieldErrors(t *testing.T) {
+	v := &Provider{dc: &kubermaticv1.DatacenterSpecVSphere{}}
+	spec := kubermaticv1.CloudSpec{
+		VSphere: &kubermaticv1.VSphereCloudSpec{
+			Username:         "user",
+			Password:         "pass",
+			Datastore:        "LocalDS_0",
+			DatastoreCluster: "DC0_POD0",
+		},
+	}
+
+	err := v.ValidateCloudSpec(context.Background(), spec)
+
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected a validation error, got %v", err)
+	}
+	if err.Error() != ErrDatastoreConflict.Error() {
+		t.Errorf("expected the message %q to be kept, got %q", ErrDatastoreConflict.Error(), err.Error())
+	}
+
+	fieldErrs := validationErr.FieldErrors(field.NewPath("spec", "cloud"))
+	expectedFields := []string{"spec.cloud.vsphere.datastore", "spec.cloud.vsphere.datastoreCluster"}
+	if len(fieldErrs) != len(expectedFields) {
+		t.Fatalf("expected errors for the fields %v, got %v", expectedFields, fieldErrs)
+	}
+	for i, fieldErr := range fieldErrs {
+		if fieldErr.Field != expectedFields[i] || fieldErr.Type != field.ErrorTypeInvalid || fieldErr.Detail != ErrDatastoreConflict.Error() {
+			t.Errorf("expected an invalid value error for %q, got %v", expectedFields[i], fieldErr)
+		}
+	}
+}
+
+func TestProviderValidateCloudSpecResolvedPaths(t *testing.T) {
+	model := simulator.VPX()
+	model.Pool = 1
+	sim := vSphereSimulator{t: t, model: model}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	if _, err := createVMFolder(ctx, session, "/DC0/vm/kubermatic"); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+
+	tests := []struct {
+		name                string
+		dcDatastore         string
+		defaultResourcePool string
+		spec                kubermaticv1.VSphereCloudSpec
+		wantErr             bool
+		expectedPaths       map[string]string
+	}{
+		{
+			name: "Objects of the cluster by their names",
+			spec: kubermaticv1.VSphereCloudSpec{
+				Datastore:    "LocalDS_0",
+				ResourcePool: "DC0_C0_RP1",
+				Folder:       "/DC0/vm/kubermatic",
+			},
+			expectedPaths: map[string]string{
+				"vsphere.datastore":    "/DC0/datastore/LocalDS_0",
+				"vsphere.resourcePool": "/DC0/host/DC0_C0/Resources/DC0_C0_RP1",
+				"vsphere.folder":       "/DC0/vm/kubermatic",
+			},
+		},
+		{
+			name: "Datastore cluster",
+			spec: kubermaticv1.VSphereCloudSpec{DatastoreCluster: "DC0_POD0"},
+			expectedPaths: map[string]string{
+				"vsphere.datastoreCluster": "/DC0/datastore/DC0_POD0",
+			},
+		},
+		{
+			name:                "Defaults of the datacenter",
+			dcDatastore:         "LocalDS_0",
+			defaultResourcePool: "DC0_C1_RP1",
+			expectedPaths: map[string]string{
+				"vsphere.datastore":    "/DC0/datastore/LocalDS_0",
+				"vsphere.resourcePool": "/DC0/host/DC0_C1/Resources/DC0_C1_RP1",
+			},
+		},
+		{
+			name:                "Defaults of the datacenter overridden by the cluster",
+			dcDatastore:         "LocalDS_0",
+			defaultResourcePool: "DC0_C1_RP1",
+			spec:                kubermaticv1.VSphereCloudSpec{DatastoreCluster: "DC0_POD0", ResourcePool: "DC0_C0_RP1"},
+			expectedPaths: map[string]string{
+				"vsphere.datastoreCluster": "/DC0/datastore/DC0_POD0",
+				"vsphere.resourcePool":     "/DC0/host/DC0_C0/Resources/DC0_C0_RP1",
+			},
+		},
+		{
+			name:    "Missing objects are left out",
+			spec:    kubermaticv1.VSphereCloudSpec{Datastore: "missing", ResourcePool: "DC0_C0_RP1"},
+			wantErr: true,
+			expectedPaths: map[string]string{
+				"vsphere.resourcePool": "/DC0/host/DC0_C0/Resources/DC0_C0_RP1",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := dc.DeepCopy()
+			dc.DefaultDatastore = tt.dcDatastore
+			v := &Provider{dc: dc, defaultResourcePool: tt.defaultResourcePool}
+
+			result := v.ValidateCloudSpecWithWarnings(ctx, kubermaticv1.CloudSpec{VSphere: &tt.spec})
+			if err := result.Err(); (err != nil) != tt.wantErr {
+				t.Fatalf("Provider.ValidateCloudSpecWithWarnings() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if changes := diff.ObjectDiff(tt.expectedPaths, result.ResolvedPaths); changes != "" {
+				t.Errorf("Got resolved paths differ from expected ones. Diff: %v", changes)
+			}
+		})
+	}
+}
+
+func TestProviderValidateCloudSpecInfraManagementUser(t *testing.T) {
+	// The simulator only accepts the infra management user.
+	sim := vSphereSimulator{t: t, user: url.UserPassword("infra", "secret")}
+	sim.setUp()
+	defer sim.tearDown()
+
+	tests := []struct {
+		name string
+		// dcInfraUser is the infra management user of the datacenter.
+		dcInfraUser *kubermaticv1.VSphereCredentials
+		spec        kubermaticv1.VSphereCloudSpec
+		wantErr     bool
+		wantErrIs   error
+	}{
+		{
+			name:        "Valid infra management user at datacenter level and invalid cluster user",
+			dcInfraUser: &kubermaticv1.VSphereCredentials{Username: "infra", Password: "secret"},
+			spec:        kubermaticv1.VSphereCloudSpec{Username: "cluster", Password: "wrong"},
+		},
+		{
+			name:        "Invalid infra management user at datacenter level",
+			dcInfraUser: &kubermaticv1.VSphereCredentials{Username: "infra", Password: "wrong"},
+			spec:        kubermaticv1.VSphereCloudSpec{Username: "infra", Password: "secret"},
+			wantErr:     true,
+			wantErrIs:   ErrInvalidInfraManagementCredentials,
+		},
+		{
+			name: "Invalid infra management user at cluster level",
+			spec: kubermaticv1.VSphereCloudSpec{
+				Username:            "infra",
+				Password:            "secret",
+				InfraManagementUser: kubermaticv1.VSphereCredentials{Username: "infra", Password: "wrong"},
+			},
+			wantErr:   true,
+			wantErrIs: ErrInvalidInfraManagementCredentials,
+		},
+		{
+			name:    "Invalid cluster user without infra management user",
+			spec:    kubermaticv1.VSphereCloudSpec{Username: "cluster", Password: "wrong"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{DefaultDatastore: "LocalDS_0"}
+			sim.fillClientInfo(dc)
+			dc.InfraManagementUser = tt.dcInfraUser
+
+			v := &Provider{dc: dc}
+			err := v.ValidateCloudSpec(context.Background(), kubermaticv1.CloudSpec{VSphere: &tt.spec})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provider.ValidateCloudSpec() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("Provider.ValidateCloudSpec() error = %v, want %v", err, tt.wantErrIs)
+			}
+			if tt.wantErrIs == nil && errors.Is(err, ErrInvalidInfraManagementCredentials) {
+				t.Errorf("Provider.ValidateCloudSpec() error = %v, must not blame the infra management user", err)
+			}
+		})
+	}
+}
+
+func TestBrowseCredentials(t *testing.T) {
+	infraUser := &kubermaticv1.VSphereCredentials{Username: "infra", Password: "infra-secret"}
+
+	tests := []struct {
+		name             string
+		dcInfraUser      *kubermaticv1.VSphereCredentials
+		opts             []SessionOption
+		expectedUsername string
+		expectedPassword string
+		expectedInfra    *kubermaticv1.VSphereCredentials
+	}{
+		{
+			name:             "Given user",
+			expectedUsername: "cluster",
+			expectedPassword: "cluster-secret",
+		},
+		{
+			name:             "Infra management user takes precedence over the given user",
+			dcInfraUser:      infraUser,
+			expectedUsername: "cluster",
+			expectedPassword: "cluster-secret",
+			expectedInfra:    infraUser,
+		},
+		{
+			name:             "Browse user takes precedence over the given user",
+			opts:             []SessionOption{WithBrowseUser("browse", "browse-secret")},
+			expectedUsername: "browse",
+			expectedPassword: "browse-secret",
+		},
+		{
+			name:             "Browse user takes precedence over the infra management user",
+			dcInfraUser:      infraUser,
+			opts:             []SessionOption{WithBrowseUser("browse", "browse-secret")},
+			expectedUsername: "browse",
+			expectedPassword: "browse-secret",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{InfraManagementUser: tt.dcInfraUser}
+
+			browseDC, username, password := browseCredentials(dc, "cluster", "cluster-secret", newSessionOptions(tt.opts))
+			if username != tt.expectedUsername || password != tt.expectedPassword {
+				t.Errorf("expected credentials %s/%s, got %s/%s", tt.expectedUsername, tt.expectedPassword, username, password)
+			}
+			if changes := diff.ObjectDiff(tt.expectedInfra, browseDC.InfraManagementUser); changes != "" {
+				t.Errorf("Got infra management user differs from expected one. Diff: %v", changes)
+			}
+			if dc.InfraManagementUser != tt.dcInfraUser {
+				t.Error("expected the datacenter spec to be left untouched")
+			}
+		})
+	}
+}
+
+func TestBrowseUser(t *testing.T) {
+	// The simulator only accepts the browse user.
+	sim := vSphereSimulator{t: t, user: url.UserPassword("browse", "secret")}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{DefaultDatastore: "LocalDS_0"}
+	sim.fillClientInfo(dc)
+	browseUser := WithBrowseUser("browse", "secret")
+
+	ctx := context.Background()
+	if _, err := GetNetworks(ctx, dc, "", "", nil, browseUser); err != nil {
+		t.Errorf("expected the networks to be listed as the browse user, got %v", err)
+	}
+	if _, err := GetDatastoreList(ctx, dc, "", "", nil, browseUser); err != nil {
+		t.Errorf("expected the datastores to be listed as the browse user, got %v", err)
+	}
+	if _, err := GetNetworks(ctx, dc, "", "", nil); !isInvalidLogin(err) {
+		t.Errorf("expected the networks to be listed as the infra management user, got %v", err)
+	}
+
+	// Provisioning operations never use the browse user.
+	v := &Provider{dc: dc, sessionOptions: []SessionOption{browseUser}}
+	if _, err := v.GetVMFolders(ctx, "", ""); err != nil {
+		t.Errorf("expected the folders to be listed as the browse user, got %v", err)
+	}
+	err := v.ValidateCloudSpec(ctx, kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{}})
+	if !errors.Is(err, ErrInvalidInfraManagementCredentials) {
+		t.Errorf("expected the cloud spec to be validated as the infra management user, got %v", err)
+	}
+}
+
+func TestProviderDefaultCloudSpec(t *testing.T) {
+	tests := []struct {
+		name                string
+		dcDatastore         string
+		defaultResourcePool string
+		spec                kubermaticv1.VSphereCloudSpec
+		expectedSpec        kubermaticv1.VSphereCloudSpec
+	}{
+		{
+			name:         "No defaults",
+			spec:         kubermaticv1.VSphereCloudSpec{},
+			expectedSpec: kubermaticv1.VSphereCloudSpec{},
+		},
+		{
+			name:         "Datastore from datacenter",
+			dcDatastore:  "LocalDS_0",
+			spec:         kubermaticv1.VSphereCloudSpec{},
+			expectedSpec: kubermaticv1.VSphereCloudSpec{Datastore: "LocalDS_0"},
+		},
+		{
+			name:         "Datastore at cluster level is kept",
+			dcDatastore:  "LocalDS_0",
+			spec:         kubermaticv1.VSphereCloudSpec{Datastore: "LocalDS_1"},
+			expectedSpec: kubermaticv1.VSphereCloudSpec{Datastore: "LocalDS_1"},
+		},
+		{
+			name:         "Datastore cluster at cluster level prevents datastore defaulting",
+			dcDatastore:  "LocalDS_0",
+			spec:         kubermaticv1.VSphereCloudSpec{DatastoreCluster: "DC0_POD0"},
+			expectedSpec: kubermaticv1.VSphereCloudSpec{DatastoreCluster: "DC0_POD0"},
+		},
+		{
+			name:                "Default resource pool",
+			defaultResourcePool: "kubermatic",
+			spec:                kubermaticv1.VSphereCloudSpec{},
+			expectedSpec:        kubermaticv1.VSphereCloudSpec{ResourcePool: "kubermatic"},
+		},
+		{
+			name:                "Resource pool at cluster level is kept",
+			defaultResourcePool: "kubermatic",
+			spec:                kubermaticv1.VSphereCloudSpec{ResourcePool: "custom"},
+			expectedSpec:        kubermaticv1.VSphereCloudSpec{ResourcePool: "custom"},
+		},
+		{
+			name:                "All defaults",
+			dcDatastore:         "LocalDS_0",
+			defaultResourcePool: "kubermatic",
+			spec:                kubermaticv1.VSphereCloudSpec{},
+			expectedSpec:        kubermaticv1.VSphereCloudSpec{Datastore: "LocalDS_0", ResourcePool: "kubermatic"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Provider{
+				dc:                  &kubermaticv1.DatacenterSpecVSphere{DefaultDatastore: tt.dcDatastore},
+				defaultResourcePool: tt.defaultResourcePool,
+			}
+
+			spec := kubermaticv1.CloudSpec{VSphere: &tt.spec}
+			if err := v.DefaultCloudSpec(context.Background(), &spec); err != nil {
+				t.Fatalf("Provider.DefaultCloudSpec() error = %v", err)
+			}
+			if changes := diff.ObjectDiff(tt.expectedSpec, *spec.VSphere); changes != "" {
+				t.Errorf("Got cloud spec differs from expected one. Diff: %v", changes)
+			}
+		})
+	}
+}
+
+func TestProviderEnforceTLS(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	tests := []struct {
+		name          string
+		enforceTLS    bool
+		allowInsecure bool
+		opts          []SessionOption
+		wantErr       bool
+	}{
+		{
+			name:          "Insecure datacenter without enforcement",
+			allowInsecure: true,
+		},
+		{
+			name: "Insecure session without enforcement",
+			opts: []SessionOption{WithInsecure()},
+		},
+		{
+			name:       "Secure connection with enforcement",
+			enforceTLS: true,
+		},
+		{
+			name:          "Insecure datacenter with enforcement",
+			enforceTLS:    true,
+			allowInsecure: true,
+			wantErr:       true,
+		},
+		{
+			name:       "Insecure session with enforcement",
+			enforceTLS: true,
+			opts:       []SessionOption{WithInsecure()},
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{
+				AllowInsecure:    tt.allowInsecure,
+				DefaultDatastore: "LocalDS_0",
+			}
+			sim.fillClientInfo(dc)
+			v := &Provider{dc: dc}
+			WithSessionOptions(tt.opts...)(v)
+			if tt.enforceTLS {
+				WithEnforceTLS()(v)
+			}
+
+			spec := kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{}}
+			defaultErr := v.DefaultCloudSpec(context.Background(), &spec)
+			validateErr := v.ValidateCloudSpec(context.Background(), spec)
+			for name, err := range map[string]error{"DefaultCloudSpec": defaultErr, "ValidateCloudSpec": validateErr} {
+				if !tt.wantErr {
+					if err != nil {
+						t.Errorf("Provider.%s() error = %v", name, err)
+					}
+					continue
+				}
+				if !errors.Is(err, ErrInsecureConnection) {
+					t.Errorf("Provider.%s() error = %v, want %v", name, err, ErrInsecureConnection)
+				}
+				var validationErr *ValidationError
+				if !errors.As(err, &validationErr) || len(validationErr.Fields) == 0 {
+					t.Errorf("Provider.%s() error = %v, want a ValidationError naming the offending field", name, err)
+				}
+			}
+
+			// No session must be established insecurely.
+			if _, err := v.GetFolderTags(context.Background(), &kubermaticv1.Cluster{
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{Folder: "/DC0/vm"}},
+				},
+			}); tt.wantErr && !errors.Is(err, ErrInsecureConnection) {
+				t.Errorf("expected the session to be refused with %v, got %v", ErrInsecureConnection, err)
+			}
+		})
+	}
+}
+
+func TestGetVMRootPath(t *testing.T) {
+	tests := []struct {
+		name         string
+		rootPath     string
+		expectedPath string
+		wantErr      bool
+	}{
+		{
+			name:         "Default root path",
+			expectedPath: "/DC0/vm",
+		},
+		{
+			name:         "Absolute root path",
+			rootPath:     "/DC0/vm/kubermatic",
+			expectedPath: "/DC0/vm/kubermatic",
+		},
+		{
+			name:         "Trailing slash",
+			rootPath:     "/DC0/vm/kubermatic/",
+			expectedPath: "/DC0/vm/kubermatic",
+		},
+		{
+			name:         "Windows-style separators",
+			rootPath:     "\\DC0\\vm\\kubermatic\\",
+			expectedPath: "/DC0/vm/kubermatic",
+		},
+		{
+			name:         "Relative root path",
+			rootPath:     "kubermatic/",
+			expectedPath: "/DC0/vm/kubermatic",
+		},
+		{
+			name:     "Only slashes",
+			rootPath: "//",
+			wantErr:  true,
+		},
+		{
+			name:     "Empty segment",
+			rootPath: "/DC0//vm",
+			wantErr:  true,
+		},
+		{
+			name:     "Parent segment",
+			rootPath: "/DC0/vm/../../DC1/vm",
+			wantErr:  true,
+		},
+		{
+			name:     "Other datacenter",
+			rootPath: "/DC1/vm/kubermatic",
+			wantErr:  true,
+		},
+		{
+			name:     "Datacenter prefix only",
+			rootPath: "/DC0-other/vm",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{
+				Datacenter: "DC0",
+				RootPath:   tt.rootPath,
+			}
+
+			rootPath, err := getVMRootPath(dc)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("getVMRootPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if !errors.Is(err, ErrInvalidRootPath) {
+					t.Errorf("expected error to be ErrInvalidRootPath, got %v", err)
+				}
+				return
+			}
+			if rootPath != tt.expectedPath {
+				t.Errorf("expected root path %q, got %q", tt.expectedPath, rootPath)
+			}
+		})
+	}
+}
+
+func TestValidateFolderPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		folder  string
+		wantErr bool
+	}{
+		{
+			name:   "Folder below the root path",
+			folder: "/DC0/vm/kubermatic/cluster",
+		},
+		{
+			name:   "Root path",
+			folder: "/DC0/vm/kubermatic",
+		},
+		{
+			name:   "Trailing slash",
+			folder: "/DC0/vm/kubermatic/cluster/",
+		},
+		{
+			name:    "Parent of the root path",
+			folder:  "/DC0/vm/kubermatic/..",
+			wantErr: true,
+		},
+		{
+			name:    "Traversal out of the datacenter",
+			folder:  "/DC0/vm/kubermatic/../../../DC1/vm",
+			wantErr: true,
+		},
+		{
+			name:    "Traversal back into the root path",
+			folder:  "/DC0/vm/kubermatic/cluster/../other",
+			wantErr: true,
+		},
+		{
+			name:    "Traversal from outside into the root path",
+			folder:  "/DC0/host/../vm/kubermatic/cluster",
+			wantErr: true,
+		},
+		{
+			name:    "Current directory segment",
+			folder:  "/DC0/vm/kubermatic/./cluster",
+			wantErr: true,
+		},
+		{
+			name:    "Relative path",
+			folder:  "kubermatic/cluster",
+			wantErr: true,
+		},
+		{
+			name:    "Absolute path outside the root path",
+			folder:  "/DC0/vm/other",
+			wantErr: true,
+		},
+		{
+			name:    "Path sharing a prefix with the root path",
+			folder:  "/DC0/vm/kubermatic-other",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateFolderPath("/DC0/vm/kubermatic", tt.folder)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateFolderPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			if !errors.Is(err, ErrInvalidFolderPath) {
+				t.Errorf("expected error to be ErrInvalidFolderPath, got %v", err)
+			}
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) || len(validationErr.Fields) != 1 || validationErr.Fields[0] != "vsphere.folder" {
+				t.Errorf("expected a validation error of the folder field, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClusterDatacenter(t *testing.T) {
+	tests := []struct {
+		name             string
+		clusterRootPaths bool
+		rootPath         string
+		projectID        string
+		expectedRootPath string
+		wantErr          bool
+	}{
+		{
+			name:             "No override",
+			clusterRootPaths: true,
+			projectID:        "project",
+			expectedRootPath: "/DC0/vm/kubermatic",
+		},
+		{
+			name:             "Override",
+			clusterRootPaths: true,
+			rootPath:         "/DC0/vm/kubermatic/project",
+			projectID:        "project",
+			expectedRootPath: "/DC0/vm/kubermatic/project",
+		},
+		{
+			name:             "Relative override",
+			clusterRootPaths: true,
+			rootPath:         "kubermatic/project/team",
+			projectID:        "project",
+			expectedRootPath: "/DC0/vm/kubermatic/project/team",
+		},
+		{
+			name:             "Override without WithClusterRootPaths",
+			rootPath:         "/DC0/vm/kubermatic/project",
+			projectID:        "project",
+			expectedRootPath: "/DC0/vm/kubermatic",
+		},
+		{
+			name:             "Override in another project",
+			clusterRootPaths: true,
+			rootPath:         "/DC0/vm/kubermatic/other",
+			projectID:        "project",
+			wantErr:          true,
+		},
+		{
+			name:             "Override outside the root path",
+			clusterRootPaths: true,
+			rootPath:         "/DC0/vm/project",
+			projectID:        "project",
+			wantErr:          true,
+		},
+		{
+			name:             "Override sharing a prefix with the project folder",
+			clusterRootPaths: true,
+			rootPath:         "/DC0/vm/kubermatic/project-other",
+			projectID:        "project",
+			wantErr:          true,
+		},
+		{
+			name:             "Override in another datacenter",
+			clusterRootPaths: true,
+			rootPath:         "/DC1/vm/kubermatic/project",
+			projectID:        "project",
+			wantErr:          true,
+		},
+		{
+			name:             "Traversing override",
+			clusterRootPaths: true,
+			rootPath:         "/DC0/vm/kubermatic/project/../other",
+			projectID:        "project",
+			wantErr:          true,
+		},
+		{
+			name:             "Override without project",
+			clusterRootPaths: true,
+			rootPath:         "/DC0/vm/kubermatic",
+			wantErr:          true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Provider{
+				dc: &kubermaticv1.DatacenterSpecVSphere{
+					Datacenter: "DC0",
+					RootPath:   "/DC0/vm/kubermatic",
+				},
+				clusterRootPaths: tt.clusterRootPaths,
+			}
+			cluster := &kubermaticv1.Cluster{ObjectMeta: metav1.ObjectMeta{Name: "test"}}
+			if tt.projectID != "" {
+				cluster.Labels = map[string]string{kubermaticv1.ProjectIDLabelKey: tt.projectID}
+			}
+			if tt.rootPath != "" {
+				cluster.Annotations = map[string]string{RootPathAnnotationKey: tt.rootPath}
+			}
+
+			dc, err := v.clusterDatacenter(cluster)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidRootPath) {
+					t.Fatalf("expected error %v, got %v", ErrInvalidRootPath, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to get the datacenter of the cluster: %v", err)
+			}
+			rootPath, err := getVMRootPath(dc)
+			if err != nil {
+				t.Fatalf("failed to get root path: %v", err)
+			}
+			if rootPath != tt.expectedRootPath {
+				t.Errorf("expected root path %q, got %q", tt.expectedRootPath, rootPath)
+			}
+			if v.dc.RootPath != "/DC0/vm/kubermatic" {
+				t.Errorf("expected the datacenter spec of the provider to be left alone, got root path %q", v.dc.RootPath)
+			}
+		})
+	}
+}
+
+func TestClusterRootPathLifecycle(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.RootPath = "/DC0/vm/kubermatic"
+	dc.DefaultDatastore = "LocalDS_0"
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+	WithClusterRootPaths()(v)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	for _, folder := range []string{"/DC0/vm/kubermatic", "/DC0/vm/kubermatic/project"} {
+		if _, err := createVMFolder(ctx, session, folder); err != nil {
+			t.Fatalf("failed to create folder %q: %v", folder, err)
+		}
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test",
+			Labels:      map[string]string{kubermaticv1.ProjectIDLabelKey: "project"},
+			Annotations: map[string]string{RootPathAnnotationKey: "kubermatic/project"},
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+	// The folder of the cluster must be located below its own root path.
+	outside := cluster.DeepCopy()
+	outside.Spec.Cloud.VSphere.Folder = "/DC0/vm/kubermatic"
+	if _, err := v.InitializeCloudProvider(ctx, outside, testClusterUpdater(outside)); !errors.Is(err, ErrInvalidFolderPath) {
+		t.Errorf("expected error %v for a folder outside the root path of the cluster, got %v", ErrInvalidFolderPath, err)
+	}
+
+	cluster, err = v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if cluster.Spec.Cloud.VSphere.Folder != "/DC0/vm/kubermatic/project/test" {
+		t.Fatalf("expected the folder to be created below the root path of the cluster, got %q", cluster.Spec.Cloud.VSphere.Folder)
+	}
+
+	// The root paths of clusters are located below the root path of the datacenter.
+	if err := v.ValidateCloudSpec(ctx, cluster.Spec.Cloud); err != nil {
+		t.Errorf("expected the cloud spec to be valid, got %v", err)
+	}
+
+	folders, err := v.GetClusterVMFolders(ctx, cluster, "", "")
+	if err != nil {
+		t.Fatalf("failed to get folders: %v", err)
+	}
+	var paths []string
+	for _, folder := range folders {
+		paths = append(paths, folder.Path)
+	}
+	if expected := []string{"/DC0/vm/kubermatic/project", "/DC0/vm/kubermatic/project/test"}; diff.ObjectDiff(expected, paths) != "" {
+		t.Errorf("expected the folders below the root path of the cluster, got %v", paths)
+	}
+
+	if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/kubermatic/project/test"); !isNotFound(err) {
+		t.Errorf("expected the cluster folder to be deleted, got %v", err)
+	}
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/kubermatic/project"); err != nil {
+		t.Errorf("expected the root path of the cluster to be kept: %v", err)
+	}
+}
+
+func TestGetNetworksVLANID(t *testing.T) {
+	sim := vSphereSimulator{t: t, model: simulator.VPX()}
+	sim.model.OpaqueNetwork = 1
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	dvsRef, err := session.Finder.Network(ctx, "DVS0")
+	if err != nil {
+		t.Fatalf("failed to get distributed virtual switch: %v", err)
+	}
+	dvs := dvsRef.(*object.DistributedVirtualSwitch)
+
+	portgroups := map[string]types.BaseVmwareDistributedVirtualSwitchVlanSpec{
+		"vlan": &types.VmwareDistributedVirtualSwitchVlanIdSpec{VlanId: 42},
+		"trunk": &types.VmwareDistributedVirtualSwitchTrunkVlanSpec{VlanId: []types.NumericRange{
+			{Start: 100, End: 200},
+			{Start: 300, End: 300},
+		}},
+		"pvlan": &types.VmwareDistributedVirtualSwitchPvlanSpec{PvlanId: 7},
+	}
+	for name, vlan := range portgroups {
+		task, err := dvs.AddPortgroup(ctx, []types.DVPortgroupConfigSpec{{
+			Name:              name,
+			Type:              string(types.DistributedVirtualPortgroupPortgroupTypeEarlyBinding),
+			DefaultPortConfig: &types.VMwareDVSPortSetting{Vlan: vlan},
+		}})
+		if err != nil {
+			t.Fatalf("failed to add portgroup %q: %v", name, err)
+		}
+		if err := task.Wait(ctx); err != nil {
+			t.Fatalf("failed to add portgroup %q: %v", name, err)
+		}
+	}
+
+	// The simulator doesn't link standard networks to the hosts they are configured on.
+	vmNetwork, err := session.Finder.Network(ctx, "VM Network")
+	if err != nil {
+		t.Fatalf("failed to get standard network: %v", err)
+	}
+	hosts, err := session.Finder.HostSystemList(ctx, "*")
+	if err != nil {
+		t.Fatalf("failed to list hosts: %v", err)
+	}
+	simulator.Map.Get(vmNetwork.Reference()).(*mo.Network).Host = []types.ManagedObjectReference{hosts[0].Reference()}
+
+	networks, err := GetNetworks(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+
+	expected := map[string]string{
+		"VM Network": "0",
+		"DC0_DVPG0":  "0",
+		"vlan":       "42",
+		"trunk":      "100-200,300",
+		"pvlan":      "7",
+		"DC0_NSX0":   "",
+	}
+	got := map[string]string{}
+	for _, network := range networks {
+		if _, ok := expected[network.Name]; ok {
+			got[network.Name] = network.VLANID
+		}
+	}
+	if changes := diff.ObjectDiff(expected, got); changes != "" {
+		t.Errorf("Got VLAN IDs differ from expected ones. Diff: %v", changes)
+	}
+}
+
+func TestGetVMFoldersRootPath(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	for _, folder := range []string{"/DC0/vm/kubermatic", "/DC0/vm/kubermatic/cluster", "/DC0/vm/kubermatic-other"} {
+		if _, err := createVMFolder(ctx, session, folder); err != nil {
+			t.Fatalf("failed to create folder %q: %v", folder, err)
+		}
+	}
+
+	for _, rootPath := range []string{"/DC0/vm/kubermatic", "/DC0/vm/kubermatic/", "kubermatic"} {
+		dc.RootPath = rootPath
+
+		folders, err := GetVMFolders(ctx, dc, "", "", nil)
+		if err != nil {
+			t.Fatalf("failed to list folders for root path %q: %v", rootPath, err)
+		}
+
+		var paths []string
+		for _, folder := range folders {
+			paths = append(paths, folder.Path)
+		}
+		sort.Strings(paths)
+
+		expected := []string{"/DC0/vm/kubermatic", "/DC0/vm/kubermatic/cluster"}
+		if changes := diff.ObjectDiff(expected, paths); changes != "" {
+			t.Errorf("Got folders for root path %q differ from expected ones. Diff: %v", rootPath, changes)
+		}
+	}
+}
+
+func TestGetVMFoldersExcludesSystemFolders(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	for _, folder := range []string{
+		"/DC0/vm/vCLS",
+		"/DC0/vm/vCLS/agents",
+		"/DC0/vm/Templates",
+		"/DC0/vm/kubermatic",
+		"/DC0/vm/kubermatic/cluster",
+		"/DC0/vm/kubermatic/vCLS",
+		"/DC0/vm/kubermatic/vCLS/agents",
+		"/DC0/vm/kubermatic/.hidden",
+		"/DC0/vm/kubermatic/.hidden/cluster",
+		"/DC0/vm/kubermatic/Templates",
+	} {
+		if _, err := createVMFolder(ctx, session, folder); err != nil {
+			t.Fatalf("failed to create folder %q: %v", folder, err)
+		}
+	}
+
+	// System folders are only excluded in the VM folder of the datacenter, user folders of the same name are listed.
+	userFolders := []string{
+		"/DC0/vm/kubermatic",
+		"/DC0/vm/kubermatic/Templates",
+		"/DC0/vm/kubermatic/cluster",
+		"/DC0/vm/kubermatic/vCLS",
+		"/DC0/vm/kubermatic/vCLS/agents",
+	}
+	tests := []struct {
+		rootPath string
+		expected []string
+	}{
+		{rootPath: "/DC0/vm/kubermatic", expected: userFolders},
+		{rootPath: "", expected: append([]string{"/DC0/vm"}, userFolders...)},
+	}
+
+	for _, tt := range tests {
+		dc.RootPath = tt.rootPath
+		for _, maxDepth := range []int{0, 3} {
+			folders, err := GetVMFoldersWithDepth(ctx, dc, "", "", nil, maxDepth)
+			if err != nil {
+				t.Fatalf("failed to list folders: %v", err)
+			}
+
+			var paths []string
+			for _, folder := range folders {
+				paths = append(paths, folder.Path)
+			}
+			sort.Strings(paths)
+
+			if changes := diff.ObjectDiff(tt.expected, paths); changes != "" {
+				t.Errorf("Got folders below %q with max depth %d differ from expected ones. Diff: %v", tt.rootPath, maxDepth, changes)
+			}
+		}
+	}
+}
+
+func TestGetTemplateFolders(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	// The template root doesn't depend on the root path of the cluster folders.
+	dc.RootPath = "/DC0/vm/kubermatic"
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	for _, folder := range []string{
+		"/DC0/vm/kubermatic",
+		"/DC0/vm/kubermatic/cluster",
+		"/DC0/vm/Templates",
+		"/DC0/vm/Templates/ubuntu",
+		"/DC0/vm/golden",
+		"/DC0/vm/golden/flatcar",
+		"/DC0/vm/golden/flatcar/stable",
+	} {
+		if _, err := createVMFolder(ctx, session, folder); err != nil {
+			t.Fatalf("failed to create folder %q: %v", folder, err)
+		}
+	}
+
+	tests := []struct {
+		name         string
+		templateRoot string
+		maxDepth     int
+		expected     []string
+	}{
+		{
+			name:     "Default template root",
+			expected: []string{"/DC0/vm/Templates", "/DC0/vm/Templates/ubuntu"},
+		},
+		{
+			name:         "Absolute template root",
+			templateRoot: "/DC0/vm/golden",
+			expected:     []string{"/DC0/vm/golden", "/DC0/vm/golden/flatcar", "/DC0/vm/golden/flatcar/stable"},
+		},
+		{
+			name:         "Relative template root with max depth",
+			templateRoot: "golden",
+			maxDepth:     1,
+			expected:     []string{"/DC0/vm/golden", "/DC0/vm/golden/flatcar"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folders, err := GetTemplateFolders(ctx, dc, "", "", nil, tt.templateRoot, tt.maxDepth)
+			if err != nil {
+				t.Fatalf("failed to list template folders: %v", err)
+			}
+
+			var paths []string
+			for _, folder := range folders {
+				paths = append(paths, folder.Path)
+			}
+			sort.Strings(paths)
+
+			if changes := diff.ObjectDiff(tt.expected, paths); changes != "" {
+				t.Errorf("Got template folders differ from expected ones. Diff: %v", changes)
+			}
+		})
+	}
+
+	if err := ValidateTemplateFolder(ctx, dc, "", "", nil, "golden", "/DC0/vm/golden/flatcar"); err != nil {
+		t.Errorf("expected the template folder to be valid, got %v", err)
+	}
+	if err := ValidateTemplateFolder(ctx, dc, "", "", nil, "golden", "/DC0/vm/golden/rhel"); !errors.Is(err, ErrTemplateFolderNotFound) {
+		t.Errorf("expected %v for a missing template folder, got %v", ErrTemplateFolderNotFound, err)
+	}
+	if err := ValidateTemplateFolder(ctx, dc, "", "", nil, "", "/DC0/vm/kubermatic/cluster"); err == nil {
+		t.Error("expected an error for a template folder outside of the template root")
+	}
+}
+
+func TestIsExcludedFolder(t *testing.T) {
+	tests := []struct {
+		path     string
+		rootPath string
+		excluded bool
+	}{
+		{path: "/DC0/vm", rootPath: "/DC0/vm"},
+		{path: "/DC0/vm/cluster", rootPath: "/DC0/vm"},
+		{path: "/DC0/vm/vCLS", rootPath: "/DC0/vm", excluded: true},
+		{path: "/DC0/vm/Discovered virtual machine", rootPath: "/DC0/vm", excluded: true},
+		{path: "/DC0/vm/Namespaces/ns", rootPath: "/DC0/vm", excluded: true},
+		{path: "/DC0/vm/Templates", rootPath: "/DC0/vm", excluded: true},
+		{path: "/DC0/vm/.hidden/cluster", rootPath: "/DC0/vm", excluded: true},
+		{path: "/DC0/vm/my.folder", rootPath: "/DC0/vm"},
+		// vCenter only creates system folders in the VM folder of the datacenter, user folders of the same name are kept.
+		{path: "/DC0/vm/team-a/Templates", rootPath: "/DC0/vm"},
+		{path: "/DC0/vm/team-a/vCLS/cluster", rootPath: "/DC0/vm"},
+		{path: "/DC0/vm/kubermatic/Namespaces", rootPath: "/DC0/vm/kubermatic"},
+		{path: "/DC0/vm/kubermatic/.hidden", rootPath: "/DC0/vm/kubermatic", excluded: true},
+		// A configured root path is honoured, even if it is a system folder itself.
+		{path: "/DC0/vm/Templates/cluster", rootPath: "/DC0/vm/Templates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if excluded := isExcludedFolder(tt.path, tt.rootPath, "/DC0/vm"); excluded != tt.excluded {
+				t.Errorf("isExcludedFolder(%q, %q) = %v, want %v", tt.path, tt.rootPath, excluded, tt.excluded)
+			}
+		})
+	}
+}
+
+func TestExcludeClusterFolders(t *testing.T) {
+	folders := []Folder{
+		{Path: "/DC0/vm"},
+		{Path: "/DC0/vm/free"},
+		{Path: "/DC0/vm/taken"},
+		{Path: "/DC0/vm/taken/nested"},
+		{Path: "/DC0/vm/taken-not"},
+	}
+	clusters := []kubermaticv1.Cluster{
+		{Spec: kubermaticv1.ClusterSpec{Cloud: kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{Folder: "/DC0/vm/taken"}}}},
+		{Spec: kubermaticv1.ClusterSpec{Cloud: kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{}}}},
+		{Spec: kubermaticv1.ClusterSpec{Cloud: kubermaticv1.CloudSpec{}}},
+	}
+
+	expected := []Folder{
+		{Path: "/DC0/vm"},
+		{Path: "/DC0/vm/free"},
+		{Path: "/DC0/vm/taken-not"},
+	}
+	if changes := diff.ObjectDiff(expected, ExcludeClusterFolders(folders, clusters)); changes != "" {
+		t.Errorf("Got folders differ from expected ones. Diff: %v", changes)
+	}
+}
+
+func TestGetNetworksComputeCluster(t *testing.T) {
+	sim := vSphereSimulator{t: t, model: simulator.VPX()}
+	sim.model.Cluster = 2
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// Create a distributed switch which only reaches the hosts of the second cluster.
+	hosts, err := session.Finder.HostSystemList(ctx, "/DC0/host/DC0_C1/*")
+	if err != nil {
+		t.Fatalf("failed to list hosts: %v", err)
+	}
+	createDVS(ctx, t, session, nil, "DVS1", "DC0_C1_only", hosts)
+	// VMs may be placed on any host of a cluster, so a switch which only reaches some of them doesn't count.
+	createDVS(ctx, t, session, nil, "DVS2", "DC0_C1_partial", hosts[:1])
+
+	tests := []struct {
+		name             string
+		computeCluster   string
+		expectedNames    []string
+		unexpectedNames  []string
+		expectedNotFound bool
+	}{
+		{
+			name:          "Unscoped",
+			expectedNames: []string{"VM Network", "DC0_DVPG0", "DC0_C1_only", "DC0_C1_partial"},
+		},
+		{
+			name:            "Cluster without the switch",
+			computeCluster:  "DC0_C0",
+			expectedNames:   []string{"VM Network", "DC0_DVPG0"},
+			unexpectedNames: []string{"DC0_C1_only"},
+		},
+		{
+			name:            "Cluster with the switch",
+			computeCluster:  "DC0_C1",
+			expectedNames:   []string{"VM Network", "DC0_DVPG0", "DC0_C1_only"},
+			unexpectedNames: []string{"DC0_C1_partial"},
+		},
+		{
+			name:             "Unknown cluster",
+			computeCluster:   "missing",
+			expectedNotFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := GetNetworks(ctx, dc, "", "", nil, WithComputeCluster(tt.computeCluster))
+			if tt.expectedNotFound {
+				if !isNotFound(err) {
+					t.Errorf("expected a not found error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to list networks: %v", err)
+			}
+
+			names := sets.NewString()
+			for _, network := range networks {
+				names.Insert(network.Name)
+			}
+			if !names.HasAll(tt.expectedNames...) {
+				t.Errorf("expected networks %v to be returned, got %v", tt.expectedNames, names.List())
+			}
+			if names.HasAny(tt.unexpectedNames...) {
+				t.Errorf("expected networks %v not to be returned, got %v", tt.unexpectedNames, names.List())
+			}
+		})
+	}
+}
+
+func TestGetNetworksHostCount(t *testing.T) {
+	sim := vSphereSimulator{t: t, model: simulator.VPX()}
+	sim.model.OpaqueNetwork = 1
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// The default switch of the simulator spans all hosts.
+	allHosts, err := session.Finder.HostSystemList(ctx, "*/*")
+	if err != nil {
+		t.Fatalf("failed to list hosts: %v", err)
+	}
+	hosts, err := session.Finder.HostSystemList(ctx, "/DC0/host/DC0_C1/*")
+	if err != nil {
+		t.Fatalf("failed to list hosts: %v", err)
+	}
+	createDVS(ctx, t, session, nil, "DVS1", "DC0_C1_only", hosts[:2])
+
+	networks, err := GetNetworks(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+
+	expected := map[string]int{
+		"DC0_DVPG0":   len(allHosts),
+		"DC0_C1_only": 2,
+		// Only distributed portgroups have a host count.
+		"VM Network": 0,
+		"DC0_NSX0":   0,
+	}
+	got := map[string]int{}
+	for _, network := range networks {
+		if _, ok := expected[network.Name]; ok {
+			got[network.Name] = network.HostCount
+		}
+	}
+	if changes := diff.ObjectDiff(expected, got); changes != "" {
+		t.Errorf("Got host counts differ from expected ones. Diff: %v", changes)
+	}
+}
+
+func TestGetNetworksDeduplication(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// A distributed portgroup in another folder, which shares its name with the standard network.
+	folders, err := session.Datacenter.Folders(ctx)
+	if err != nil {
+		t.Fatalf("failed to get datacenter folders: %v", err)
+	}
+	folder, err := folders.NetworkFolder.CreateFolder(ctx, "other")
+	if err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	createDVS(ctx, t, session, folder, "DVS1", "VM Network", nil)
+
+	networks, err := session.Finder.NetworkList(ctx, "*")
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+	portgroup, err := session.Finder.Network(ctx, "DC0_DVPG0")
+	if err != nil {
+		t.Fatalf("failed to get portgroup: %v", err)
+	}
+
+	// Every network is listed twice and the portgroup is listed as standard network before its distributed representation.
+	standardRef := types.ManagedObjectReference{Type: NetworkTypeNetwork, Value: portgroup.Reference().Value}
+	duplicated := append([]object.NetworkReference{object.NewNetwork(session.Client.Client, standardRef)}, networks...)
+	duplicated = append(duplicated, networks...)
+
+	deduped := dedupNetworks(duplicated)
+	if len(deduped) != len(networks) {
+		t.Errorf("expected %d networks, got %d", len(networks), len(deduped))
+	}
+	for _, network := range deduped {
+		if network.Reference().Value == portgroup.Reference().Value && network.Reference().Type != NetworkTypeDistributedVirtualPortgroup {
+			t.Errorf("expected the distributed representation of %v to be kept, got %v", portgroup.Reference(), network.Reference())
+		}
+	}
+
+	infos, err := GetNetworks(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+	if !sort.SliceIsSorted(infos, func(i, j int) bool { return infos[i].AbsolutePath < infos[j].AbsolutePath }) {
+		t.Errorf("expected the networks to be sorted by path, got %v", infos)
+	}
+	var networkTypes []string
+	for _, info := range infos {
+		if info.Name == "VM Network" {
+			networkTypes = append(networkTypes, info.Type)
+		}
+	}
+	if changes := diff.ObjectDiff([]string{NetworkTypeNetwork, NetworkTypeDistributedVirtualPortgroup}, networkTypes); changes != "" {
+		t.Errorf("expected both networks named %q to be returned. Diff: %v", "VM Network", changes)
+	}
+}
+
+func TestGetNetworksByFolder(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// Nested network folders, each holding a switch with a portgroup.
+	folders, err := session.Datacenter.Folders(ctx)
+	if err != nil {
+		t.Fatalf("failed to get datacenter folders: %v", err)
+	}
+	outer, err := folders.NetworkFolder.CreateFolder(ctx, "outer")
+	if err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	inner, err := outer.CreateFolder(ctx, "inner")
+	if err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	createDVS(ctx, t, session, outer, "DVS-outer", "pg-outer", nil)
+	createDVS(ctx, t, session, inner, "DVS-inner", "pg-inner", nil)
+
+	groups, err := GetNetworksByFolder(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list networks: %v", err)
+	}
+
+	expected := map[string][]string{
+		"/DC0/network":             {"VM Network", "DC0_DVPG0"},
+		"/DC0/network/outer":       {"pg-outer"},
+		"/DC0/network/outer/inner": {"pg-inner"},
+	}
+	for folder, expectedNames := range expected {
+		names := sets.NewString()
+		for _, network := range groups[folder] {
+			if path.Dir(network.AbsolutePath) != folder {
+				t.Errorf("network %q is not located in folder %q", network.AbsolutePath, folder)
+			}
+			names.Insert(network.Name)
+		}
+		// The uplink portgroups of the switches are part of the groups as well.
+		if !names.HasAll(expectedNames...) {
+			t.Errorf("expected folder %q to contain networks %v, got %v", folder, expectedNames, names.List())
+		}
+	}
+	if len(groups) != len(expected) {
+		t.Errorf("expected %d folders, got %d", len(expected), len(groups))
+	}
+}
+
+// createDVS creates a distributed virtual switch with a single portgroup, which spans the given hosts. The switch
+// is created in the given folder or, if it is nil, in the network folder of the datacenter.
+func createDVS(ctx context.Context, t *testing.T, session *Session, folder *object.Folder, name, portgroup string, hosts []*object.HostSystem) {
+	t.Helper()
+
+	if folder == nil {
+		folders, err := session.Datacenter.Folders(ctx)
+		if err != nil {
+			t.Fatalf("failed to get datacenter folders: %v", err)
+		}
+		folder = folders.NetworkFolder
+	}
+	spec := types.DVSCreateSpec{ConfigSpec: &types.VMwareDVSConfigSpec{}}
+	spec.ConfigSpec.GetDVSConfigSpec().Name = name
+	task, err := folder.CreateDVS(ctx, spec)
+	if err != nil {
+		t.Fatalf("failed to create distributed virtual switch: %v", err)
+	}
+	info, err := task.WaitForResult(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to create distributed virtual switch: %v", err)
+	}
+	dvs := object.NewDistributedVirtualSwitch(session.Client.Client, info.Result.(types.ManagedObjectReference))
+
+	task, err = dvs.AddPortgroup(ctx, []types.DVPortgroupConfigSpec{{
+		Name: portgroup,
+		Type: string(types.DistributedVirtualPortgroupPortgroupTypeEarlyBinding),
+	}})
+	if err != nil {
+		t.Fatalf("failed to add portgroup: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to add portgroup: %v", err)
+	}
+
+	config := &types.DVSConfigSpec{}
+	for _, host := range hosts {
+		config.Host = append(config.Host, types.DistributedVirtualSwitchHostMemberConfigSpec{
+			Operation: string(types.ConfigSpecOperationAdd),
+			Host:      host.Reference(),
+		})
+	}
+	task, err = dvs.Reconfigure(ctx, config)
+	if err != nil {
+		t.Fatalf("failed to add hosts to the distributed virtual switch: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to add hosts to the distributed virtual switch: %v", err)
+	}
+}
+
+func TestGetNetworksFiltered(t *testing.T) {
+	sim := vSphereSimulator{t: t, model: simulator.VPX()}
+	sim.model.OpaqueNetwork = 1
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	tests := []struct {
+		name          string
+		networkTypes  []string
+		expectedNames []string
+		wantErr       bool
+	}{
+		{
+			name:          "Standard networks",
+			networkTypes:  []string{NetworkTypeNetwork},
+			expectedNames: []string{"VM Network"},
+		},
+		{
+			name:          "Distributed virtual portgroups",
+			networkTypes:  []string{NetworkTypeDistributedVirtualPortgroup},
+			expectedNames: []string{"DC0_DVPG0"},
+		},
+		{
+			name:          "Opaque networks",
+			networkTypes:  []string{NetworkTypeOpaqueNetwork},
+			expectedNames: []string{"DC0_NSX0"},
+		},
+		{
+			name:          "Multiple types",
+			networkTypes:  []string{NetworkTypeNetwork, NetworkTypeOpaqueNetwork},
+			expectedNames: []string{"DC0_NSX0", "VM Network"},
+		},
+		{
+			name:          "No filter",
+			expectedNames: []string{"DC0_DVPG0", "DC0_NSX0", "VM Network"},
+		},
+		{
+			name:         "Unsupported type",
+			networkTypes: []string{"HostNetwork"},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := GetNetworksFiltered(context.Background(), dc, "", "", nil, tt.networkTypes)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GetNetworksFiltered() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// The simulator also creates an uplink portgroup with a generated name, so we only check
+			// that the expected networks are part of the result.
+			names := sets.NewString()
+			for _, network := range networks {
+				if len(tt.networkTypes) > 0 && !sets.NewString(tt.networkTypes...).Has(network.Type) {
+					t.Errorf("network %q has type %q, which was not requested", network.Name, network.Type)
+				}
+				names.Insert(network.Name)
+			}
+
+			if !names.HasAll(tt.expectedNames...) {
+				t.Errorf("expected networks %v to be returned, got %v", tt.expectedNames, names.List())
+			}
+		})
+	}
+}
+
+func TestGetDistributedSwitches(t *testing.T) {
+	sim := vSphereSimulator{t: t, model: simulator.VPX()}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// A second switch in a network folder with two portgroups.
+	folders, err := session.Datacenter.Folders(ctx)
+	if err != nil {
+		t.Fatalf("failed to get datacenter folders: %v", err)
+	}
+	folder, err := folders.NetworkFolder.CreateFolder(ctx, "kubermatic")
+	if err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	createDVS(ctx, t, session, folder, "DVS1", "DVS1_PG0", nil)
+	dvs, err := session.Finder.Network(ctx, "/DC0/network/kubermatic/DVS1")
+	if err != nil {
+		t.Fatalf("failed to get distributed virtual switch: %v", err)
+	}
+	task, err := dvs.(*object.DistributedVirtualSwitch).AddPortgroup(ctx, []types.DVPortgroupConfigSpec{{
+		Name: "DVS1_PG1",
+		Type: string(types.DistributedVirtualPortgroupPortgroupTypeEarlyBinding),
+	}})
+	if err != nil {
+		t.Fatalf("failed to add portgroup: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to add portgroup: %v", err)
+	}
+
+	switches, err := GetDistributedSwitches(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("GetDistributedSwitches() error = %v", err)
+	}
+
+	// The UUIDs are generated by the simulator, so they are only checked for presence.
+	uuids := sets.NewString()
+	for i := range switches {
+		if switches[i].UUID == "" {
+			t.Errorf("expected switch %q to have a UUID", switches[i].Name)
+		}
+		uuids.Insert(switches[i].UUID)
+		switches[i].UUID = ""
+	}
+	if uuids.Len() != len(switches) {
+		t.Errorf("expected the switches to have distinct UUIDs, got %v", uuids.List())
+	}
+
+	// Every switch also has an uplink portgroup.
+	expected := []DVSInfo{
+		{Name: "DVS0", Path: "/DC0/network/DVS0", PortgroupCount: 2},
+		{Name: "DVS1", Path: "/DC0/network/kubermatic/DVS1", PortgroupCount: 3},
+	}
+	if changes := diff.ObjectDiff(expected, switches); changes != "" {
+		t.Errorf("Got distributed switches differ from expected ones. Diff: %v", changes)
+	}
+}
+
+func TestGetVMFoldersWithDepth(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.RootPath = "/DC0/vm/kubermatic"
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	if _, err := createVMFolder(ctx, session, dc.RootPath); err != nil {
+		t.Fatalf("failed to create root folder: %v", err)
+	}
+	createFolderTree(ctx, t, session, dc.RootPath, 3, 2)
+
+	tests := []struct {
+		name          string
+		maxDepth      int
+		expectedCount int
+	}{
+		{
+			name:          "Only direct children",
+			maxDepth:      1,
+			expectedCount: 1 + 2,
+		},
+		{
+			name:          "Two levels",
+			maxDepth:      2,
+			expectedCount: 1 + 2 + 4,
+		},
+		{
+			name:          "Depth exceeding the tree",
+			maxDepth:      10,
+			expectedCount: 1 + 2 + 4 + 8,
+		},
+		{
+			name:          "Full list",
+			expectedCount: 1 + 2 + 4 + 8,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folders, err := GetVMFoldersWithDepth(ctx, dc, "", "", nil, tt.maxDepth)
+			if err != nil {
+				t.Fatalf("failed to list folders: %v", err)
+			}
+
+			paths := sets.NewString()
+			for _, folder := range folders {
+				if !isSubPath(folder.Path, dc.RootPath) {
+					t.Errorf("folder %q is not below the root path %q", folder.Path, dc.RootPath)
+				}
+				paths.Insert(folder.Path)
+			}
+			if paths.Len() != tt.expectedCount {
+				t.Errorf("expected %d folders, got %d: %v", tt.expectedCount, paths.Len(), paths.List())
+			}
+		})
+	}
+}
+
+func TestWaitForFolder(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	backoff := wait.Backoff{Steps: 6, Duration: 50 * time.Millisecond, Factor: 2}
+
+	// The folder appears only after the first lookups, like a folder which vCenter hasn't propagated yet.
+	created := make(chan error, 1)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, err := createVMFolder(ctx, session, "/DC0/vm/late")
+		created <- err
+	}()
+	if err := waitForFolder(ctx, session, "/DC0/vm/late", backoff); err != nil {
+		t.Errorf("expected the folder to become visible, got %v", err)
+	}
+	if err := <-created; err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+
+	// The wait is bounded if the folder never shows up.
+	backoff.Steps = 2
+	if err := waitForFolder(ctx, session, "/DC0/vm/missing", backoff); !isNotFound(err) {
+		t.Errorf("expected a not found error, got %v", err)
+	}
+}
+
+func TestGetVMFoldersChildCount(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.RootPath = "/DC0/vm/kubermatic"
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	if _, err := createVMFolder(ctx, session, dc.RootPath); err != nil {
+		t.Fatalf("failed to create root folder: %v", err)
+	}
+	createFolderTree(ctx, t, session, dc.RootPath, 2, 2)
+
+	// A VM in a leaf folder counts as well.
+	vm, err := session.Finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	leaf, err := session.Finder.Folder(ctx, path.Join(dc.RootPath, "folder-1/folder-0"))
+	if err != nil {
+		t.Fatalf("failed to get folder: %v", err)
+	}
+	task, err := leaf.MoveInto(ctx, []types.ManagedObjectReference{vm.Reference()})
+	if err != nil {
+		t.Fatalf("failed to move VM: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to move VM: %v", err)
+	}
+
+	expected := map[string]int{
+		dc.RootPath:                                 2,
+		path.Join(dc.RootPath, "folder-0"):          2,
+		path.Join(dc.RootPath, "folder-0/folder-0"): 0,
+		path.Join(dc.RootPath, "folder-0/folder-1"): 0,
+		path.Join(dc.RootPath, "folder-1"):          2,
+		path.Join(dc.RootPath, "folder-1/folder-0"): 1,
+		path.Join(dc.RootPath, "folder-1/folder-1"): 0,
+	}
+	for _, maxDepth := range []int{0, 2} {
+		t.Run(fmt.Sprintf("Depth %d", maxDepth), func(t *testing.T) {
+			folders, err := GetVMFoldersWithDepth(ctx, dc, "", "", nil, maxDepth)
+			if err != nil {
+				t.Fatalf("failed to list folders: %v", err)
+			}
+
+			childCounts := map[string]int{}
+			for _, folder := range folders {
+				if folder.ChildCount == nil {
+					t.Fatalf("expected the children of folder %q to be counted", folder.Path)
+				}
+				childCounts[folder.Path] = *folder.ChildCount
+			}
+			if changes := diff.ObjectDiff(expected, childCounts); changes != "" {
+				t.Errorf("unexpected child counts: %s", changes)
+			}
+		})
+	}
+
+	// Folders which cannot be counted are listed without a count.
+	folders := []Folder{{Path: dc.RootPath}}
+	countFolderChildren(ctx, session, folders, []types.ManagedObjectReference{{Type: "Folder", Value: "missing"}})
+	if folders[0].ChildCount != nil {
+		t.Errorf("expected no child count, got %d", *folders[0].ChildCount)
+	}
+}
+
+// failingFolderRoundTripper fails the property retrievals starting at the given folder, which
+// makes listing the children of the folder fail.
+type failingFolderRoundTripper struct {
+	soap.RoundTripper
+	folder types.ManagedObjectReference
+}
+
+func (f *failingFolderRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	if body, ok := req.(*methods.RetrievePropertiesBody); ok {
+		for _, spec := range body.Req.SpecSet {
+			for _, object := range spec.ObjectSet {
+				if object.Obj == f.folder {
+					return errors.New("simulated failure")
+				}
+			}
+		}
+	}
+	return f.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+func TestGetVMFoldersWithDepthPartialFailure(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.RootPath = "/DC0/vm/kubermatic"
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	if _, err := createVMFolder(ctx, session, dc.RootPath); err != nil {
+		t.Fatalf("failed to create root folder: %v", err)
+	}
+	if _, err := createVMFolder(ctx, session, "/DC0/vm/outside"); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+	createFolderTree(ctx, t, session, dc.RootPath, 2, 2)
+
+	failing, err := session.Finder.Folder(ctx, path.Join(dc.RootPath, "folder-0"))
+	if err != nil {
+		t.Fatalf("failed to get folder: %v", err)
+	}
+	session.Client.Client.RoundTripper = &failingFolderRoundTripper{
+		RoundTripper: session.Client.Client.RoundTripper,
+		folder:       failing.Reference(),
+	}
+
+	rootPath, err := getVMRootPath(dc)
+	if err != nil {
+		t.Fatalf("failed to get root path: %v", err)
+	}
+	folders, err := getVMFoldersWithDepth(ctx, session, rootPath, 2)
+
+	var partialErr *PartialResultError
+	if !errors.As(err, &partialErr) {
+		t.Fatalf("expected a partial result error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), path.Join(dc.RootPath, "folder-0")) {
+		t.Errorf("expected the error to name the failing folder, got %v", err)
+	}
+
+	// Everything but the children of the failing folder is listed, and nothing outside of the root path.
+	paths := sets.NewString()
+	for _, folder := range folders {
+		paths.Insert(folder.Path)
+	}
+	expected := sets.NewString(
+		dc.RootPath,
+		path.Join(dc.RootPath, "folder-0"),
+		path.Join(dc.RootPath, "folder-1"),
+		path.Join(dc.RootPath, "folder-1/folder-0"),
+		path.Join(dc.RootPath, "folder-1/folder-1"),
+	)
+	if !paths.Equal(expected) {
+		t.Errorf("expected folders %v, got %v", expected.List(), paths.List())
+	}
+}
+
+func BenchmarkGetVMFolders(b *testing.B) {
+	sim := vSphereSimulator{t: b}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		b.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	createFolderTree(ctx, b, session, "/DC0/vm", 5, 3)
+
+	// Reuse the session, so the benchmark measures listing the folders rather than logging in.
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	for _, maxDepth := range []int{0, 1, 2} {
+		b.Run(fmt.Sprintf("depth-%d", maxDepth), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := GetVMFoldersWithDepth(ctx, dc, "", "", nil, maxDepth, WithSessionProvider(pool)); err != nil {
+					b.Fatalf("failed to list folders: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// createFolderTree creates a tree of folders below parent, with fanout child folders per folder.
+func createFolderTree(ctx context.Context, tb testing.TB, session *Session, parent string, depth, fanout int) {
+	if depth == 0 {
+		return
+	}
+
+	parentFolder, err := session.Finder.Folder(ctx, parent)
+	if err != nil {
+		tb.Fatalf("failed to get folder %q: %v", parent, err)
+	}
+	for i := 0; i < fanout; i++ {
+		name := fmt.Sprintf("folder-%d", i)
+		if _, err := parentFolder.CreateFolder(ctx, name); err != nil {
+			tb.Fatalf("failed to create folder %q below %q: %v", name, parent, err)
+		}
+		createFolderTree(ctx, tb, session, path.Join(parent, name), depth-1, fanout)
+	}
+}
+
+func TestSessionIsValid(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	expired, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer expired.Logout(ctx)
+
+	kept, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer kept.Logout(ctx)
+
+	if !expired.IsValid(ctx) || !kept.IsValid(ctx) {
+		t.Fatal("expected new sessions to be valid")
+	}
+
+	keepaliveCtx, cancel := context.WithCancel(ctx)
+	keepaliveErr := make(chan error)
+	go func() {
+		keepaliveErr <- kept.Keepalive(keepaliveCtx, 50*time.Millisecond)
+	}()
+
+	// Expire the session on the vCenter side. The idle timeout of the simulator is a global, which
+	// its goroutines keep reading after the test, so it is left untouched.
+	userSession, err := expired.Client.SessionManager.UserSession(ctx)
+	if err != nil {
+		t.Fatalf("failed to get the user session: %v", err)
+	}
+	if _, err := methods.TerminateSession(ctx, kept.Client.Client, &types.TerminateSession{
+		This:      *kept.Client.ServiceContent.SessionManager,
+		SessionId: []string{userSession.Key},
+	}); err != nil {
+		t.Fatalf("failed to terminate session: %v", err)
+	}
+
+	if expired.IsValid(ctx) {
+		t.Error("expected the terminated session to be invalid")
+	}
+	if !kept.IsValid(ctx) {
+		t.Error("expected the session to be kept alive")
+	}
+
+	cancel()
+	if err := <-keepaliveErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Keepalive to stop with the context, got %v", err)
+	}
+
+	expiredKeepaliveCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := expired.Keepalive(expiredKeepaliveCtx, 10*time.Millisecond); !errors.Is(err, ErrSessionInvalid) {
+		t.Errorf("expected Keepalive to report the terminated session, got %v", err)
+	}
+}
+
+func TestLogoutCancelledContext(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client session: %v", err)
+	}
+
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	session.Logout(cancelledCtx)
+	if session.IsValid(ctx) {
+		t.Error("expected the session to be logged out despite the cancelled context")
+	}
+
+	restSession.Logout(cancelledCtx)
+	if userSession, err := restSession.Client.Session(ctx); err != nil || userSession != nil {
+		t.Errorf("expected the REST client session to be logged out despite the cancelled context, got %v and error %v", userSession, err)
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	// The simulator accepts any non-empty username and password.
+	tests := []struct {
+		name     string
+		username string
+		password string
+		// endpoint overrides the simulator endpoint if set.
+		endpoint  string
+		wantErr   bool
+		wantErrIs error
+	}{
+		{
+			name:     "Valid credentials",
+			username: "user",
+			password: "pass",
+		},
+		{
+			// The datacenter has a valid InfraManagementUser, which must not be used instead.
+			name:      "Invalid credentials",
+			username:  "user",
+			wantErr:   true,
+			wantErrIs: ErrInvalidCredentials,
+		},
+		{
+			name:     "Unreachable vCenter",
+			username: "user",
+			password: "pass",
+			endpoint: "http://127.0.0.1:1",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			if tt.endpoint != "" {
+				dc.Endpoint = tt.endpoint
+			}
+
+			err := ValidateCredentials(context.Background(), dc, tt.username, tt.password, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateCredentials() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("ValidateCredentials() error = %v, want %v", err, tt.wantErrIs)
+			}
+			if tt.wantErrIs == nil && errors.Is(err, ErrInvalidCredentials) {
+				t.Errorf("ValidateCredentials() error = %v, must not be reported as invalid credentials", err)
+			}
+			if dc.InfraManagementUser == nil {
+				t.Error("ValidateCredentials() must not modify the datacenter")
+			}
+		})
+	}
+}
+
+func TestValidateCredentialsReference(t *testing.T) {
+	sim := vSphereSimulator{t: t, user: url.UserPassword("user", "pass")}
+	sim.setUp()
+	defer sim.tearDown()
+
+	tests := []struct {
+		name      string
+		ref       *providerconfig.GlobalSecretKeySelector
+		secret    map[string]string
+		wantErrIs error
+	}{
+		{
+			name: "Valid credentials",
+			ref:  &providerconfig.GlobalSecretKeySelector{},
+			secret: map[string]string{
+				resources.VsphereUsername: "user",
+				resources.VspherePassword: "pass",
+			},
+		},
+		{
+			name: "Invalid password",
+			ref:  &providerconfig.GlobalSecretKeySelector{},
+			secret: map[string]string{
+				resources.VsphereUsername: "user",
+				resources.VspherePassword: "wrong",
+			},
+			wantErrIs: ErrInvalidCredentials,
+		},
+		{
+			name: "Invalid infra management user",
+			ref:  &providerconfig.GlobalSecretKeySelector{},
+			secret: map[string]string{
+				resources.VsphereUsername:                    "user",
+				resources.VspherePassword:                    "pass",
+				resources.VsphereInfraManagementUserUsername: "infra",
+				resources.VsphereInfraManagementUserPassword: "pass",
+			},
+			wantErrIs: ErrInvalidCredentials,
+		},
+		{
+			name: "Missing password",
+			ref:  &providerconfig.GlobalSecretKeySelector{},
+			secret: map[string]string{
+				resources.VsphereUsername: "user",
+			},
+			wantErrIs: ErrNoCredentials,
+		},
+		{
+			name:      "Missing reference",
+			wantErrIs: ErrNoCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+
+			err := ValidateCredentialsReference(context.Background(), dc, tt.ref, testSecretKeySelectorValueFuncFactory(tt.secret), nil)
+			if tt.wantErrIs == nil && err != nil {
+				t.Fatalf("ValidateCredentialsReference() error = %v", err)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("ValidateCredentialsReference() error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestSessionToken(t *testing.T) {
+	sim := vSphereSimulator{t: t, user: url.UserPassword("user", "secret")}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.InfraManagementUser = nil
+
+	ctx := context.Background()
+	ssoSession, err := newSession(ctx, dc, "user", "secret", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer ssoSession.Logout(ctx)
+
+	var token string
+	for _, cookie := range ssoSession.Client.Client.Client.Jar.Cookies(ssoSession.Client.URL()) {
+		if cookie.Name == soap.SessionCookieName {
+			token = cookie.Value
+		}
+	}
+	if token == "" {
+		t.Fatal("expected the session to have a session cookie")
+	}
+
+	tests := []struct {
+		name      string
+		password  string
+		opts      []SessionOption
+		wantErrIs error
+	}{
+		{
+			// The token takes precedence, so the wrong password is not used.
+			name:     "Valid token",
+			password: "wrong",
+			opts:     []SessionOption{WithSessionToken(token)},
+		},
+		{
+			name:     "Password without token",
+			password: "secret",
+		},
+		{
+			name:      "Invalid token",
+			password:  "secret",
+			opts:      []SessionOption{WithSessionToken("invalid")},
+			wantErrIs: ErrInvalidSessionToken,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			session, err := newSession(ctx, dc, "user", tt.password, nil, append(tt.opts, WithLoginAttempts(1))...)
+			if tt.wantErrIs != nil {
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("expected error %v, got %v", tt.wantErrIs, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			session.Logout(ctx)
+		})
+	}
+
+	// The session belongs to whoever acquired the token, so it must outlive the sessions resumed from it.
+	if !ssoSession.IsValid(ctx) {
+		t.Error("expected the session of the token to stay valid")
+	}
+}
+
+func TestNewSessionDatacenterNotFound(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.Datacenter = "missing"
+
+	var calls []string
+	_, err := newSession(context.Background(), dc, "", "", nil, WithSOAPTracer(func(method string, _ time.Duration, _ error) {
+		calls = append(calls, method)
+	}))
+	if !errors.Is(err, ErrDatacenterNotFound) {
+		t.Fatalf("expected error %v, got %v", ErrDatacenterNotFound, err)
+	}
+
+	var notFoundErr *DatacenterNotFoundError
+	if !errors.As(err, &notFoundErr) || notFoundErr.Datacenter != "missing" {
+		t.Errorf("expected the error to name the datacenter, got %v", err)
+	}
+	if !isNotFound(err) {
+		t.Errorf("expected the finder error to be wrapped, got %v", err)
+	}
+	if len(calls) == 0 || calls[len(calls)-1] != "Logout" {
+		t.Errorf("expected the session to be logged out, got the calls %v", calls)
+	}
+}
+
+func TestProviderValidateCloudSpecUpdate(t *testing.T) {
+	tests := []struct {
+		name                  string
+		allowFolderRelocation bool
+		oldFolder             string
+		newFolder             string
+		wantErr               bool
+	}{
+		{
+			name:      "Unchanged folder",
+			oldFolder: "/DC0/vm/test",
+			newFolder: "/DC0/vm/test",
+		},
+		{
+			name:      "Folder set for the first time",
+			newFolder: "/DC0/vm/test",
+		},
+		{
+			name:      "Folder changed without opt-in",
+			oldFolder: "/DC0/vm/test",
+			newFolder: "/DC0/vm/other",
+			wantErr:   true,
+		},
+		{
+			name:                  "Folder changed with opt-in, but without the cluster",
+			allowFolderRelocation: true,
+			oldFolder:             "/DC0/vm/test",
+			newFolder:             "/DC0/vm/team/test",
+			wantErr:               true,
+		},
+		{
+			name:                  "Folder moved outside of the root path",
+			allowFolderRelocation: true,
+			oldFolder:             "/DC0/vm/test",
+			newFolder:             "/DC0/host/test",
+			wantErr:               true,
+		},
+		{
+			name:                  "Folder removed",
+			allowFolderRelocation: true,
+			oldFolder:             "/DC0/vm/test",
+			wantErr:               true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &Provider{
+				dc:                    &kubermaticv1.DatacenterSpecVSphere{Datacenter: "DC0"},
+				allowFolderRelocation: tt.allowFolderRelocation,
+			}
+			oldSpec := kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{Folder: tt.oldFolder}}
+			newSpec := kubermaticv1.CloudSpec{VSphere: &kubermaticv1.VSphereCloudSpec{Folder: tt.newFolder}}
+
+			err := v.ValidateCloudSpecUpdate(context.Background(), oldSpec, newSpec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Provider.ValidateCloudSpecUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProviderValidateClusterUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		newFolder string
+		// untagged drops the tag category, so the folder reference can't be verified.
+		untagged bool
+		wantErr  bool
+	}{
+		{
+			name:      "Folder relocated in vCenter",
+			newFolder: "/DC0/vm/team/test",
+		},
+		{
+			name:      "Folder of another cluster",
+			newFolder: "/DC0/vm/other",
+			wantErr:   true,
+		},
+		{
+			name:      "Missing folder",
+			newFolder: "/DC0/vm/missing",
+			wantErr:   true,
+		},
+		{
+			name:      "Folder outside of the root path",
+			newFolder: "/DC0/host/test",
+			wantErr:   true,
+		},
+		{
+			name:      "Unverifiable folder reference",
+			newFolder: "/DC0/vm/team/test",
+			untagged:  true,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := vSphereSimulator{t: t}
+			sim.setUp()
+			defer sim.tearDown()
+
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			v := &Provider{dc: dc, allowFolderRelocation: true}
+
+			ctx := context.Background()
+			oldCluster := &kubermaticv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "test",
+				},
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{
+						VSphere: &kubermaticv1.VSphereCloudSpec{},
+					},
+				},
+			}
+			oldCluster, err := v.InitializeCloudProvider(ctx, oldCluster, testClusterUpdater(oldCluster))
+			if err != nil {
+				t.Fatalf("failed to initialize cloud provider: %v", err)
+			}
+			if tt.untagged {
+				oldCluster.Spec.Cloud.VSphere.TagCategoryID = ""
+			}
+
+			session, err := newSession(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+
+			for _, folder := range []string{"/DC0/vm/team", "/DC0/host/test", "/DC0/vm/other"} {
+				if _, err := createVMFolder(ctx, session, folder); err != nil {
+					t.Fatalf("failed to create folder %q: %v", folder, err)
+				}
+			}
+			// Move the folder behind the back of the cluster.
+			if err := relocateVMFolder(ctx, session, oldCluster.Spec.Cloud.VSphere.Folder, "/DC0/vm/team/test"); err != nil {
+				t.Fatalf("failed to move cluster folder: %v", err)
+			}
+
+			newCluster := oldCluster.DeepCopy()
+			newCluster.Spec.Cloud.VSphere.Folder = tt.newFolder
+
+			err = v.ValidateClusterUpdate(ctx, oldCluster, newCluster)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Provider.ValidateClusterUpdate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProviderRelocateClusterFolder(t *testing.T) {
+	tests := []struct {
+		name      string
+		newFolder string
+		wantErr   bool
+	}{
+		{
+			name:      "Rename",
+			newFolder: "/DC0/vm/renamed",
+		},
+		{
+			name:      "Move",
+			newFolder: "/DC0/vm/team/test",
+		},
+		{
+			name:      "Move and rename",
+			newFolder: "/DC0/vm/team/renamed",
+		},
+		{
+			name:      "Move outside of the root path",
+			newFolder: "/DC0/host/test",
+			wantErr:   true,
+		},
+		{
+			name:      "Move into itself",
+			newFolder: "/DC0/vm/test/nested",
+			wantErr:   true,
+		},
+		{
+			name:      "Move onto an existing folder",
+			newFolder: "/DC0/vm/team",
+			wantErr:   true,
+		},
+		{
+			name:      "Move and rename into a missing folder",
+			newFolder: "/DC0/vm/missing/renamed",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := vSphereSimulator{t: t}
+			sim.setUp()
+			defer sim.tearDown()
+
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			v := &Provider{dc: dc}
+
+			ctx := context.Background()
+			session, err := newSession(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+
+			for _, folder := range []string{"/DC0/vm/test", "/DC0/vm/team"} {
+				if _, err := createVMFolder(ctx, session, folder); err != nil {
+					t.Fatalf("failed to create folder %q: %v", folder, err)
+				}
+			}
+
+			cluster := &kubermaticv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "test",
+					Finalizers: []string{folderCleanupFinalizer},
+				},
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{
+						VSphere: &kubermaticv1.VSphereCloudSpec{
+							Folder: "/DC0/vm/test",
+						},
+					},
+				},
+			}
+
+			cluster, err = v.RelocateClusterFolder(ctx, cluster, tt.newFolder, testClusterUpdater(cluster))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Provider.RelocateClusterFolder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if _, err := session.Finder.Folder(ctx, "/DC0/vm/test"); err != nil {
+					t.Errorf("expected the folder to stay in place: %v", err)
+				}
+				return
+			}
+
+			if cluster.Spec.Cloud.VSphere.Folder != tt.newFolder {
+				t.Errorf("expected the cluster folder to be %q, got %q", tt.newFolder, cluster.Spec.Cloud.VSphere.Folder)
+			}
+			if !kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer) {
+				t.Error("expected the folder cleanup finalizer to be kept")
+			}
+			if _, err := session.Finder.Folder(ctx, tt.newFolder); err != nil {
+				t.Errorf("expected the folder to exist at %q: %v", tt.newFolder, err)
+			}
+			if _, err := session.Finder.Folder(ctx, "/DC0/vm/test"); !isNotFound(err) {
+				t.Errorf("expected the folder to be gone from its old location, got %v", err)
+			}
+		})
+	}
+}
+
+func TestProviderReconcileFolderName(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+	WithFolderNameTemplate("{{ .HumanReadableName }}-{{ .Name }}")(v)
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "abcdefghij",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			HumanReadableName: "before",
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.ReconcileCluster(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to reconcile cluster: %v", err)
+	}
+	if cluster.Spec.Cloud.VSphere.Folder != "/DC0/vm/before-abcdefghij" {
+		t.Fatalf("expected the folder to be named after the template, got %q", cluster.Spec.Cloud.VSphere.Folder)
+	}
+	ref := folderRef(cluster)
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	if _, err := createVMFolder(ctx, session, "/DC0/vm/taken-abcdefghij"); err != nil {
+		t.Fatalf("failed to create folder: %v", err)
+	}
+
+	tests := []struct {
+		humanReadableName string
+		expectedFolder    string
+	}{
+		{
+			humanReadableName: "after",
+			expectedFolder:    "/DC0/vm/after-abcdefghij",
+		},
+		{
+			// The name is taken by another folder, so the folder is left alone.
+			humanReadableName: "taken",
+			expectedFolder:    "/DC0/vm/after-abcdefghij",
+		},
+	}
+	for _, tt := range tests {
+		cluster.Spec.HumanReadableName = tt.humanReadableName
+		cluster, err = v.ReconcileCluster(ctx, cluster, testClusterUpdater(cluster))
+		if err != nil {
+			t.Fatalf("failed to reconcile cluster named %q: %v", tt.humanReadableName, err)
+		}
+
+		if cluster.Spec.Cloud.VSphere.Folder != tt.expectedFolder {
+			t.Errorf("expected the cluster folder to be %q, got %q", tt.expectedFolder, cluster.Spec.Cloud.VSphere.Folder)
+		}
+		folder, err := session.Finder.Folder(ctx, tt.expectedFolder)
+		if err != nil {
+			t.Fatalf("expected the folder to exist at %q: %v", tt.expectedFolder, err)
+		}
+		if current := folderRef(cluster); current == nil || *current != *ref || folder.Reference() != *ref {
+			t.Errorf("expected the folder %v to be kept, got %v at %q", ref, current, tt.expectedFolder)
+		}
+	}
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/before-abcdefghij"); !isNotFound(err) {
+		t.Errorf("expected the folder to be gone from its old location, got %v", err)
+	}
+}
+
+func TestNewSessionTimeout(t *testing.T) {
+	// A listener which accepts connections but never answers simulates a hung vCenter.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{
+		Endpoint:   "https://" + listener.Addr().String(),
+		Datacenter: "DC0",
+	}
+
+	timeout := 500 * time.Millisecond
+	start := time.Now()
+
+	_, err = newSession(context.Background(), dc, "user", "pass", nil, WithLoginTimeout(timeout))
+	if !IsTimeout(err) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*timeout {
+		t.Fatalf("expected newSession to return within %v, took %v", timeout, elapsed)
+	}
+
+	_, err = newRESTSession(context.Background(), dc, "user", "pass", nil, WithLoginTimeout(timeout))
+	if !IsTimeout(err) {
+		t.Fatalf("expected a timeout error for the REST session, got %v", err)
+	}
+}
+
+func TestNewSessionRetry(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	// A proxy which answers the first requests with 503 simulates a vCenter which is still starting up.
+	var requests int32
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: sim.server.URL.Scheme, Host: sim.server.URL.Host})
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			http.Error(w, "vCenter is starting", http.StatusServiceUnavailable)
+			return
+		}
+		proxy.ServeHTTP(w, r)
+	}))
+	defer flaky.Close()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.Endpoint = flaky.URL
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "user", "pass", nil)
+	if err != nil {
+		t.Fatalf("expected the login to succeed on the third attempt, got %v", err)
+	}
+	session.Logout(ctx)
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = newSession(ctx, dc, "user", "pass", nil, WithLoginAttempts(2))
+	if err == nil {
+		t.Fatal("expected the login to fail if vCenter is unavailable for longer than the login attempts")
+	}
+	if !isTransientError(err) {
+		t.Errorf("expected a transient error, got %v", err)
+	}
+
+	// Rejected credentials must not be retried.
+	dc.Endpoint = strings.TrimSuffix(sim.server.URL.String(), "/sdk")
+	dc.InfraManagementUser = nil
+	_, loginErr := connect(ctx, dc, "user", "", nil, newSessionOptions(nil))
+	if !isInvalidLogin(loginErr) {
+		t.Fatalf("expected an invalid login error, got %v", loginErr)
+	}
+
+	calls := 0
+	err = retryLogin(ctx, 3, func() error {
+		calls++
+		return loginErr
+	})
+	if !errors.Is(err, loginErr) {
+		t.Fatalf("expected the login error to be returned, got %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single attempt for invalid credentials, got %d", calls)
+	}
+}
+
+func TestAccountErrors(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	tests := []struct {
+		name        string
+		fault       string
+		message     string
+		expectedErr error
+	}{
+		{
+			name:        "Locked account",
+			fault:       "InvalidLogin",
+			message:     "The account of the user trying to authenticate is locked.",
+			expectedErr: ErrAccountLocked,
+		},
+		{
+			name:        "Expired password",
+			fault:       "PasswordExpired",
+			message:     "The password has expired.",
+			expectedErr: ErrPasswordExpired,
+		},
+		{
+			name:        "Rejected credentials",
+			fault:       "InvalidLogin",
+			message:     "Cannot complete login due to an incorrect user name or password.",
+			expectedErr: ErrInvalidCredentials,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A proxy answers the login with the fault vCenter reports for the account.
+			proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: sim.server.URL.Scheme, Host: sim.server.URL.Host})
+			vcenter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if !bytes.Contains(body, []byte("<Login ")) {
+					r.Body = io.NopCloser(bytes.NewReader(body))
+					proxy.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<soapenv:Body><soapenv:Fault><faultcode>ServerFaultCode</faultcode><faultstring>%s</faultstring>
+<detail><%sFault xmlns="urn:vim25" xsi:type="%s"></%sFault></detail></soapenv:Fault></soapenv:Body></soapenv:Envelope>`,
+					tt.message, tt.fault, tt.fault, tt.fault)
+			}))
+			defer vcenter.Close()
+
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			dc.Endpoint = vcenter.URL
+			dc.InfraManagementUser = nil
+
+			_, err := loginWithCredentials(context.Background(), dc, "user", "pass", nil, nil)
+			if !errors.Is(err, tt.expectedErr) {
+				t.Fatalf("expected error %v, got %v", tt.expectedErr, err)
+			}
+			var accountErr *AccountError
+			if errors.Is(tt.expectedErr, ErrInvalidCredentials) {
+				if errors.As(err, &accountErr) {
+					t.Errorf("expected rejected credentials not to be reported as account error, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &accountErr) {
+				t.Fatalf("expected an account error, got %v", err)
+			}
+			// The account can't log in until an admin intervenes, so the login must not be retried.
+			if !isInvalidLogin(err) {
+				t.Errorf("expected an invalid login error, got %v", err)
+			}
+			if accountErr.Username != "user" {
+				t.Errorf("expected the account error to name user %q, got %q", "user", accountErr.Username)
+			}
+		})
+	}
+}
+
+func TestBrowseSessionReauthentication(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	const (
+		passThrough int32 = iota
+		// expireOnce fails the next call with NotAuthenticated, like a session which expired while idling.
+		expireOnce
+		// expireAlways fails all calls with NotAuthenticated, like a vCenter which drops every session.
+		expireAlways
+	)
+	var mode, logins int32
+	// A proxy answers inventory calls with NotAuthenticated. Checking and logging out sessions is left
+	// alone, so pooled sessions still pass their validity check.
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: sim.server.URL.Scheme, Host: sim.server.URL.Host})
+	vcenter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if bytes.Contains(body, []byte("<Login ")) {
+			atomic.AddInt32(&logins, 1)
+		}
+		inventoryCall := bytes.Contains(body, []byte("<RetrieveProperties")) && !bytes.Contains(body, []byte("SessionManager"))
+		if !inventoryCall || atomic.LoadInt32(&mode) == passThrough {
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			proxy.ServeHTTP(w, r)
+			return
+		}
+		atomic.CompareAndSwapInt32(&mode, expireOnce, passThrough)
+		w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>
+<soapenv:Envelope xmlns:soapenv="http://schemas.xmlsoap.org/soap/envelope/" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+<soapenv:Body><soapenv:Fault><faultcode>ServerFaultCode</faultcode><faultstring>The session is not authenticated.</faultstring>
+<detail><NotAuthenticatedFault xmlns="urn:vim25" xsi:type="NotAuthenticated"><object type="Folder">group-d1</object><privilegeId>System.View</privilegeId></NotAuthenticatedFault></detail></soapenv:Fault></soapenv:Body></soapenv:Envelope>`)
+	}))
+	defer vcenter.Close()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.Endpoint = vcenter.URL
+
+	ctx := context.Background()
+	pool := NewSessionProvider(0, 0)
+	defer pool.Close(ctx)
+
+	listings := map[string]func() error{
+		"GetNetworks": func() error {
+			_, err := GetNetworks(ctx, dc, "", "", nil, WithSessionProvider(pool))
+			return err
+		},
+		"GetDatastoreList": func() error {
+			_, err := GetDatastoreList(ctx, dc, "", "", nil, WithSessionProvider(pool))
+			return err
+		},
+		"GetVMFolders": func() error {
+			_, err := GetVMFolders(ctx, dc, "", "", nil, WithSessionProvider(pool))
+			return err
+		},
+	}
+	for name, list := range listings {
+		t.Run(name, func(t *testing.T) {
+			// Establish the pooled session, which expires afterwards.
+			expired, err := pool.Session(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create pooled session: %v", err)
+			}
+			expired.Logout(ctx)
+			atomic.StoreInt32(&logins, 0)
+			atomic.StoreInt32(&mode, expireOnce)
+
+			if err := list(); err != nil {
+				t.Fatalf("expected the listing to succeed after re-establishing the session, got %v", err)
+			}
+			if n := atomic.LoadInt32(&logins); n != 1 {
+				t.Errorf("expected the session to be re-established once, got %d logins", n)
+			}
+			session, err := pool.Session(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to get pooled session: %v", err)
+			}
+			session.Logout(ctx)
+			if session.Client == expired.Client {
+				t.Error("expected the expired session to be dropped from the pool")
+			}
+
+			// Sessions which are rejected right away are re-established only once.
+			atomic.StoreInt32(&logins, 0)
+			atomic.StoreInt32(&mode, expireAlways)
+			defer atomic.StoreInt32(&mode, passThrough)
+			if err := list(); !isNotAuthenticated(err) {
+				t.Fatalf("expected a NotAuthenticated fault, got %v", err)
+			}
+			if n := atomic.LoadInt32(&logins); n != 1 {
+				t.Errorf("expected a single attempt to re-establish the session, got %d logins", n)
+			}
+		})
+	}
+}
+
+func TestInitializeCloudProviderLogins(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	metrics := NewMetrics()
+	v := &Provider{
+		dc:             dc,
+		sessionOptions: []SessionOption{WithMetrics(metrics)},
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if cluster.Spec.Cloud.VSphere.Folder == "" || cluster.Spec.Cloud.VSphere.TagCategoryID == "" {
+		t.Fatalf("expected folder and tag category to be created, got %+v", cluster.Spec.Cloud.VSphere)
+	}
+
+	// The folder and the tag steps must share a single vCenter session.
+	if logins := testutil.ToFloat64(metrics.Logins.WithLabelValues("DC0", operationSOAPLogin, resultSuccess)); logins != 1 {
+		t.Errorf("expected a single vCenter login, got %v", logins)
+	}
+	if logins := testutil.ToFloat64(metrics.Logins.WithLabelValues("DC0", operationRESTLogin, resultSuccess)); logins != 1 {
+		t.Errorf("expected a single REST login, got %v", logins)
+	}
+
+	// An initialized cluster doesn't need any session at all.
+	if _, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to initialize cloud provider again: %v", err)
+	}
+	if logins := testutil.ToFloat64(metrics.Logins.WithLabelValues("DC0", operationSOAPLogin, resultSuccess)); logins != 1 {
+		t.Errorf("expected no further vCenter login, got %v in total", logins)
+	}
+}
+
+func TestInitializeCloudProviderAfterPartialFailure(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	// The folder gets created, but neither it nor the finalizer make it into the cluster.
+	updateErr := errors.New("conflict")
+	failingUpdate := func(context.Context, string, func(*kubermaticv1.Cluster)) (*kubermaticv1.Cluster, error) {
+		return nil, updateErr
+	}
+
+	ctx := context.Background()
+	if _, err := v.InitializeCloudProvider(ctx, cluster, failingUpdate); !errors.Is(err, updateErr) {
+		t.Fatalf("expected the cluster update to fail, got %v", err)
+	}
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// The folder is deleted again, as the next attempt would not adopt it without the reference.
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/test"); !isNotFound(err) {
+		t.Fatalf("expected the folder of the first attempt to be deleted, got %v", err)
+	}
+
+	cluster, err = v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider again: %v", err)
+	}
+	if cluster.Spec.Cloud.VSphere.Folder != "/DC0/vm/test" {
+		t.Errorf("expected the folder to be created again, got %q", cluster.Spec.Cloud.VSphere.Folder)
+	}
+	if !kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer) {
+		t.Errorf("expected finalizer %q to be added", folderCleanupFinalizer)
+	}
+	folder, err := session.Finder.Folder(ctx, "/DC0/vm/test")
+	if err != nil {
+		t.Fatalf("expected the folder to be created by the second attempt: %v", err)
+	}
+	if ref := folderRef(cluster); ref == nil || *ref != folder.Reference() {
+		t.Errorf("expected the reference of the created folder %v, got %v", folder.Reference(), ref)
+	}
+
+	// Creating the folder again must be refused by vCenter, which createVMFolder needs to detect.
+	parent, err := session.Finder.Folder(ctx, "/DC0/vm")
+	if err != nil {
+		t.Fatalf("failed to get VM folder: %v", err)
+	}
+	if _, err := parent.CreateFolder(ctx, "test"); !isDuplicateName(err) {
+		t.Errorf("expected a duplicate name error, got %v", err)
+	}
+}
+
+func TestCheckFolderCollision(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+	restSession, err := newRESTSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create REST session: %v", err)
+	}
+	defer restSession.Logout(ctx)
+
+	for _, folder := range []string{
+		"/DC0/vm/empty",
+		"/DC0/vm/taken",
+		"/DC0/vm/taken/nodes",
+		"/DC0/vm/referenced",
+		"/DC0/vm/tagged",
+	} {
+		if _, err := createVMFolder(ctx, session, folder); err != nil {
+			t.Fatalf("failed to create folder %q: %v", folder, err)
+		}
+	}
+	referenced, err := session.Finder.Folder(ctx, "/DC0/vm/referenced")
+	if err != nil {
+		t.Fatalf("failed to get folder: %v", err)
+	}
+	tagged, err := session.Finder.Folder(ctx, "/DC0/vm/tagged")
+	if err != nil {
+		t.Fatalf("failed to get folder: %v", err)
+	}
+	categoryID, err := createTagCategory(ctx, restSession, "cluster-test", "test")
+	if err != nil {
+		t.Fatalf("failed to create tag category: %v", err)
+	}
+
+	newCluster := func(annotations map[string]string, categoryID string) *kubermaticv1.Cluster {
+		return &kubermaticv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test",
+				Annotations: annotations,
+			},
+			Spec: kubermaticv1.ClusterSpec{
+				Cloud: kubermaticv1.CloudSpec{
+					VSphere: &kubermaticv1.VSphereCloudSpec{
+						TagCategoryID: categoryID,
+					},
+				},
+			},
+		}
+	}
+	if err := createAndAttachTag(ctx, restSession, newCluster(nil, categoryID), categoryID, tagged); err != nil {
+		t.Fatalf("failed to tag folder: %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		folder      string
+		cluster     *kubermaticv1.Cluster
+		expectedErr bool
+	}{
+		{
+			name:    "Missing folder",
+			folder:  "/DC0/vm/missing",
+			cluster: newCluster(nil, ""),
+		},
+		{
+			name:        "Empty folder",
+			folder:      "/DC0/vm/empty",
+			cluster:     newCluster(nil, ""),
+			expectedErr: true,
+		},
+		{
+			name:        "Folder of another cluster",
+			folder:      "/DC0/vm/taken",
+			cluster:     newCluster(nil, categoryID),
+			expectedErr: true,
+		},
+		{
+			name:    "Folder referenced by the cluster",
+			folder:  "/DC0/vm/referenced",
+			cluster: newCluster(map[string]string{folderRefAnnotationKey: referenced.Reference().String()}, ""),
+		},
+		{
+			name:    "Folder tagged for the cluster",
+			folder:  "/DC0/vm/tagged",
+			cluster: newCluster(nil, categoryID),
+		},
+		{
+			name:        "Folder tagged in another category",
+			folder:      "/DC0/vm/tagged",
+			cluster:     newCluster(nil, "urn:vmomi:InventoryServiceCategory:other:GLOBAL"),
+			expectedErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckFolderCollision(ctx, dc, "", "", nil, tt.cluster, tt.folder)
+			var collisionErr *FolderCollisionError
+			if tt.expectedErr != errors.As(err, &collisionErr) {
+				t.Fatalf("expected a collision %v, got %v", tt.expectedErr, err)
+			}
+			if tt.expectedErr && !errors.Is(err, ErrFolderAlreadyExists) {
+				t.Errorf("expected the collision to match %v", ErrFolderAlreadyExists)
+			}
+		})
+	}
+
+	// The folder of a cluster must not be adopted by another cluster with the same name, even if it is empty.
+	v := &Provider{dc: dc}
+	for _, name := range []string{"taken", "empty"} {
+		cluster := newCluster(nil, "")
+		cluster.Name = name
+		if _, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster)); !errors.Is(err, ErrFolderAlreadyExists) {
+			t.Errorf("expected the initialization of cluster %q to fail with %v, got %v", name, ErrFolderAlreadyExists, err)
+		}
+	}
+}
+
+// restrictedAuthorizationManager reports only the given privileges for every entity, while the simulator
+// otherwise grants all of them.
+type restrictedAuthorizationManager struct {
+	*simulator.AuthorizationManager
+	privileges []string
+}
+
+func (m *restrictedAuthorizationManager) FetchUserPrivilegeOnEntities(req *types.FetchUserPrivilegeOnEntities) soap.HasFault {
+	var results []types.UserPrivilegeResult
+	for _, entity := range req.Entities {
+		results = append(results, types.UserPrivilegeResult{
+			Entity:     entity,
+			Privileges: m.privileges,
+		})
+	}
+
+	return &methods.FetchUserPrivilegeOnEntitiesBody{
+		Res: &types.FetchUserPrivilegeOnEntitiesResponse{
+			Returnval: results,
+		},
+	}
+}
+
+func TestInitializeCloudProviderMissingFolderPrivilege(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	authManager := simulator.Map.Get(*simulator.Map.Get(vim25.ServiceInstance).(*simulator.ServiceInstance).Content.AuthorizationManager).(*simulator.AuthorizationManager)
+	simulator.Map.Put(&restrictedAuthorizationManager{
+		AuthorizationManager: authManager,
+		privileges:           []string{"System.Anonymous", "System.View", "System.Read"},
+	})
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{dc: dc}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	_, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if !errors.Is(err, ErrMissingPrivilege) {
+		t.Fatalf("expected a missing privilege error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), folderCreatePrivilege) {
+		t.Errorf("expected the error to name the privilege %q, got %v", folderCreatePrivilege, err)
+	}
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/test"); !isNotFound(err) {
+		t.Errorf("expected the folder not to be created, got %v", err)
+	}
+}
+
+func TestProviderLogging(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.InfraManagementUser = nil
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+	WithLogger(zap.New(core).Sugar())(v)
+
+	const password = "s3cr3t-password"
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Username: "user",
+					Password: password,
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+
+	for _, message := range []string{
+		"Opened vCenter session",
+		"Created VM folder",
+		"Created tag category",
+		"Deleted VM folder",
+		"Deleted tag category",
+	} {
+		entries := logs.FilterMessage(message).All()
+		if len(entries) == 0 {
+			t.Errorf("expected %q to be logged", message)
+			continue
+		}
+		fields := entries[0].ContextMap()
+		if fields["datacenter"] != "DC0" || fields["cluster"] != "test" {
+			t.Errorf("expected %q to be logged with the datacenter and cluster, got %v", message, fields)
+		}
+	}
+
+	for _, entry := range logs.All() {
+		if strings.Contains(entry.Message, password) || strings.Contains(fmt.Sprint(entry.ContextMap()), password) {
+			t.Errorf("expected the password to never be logged, got %q with %v", entry.Message, entry.ContextMap())
+		}
+	}
+
+	// The endpoint of the simulator contains its credentials.
+	simPassword, _ := sim.server.URL.User.Password()
+	for _, entry := range logs.FilterMessage("Opened vCenter session").All() {
+		if endpoint := fmt.Sprint(entry.ContextMap()["endpoint"]); strings.Contains(endpoint, ":"+simPassword+"@") {
+			t.Errorf("expected the endpoint to be logged without its password, got %q", endpoint)
+		}
+	}
+}
+
+func TestNewCloudProviderOptions(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	datacenter := &kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: dc}}
+
+	newCluster := func() *kubermaticv1.Cluster {
+		return &kubermaticv1.Cluster{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "test",
+			},
+			Spec: kubermaticv1.ClusterSpec{
+				Cloud: kubermaticv1.CloudSpec{
+					VSphere: &kubermaticv1.VSphereCloudSpec{},
+				},
+			},
+		}
+	}
+
+	core, logs := observer.New(zapcore.DebugLevel)
+	metrics := NewMetrics()
+	v, err := NewCloudProvider(datacenter, nil, nil,
+		WithLogger(zap.New(core).Sugar()),
+		WithSessionOptions(WithMetrics(metrics)),
+		WithSessionTimeout(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+
+	ctx := context.Background()
+	cluster := newCluster()
+	if _, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if logs.FilterMessage("Created VM folder").Len() != 1 {
+		t.Error("expected the folder creation to be logged by the configured logger")
+	}
+	if value := testutil.ToFloat64(metrics.Operations.WithLabelValues("DC0", operationInitialize, resultSuccess)); value != 1 {
+		t.Errorf("expected the initialization to be recorded in the configured metrics, got %v", value)
+	}
+
+	// A session timeout, which is too short for any call, must abort the initialization.
+	v, err = NewCloudProvider(datacenter, nil, nil, WithSessionTimeout(time.Nanosecond))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	cluster = newCluster()
+	var timeoutErr *TimeoutError
+	if _, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster)); !errors.As(err, &timeoutErr) {
+		t.Errorf("expected a %T, got %v", timeoutErr, err)
+	}
+}
+
+func TestRetryCleanup(t *testing.T) {
+	metrics := NewMetrics()
+	v := &Provider{
+		dc:             &kubermaticv1.DatacenterSpecVSphere{Datacenter: "DC0"},
+		cleanupBackoff: &wait.Backoff{Steps: 3, Duration: time.Millisecond},
+		sessionOptions: []SessionOption{WithMetrics(metrics)},
+	}
+	transientErr := errors.New("transient")
+
+	calls := 0
+	err := v.retryCleanup(context.Background(), v.logger(nil), operationDeleteFolder, func() error {
+		calls++
+		if calls < 3 {
+			return transientErr
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected cleanup to succeed after retries, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+	if retries := testutil.ToFloat64(metrics.CleanupRetries.WithLabelValues("DC0", operationDeleteFolder)); retries != 2 {
+		t.Errorf("expected 2 retries to be recorded, got %v", retries)
+	}
+
+	calls = 0
+	err = v.retryCleanup(context.Background(), v.logger(nil), operationDeleteFolder, func() error {
+		calls++
+		return transientErr
+	})
+	if !errors.Is(err, transientErr) {
+		t.Fatalf("expected the last error to be returned, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 3 attempts, got %d", calls)
+	}
+}
+
+// cleanUpTestCase describes the state of a cluster before CleanUpCloudProvider runs and the
+// finalizers expected to remain afterwards. See testCleanUp.
+type cleanUpTestCase struct {
+	name       string
+	finalizers []string
+	// folder overrides the folder of the cluster, e.g. to make its deletion fail.
+	folder string
+	// folderExists and categoryExists create the resources in vCenter, otherwise they are
+	// already deleted although the finalizers might still be present.
+	folderExists   bool
+	categoryExists bool
+	// restUnavailable makes the REST API of vCenter unavailable, so tags cannot be cleaned up.
+	restUnavailable bool
+	// holdFolderDeletion holds the deletion of the folder in vCenter until the tag category finalizer is removed,
+	// which makes sure the tag category is cleaned up without waiting for the folder.
+	holdFolderDeletion bool
+	// cancelAfterTagCategory cancels the context of the cleanup once the tag category finalizer is removed.
+	cancelAfterTagCategory bool
+	wantErr                bool
+	expectedFinalizers     []string
+	// expectedPending are the steps reported as pending by the CleanupError.
+	expectedPending []string
+}
+
+func TestProviderCleanUpCloudProvider(t *testing.T) {
+	bothFinalizers := []string{folderCleanupFinalizer, tagCategoryCleanupFinilizer}
+
+	tests := []cleanUpTestCase{
+		{
+			name:           "No finalizers",
+			folderExists:   true,
+			categoryExists: true,
+		},
+		{
+			name:           "Folder finalizer",
+			finalizers:     []string{folderCleanupFinalizer},
+			folderExists:   true,
+			categoryExists: true,
+		},
+		{
+			name:           "Tag category finalizer",
+			finalizers:     []string{tagCategoryCleanupFinilizer},
+			folderExists:   true,
+			categoryExists: true,
+		},
+		{
+			name:           "Both finalizers",
+			finalizers:     bothFinalizers,
+			folderExists:   true,
+			categoryExists: true,
+		},
+		{
+			name:           "Folder already gone",
+			finalizers:     bothFinalizers,
+			categoryExists: true,
+		},
+		{
+			name:         "Tag category already gone",
+			finalizers:   bothFinalizers,
+			folderExists: true,
+		},
+		{
+			name:       "Both already gone",
+			finalizers: bothFinalizers,
+		},
+		{
+			name:               "Folder cleanup fails permanently",
+			finalizers:         bothFinalizers,
+			folder:             "..",
+			categoryExists:     true,
+			wantErr:            true,
+			expectedFinalizers: []string{folderCleanupFinalizer},
+			expectedPending:    []string{operationDeleteFolder},
+		},
+		{
+			name:               "Tag category cleanup fails permanently",
+			finalizers:         bothFinalizers,
+			folderExists:       true,
+			restUnavailable:    true,
+			wantErr:            true,
+			expectedFinalizers: []string{tagCategoryCleanupFinilizer},
+			expectedPending:    []string{operationDeleteTagCategory},
+		},
+		{
+			name:               "Slow folder cleanup",
+			finalizers:         bothFinalizers,
+			folderExists:       true,
+			categoryExists:     true,
+			holdFolderDeletion: true,
+		},
+		{
+			name:                   "Cancelled during folder cleanup",
+			finalizers:             bothFinalizers,
+			folderExists:           true,
+			categoryExists:         true,
+			holdFolderDeletion:     true,
+			cancelAfterTagCategory: true,
+			wantErr:                true,
+			expectedFinalizers:     []string{folderCleanupFinalizer},
+			expectedPending:        []string{operationDeleteFolder},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testCleanUp(t, tt)
+		})
+	}
+}
+
+// testCleanUp runs CleanUpCloudProvider for the test case and checks which finalizers remain and that
+// the resources whose finalizers got removed are gone. A successful cleanup must be idempotent.
+func testCleanUp(t *testing.T, tt cleanUpTestCase) {
+	sim := &vSphereSimulator{t: t}
+	if tt.restUnavailable {
+		// Without the registered endpoints, the simulator only serves the SOAP API.
+		sim.model = simulator.VPX()
+		if err := sim.model.Create(); err != nil {
+			t.Fatal(err)
+		}
+		sim.server = sim.model.Service.NewServer()
+	} else {
+		sim.setUp()
+	}
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 2, Duration: time.Millisecond},
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       "test",
+			Finalizers: tt.finalizers,
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{
+					Folder: "/DC0/vm/test",
+					// The ID of a category which does not exist.
+					TagCategoryID: "urn:vmomi:InventoryServiceCategory:00000000-0000-0000-0000-000000000000:GLOBAL",
+				},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	if tt.folderExists {
+		if _, err := createVMFolder(ctx, session, cluster.Spec.Cloud.VSphere.Folder); err != nil {
+			t.Fatalf("failed to create folder: %v", err)
+		}
+	}
+	if tt.folder != "" {
+		cluster.Spec.Cloud.VSphere.Folder = tt.folder
+	}
+
+	var tagManager *tags.Manager
+	if !tt.restUnavailable {
+		restSession, err := newRESTSession(ctx, dc, "", "", nil)
+		if err != nil {
+			t.Fatalf("failed to create REST client session: %v", err)
+		}
+		defer restSession.Logout(ctx)
+		tagManager = tags.NewManager(restSession.Client)
+
+		if tt.categoryExists {
+			categoryID, err := createTagCategory(ctx, restSession, categoryName("", cluster), cluster.Name)
+			if err != nil {
+				t.Fatalf("failed to create tag category: %v", err)
+			}
+			cluster.Spec.Cloud.VSphere.TagCategoryID = categoryID
+		}
+	}
+
+	cleanupCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	tagCategoryDeleted := make(chan struct{})
+	deletionHeld := make(chan struct{})
+	update := func(ctx context.Context, name string, modify func(*kubermaticv1.Cluster)) (*kubermaticv1.Cluster, error) {
+		hadFinalizer := kuberneteshelper.HasFinalizer(cluster, tagCategoryCleanupFinilizer)
+		cluster, err := testClusterUpdater(cluster)(ctx, name, modify)
+		if hadFinalizer && !kuberneteshelper.HasFinalizer(cluster, tagCategoryCleanupFinilizer) {
+			if tt.holdFolderDeletion {
+				// The folder deletion must be held before the cleanup is cancelled.
+				select {
+				case <-deletionHeld:
+				case <-time.After(10 * time.Second):
+					t.Error("expected the folder deletion to be held while the tag category is cleaned up")
+				}
+			}
+			if tt.cancelAfterTagCategory {
+				cancel()
+			}
+			close(tagCategoryDeleted)
+		}
+		return cluster, err
+	}
+
+	if tt.holdFolderDeletion {
+		// A proxy holds the deletion of the folder, the only object destroyed in the cleanup.
+		var holdOnce sync.Once
+		proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: sim.server.URL.Scheme, Host: sim.server.URL.Host})
+		vcenter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if bytes.Contains(body, []byte("<Destroy_Task ")) {
+				holdOnce.Do(func() { close(deletionHeld) })
+				select {
+				case <-tagCategoryDeleted:
+				case <-time.After(10 * time.Second):
+					t.Error("expected the tag category to be cleaned up while the folder deletion is pending")
+				}
+				if tt.cancelAfterTagCategory {
+					// The cancelled client doesn't wait for the answer anyway.
+					<-r.Context().Done()
+					return
+				}
+			}
+			proxy.ServeHTTP(w, r)
+		}))
+		defer vcenter.Close()
+
+		cleanupDC := dc.DeepCopy()
+		cleanupDC.Endpoint = vcenter.URL
+		v.dc = cleanupDC
+	}
+
+	_, err = v.CleanUpCloudProvider(cleanupCtx, cluster, update)
+	if (err != nil) != tt.wantErr {
+		t.Fatalf("Provider.CleanUpCloudProvider() error = %v, wantErr %v", err, tt.wantErr)
+	}
+	if tt.expectedPending != nil {
+		var cleanupErr *CleanupError
+		if !errors.As(err, &cleanupErr) {
+			t.Fatalf("expected a cleanup error, got %v", err)
+		}
+		if changes := diff.ObjectDiff(tt.expectedPending, cleanupErr.Pending); changes != "" {
+			t.Errorf("Got pending steps differ from expected ones. Diff: %v", changes)
+		}
+		expectedCompleted := sets.NewString(tt.finalizers...).Difference(sets.NewString(tt.expectedFinalizers...))
+		if len(cleanupErr.Completed) != expectedCompleted.Len() {
+			t.Errorf("expected %d completed steps, got %v", expectedCompleted.Len(), cleanupErr.Completed)
+		}
+	}
+
+	if changes := diff.ObjectDiff(sets.NewString(tt.expectedFinalizers...).List(), sets.NewString(cluster.Finalizers...).List()); changes != "" {
+		t.Errorf("Got finalizers differ from expected ones. Diff: %v", changes)
+	}
+
+	// The resources must be gone once their finalizer is removed, and must be left alone without finalizer.
+	removed := sets.NewString(tt.finalizers...).Difference(sets.NewString(cluster.Finalizers...))
+	if tt.folderExists {
+		_, err := session.Finder.Folder(ctx, "/DC0/vm/test")
+		if removed.Has(folderCleanupFinalizer) != isNotFound(err) {
+			t.Errorf("expected the folder to be deleted: %v, got %v", removed.Has(folderCleanupFinalizer), err)
+		}
+	}
+	if tt.categoryExists {
+		_, err := tagManager.GetCategory(ctx, cluster.Spec.Cloud.VSphere.TagCategoryID)
+		if removed.Has(tagCategoryCleanupFinilizer) != isRESTNotFound(err) {
+			t.Errorf("expected the tag category to be deleted: %v, got %v", removed.Has(tagCategoryCleanupFinilizer), err)
+		}
+	}
+
+	// An interrupted cleanup resumes with the pending steps.
+	if tt.cancelAfterTagCategory {
+		v.dc = dc
+		if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+			t.Fatalf("expected the retried cleanup to succeed, got %v", err)
+		}
+		if len(cluster.Finalizers) != 0 {
+			t.Errorf("expected all finalizers to be removed, got %v", cluster.Finalizers)
+		}
+		if _, err := session.Finder.Folder(ctx, "/DC0/vm/test"); !isNotFound(err) {
+			t.Errorf("expected the folder to be deleted, got %v", err)
+		}
+	}
+
+	if tt.wantErr {
+		return
+	}
+	if _, err := v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster)); err != nil {
+		t.Errorf("expected a repeated cleanup to succeed, got %v", err)
+	}
+}
+
+func TestProviderCleanUpRenamedFolder(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	v := &Provider{
+		dc:             dc,
+		cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+	}
+
+	cluster := &kubermaticv1.Cluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "test",
+		},
+		Spec: kubermaticv1.ClusterSpec{
+			Cloud: kubermaticv1.CloudSpec{
+				VSphere: &kubermaticv1.VSphereCloudSpec{},
+			},
+		},
+	}
+
+	ctx := context.Background()
+	cluster, err := v.InitializeCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to initialize cloud provider: %v", err)
+	}
+	if folderRef(cluster) == nil {
+		t.Fatalf("expected the folder reference to be stored, got annotations %v", cluster.Annotations)
+	}
+
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// Rename the folder behind the back of the cluster, so its path is outdated.
+	folder, err := session.Finder.Folder(ctx, cluster.Spec.Cloud.VSphere.Folder)
+	if err != nil {
+		t.Fatalf("failed to get cluster folder: %v", err)
+	}
+	task, err := folder.Rename(ctx, "renamed")
+	if err != nil {
+		t.Fatalf("failed to rename cluster folder: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to rename cluster folder: %v", err)
+	}
+
+	cluster, err = v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+	if err != nil {
+		t.Fatalf("failed to clean up cloud provider: %v", err)
+	}
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/renamed"); !isNotFound(err) {
+		t.Errorf("expected the renamed folder to be deleted, got %v", err)
+	}
+	if _, ok := cluster.Annotations[folderRefAnnotationKey]; ok {
+		t.Errorf("expected the folder reference to be removed, got annotations %v", cluster.Annotations)
+	}
+	if kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer) {
+		t.Errorf("expected finalizer %q to be removed", folderCleanupFinalizer)
+	}
+}
+
+func TestProviderCleanUpForeignFolderRef(t *testing.T) {
+	tests := []struct {
+		name   string
+		folder string
+	}{
+		{
+			name:   "Folder of another cluster",
+			folder: "/DC0/vm/other",
+		},
+		{
+			name:   "Folder outside of the root path",
+			folder: "/DC0/host/other",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sim := vSphereSimulator{t: t}
+			sim.setUp()
+			defer sim.tearDown()
+
+			dc := &kubermaticv1.DatacenterSpecVSphere{}
+			sim.fillClientInfo(dc)
+			v := &Provider{
+				dc:             dc,
+				cleanupBackoff: &wait.Backoff{Steps: 1, Duration: time.Millisecond},
+			}
+
+			ctx := context.Background()
+			session, err := newSession(ctx, dc, "", "", nil)
+			if err != nil {
+				t.Fatalf("failed to create vCenter session: %v", err)
+			}
+			defer session.Logout(ctx)
+
+			if _, err := createVMFolder(ctx, session, "/DC0/vm/test"); err != nil {
+				t.Fatalf("failed to create cluster folder: %v", err)
+			}
+			foreign, err := createVMFolder(ctx, session, tt.folder)
+			if err != nil {
+				t.Fatalf("failed to create folder %q: %v", tt.folder, err)
+			}
+
+			// The reference was edited to point to a folder which doesn't belong to the cluster.
+			cluster := &kubermaticv1.Cluster{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test",
+					Annotations: map[string]string{folderRefAnnotationKey: foreign.Reference().String()},
+					Finalizers:  []string{folderCleanupFinalizer},
+				},
+				Spec: kubermaticv1.ClusterSpec{
+					Cloud: kubermaticv1.CloudSpec{
+						VSphere: &kubermaticv1.VSphereCloudSpec{
+							Folder: "/DC0/vm/test",
+						},
+					},
+				},
+			}
+
+			if _, err := v.GetClusterEvents(ctx, cluster, "", "", time.Time{}); err != nil {
+				t.Errorf("failed to get cluster events: %v", err)
+			}
+
+			cluster, err = v.CleanUpCloudProvider(ctx, cluster, testClusterUpdater(cluster))
+			if err != nil {
+				t.Fatalf("failed to clean up cloud provider: %v", err)
+			}
+			if _, err := session.Finder.Folder(ctx, tt.folder); err != nil {
+				t.Errorf("expected the referenced folder to be kept: %v", err)
+			}
+			if _, err := session.Finder.Folder(ctx, "/DC0/vm/test"); !isNotFound(err) {
+				t.Errorf("expected the cluster folder to be deleted by its path, got %v", err)
+			}
+			if kuberneteshelper.HasFinalizer(cluster, folderCleanupFinalizer) {
+				t.Errorf("expected finalizer %q to be removed", folderCleanupFinalizer)
+			}
+		})
+	}
+}
+
+// testClusterUpdater returns a ClusterUpdater which applies all modifications to the given cluster.
+func testClusterUpdater(cluster *kubermaticv1.Cluster) provider.ClusterUpdater {
+	return func(_ context.Context, _ string, modify func(*kubermaticv1.Cluster)) (*kubermaticv1.Cluster, error) {
+		modify(cluster)
+		return cluster, nil
+	}
+}
+
+// The following resources are made available:
+// * Datastore named: LocalDS_0
+// * Datastore cluster named: DC0_POD0.
+type vSphereSimulator struct {
+	t      testing.TB
+	model  *simulator.Model
+	server *simulator.Server
+	// user, if set, is the only user the simulator accepts.
+	user *url.Userinfo
+}
+
+func (v *vSphereSimulator) setUp() {
+	if v.model == nil {
+		v.model = simulator.VPX()
+	}
+	// Pod == StoragePod == DatastoreCluster
+	v.model.Pod++
+	v.model.Cluster++
+
+	err := v.model.Create()
+	if err != nil {
+		v.t.Fatal(err)
+	}
+
+	// Serve the REST and storage policy endpoints as well, they are needed for tags and storage policies.
+	v.model.Service.RegisterEndpoints = true
+	if v.user != nil {
+		v.model.Service.Listen = &url.URL{User: v.user}
+	}
 	v.server = v.model.Service.NewServer()
 }
 
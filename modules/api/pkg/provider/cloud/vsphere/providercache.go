@@ -0,0 +1,113 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// ProviderCache keeps a provider per datacenter, so the state of the providers, like the folder
+// cache, outlives single API requests. A provider is replaced once the spec of its datacenter or
+// the CA bundle changes, and closed once it was not used for the idle TTL, so providers of deleted
+// or renamed datacenters do not live for the whole process.
+type ProviderCache struct {
+	opts    []Option
+	idleTTL time.Duration
+
+	lock      sync.Mutex
+	providers map[string]*cachedProvider
+}
+
+type cachedProvider struct {
+	spec     *kubermaticv1.DatacenterSpecVSphere
+	caBundle *x509.CertPool
+	provider *Provider
+	lastUsed time.Time
+}
+
+// NewProviderCache creates a cache of providers, which are created with the given options and
+// closed once they were not used for idleTTL.
+func NewProviderCache(idleTTL time.Duration, opts ...Option) *ProviderCache {
+	return &ProviderCache{
+		opts:      opts,
+		idleTTL:   idleTTL,
+		providers: map[string]*cachedProvider{},
+	}
+}
+
+// Provider returns the provider of the named datacenter, creating it if the cache holds none or
+// an outdated one. Providers returned by the cache must not be closed by the caller.
+func (c *ProviderCache) Provider(ctx context.Context, name string, dc *kubermaticv1.Datacenter, caBundle *x509.CertPool) (*Provider, error) {
+	now := time.Now()
+	defer c.evictIdle(ctx, name, now)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	cached, ok := c.providers[name]
+	if ok && cached.caBundle == caBundle && equality.Semantic.DeepEqual(cached.spec, dc.Spec.VSphere) {
+		cached.lastUsed = now
+		return cached.provider, nil
+	}
+
+	p, err := NewCloudProvider(dc, nil, caBundle, c.opts...)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if err := cached.provider.Close(ctx); err != nil {
+			p.log.Warnw("Failed to close outdated provider", "datacenter", name, zap.Error(err))
+		}
+	}
+	c.providers[name] = &cachedProvider{
+		spec:     dc.Spec.VSphere.DeepCopy(),
+		caBundle: caBundle,
+		provider: p,
+		lastUsed: now,
+	}
+
+	return p, nil
+}
+
+// evictIdle closes and removes the providers, except the named one, which were not used since the
+// idle TTL. They are closed without holding the lock, as closing them logs out their sessions.
+func (c *ProviderCache) evictIdle(ctx context.Context, name string, now time.Time) {
+	c.lock.Lock()
+	evicted := map[string]*Provider{}
+	for cachedName, cached := range c.providers {
+		if cachedName != name && now.Sub(cached.lastUsed) > c.idleTTL {
+			evicted[cachedName] = cached.provider
+			delete(c.providers, cachedName)
+		}
+	}
+	c.lock.Unlock()
+
+	for evictedName, p := range evicted {
+		if err := p.Close(ctx); err != nil {
+			p.log.Warnw("Failed to close idle provider", "datacenter", evictedName, zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestProviderCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewProviderCache(time.Hour, WithFolderCache(time.Hour))
+
+	newDatacenter := func(endpoint string) *kubermaticv1.Datacenter {
+		return &kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: &kubermaticv1.DatacenterSpecVSphere{
+			Endpoint:   endpoint,
+			Datacenter: "DC0",
+		}}}
+	}
+	getProvider := func(name string, dc *kubermaticv1.Datacenter, caBundle *x509.CertPool) *Provider {
+		p, err := cache.Provider(ctx, name, dc, caBundle)
+		if err != nil {
+			t.Fatalf("failed to get provider: %v", err)
+		}
+		return p
+	}
+
+	first := getProvider("dc", newDatacenter("https://vcenter"), nil)
+	if first.folderCache == nil {
+		t.Fatal("expected the provider to be created with the options of the cache")
+	}
+	if p := getProvider("dc", newDatacenter("https://vcenter"), nil); p != first {
+		t.Error("expected the provider to be reused for an unchanged datacenter")
+	}
+	if p := getProvider("other", newDatacenter("https://vcenter"), nil); p == first {
+		t.Error("expected every datacenter to get its own provider")
+	}
+
+	second := getProvider("dc", newDatacenter("https://other-vcenter"), nil)
+	if second == first {
+		t.Error("expected the provider to be replaced once the datacenter changed")
+	}
+	if p := getProvider("dc", newDatacenter("https://other-vcenter"), x509.NewCertPool()); p == second {
+		t.Error("expected the provider to be replaced once the CA bundle changed")
+	}
+
+	if _, err := cache.Provider(ctx, "invalid", &kubermaticv1.Datacenter{}, nil); err == nil {
+		t.Error("expected an error for a datacenter which is not a vSphere datacenter")
+	}
+}
+
+func TestProviderCacheEvictsIdleProviders(t *testing.T) {
+	ctx := context.Background()
+	cache := NewProviderCache(time.Hour, WithFolderCache(time.Hour))
+
+	dc := &kubermaticv1.Datacenter{Spec: kubermaticv1.DatacenterSpec{VSphere: &kubermaticv1.DatacenterSpecVSphere{
+		Endpoint:   "https://vcenter",
+		Datacenter: "DC0",
+	}}}
+	getProvider := func(name string) *Provider {
+		p, err := cache.Provider(ctx, name, dc, nil)
+		if err != nil {
+			t.Fatalf("failed to get provider: %v", err)
+		}
+		return p
+	}
+
+	removed := getProvider("removed")
+	removed.folderCache.set(folderCacheKey{}, []Folder{{Path: "/DC0/vm/folder"}})
+	used := getProvider("used")
+
+	// The removed datacenter is no longer requested, while the other one is.
+	cache.providers["removed"].lastUsed = time.Now().Add(-2 * time.Hour)
+	cache.providers["used"].lastUsed = time.Now().Add(-30 * time.Minute)
+
+	if p := getProvider("used"); p != used {
+		t.Error("expected a provider used within the idle TTL to be kept")
+	}
+	if _, ok := cache.providers["removed"]; ok {
+		t.Fatal("expected the idle provider to be evicted")
+	}
+	if len(removed.folderCache.entries) != 0 {
+		t.Error("expected the evicted provider to be closed")
+	}
+
+	// Even an idle provider is not evicted by the request it is returned to.
+	cache.providers["used"].lastUsed = time.Now().Add(-2 * time.Hour)
+	if p := getProvider("used"); p != used {
+		t.Error("expected the requested provider to be reused")
+	}
+	if p := getProvider("removed"); p == removed {
+		t.Error("expected a new provider once the evicted datacenter is requested again")
+	}
+}
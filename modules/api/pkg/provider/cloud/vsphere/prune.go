@@ -0,0 +1,199 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// clusterNameRegexp matches the names KKP generates for clusters. Folders with other names were
+// created by users and are never pruned.
+var clusterNameRegexp = regexp.MustCompile(`^[a-z0-9]{10}$`)
+
+// ClusterLister returns all clusters which currently exist.
+type ClusterLister func(ctx context.Context) ([]kubermaticv1.Cluster, error)
+
+// PruneOrphanedFolders deletes the cluster folders which were left behind by deleted clusters, e.g. because
+// their finalizer got lost, and returns their paths. In dry-run mode the folders are only returned. The root path
+// of the datacenter is searched as well as the root paths the listed clusters override, see RootPathAnnotationKey.
+// To not delete anything which is still in use, a folder is only pruned if
+//   - it is located directly below one of the root paths, but is no root path itself,
+//   - its name has the format of a cluster name, but doesn't belong to any of the listed clusters or their
+//     projects, and
+//   - it doesn't contain anything, neither VMs nor other folders.
+//
+// vCenter deletes the content of folders along with them, so the content is checked right before the deletion.
+// A cluster might be created while the folders are pruned and its folder is created empty, so the clusters are
+// listed again right before every deletion as well.
+func PruneOrphanedFolders(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, listClusters ClusterLister, dryRun bool, opts ...SessionOption) ([]string, error) {
+	dcRootPath, err := getVMRootPath(dc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get vm root path: %w", err)
+	}
+
+	clusters, err := listClusters(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list clusters: %w", err)
+	}
+	rootPaths := sets.NewString(dcRootPath)
+	for i := range clusters {
+		if clusters[i].Annotations[RootPathAnnotationKey] == "" {
+			continue
+		}
+		// Overrides which are invalid were never used by the provider.
+		if rootPath, err := clusterRootPath(dc, &clusters[i]); err == nil {
+			rootPaths.Insert(rootPath)
+		}
+	}
+
+	session, err := newSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	orphans := map[types.ManagedObjectReference]string{}
+	for _, rootPath := range rootPaths.List() {
+		rootOrphans, err := getOrphanedFolders(ctx, session, rootPath, knownFolderNames(clusters))
+		if err != nil {
+			return nil, err
+		}
+		for ref, folderPath := range rootOrphans {
+			if !rootPaths.Has(folderPath) {
+				orphans[ref] = folderPath
+			}
+		}
+	}
+
+	var pruned []string
+	var errs []error
+	for ref, folderPath := range orphans {
+		if !dryRun {
+			clusters, err := listClusters(ctx)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to list clusters: %w", err))
+				break
+			}
+			if knownFolderNames(clusters).Has(path.Base(folderPath)) {
+				continue
+			}
+
+			if err := deleteOrphanedFolder(ctx, session, ref, folderPath); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+		}
+		pruned = append(pruned, folderPath)
+	}
+
+	sort.Strings(pruned)
+	return pruned, kerrors.NewAggregate(errs)
+}
+
+// knownFolderNames returns the names of the clusters and of their projects, as folders named after projects
+// hold the root paths of clusters.
+func knownFolderNames(clusters []kubermaticv1.Cluster) sets.String {
+	names := sets.NewString()
+	for _, cluster := range clusters {
+		names.Insert(cluster.Name)
+		if projectID := cluster.Labels[kubermaticv1.ProjectIDLabelKey]; projectID != "" {
+			names.Insert(projectID)
+		}
+	}
+	return names
+}
+
+// getOrphanedFolders returns the paths of the empty folders directly below the root path, which look like
+// cluster folders, but don't have any of the known names.
+func getOrphanedFolders(ctx context.Context, session *Session, rootPath string, knownNames sets.String) (map[types.ManagedObjectReference]string, error) {
+	if _, err := session.Finder.Folder(ctx, rootPath); err != nil {
+		return nil, fmt.Errorf("couldn't find rootpath %q: %w", rootPath, err)
+	}
+
+	folderRefs, err := session.Finder.FolderList(ctx, path.Join(rootPath, "*"))
+	if err != nil {
+		// Root paths without any child folders are reported as not found.
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve folders below %q: %w", rootPath, err)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(folderRefs))
+	paths := make(map[types.ManagedObjectReference]string, len(folderRefs))
+	vmRoot := vmRootFolder(session)
+	for _, folderRef := range folderRefs {
+		name := path.Base(folderRef.InventoryPath)
+		if knownNames.Has(name) || !clusterNameRegexp.MatchString(name) || isExcludedFolder(folderRef.InventoryPath, rootPath, vmRoot) {
+			continue
+		}
+		refs = append(refs, folderRef.Reference())
+		paths[folderRef.Reference()] = folderRef.InventoryPath
+	}
+	if len(refs) == 0 {
+		return nil, nil
+	}
+
+	var folders []mo.Folder
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"childEntity"}, &folders); err != nil {
+		return nil, fmt.Errorf("failed to get folder properties: %w", err)
+	}
+
+	orphans := map[types.ManagedObjectReference]string{}
+	for _, folder := range folders {
+		if len(folder.ChildEntity) == 0 {
+			orphans[folder.Reference()] = paths[folder.Reference()]
+		}
+	}
+
+	return orphans, nil
+}
+
+// deleteOrphanedFolder deletes the folder if it is still empty.
+func deleteOrphanedFolder(ctx context.Context, session *Session, ref types.ManagedObjectReference, folderPath string) error {
+	var folder mo.Folder
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.RetrieveOne(ctx, ref, []string{"childEntity"}, &folder); err != nil {
+		if isManagedObjectNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to get properties of folder %q: %w", folderPath, err)
+	}
+	if len(folder.ChildEntity) > 0 {
+		return fmt.Errorf("folder %q is no longer empty", folderPath)
+	}
+
+	if err := deleteVMFolder(ctx, session, &ref, folderPath); err != nil {
+		return fmt.Errorf("failed to delete folder %q: %w", folderPath, err)
+	}
+	return nil
+}
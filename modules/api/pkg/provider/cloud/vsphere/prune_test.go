@@ -0,0 +1,151 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+)
+
+func TestPruneOrphanedFolders(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	createFolder := func(fullPath string) types.ManagedObjectReference {
+		ref, err := createVMFolder(ctx, session, fullPath)
+		if err != nil {
+			t.Fatalf("failed to create VM folder %q: %v", fullPath, err)
+		}
+		return ref
+	}
+
+	createFolder("/DC0/vm/orphan0001")
+	// Folders of existing clusters, user folders and folders which are not empty must be kept.
+	createFolder("/DC0/vm/cluster001")
+	createFolder("/DC0/vm/team-folder")
+	createFolder("/DC0/vm/withfolder")
+	createFolder("/DC0/vm/withfolder/nested")
+	createFolder("/DC0/vm/cluster001/orphan0002")
+
+	vm, err := session.Finder.VirtualMachine(ctx, "/DC0/vm/DC0_H0_VM0")
+	if err != nil {
+		t.Fatalf("failed to get VM: %v", err)
+	}
+	task, err := object.NewFolder(session.Client.Client, createFolder("/DC0/vm/withvm0001")).MoveInto(ctx, []types.ManagedObjectReference{vm.Reference()})
+	if err != nil {
+		t.Fatalf("failed to move VM: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to move VM: %v", err)
+	}
+
+	// Root paths overridden by clusters are searched as well, but the folders holding them are kept.
+	createFolder("/DC0/vm/project001")
+	createFolder("/DC0/vm/project001/orphan0003")
+	createFolder("/DC0/vm/project001/cluster003")
+
+	newCluster := func(name string, rootPath string) kubermaticv1.Cluster {
+		cluster := kubermaticv1.Cluster{}
+		cluster.Name = name
+		cluster.Labels = map[string]string{kubermaticv1.ProjectIDLabelKey: "project001"}
+		if rootPath != "" {
+			cluster.Annotations = map[string]string{RootPathAnnotationKey: rootPath}
+		}
+		return cluster
+	}
+	clusters := []kubermaticv1.Cluster{
+		newCluster("cluster001", ""),
+		newCluster("cluster003", "/DC0/vm/project001"),
+		// Invalid overrides are not searched.
+		newCluster("cluster004", "/DC0/vm/cluster001"),
+	}
+
+	expected := []string{"/DC0/vm/orphan0001", "/DC0/vm/project001/orphan0003"}
+	listClusters := func(context.Context) ([]kubermaticv1.Cluster, error) {
+		return clusters, nil
+	}
+
+	pruned, err := PruneOrphanedFolders(ctx, dc, "", "", nil, listClusters, true)
+	if err != nil {
+		t.Fatalf("failed to prune orphaned folders: %v", err)
+	}
+	if changes := diff.ObjectDiff(expected, pruned); changes != "" {
+		t.Errorf("Got orphaned folders differ from expected ones. Diff: %v", changes)
+	}
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/orphan0001"); err != nil {
+		t.Errorf("expected the folder to be kept in dry-run mode: %v", err)
+	}
+
+	pruned, err = PruneOrphanedFolders(ctx, dc, "", "", nil, listClusters, false)
+	if err != nil {
+		t.Fatalf("failed to prune orphaned folders: %v", err)
+	}
+	if changes := diff.ObjectDiff(expected, pruned); changes != "" {
+		t.Errorf("Got pruned folders differ from expected ones. Diff: %v", changes)
+	}
+	for _, folder := range expected {
+		if _, err := session.Finder.Folder(ctx, folder); !isNotFound(err) {
+			t.Errorf("expected the orphaned folder %q to be deleted, got %v", folder, err)
+		}
+	}
+
+	for _, folder := range []string{"/DC0/vm/cluster001", "/DC0/vm/cluster001/orphan0002", "/DC0/vm/team-folder", "/DC0/vm/withfolder", "/DC0/vm/withvm0001", "/DC0/vm/project001", "/DC0/vm/project001/cluster003"} {
+		if _, err := session.Finder.Folder(ctx, folder); err != nil {
+			t.Errorf("expected folder %q to be kept: %v", folder, err)
+		}
+	}
+	if _, err := session.Finder.VirtualMachine(ctx, "/DC0/vm/withvm0001/DC0_H0_VM0"); err != nil {
+		t.Errorf("expected the VM to be kept: %v", err)
+	}
+
+	// The folder of a cluster created after the folders were searched must be kept.
+	createFolder("/DC0/vm/cluster002")
+	calls := 0
+	pruned, err = PruneOrphanedFolders(ctx, dc, "", "", nil, func(context.Context) ([]kubermaticv1.Cluster, error) {
+		calls++
+		if calls == 1 {
+			return clusters, nil
+		}
+		return append(clusters, newCluster("cluster002", "")), nil
+	}, false)
+	if err != nil {
+		t.Fatalf("failed to prune orphaned folders: %v", err)
+	}
+	if len(pruned) != 0 {
+		t.Errorf("expected no folder to be pruned, got %v", pruned)
+	}
+	if _, err := session.Finder.Folder(ctx, "/DC0/vm/cluster002"); err != nil {
+		t.Errorf("expected the folder of the new cluster to be kept: %v", err)
+	}
+}
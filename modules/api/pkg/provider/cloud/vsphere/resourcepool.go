@@ -0,0 +1,186 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// mebibyte is the unit vSphere uses for the memory allocation of resource pools.
+const mebibyte = 1024 * 1024
+
+// ResourcePool represents a vsphere resource pool.
+type ResourcePool struct {
+	Name string
+	Path string
+	// CPU is the CPU allocation and usage of the pool in MHz.
+	CPU ResourcePoolAllocation
+	// Memory is the memory allocation and usage of the pool in bytes.
+	Memory ResourcePoolAllocation
+}
+
+// ResourcePoolAllocation describes how much of a resource is configured for and used by a resource pool.
+type ResourcePoolAllocation struct {
+	// Reservation is the amount guaranteed to the pool.
+	Reservation int64
+	// ExpandableReservation is true if the pool may borrow unreserved resources from its parent
+	// once its own reservation is used up.
+	ExpandableReservation bool
+	// Limit is the maximum amount the pool may use, it is only set if Unlimited is false.
+	Limit int64
+	// Unlimited is true if the usage of the pool is only limited by its parent.
+	Unlimited bool
+	// ReservationUsed is the amount reserved by the VMs and child pools of the pool.
+	ReservationUsed int64
+	// Unreserved is the amount which is still available for reservations, including the one
+	// which can be borrowed from the parent for expandable reservations.
+	Unreserved int64
+	// Usage is the amount currently used by the VMs of the pool.
+	Usage int64
+}
+
+// GetResourcePools returns a slice of ResourcePools of the datacenter from the passed cloudspec.
+// Resource pools live below the host folder of the datacenter, so they are not scoped by the RootPath,
+// which only applies to VM folders.
+func GetResourcePools(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]ResourcePool, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return getResourcePools(ctx, session)
+}
+
+func getResourcePools(ctx context.Context, session *Session) ([]ResourcePool, error) {
+	poolRefs, err := session.Finder.ResourcePoolList(ctx, "*")
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve resource pool list: %w", err)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(poolRefs))
+	paths := make(map[types.ManagedObjectReference]string, len(poolRefs))
+	for _, poolRef := range poolRefs {
+		refs = append(refs, poolRef.Reference())
+		paths[poolRef.Reference()] = poolRef.InventoryPath
+	}
+
+	var pools []mo.ResourcePool
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "parent", "config", "runtime"}, &pools); err != nil {
+		return nil, fmt.Errorf("failed to get resource pool properties: %w", err)
+	}
+
+	var resourcePools []ResourcePool
+	for _, pool := range pools {
+		// Every compute resource has a hidden root pool called "Resources", which is just noise.
+		if isRootResourcePool(pool) {
+			continue
+		}
+
+		resourcePools = append(resourcePools, ResourcePool{
+			Name:   pool.Name,
+			Path:   paths[pool.Reference()],
+			CPU:    newResourcePoolAllocation(pool.Config.CpuAllocation, pool.Runtime.Cpu, 1),
+			Memory: newResourcePoolAllocation(pool.Config.MemoryAllocation, pool.Runtime.Memory, mebibyte),
+		})
+	}
+
+	return resourcePools, nil
+}
+
+// validateResourcePool checks that the resource pool, given by its name or its absolute or relative
+// inventory path, exists and is unique. Pool names are only unique within their parent, so a name
+// matching pools in several clusters is reported along with the paths to pick from. The inventory path of
+// the resource pool is returned.
+func validateResourcePool(ctx context.Context, session *Session, resourcePool string) (string, error) {
+	pool, err := session.Finder.ResourcePool(ctx, resourcePool)
+	if err == nil {
+		return pool.InventoryPath, nil
+	}
+
+	var multipleErr *find.MultipleFoundError
+	if !errors.As(err, &multipleErr) {
+		return "", err
+	}
+
+	pools, listErr := session.Finder.ResourcePoolList(ctx, resourcePool)
+	if listErr != nil {
+		return "", err
+	}
+
+	paths := make([]string, 0, len(pools))
+	for _, pool := range pools {
+		paths = append(paths, pool.InventoryPath)
+	}
+	sort.Strings(paths)
+
+	return "", fmt.Errorf("%w: %q matches %s, use the inventory path of one of them", ErrAmbiguousResourcePool, resourcePool, strings.Join(paths, ", "))
+}
+
+// newResourcePoolAllocation maps the allocation and usage of a resource. vSphere configures memory in MB, but
+// reports its usage in bytes, so the configured values are multiplied by configUnit.
+func newResourcePoolAllocation(config types.ResourceAllocationInfo, usage types.ResourcePoolResourceUsage, configUnit int64) ResourcePoolAllocation {
+	allocation := ResourcePoolAllocation{
+		ReservationUsed: usage.ReservationUsed,
+		Unreserved:      usage.UnreservedForPool,
+		Usage:           usage.OverallUsage,
+	}
+
+	if config.Reservation != nil {
+		allocation.Reservation = *config.Reservation * configUnit
+	}
+	if config.ExpandableReservation != nil {
+		allocation.ExpandableReservation = *config.ExpandableReservation
+	}
+	// A limit of -1 means that the pool is unlimited.
+	if config.Limit == nil || *config.Limit < 0 {
+		allocation.Unlimited = true
+	} else {
+		allocation.Limit = *config.Limit * configUnit
+	}
+
+	return allocation
+}
+
+func isRootResourcePool(pool mo.ResourcePool) bool {
+	if pool.Parent == nil {
+		return false
+	}
+
+	switch pool.Parent.Type {
+	case "ComputeResource", "ClusterComputeResource":
+		return true
+	default:
+		return false
+	}
+}
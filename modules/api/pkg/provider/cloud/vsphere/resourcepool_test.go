@@ -0,0 +1,225 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+	"k8c.io/kubermatic/v2/pkg/test/diff"
+)
+
+func TestGetResourcePools(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// Without any user defined pools only the hidden root pools exist.
+	pools, err := GetResourcePools(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list resource pools: %v", err)
+	}
+	if len(pools) != 0 {
+		t.Fatalf("expected root resource pools to be filtered, got %v", pools)
+	}
+
+	rootPool, err := session.Finder.ResourcePool(ctx, "/DC0/host/DC0_C0/Resources")
+	if err != nil {
+		t.Fatalf("failed to get root resource pool: %v", err)
+	}
+	spec := types.DefaultResourceConfigSpec()
+	spec.CpuAllocation.Reservation = types.NewInt64(1000)
+	spec.CpuAllocation.Limit = types.NewInt64(2000)
+	spec.CpuAllocation.ExpandableReservation = types.NewBool(false)
+	spec.MemoryAllocation.Reservation = types.NewInt64(512)
+	parent, err := rootPool.Create(ctx, "kubermatic", spec)
+	if err != nil {
+		t.Fatalf("failed to create resource pool: %v", err)
+	}
+	if _, err := parent.Create(ctx, "nested", types.DefaultResourceConfigSpec()); err != nil {
+		t.Fatalf("failed to create nested resource pool: %v", err)
+	}
+
+	simPool := simulator.Map.Get(parent.Reference()).(*simulator.ResourcePool)
+	simPool.Runtime.Cpu = types.ResourcePoolResourceUsage{ReservationUsed: 600, UnreservedForPool: 400, OverallUsage: 800}
+	simPool.Runtime.Memory = types.ResourcePoolResourceUsage{ReservationUsed: 256 * mebibyte, UnreservedForPool: 768 * mebibyte, OverallUsage: 300 * mebibyte}
+
+	pools, err = GetResourcePools(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list resource pools: %v", err)
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Path < pools[j].Path
+	})
+
+	// The nested pool keeps the default allocation, an expandable reservation without limit,
+	// and the usage the simulator reports for every pool.
+	expected := []ResourcePool{
+		{
+			Name: "kubermatic",
+			Path: "/DC0/host/DC0_C0/Resources/kubermatic",
+			CPU: ResourcePoolAllocation{
+				Reservation:     1000,
+				Limit:           2000,
+				ReservationUsed: 600,
+				Unreserved:      400,
+				Usage:           800,
+			},
+			Memory: ResourcePoolAllocation{
+				Reservation:           512 * mebibyte,
+				ExpandableReservation: true,
+				Unlimited:             true,
+				ReservationUsed:       256 * mebibyte,
+				Unreserved:            768 * mebibyte,
+				Usage:                 300 * mebibyte,
+			},
+		},
+		{
+			Name: "nested",
+			Path: "/DC0/host/DC0_C0/Resources/kubermatic/nested",
+			CPU: ResourcePoolAllocation{
+				ExpandableReservation: true,
+				Unlimited:             true,
+				Unreserved:            4121,
+			},
+			Memory: ResourcePoolAllocation{
+				ExpandableReservation: true,
+				Unlimited:             true,
+				Unreserved:            1007681536,
+			},
+		},
+	}
+	if changes := diff.ObjectDiff(expected, pools); changes != "" {
+		t.Errorf("Got resource pools differ from expected ones. Diff: %v", changes)
+	}
+}
+
+func TestValidateResourcePool(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	// Both clusters get a pool named "shared", only the first one a pool named "unique".
+	for cluster, names := range map[string][]string{
+		"DC0_C0": {"shared", "unique"},
+		"DC0_C1": {"shared"},
+	} {
+		root, err := session.Finder.ResourcePool(ctx, "/DC0/host/"+cluster+"/Resources")
+		if err != nil {
+			t.Fatalf("failed to get root resource pool: %v", err)
+		}
+		for _, name := range names {
+			if _, err := root.Create(ctx, name, types.DefaultResourceConfigSpec()); err != nil {
+				t.Fatalf("failed to create resource pool: %v", err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name         string
+		resourcePool string
+		wantErrIs    error
+		wantNotFound bool
+		// expectedCandidates are expected to be listed in the error.
+		expectedCandidates []string
+		expectedPath       string
+	}{
+		{
+			name:         "Unique name",
+			resourcePool: "unique",
+			expectedPath: "/DC0/host/DC0_C0/Resources/unique",
+		},
+		{
+			name:         "Ambiguous name",
+			resourcePool: "shared",
+			wantErrIs:    ErrAmbiguousResourcePool,
+			expectedCandidates: []string{
+				"/DC0/host/DC0_C0/Resources/shared",
+				"/DC0/host/DC0_C1/Resources/shared",
+			},
+		},
+		{
+			name:         "Inventory path",
+			resourcePool: "/DC0/host/DC0_C0/Resources/shared",
+			expectedPath: "/DC0/host/DC0_C0/Resources/shared",
+		},
+		{
+			name:         "Relative inventory path",
+			resourcePool: "DC0_C1/Resources/shared",
+			expectedPath: "/DC0/host/DC0_C1/Resources/shared",
+		},
+		{
+			name:         "Missing pool",
+			resourcePool: "missing",
+			wantNotFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolvedPath, err := validateResourcePool(ctx, session, tt.resourcePool)
+			switch {
+			case tt.wantErrIs != nil:
+				if !errors.Is(err, tt.wantErrIs) {
+					t.Fatalf("expected error %v, got %v", tt.wantErrIs, err)
+				}
+			case tt.wantNotFound:
+				if !isNotFound(err) {
+					t.Fatalf("expected a not found error, got %v", err)
+				}
+			case err != nil:
+				t.Fatalf("failed to validate resource pool: %v", err)
+			}
+
+			for _, candidate := range tt.expectedCandidates {
+				if !strings.Contains(err.Error(), candidate) {
+					t.Errorf("expected the error to list %q, got %v", candidate, err)
+				}
+			}
+			if resolvedPath != tt.expectedPath {
+				t.Errorf("expected resolved path %q, got %q", tt.expectedPath, resolvedPath)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// StoragePolicy represents a vsphere storage policy (SPBM profile).
+type StoragePolicy struct {
+	ID   string
+	Name string
+}
+
+// GetStoragePolicies returns a slice of StoragePolicy of the vCenter of the datacenter from the passed cloudspec.
+func GetStoragePolicies(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]StoragePolicy, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return getStoragePolicies(ctx, session)
+}
+
+func getStoragePolicies(ctx context.Context, session *Session) ([]StoragePolicy, error) {
+	pbmClient, err := pbm.NewClient(ctx, session.Client.Client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage policy client: %w", err)
+	}
+
+	resourceType := pbmtypes.PbmProfileResourceType{
+		ResourceType: string(pbmtypes.PbmProfileResourceTypeEnumSTORAGE),
+	}
+	ids, err := pbmClient.QueryProfile(ctx, resourceType, string(pbmtypes.PbmProfileCategoryEnumREQUIREMENT))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query storage policies: %w", err)
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	profiles, err := pbmClient.RetrieveContent(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get storage policy details: %w", err)
+	}
+
+	policies := make([]StoragePolicy, 0, len(profiles))
+	for _, profile := range profiles {
+		p := profile.GetPbmProfile()
+		policies = append(policies, StoragePolicy{
+			ID:   p.ProfileId.UniqueId,
+			Name: p.Name,
+		})
+	}
+
+	return policies, nil
+}
+
+// validateStoragePolicy checks that a storage policy with the given name exists.
+func validateStoragePolicy(ctx context.Context, session *Session, name string) error {
+	policies, err := getStoragePolicies(ctx, session)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range policies {
+		if policy.Name == name {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %q", ErrStoragePolicyNotFound, name)
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestGetStoragePolicies(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	policies, err := GetStoragePolicies(context.Background(), dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list storage policies: %v", err)
+	}
+
+	names := sets.NewString()
+	for _, policy := range policies {
+		if policy.ID == "" {
+			t.Errorf("expected storage policy %q to have an ID", policy.Name)
+		}
+		names.Insert(policy.Name)
+	}
+
+	expected := []string{fakeStoragePolicy, "VM Encryption Policy"}
+	if !names.HasAll(expected...) {
+		t.Errorf("expected storage policies %v to be returned, got %v", expected, names.List())
+	}
+}
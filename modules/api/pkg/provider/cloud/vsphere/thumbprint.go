@@ -0,0 +1,87 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// ValidateThumbprint checks that the thumbprint is a SHA-1 or SHA-256 certificate fingerprint in the
+// colon separated hex notation shown by vCenter, e.g. "AB:CD:EF:...".
+func ValidateThumbprint(thumbprint string) error {
+	_, err := parseThumbprint(thumbprint)
+	return err
+}
+
+func parseThumbprint(thumbprint string) ([]byte, error) {
+	segments := strings.Split(thumbprint, ":")
+	for _, segment := range segments {
+		if len(segment) != 2 {
+			return nil, fmt.Errorf("%w: %q is not a colon separated list of hex bytes", ErrInvalidThumbprint, thumbprint)
+		}
+	}
+
+	fingerprint, err := hex.DecodeString(strings.Join(segments, ""))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q is not hex encoded", ErrInvalidThumbprint, thumbprint)
+	}
+	if len(fingerprint) != sha1.Size && len(fingerprint) != sha256.Size {
+		return nil, fmt.Errorf("%w: %q is neither a SHA-1 nor a SHA-256 fingerprint", ErrInvalidThumbprint, thumbprint)
+	}
+
+	return fingerprint, nil
+}
+
+// pinThumbprint configures the TLS config to trust the server certificate only if it matches the
+// given thumbprint. The regular chain verification is skipped, as this is meant for self-signed
+// certificates, which cannot be verified with a CA bundle.
+func pinThumbprint(config *tls.Config, thumbprint string) error {
+	expected, err := parseThumbprint(thumbprint)
+	if err != nil {
+		return err
+	}
+
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("%w: no server certificate presented", ErrThumbprintMismatch)
+		}
+
+		var actual []byte
+		if len(expected) == sha1.Size {
+			sum := sha1.Sum(rawCerts[0])
+			actual = sum[:]
+		} else {
+			sum := sha256.Sum256(rawCerts[0])
+			actual = sum[:]
+		}
+
+		if subtle.ConstantTimeCompare(expected, actual) != 1 {
+			return fmt.Errorf("%w: expected %s", ErrThumbprintMismatch, thumbprint)
+		}
+		return nil
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/soap"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestValidateThumbprint(t *testing.T) {
+	tests := []struct {
+		name       string
+		thumbprint string
+		wantErr    bool
+	}{
+		{
+			name:       "SHA-1",
+			thumbprint: "1B:6B:B2:6F:0B:8E:8C:3F:8D:7C:53:1F:8D:2E:7A:1F:0E:3E:0B:6A",
+		},
+		{
+			name:       "SHA-256 lower case",
+			thumbprint: "1b:6b:b2:6f:0b:8e:8c:3f:8d:7c:53:1f:8d:2e:7a:1f:0e:3e:0b:6a:1b:6b:b2:6f:0b:8e:8c:3f:8d:7c:53:1f",
+		},
+		{
+			name:    "Empty",
+			wantErr: true,
+		},
+		{
+			name:       "Missing colons",
+			thumbprint: "1B6BB26F0B8E8C3F8D7C531F8D2E7A1F0E3E0B6A",
+			wantErr:    true,
+		},
+		{
+			name:       "No hex",
+			thumbprint: "ZZ:6B:B2:6F:0B:8E:8C:3F:8D:7C:53:1F:8D:2E:7A:1F:0E:3E:0B:6A",
+			wantErr:    true,
+		},
+		{
+			name:       "Wrong length",
+			thumbprint: "1B:6B:B2:6F",
+			wantErr:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateThumbprint(tt.thumbprint)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ValidateThumbprint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrInvalidThumbprint) {
+				t.Errorf("expected error to be ErrInvalidThumbprint, got %v", err)
+			}
+		})
+	}
+}
+
+func TestThumbprintPinning(t *testing.T) {
+	sim := newTLSSimulator(t)
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	cert := sim.server.Certificate()
+	sha256Sum := sha256.Sum256(cert.Raw)
+	sha256Thumbprint := make([]string, len(sha256Sum))
+	for i, b := range sha256Sum {
+		sha256Thumbprint[i] = fmt.Sprintf("%02X", b)
+	}
+	otherThumbprint := strings.Repeat("00:", sha256.Size-1) + "00"
+
+	tests := []struct {
+		name       string
+		thumbprint string
+		wantErr    bool
+	}{
+		{
+			name:       "Matching SHA-1 thumbprint",
+			thumbprint: soap.ThumbprintSHA1(cert),
+		},
+		{
+			name:       "Matching SHA-256 thumbprint",
+			thumbprint: strings.Join(sha256Thumbprint, ":"),
+		},
+		{
+			name:       "Other thumbprint",
+			thumbprint: otherThumbprint,
+			wantErr:    true,
+		},
+		{
+			name:    "Self-signed certificate without thumbprint",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			opts := []SessionOption{WithThumbprint(tt.thumbprint)}
+
+			session, err := newSession(ctx, dc, "", "", nil, opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newSession() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				session.Logout(ctx)
+			}
+			if err != nil && tt.thumbprint != "" && !strings.Contains(err.Error(), ErrThumbprintMismatch.Error()) {
+				t.Errorf("expected a thumbprint mismatch, got %v", err)
+			}
+
+			restSession, err := newRESTSession(ctx, dc, "", "", nil, opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newRESTSession() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				restSession.Logout(ctx)
+			}
+		})
+	}
+}
+
+func TestInsecureOverride(t *testing.T) {
+	sim := newTLSSimulator(t)
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	for _, opts := range [][]SessionOption{nil, {WithSessionProvider(pool)}} {
+		session, err := newSession(ctx, dc, "", "", nil, append(opts, WithInsecure())...)
+		if err != nil {
+			t.Fatalf("failed to create insecure vCenter session: %v", err)
+		}
+		session.Logout(ctx)
+
+		restSession, err := newRESTSession(ctx, dc, "", "", nil, WithInsecure())
+		if err != nil {
+			t.Fatalf("failed to create insecure REST client session: %v", err)
+		}
+		restSession.Logout(ctx)
+
+		if dc.AllowInsecure {
+			t.Fatal("expected the datacenter to be left untouched")
+		}
+
+		// The override must neither stick to the datacenter nor to pooled sessions.
+		if _, err := newSession(ctx, dc, "", "", nil, opts...); err == nil {
+			t.Fatal("expected a session without the override to verify the self-signed certificate")
+		}
+		if _, err := newRESTSession(ctx, dc, "", "", nil); err == nil {
+			t.Fatal("expected a REST client session without the override to verify the self-signed certificate")
+		}
+	}
+}
+
+func TestSessionProviderTLSPolicy(t *testing.T) {
+	sim := newTLSSimulator(t)
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	thumbprint := soap.ThumbprintSHA1(sim.server.Certificate())
+	otherThumbprint := strings.Repeat("00:", sha256.Size-1) + "00"
+
+	session, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool), WithThumbprint(thumbprint))
+	if err != nil {
+		t.Fatalf("failed to create pinned vCenter session: %v", err)
+	}
+	session.Logout(ctx)
+
+	// Sessions must only be shared between callers with the same TLS policy, a session pinned to the
+	// certificate must not be handed out to callers pinning another one.
+	if session, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool), WithThumbprint(otherThumbprint)); err == nil {
+		session.Logout(ctx)
+		t.Fatal("expected a session pinned to another thumbprint to be rejected")
+	}
+	if session, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool), WithThumbprint(thumbprint), WithMinTLSVersion(tls.VersionTLS13)); err != nil {
+		t.Fatalf("failed to create pinned vCenter session with TLS 1.3: %v", err)
+	} else {
+		session.Logout(ctx)
+	}
+	if len(pool.sessions) != 2 {
+		t.Errorf("expected a session per TLS policy, got %d sessions", len(pool.sessions))
+	}
+}
+
+// newTLSSimulator starts a simulator serving a self-signed certificate.
+func newTLSSimulator(t *testing.T) *vSphereSimulator {
+	model := simulator.VPX()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.RegisterEndpoints = true
+
+	return &vSphereSimulator{t: t, model: model, server: model.Service.NewServer()}
+}
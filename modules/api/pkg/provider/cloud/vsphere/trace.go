@@ -0,0 +1,78 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/vim25/soap"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// SOAPTracer is called after every SOAP request to vCenter with the name of the called method,
+// e.g. "RetrievePropertiesEx", the duration of the request and its error. It never sees the
+// request or response, which might contain credentials.
+type SOAPTracer func(method string, duration time.Duration, err error)
+
+// WithSOAPTracer calls the tracer for every SOAP request of the session. Traced sessions are never
+// taken from or added to a SessionProvider, so a tracer only ever sees the requests of its caller.
+func WithSOAPTracer(tracer SOAPTracer) SessionOption {
+	return func(o *sessionOptions) {
+		o.soapTracer = tracer
+	}
+}
+
+// WithSOAPLogging logs the method and duration of every SOAP request to vCenter, if the logger
+// has debug logging enabled. Otherwise, no tracing is installed at all.
+func WithSOAPLogging(log *zap.SugaredLogger) SessionOption {
+	return func(o *sessionOptions) {
+		if log == nil || !log.Desugar().Core().Enabled(zapcore.DebugLevel) {
+			return
+		}
+		o.soapTracer = func(method string, duration time.Duration, err error) {
+			log.Debugw("Sent vCenter SOAP request", "method", method, "duration", duration, zap.Error(err))
+		}
+	}
+}
+
+// tracingRoundTripper reports every request passed to the wrapped round tripper to the tracer.
+type tracingRoundTripper struct {
+	soap.RoundTripper
+	tracer SOAPTracer
+}
+
+func (t *tracingRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	start := time.Now()
+	err := t.RoundTripper.RoundTrip(ctx, req, res)
+	t.tracer(soapMethod(req), time.Since(start), err)
+
+	return err
+}
+
+// soapMethod returns the name of the method of a request, the request types of govmomi are named
+// after their method with a "Body" suffix.
+func soapMethod(req soap.HasFault) string {
+	t := reflect.TypeOf(req)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return strings.TrimSuffix(t.Name(), "Body")
+}
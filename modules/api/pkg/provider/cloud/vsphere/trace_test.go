@@ -0,0 +1,169 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestSOAPTracing(t *testing.T) {
+	const password = "s3cr3t-password"
+	sim := vSphereSimulator{t: t, user: url.UserPassword("user", password)}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+	dc.InfraManagementUser = nil
+
+	var (
+		lock    sync.Mutex
+		methods []string
+	)
+	tracer := func(method string, _ time.Duration, _ error) {
+		lock.Lock()
+		defer lock.Unlock()
+		methods = append(methods, method)
+	}
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "user", password, nil, WithSOAPTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	lock.Lock()
+	if !sets.NewString(methods...).Has("Login") {
+		t.Errorf("expected the login to be traced, got %v", methods)
+	}
+	methods = nil
+	lock.Unlock()
+
+	if _, err := session.Finder.Datastore(ctx, "LocalDS_0"); err != nil {
+		t.Fatalf("failed to get datastore: %v", err)
+	}
+
+	lock.Lock()
+	if !sets.NewString(methods...).Has("RetrieveProperties") {
+		t.Errorf("expected the finder call to be traced, got %v", methods)
+	}
+	lock.Unlock()
+
+	for _, level := range []zapcore.Level{zapcore.DebugLevel, zapcore.InfoLevel} {
+		core, logs := observer.New(level)
+		session, err := newSession(ctx, dc, "user", password, nil, WithSOAPLogging(zap.New(core).Sugar()))
+		if err != nil {
+			t.Fatalf("failed to create vCenter session: %v", err)
+		}
+		session.Logout(ctx)
+
+		if level == zapcore.InfoLevel {
+			if logs.Len() != 0 {
+				t.Errorf("expected no SOAP requests to be logged without debug logging, got %d", logs.Len())
+			}
+			continue
+		}
+		if logs.FilterField(zap.String("method", "Login")).Len() != 1 {
+			t.Errorf("expected the login to be logged, got %v", logs.All())
+		}
+		for _, entry := range logs.All() {
+			if strings.Contains(fmt.Sprint(entry.Message, entry.ContextMap()), password) {
+				t.Errorf("expected the password never to be logged, got %v", entry)
+			}
+		}
+	}
+}
+
+func TestSOAPTracingBypassesSessionProvider(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	pool := NewSessionProvider(time.Hour, time.Minute)
+	defer pool.Close(ctx)
+
+	untraced, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool))
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	untraced.Logout(ctx)
+
+	var (
+		lock   sync.Mutex
+		traced int
+	)
+	tracer := func(string, time.Duration, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		traced++
+	}
+
+	// A caller asking for tracing must not get the untraced pooled session.
+	session, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool), WithSOAPTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	if session.Client == untraced.Client {
+		t.Fatal("expected a traced session not to be taken from the pool")
+	}
+	session.Logout(ctx)
+	if session.IsValid(ctx) {
+		t.Fatal("expected the traced session to be logged out instead of being pooled")
+	}
+
+	// Callers which did not ask for tracing must not have their requests traced.
+	lock.Lock()
+	traced = 0
+	lock.Unlock()
+
+	pooled, err := newSession(ctx, dc, "", "", nil, WithSessionProvider(pool))
+	if err != nil {
+		t.Fatalf("failed to get pooled session: %v", err)
+	}
+	defer pooled.Logout(ctx)
+	if pooled.Client != untraced.Client {
+		t.Fatal("expected the untraced session to be reused")
+	}
+	if _, err := pooled.Finder.Datastore(ctx, "LocalDS_0"); err != nil {
+		t.Fatalf("failed to get datastore: %v", err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if traced != 0 {
+		t.Errorf("expected requests of pooled sessions not to be traced, got %d traced requests", traced)
+	}
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// transportTTL is the time after which a transport, which wasn't used anymore, is dropped from the cache.
+	transportTTL = time.Hour
+	// maxTransports bounds the number of cached transports, the least recently used one is dropped first.
+	maxTransports = 64
+)
+
+// transports is shared by all sessions, so connections to vCenter are kept alive and reused
+// instead of being established, including the TLS handshake, for every session.
+var transports = &transportCache{ttl: transportTTL, maxEntries: maxTransports}
+
+// transportCache holds one HTTP transport per transport configuration. A transport is never
+// modified once it is cached, so it is safe to share it between concurrent sessions. Transports
+// dropped from the cache keep working for the sessions still using them.
+type transportCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	lock    sync.Mutex
+	entries map[transportConfig]*transportCacheEntry
+}
+
+type transportCacheEntry struct {
+	transport *http.Transport
+	expires   time.Time
+}
+
+// transportConfig holds the TLS and proxy settings of a transport. CA bundles are compared by identity,
+// the dashboard loads its CA bundle once and passes the same pool to all calls.
+type transportConfig struct {
+	caBundle      *x509.CertPool
+	insecure      bool
+	thumbprint    string
+	proxy         string
+	minTLSVersion uint16
+}
+
+// get returns the transport for the given configuration and creates it if needed.
+func (c *transportCache) get(config transportConfig) (*http.Transport, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	if entry, ok := c.entries[config]; ok && now.Before(entry.expires) {
+		entry.expires = now.Add(c.ttl)
+		return entry.transport, nil
+	}
+
+	transport, err := newTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	c.prune(now)
+	if c.entries == nil {
+		c.entries = map[transportConfig]*transportCacheEntry{}
+	}
+	c.entries[config] = &transportCacheEntry{
+		transport: transport,
+		expires:   now.Add(c.ttl),
+	}
+
+	return transport, nil
+}
+
+// prune drops the expired transports and, if the cache is full, the least recently used one. It must be
+// called with the lock held.
+func (c *transportCache) prune(now time.Time) {
+	var oldest *transportConfig
+	for config, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			c.drop(config)
+			continue
+		}
+		if oldest == nil || entry.expires.Before(c.entries[*oldest].expires) {
+			config := config
+			oldest = &config
+		}
+	}
+	if oldest != nil && len(c.entries) >= c.maxEntries {
+		c.drop(*oldest)
+	}
+}
+
+// drop removes the transport from the cache and closes its idle connections. It must be called with the lock held.
+func (c *transportCache) drop(config transportConfig) {
+	c.entries[config].transport.CloseIdleConnections()
+	delete(c.entries, config)
+}
+
+// newTransport creates a transport with the same defaults govmomi uses for its own transports. If
+// no proxy is given, the proxy is taken from the environment.
+func newTransport(config transportConfig) (*http.Transport, error) {
+	if err := validateMinTLSVersion(config.minTLSVersion); err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{}
+	if defaultTransport, ok := http.DefaultTransport.(*http.Transport); ok {
+		transport = &http.Transport{
+			Proxy:                 defaultTransport.Proxy,
+			DialContext:           defaultTransport.DialContext,
+			MaxIdleConns:          defaultTransport.MaxIdleConns,
+			IdleConnTimeout:       defaultTransport.IdleConnTimeout,
+			TLSHandshakeTimeout:   defaultTransport.TLSHandshakeTimeout,
+			ExpectContinueTimeout: defaultTransport.ExpectContinueTimeout,
+		}
+	}
+
+	transport.TLSClientConfig = &tls.Config{
+		RootCAs:            config.caBundle,
+		InsecureSkipVerify: config.insecure,
+		MinVersion:         config.minTLSVersion,
+	}
+	if config.thumbprint != "" {
+		if err := pinThumbprint(transport.TLSClientConfig, config.thumbprint); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.proxy != "" {
+		proxyURL, err := parseProxy(config.proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return transport, nil
+}
+
+// validateMinTLSVersion returns an error unless the version is TLS 1.2 or 1.3, older versions are insecure.
+func validateMinTLSVersion(version uint16) error {
+	switch version {
+	case tls.VersionTLS12, tls.VersionTLS13:
+		return nil
+	default:
+		return fmt.Errorf("%w: %#04x, only TLS 1.2 and 1.3 are supported", ErrInvalidTLSVersion, version)
+	}
+}
+
+// parseProxy returns the URL of the proxy. Only HTTP(S) and SOCKS5 proxies are supported. The URL may
+// contain credentials, so errors never include it.
+func parseProxy(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		// The error of url.Parse quotes the whole URL.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("%w: %s", ErrInvalidProxy, err.Error())
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("%w: unsupported scheme %q", ErrInvalidProxy, u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("%w: missing host", ErrInvalidProxy)
+	}
+
+	return u, nil
+}
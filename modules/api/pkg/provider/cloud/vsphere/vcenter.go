@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/version"
+)
+
+// Capabilities of a vCenter, as reported by GetVCenterInfo.
+const (
+	// CapabilityStoragePolicies is set if storage policies (SPBM) are available.
+	CapabilityStoragePolicies = "StoragePolicies"
+	// CapabilityTagging is set if tags and tag categories can be managed via the REST API.
+	CapabilityTagging = "Tagging"
+	// CapabilityContentLibrary is set if content libraries can be managed via the REST API.
+	CapabilityContentLibrary = "ContentLibrary"
+)
+
+// apiTypeVirtualCenter is the API type reported by vCenter, as opposed to standalone ESXi hosts.
+const apiTypeVirtualCenter = "VirtualCenter"
+
+// capabilityVersions are the minimum vCenter versions of the capabilities.
+var capabilityVersions = map[string]*version.Version{
+	CapabilityStoragePolicies: version.MustParseGeneric("5.5"),
+	CapabilityTagging:         version.MustParseGeneric("6.5"),
+	CapabilityContentLibrary:  version.MustParseGeneric("6.5"),
+}
+
+// VCenterInfo describes the vCenter of a datacenter.
+type VCenterInfo struct {
+	Version    string
+	Build      string
+	APIType    string
+	APIVersion string
+	// Capabilities are the features detected for the vCenter version, e.g. CapabilityTagging.
+	Capabilities sets.String
+}
+
+// GetVCenterInfo returns the version and the capabilities of the vCenter of the datacenter from the passed cloudspec.
+func GetVCenterInfo(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, username, password string, caBundle *x509.CertPool, opts ...SessionOption) (*VCenterInfo, error) {
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return newVCenterInfo(session.Client.ServiceContent.About)
+}
+
+func newVCenterInfo(about types.AboutInfo) (*VCenterInfo, error) {
+	info := &VCenterInfo{
+		Version:      about.Version,
+		Build:        about.Build,
+		APIType:      about.ApiType,
+		APIVersion:   about.ApiVersion,
+		Capabilities: sets.NewString(),
+	}
+
+	// Standalone hosts lack all of the vCenter services.
+	if about.ApiType != apiTypeVirtualCenter {
+		return info, nil
+	}
+
+	v, err := version.ParseGeneric(about.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vCenter version %q: %w", about.Version, err)
+	}
+
+	for capability, minVersion := range capabilityVersions {
+		if v.AtLeast(minVersion) {
+			info.Capabilities.Insert(capability)
+		}
+	}
+
+	return info, nil
+}
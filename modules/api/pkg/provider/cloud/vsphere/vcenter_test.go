@@ -0,0 +1,99 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+func TestGetVCenterInfo(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	info, err := GetVCenterInfo(context.Background(), dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to get vCenter info: %v", err)
+	}
+
+	if info.Version != "6.5.0" || info.Build != "5973321" || info.APIType != "VirtualCenter" || info.APIVersion != "6.5" {
+		t.Errorf("expected the simulator's About data, got %+v", info)
+	}
+	expected := sets.NewString(CapabilityStoragePolicies, CapabilityTagging, CapabilityContentLibrary)
+	if !info.Capabilities.Equal(expected) {
+		t.Errorf("expected capabilities %v, got %v", expected.List(), info.Capabilities.List())
+	}
+}
+
+func TestNewVCenterInfo(t *testing.T) {
+	tests := []struct {
+		name                 string
+		about                types.AboutInfo
+		expectedCapabilities sets.String
+		wantErr              bool
+	}{
+		{
+			name:                 "vCenter 7",
+			about:                types.AboutInfo{ApiType: "VirtualCenter", Version: "7.0.3"},
+			expectedCapabilities: sets.NewString(CapabilityStoragePolicies, CapabilityTagging, CapabilityContentLibrary),
+		},
+		{
+			name:                 "vCenter 6.0",
+			about:                types.AboutInfo{ApiType: "VirtualCenter", Version: "6.0.0"},
+			expectedCapabilities: sets.NewString(CapabilityStoragePolicies),
+		},
+		{
+			name:                 "vCenter 5.1",
+			about:                types.AboutInfo{ApiType: "VirtualCenter", Version: "5.1.0"},
+			expectedCapabilities: sets.NewString(),
+		},
+		{
+			name:                 "Standalone host",
+			about:                types.AboutInfo{ApiType: "HostAgent", Version: "7.0.3"},
+			expectedCapabilities: sets.NewString(),
+		},
+		{
+			name:    "Invalid version",
+			about:   types.AboutInfo{ApiType: "VirtualCenter", Version: "seven"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := newVCenterInfo(tt.about)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newVCenterInfo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if !info.Capabilities.Equal(tt.expectedCapabilities) {
+				t.Errorf("expected capabilities %v, got %v", tt.expectedCapabilities.List(), info.Capabilities.List())
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"path"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+// VMInfo represents a vsphere virtual machine.
+type VMInfo struct {
+	Name string
+	Path string
+	// PowerState is one of "poweredOn", "poweredOff" or "suspended".
+	PowerState string
+	// IPAddress is the primary IP address reported by the VMware tools, it is empty if the tools
+	// are not running.
+	IPAddress string
+	// UUID is the BIOS UUID of the VM, which is also part of the provider ID of the node.
+	UUID string
+}
+
+// ListClusterVMs returns the VMs in the folder of the cluster, e.g. to troubleshoot its nodes. No VMs are
+// returned if the cluster has no folder or the folder doesn't exist (anymore).
+func ListClusterVMs(ctx context.Context, dc *kubermaticv1.DatacenterSpecVSphere, cluster *kubermaticv1.Cluster, username, password string, caBundle *x509.CertPool, opts ...SessionOption) ([]VMInfo, error) {
+	folder := cluster.Spec.Cloud.VSphere.Folder
+	if folder == "" {
+		return nil, nil
+	}
+
+	session, err := newBrowseSession(ctx, dc, username, password, caBundle, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create vCenter session: %w", err)
+	}
+	defer session.Logout(ctx)
+
+	return listVMs(ctx, session, folder)
+}
+
+// listVMs returns the VMs directly in the given folder.
+func listVMs(ctx context.Context, session *Session, folder string) ([]VMInfo, error) {
+	vmRefs, err := session.Finder.VirtualMachineList(ctx, path.Join(folder, "*"))
+	if err != nil {
+		// The finder doesn't tell a missing folder apart from an empty one.
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("couldn't retrieve VM list: %w", err)
+	}
+
+	refs := make([]types.ManagedObjectReference, 0, len(vmRefs))
+	paths := make(map[types.ManagedObjectReference]string, len(vmRefs))
+	for _, vmRef := range vmRefs {
+		refs = append(refs, vmRef.Reference())
+		paths[vmRef.Reference()] = vmRef.InventoryPath
+	}
+
+	var vms []mo.VirtualMachine
+	pc := property.DefaultCollector(session.Client.Client)
+	if err := pc.Retrieve(ctx, refs, []string{"name", "runtime.powerState", "guest.ipAddress", "config.uuid"}, &vms); err != nil {
+		return nil, fmt.Errorf("failed to get VM properties: %w", err)
+	}
+
+	vmInfos := make([]VMInfo, 0, len(vms))
+	for _, vm := range vms {
+		info := VMInfo{
+			Name:       vm.Name,
+			Path:       paths[vm.Reference()],
+			PowerState: string(vm.Runtime.PowerState),
+		}
+		if vm.Guest != nil {
+			info.IPAddress = vm.Guest.IpAddress
+		}
+		if vm.Config != nil {
+			info.UUID = vm.Config.Uuid
+		}
+
+		vmInfos = append(vmInfos, info)
+	}
+
+	return vmInfos, nil
+}
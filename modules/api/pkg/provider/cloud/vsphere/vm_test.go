@@ -0,0 +1,115 @@
+/*
+Copyright 2022 The Kubermatic Kubernetes Platform contributors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vsphere
+
+import (
+	"context"
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/types"
+
+	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
+)
+
+func TestListClusterVMs(t *testing.T) {
+	sim := vSphereSimulator{t: t}
+	sim.setUp()
+	defer sim.tearDown()
+
+	dc := &kubermaticv1.DatacenterSpecVSphere{}
+	sim.fillClientInfo(dc)
+
+	ctx := context.Background()
+	session, err := newSession(ctx, dc, "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to create vCenter session: %v", err)
+	}
+	defer session.Logout(ctx)
+
+	newCluster := func(folder string) *kubermaticv1.Cluster {
+		return &kubermaticv1.Cluster{
+			Spec: kubermaticv1.ClusterSpec{
+				Cloud: kubermaticv1.CloudSpec{
+					VSphere: &kubermaticv1.VSphereCloudSpec{Folder: folder},
+				},
+			},
+		}
+	}
+
+	// Clusters without folder and with a missing or empty folder have no VMs.
+	if _, err := createVMFolder(ctx, session, "/DC0/vm/empty"); err != nil {
+		t.Fatalf("failed to create VM folder: %v", err)
+	}
+	for _, folder := range []string{"", "/DC0/vm/missing", "/DC0/vm/empty"} {
+		vms, err := ListClusterVMs(ctx, dc, newCluster(folder), "", "", nil)
+		if err != nil {
+			t.Fatalf("failed to list VMs of folder %q: %v", folder, err)
+		}
+		if len(vms) != 0 {
+			t.Errorf("expected no VMs in folder %q, got %v", folder, vms)
+		}
+	}
+
+	folderRef, err := createVMFolder(ctx, session, "/DC0/vm/cluster")
+	if err != nil {
+		t.Fatalf("failed to create VM folder: %v", err)
+	}
+	vmRefs, err := session.Finder.VirtualMachineList(ctx, "/DC0/vm/DC0_H0_VM*")
+	if err != nil {
+		t.Fatalf("failed to list VMs: %v", err)
+	}
+	var refs []types.ManagedObjectReference
+	for _, vmRef := range vmRefs {
+		refs = append(refs, vmRef.Reference())
+	}
+	task, err := object.NewFolder(session.Client.Client, folderRef).MoveInto(ctx, refs)
+	if err != nil {
+		t.Fatalf("failed to move VMs: %v", err)
+	}
+	if err := task.Wait(ctx); err != nil {
+		t.Fatalf("failed to move VMs: %v", err)
+	}
+
+	simVM := simulator.Map.Get(refs[0]).(*simulator.VirtualMachine)
+	simVM.Guest.IpAddress = "10.0.0.10"
+	simVM.Runtime.PowerState = types.VirtualMachinePowerStatePoweredOff
+
+	vms, err := ListClusterVMs(ctx, dc, newCluster("/DC0/vm/cluster"), "", "", nil)
+	if err != nil {
+		t.Fatalf("failed to list VMs: %v", err)
+	}
+	if len(vms) != len(refs) {
+		t.Fatalf("expected %d VMs, got %v", len(refs), vms)
+	}
+
+	for _, vm := range vms {
+		if vm.Path != "/DC0/vm/cluster/"+vm.Name {
+			t.Errorf("expected VM %q to be in the cluster folder, got path %q", vm.Name, vm.Path)
+		}
+		if vm.UUID == "" {
+			t.Errorf("expected the UUID of VM %q to be set", vm.Name)
+		}
+		if vm.Name != simVM.Name {
+			continue
+		}
+		if vm.IPAddress != "10.0.0.10" || vm.PowerState != "poweredOff" || vm.UUID != simVM.Config.Uuid {
+			t.Errorf("expected VM %q to be powered off with IP 10.0.0.10 and UUID %q, got %+v", vm.Name, simVM.Config.Uuid, vm)
+		}
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	restclient "k8s.io/client-go/rest"
@@ -51,6 +52,9 @@ var (
 
 	ErrNoKubermaticConfigurationFound      = errors.New("no KubermaticConfiguration resource found")
 	ErrTooManyKubermaticConfigurationFound = errors.New("more than one KubermaticConfiguration resource found")
+
+	// ErrSecretKeyNotFound tells that the secret doesn't contain the requested key.
+	ErrSecretKeyNotFound = errors.New("the given key was not found in the secret")
 )
 
 const (
@@ -138,6 +142,24 @@ type ReconcilingCloudProvider interface {
 	ReconcileCluster(context.Context, *kubermaticv1.Cluster, ClusterUpdater) (*kubermaticv1.Cluster, error)
 }
 
+// ClusterUpdateValidatingCloudProvider is a cloud provider which needs the cluster, not just its cloud spec, to
+// validate an update, e.g. to compare the cloud spec with the resources created for the cluster. It is used
+// instead of ValidateCloudSpecUpdate.
+type ClusterUpdateValidatingCloudProvider interface {
+	CloudProvider
+
+	ValidateClusterUpdate(ctx context.Context, oldCluster, newCluster *kubermaticv1.Cluster) error
+}
+
+// CloudSpecFieldError is implemented by errors of cloud providers, which name the offending fields
+// of the cloud spec, so they can be reported at these fields.
+type CloudSpecFieldError interface {
+	error
+
+	// FieldErrors returns an error for every offending field below the given cloud spec path.
+	FieldErrors(cloudPath *field.Path) field.ErrorList
+}
+
 // ClusterUpdater defines a function to persist an update to a cluster.
 type ClusterUpdater func(context.Context, string, func(*kubermaticv1.Cluster)) (*kubermaticv1.Cluster, error)
 
@@ -180,7 +202,7 @@ func SecretKeySelectorValueFuncFactory(ctx context.Context, client ctrlruntimecl
 		}
 
 		if _, ok := secret.Data[key]; !ok {
-			return "", fmt.Errorf("secret %q has no key %q", namespacedName.String(), key)
+			return "", fmt.Errorf("secret %q has no key %q: %w", namespacedName.String(), key, ErrSecretKeyNotFound)
 		}
 
 		return string(secret.Data[key]), nil
@@ -40,6 +40,7 @@ import (
 
 	"k8s.io/apimachinery/pkg/api/equality"
 	apimachineryvalidation "k8s.io/apimachinery/pkg/api/validation"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	kubenetutil "k8s.io/apimachinery/pkg/util/net"
 	"k8s.io/apimachinery/pkg/util/sets"
 	"k8s.io/apimachinery/pkg/util/validation/field"
@@ -190,17 +191,43 @@ func ValidateNewClusterSpec(ctx context.Context, spec *kubermaticv1.ClusterSpec,
 	// No error needs to be reported here if there's a mismatch, as ValidateClusterSpec() already reported one.
 	if cloudProvider != nil && validateDatacenterMatchesProvider(spec.Cloud, dc) == nil {
 		if err := cloudProvider.ValidateCloudSpec(ctx, spec.Cloud); err != nil {
-			// Just using spec.Cloud for the error leads to a Go-representation of the struct being printed in
-			// the error message, which looks awful an is not helpful. However any other encoding (e.g. JSON)
-			// could lead to us leaking credentials that were given in the CloudSpec, so to be safe, we never
-			// reveal the CloudSpec in an error.
-			allErrs = append(allErrs, field.Invalid(parentFieldPath.Child("cloud"), "<redacted>", err.Error()))
+			allErrs = append(allErrs, cloudSpecErrors(err, parentFieldPath.Child("cloud"))...)
 		}
 	}
 
 	return allErrs
 }
 
+// cloudSpecErrors converts the error of a cloud provider validating the cloud spec to field errors. Errors naming
+// the offending fields are reported at these fields, also if the provider reports them along with other errors.
+func cloudSpecErrors(err error, cloudPath *field.Path) field.ErrorList {
+	errs := []error{err}
+	var aggregate kerrors.Aggregate
+	if errors.As(err, &aggregate) {
+		errs = kerrors.Flatten(aggregate).Errors()
+	}
+
+	var allErrs field.ErrorList
+	var others []error
+	for _, err := range errs {
+		var fieldErr provider.CloudSpecFieldError
+		if errors.As(err, &fieldErr) {
+			allErrs = append(allErrs, fieldErr.FieldErrors(cloudPath)...)
+		} else {
+			others = append(others, err)
+		}
+	}
+	if len(others) > 0 {
+		// Just using spec.Cloud for the error leads to a Go-representation of the struct being printed in
+		// the error message, which looks awful an is not helpful. However any other encoding (e.g. JSON)
+		// could lead to us leaking credentials that were given in the CloudSpec, so to be safe, we never
+		// reveal the CloudSpec in an error.
+		allErrs = append(allErrs, field.Invalid(cloudPath, "<redacted>", kerrors.Reduce(kerrors.NewAggregate(others)).Error()))
+	}
+
+	return allErrs
+}
+
 // ValidateClusterUpdate validates the new cluster and if no forbidden changes were attempted.
 func ValidateClusterUpdate(ctx context.Context, newCluster, oldCluster *kubermaticv1.Cluster, dc *kubermaticv1.Datacenter, cloudProvider provider.CloudProvider, versionManager *version.Manager, features features.FeatureGate) field.ErrorList {
 	specPath := field.NewPath("spec")
@@ -212,7 +239,13 @@ func ValidateClusterUpdate(ctx context.Context, newCluster, oldCluster *kubermat
 	}
 
 	if cloudProvider != nil {
-		if err := cloudProvider.ValidateCloudSpecUpdate(ctx, oldCluster.Spec.Cloud, newCluster.Spec.Cloud); err != nil {
+		var err error
+		if updateValidator, ok := cloudProvider.(provider.ClusterUpdateValidatingCloudProvider); ok {
+			err = updateValidator.ValidateClusterUpdate(ctx, oldCluster, newCluster)
+		} else {
+			err = cloudProvider.ValidateCloudSpecUpdate(ctx, oldCluster.Spec.Cloud, newCluster.Spec.Cloud)
+		}
+		if err != nil {
 			allErrs = append(allErrs, field.Forbidden(specPath.Child("cloud"), err.Error()))
 		}
 	}
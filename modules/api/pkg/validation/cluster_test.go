@@ -28,10 +28,14 @@ import (
 	"github.com/stretchr/testify/assert"
 
 	apiv1 "k8c.io/dashboard/v2/pkg/api/v1"
+	"k8c.io/dashboard/v2/pkg/provider"
+	"k8c.io/dashboard/v2/pkg/provider/cloud/fake"
+	"k8c.io/dashboard/v2/pkg/provider/cloud/vsphere"
 	kubermaticv1 "k8c.io/kubermatic/v2/pkg/apis/kubermatic/v1"
 	"k8c.io/kubermatic/v2/pkg/features"
 	"k8c.io/kubermatic/v2/pkg/version"
 
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/utils/pointer"
 )
@@ -73,6 +77,77 @@ func TestValidateClusterSpec(t *testing.T) {
 	}
 }
 
+// clusterUpdateValidatingProvider rejects every update of a cluster, but accepts every update of a cloud spec.
+type clusterUpdateValidatingProvider struct {
+	provider.CloudProvider
+}
+
+func (p *clusterUpdateValidatingProvider) ValidateClusterUpdate(_ context.Context, _, _ *kubermaticv1.Cluster) error {
+	return errors.New("cluster update rejected")
+}
+
+func TestValidateClusterUpdateCloudProvider(t *testing.T) {
+	cluster := &kubermaticv1.Cluster{}
+	cloudProvider := &clusterUpdateValidatingProvider{CloudProvider: fake.NewCloudProvider()}
+	versionManager := version.New([]*version.Version{{
+		Version: semverlib.MustParse("1.2.3"),
+	}}, nil, nil)
+
+	// Providers validating the whole cluster are asked instead of validating the cloud spec only.
+	errs := ValidateClusterUpdate(context.Background(), cluster, cluster, dc, cloudProvider, versionManager, features.FeatureGate{})
+	for _, err := range errs {
+		if err.Type == field.ErrorTypeForbidden && err.Field == "spec.cloud" && err.Detail == "cluster update rejected" {
+			return
+		}
+	}
+	t.Errorf("expected the cluster update to be rejected by the cloud provider, got %v", errs)
+}
+
+func TestCloudSpecErrors(t *testing.T) {
+	conflict := &vsphere.ValidationError{
+		Fields: []string{"vsphere.datastore", "vsphere.datastoreCluster"},
+		Err:    vsphere.ErrDatastoreConflict,
+	}
+	cloudPath := field.NewPath("spec", "cloud")
+
+	tests := []struct {
+		name     string
+		err      error
+		expected field.ErrorList
+	}{
+		{
+			name: "field error",
+			err:  conflict,
+			expected: field.ErrorList{
+				field.Invalid(cloudPath.Child("vsphere", "datastore"), field.OmitValueType{}, vsphere.ErrDatastoreConflict.Error()),
+				field.Invalid(cloudPath.Child("vsphere", "datastoreCluster"), field.OmitValueType{}, vsphere.ErrDatastoreConflict.Error()),
+			},
+		},
+		{
+			name: "other error",
+			err:  errors.New("resource pool not found"),
+			expected: field.ErrorList{
+				field.Invalid(cloudPath, "<redacted>", "resource pool not found"),
+			},
+		},
+		{
+			name: "field error along with other errors",
+			err:  kerrors.NewAggregate([]error{errors.New("resource pool not found"), conflict, errors.New("folder not found")}),
+			expected: field.ErrorList{
+				field.Invalid(cloudPath.Child("vsphere", "datastore"), field.OmitValueType{}, vsphere.ErrDatastoreConflict.Error()),
+				field.Invalid(cloudPath.Child("vsphere", "datastoreCluster"), field.OmitValueType{}, vsphere.ErrDatastoreConflict.Error()),
+				field.Invalid(cloudPath, "<redacted>", "[resource pool not found, folder not found]"),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, cloudSpecErrors(test.err, cloudPath))
+		})
+	}
+}
+
 func TestValidateCloudSpec(t *testing.T) {
 	tests := []struct {
 		name  string